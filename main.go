@@ -5,14 +5,36 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 
 	"github.com/mkabilov/pg2ch/pkg/config"
 	"github.com/mkabilov/pg2ch/pkg/replicator"
+	"github.com/mkabilov/pg2ch/pkg/utils/logger"
 )
 
+// configFiles is the list of the config files given by the repeated flag
+type configFiles []string
+
+func (f *configFiles) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *configFiles) Set(val string) error {
+	*f = append(*f, val)
+
+	return nil
+}
+
 var (
-	configFile    = flag.String("config", "config.yaml", "path to the config file")
+	configs       configFiles
 	generateChDDL = flag.Bool("generate-ch-ddl", false, "generates clickhouse's tables ddl")
+	forceStart    = flag.Bool("force", false, "start even if the replication slot is ahead of the stored lsn positions")
+	inspect       = flag.Bool("inspect", false, "consume and convert the stream, but never write to clickhouse")
+	startFrom     = flag.String("start-from", "", "stream the tables with no stored lsn from the first commit after that RFC3339 time instead of the initial sync")
+	resync        = flag.String("resync", "", "comma separated tables to sync again from scratch at the start, the other tables keep streaming")
+	progress      = flag.Bool("progress", false, "show per table progress, rates and ETA of the initial sync on the terminal")
+	confirmResync = flag.String("confirm-resync", "", "comma separated tables allowed to be synced regardless of the size, or \"all\"")
 	Version       = "devel"
 	Revision      = "devel"
 
@@ -30,22 +52,45 @@ func init() {
 		flag.PrintDefaults()
 	}
 
+	flag.Var(&configs, "config", "path to the config file, repeat to merge overlays on top of it (default config.yaml)")
+	flag.Var(&configs, "c", "shorthand for -config")
 	flag.Parse()
 
-	if *configFile == "" {
-		flag.Usage()
-		os.Exit(1)
+	if len(configs) == 0 {
+		configs = configFiles{"config.yaml"}
 	}
 }
 
 func main() {
-	cfg, err := config.New(*configFile)
+	cfg, err := config.New(configs...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "could not load config: %v\n", err)
 		os.Exit(1)
 	}
+	logger.Setup(cfg.LogLevel.Level(), cfg.LogFormat == config.LogJSON)
+
+	cfg.ForceStart = *forceStart
+	cfg.Inspect = *inspect
+	cfg.Progress = *progress
+	if *startFrom != "" {
+		cfg.StartFrom, err = time.Parse(time.RFC3339, *startFrom)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not parse start-from time: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *confirmResync != "" {
+		cfg.ConfirmResync = strings.Split(*confirmResync, ",")
+	}
+	if *resync != "" {
+		cfg.Resync = strings.Split(*resync, ",")
+	}
 
-	repl := replicator.New(*cfg)
+	repl := replicator.New(*cfg, replicator.BuildInfo{
+		Version:   Version,
+		Revision:  Revision,
+		GoVersion: GoVersion,
+	})
 	if *generateChDDL {
 		if err := repl.GenerateChDDL(); err != nil {
 			fmt.Fprintf(os.Stderr, "could not create tables on the clickhouse side: %v\n", err)
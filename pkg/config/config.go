@@ -1,10 +1,15 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"log/slog"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,6 +17,10 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/tokenizer"
+	"github.com/mkabilov/pg2ch/pkg/utils/colcrypt"
+	"github.com/mkabilov/pg2ch/pkg/utils/deadletter"
+	"github.com/mkabilov/pg2ch/pkg/utils/expr"
 )
 
 const (
@@ -24,8 +33,29 @@ const (
 	defaultRowIdColumn            = "row_id"
 	defaultMaxBufferLength        = 1000
 	defaultSignColumn             = "sign"
+	defaultSignColumnType         = "Int8"
 	defaultVerColumn              = "ver"
 	defaultIsDeletedColumn        = "is_deleted"
+	defaultSerialGapCheckInterval = 5 * time.Minute
+	defaultReconnectInterval      = 5 * time.Second
+	defaultSystemDatabase         = "pg2ch"
+	defaultSystemTablesTTL        = 30 * 24 * time.Hour
+	defaultPartsMaxDelay          = 5 * time.Minute
+	defaultShadowCompareInterval  = 10 * time.Minute
+	defaultSyncWorkers            = 1
+	defaultChMaxIdleConns         = 8
+	defaultChPingInterval         = 30 * time.Second
+	defaultTokenizerBatchSize     = 1000
+	defaultTokenizerCacheSize     = 100000
+	defaultTokenizerTimeout       = 10 * time.Second
+	defaultHealthFlushRetries     = 10
+	defaultMaskKeep               = 4
+	defaultGRPCRetainedEvents     = 100000
+
+	defaultReplicaIdentityAlterInterval = time.Second
+
+	nameVariableEnvPrefix = "PG2CH_VAR_"
+	sourceDBVariable      = "source_db"
 )
 
 type tableEngine int
@@ -39,19 +69,400 @@ const (
 
 	//MergeTree represents MergeTree table engine
 	MergeTree
+
+	//SummingMergeTree represents SummingMergeTree table engine
+	SummingMergeTree
+
+	//AggregatingMergeTree represents AggregatingMergeTree table engine
+	AggregatingMergeTree
 )
 
 var tableEngines = map[tableEngine]string{
-	CollapsingMergeTree: "CollapsingMergeTree",
-	ReplacingMergeTree:  "ReplacingMergeTree",
-	MergeTree:           "MergeTree",
+	CollapsingMergeTree:  "CollapsingMergeTree",
+	ReplacingMergeTree:   "ReplacingMergeTree",
+	MergeTree:            "MergeTree",
+	SummingMergeTree:     "SummingMergeTree",
+	AggregatingMergeTree: "AggregatingMergeTree",
+}
+
+type trimPolicy int
+
+const (
+	// TrimKeep keeps the blank padding of char(n) values as is
+	TrimKeep trimPolicy = iota
+
+	// TrimRight removes trailing spaces of char(n) values
+	TrimRight
+)
+
+var trimPolicies = map[trimPolicy]string{
+	TrimKeep:  "keep",
+	TrimRight: "rtrim",
+}
+
+type encryptionMode int
+
+const (
+	// EncryptNone stores the values as is
+	EncryptNone encryptionMode = iota
+
+	// EncryptDeterministic encrypts equal values into equal ciphertexts, so that they stay joinable
+	EncryptDeterministic
+
+	// EncryptRandomized encrypts the values with random nonces
+	EncryptRandomized
+)
+
+var encryptionModes = map[encryptionMode]string{
+	EncryptNone:          "none",
+	EncryptDeterministic: "deterministic",
+	EncryptRandomized:    "randomized",
+}
+
+type jsonTarget int
+
+const (
+	// JSONString writes the json and jsonb values as text into the String column
+	JSONString jsonTarget = iota
+
+	// JSONObject writes the values into the JSON column via the String column of the buffer table
+	JSONObject
+
+	// JSONFlatten writes only the values at the json_paths into their own columns
+	JSONFlatten
+)
+
+var jsonTargets = map[jsonTarget]string{
+	JSONString:  "string",
+	JSONObject:  "object",
+	JSONFlatten: "flatten",
+}
+
+type hstoreTarget int
+
+const (
+	// HStoreText writes the hstore values as text into the String column
+	HStoreText hstoreTarget = iota
+
+	// HStoreMap writes the values into the Map(String, String) column via the String column of the buffer table
+	HStoreMap
+
+	// HStoreArrays writes the keys and the values into the <column>.keys and <column>.values Array(String) columns
+	HStoreArrays
+
+	// HStoreFlatten writes only the values of the hstore_columns keys into their own columns
+	HStoreFlatten
+)
+
+var hstoreTargets = map[hstoreTarget]string{
+	HStoreText:    "text",
+	HStoreMap:     "map",
+	HStoreArrays:  "arrays",
+	HStoreFlatten: "flatten",
+}
+
+type maskMode int
+
+const (
+	// MaskNone stores the values as is
+	MaskNone maskMode = iota
+
+	// MaskHash stores the salted hash of the value, equal values give equal hashes
+	MaskHash
+
+	// MaskRedact stores the constant placeholder instead of the value
+	MaskRedact
+
+	// MaskPartial stores the value with all but its last characters replaced with asterisks
+	MaskPartial
+
+	// MaskNull stores NULL instead of the value
+	MaskNull
+)
+
+var maskModes = map[maskMode]string{
+	MaskNone:    "none",
+	MaskHash:    "hash",
+	MaskRedact:  "redact",
+	MaskPartial: "partial",
+	MaskNull:    "null",
+}
+
+type overflowPolicy int
+
+const (
+	// OverflowError stops the replication on the value not fitting the clickhouse column
+	OverflowError overflowPolicy = iota
+
+	// OverflowClamp writes the nearest value of the column's range
+	OverflowClamp
+
+	// OverflowNull writes NULL into the nullable column
+	OverflowNull
+
+	// OverflowDeadLetter skips the row, writing it to the dead letter file
+	OverflowDeadLetter
+)
+
+var overflowPolicies = map[overflowPolicy]string{
+	OverflowError:      "error",
+	OverflowClamp:      "clamp",
+	OverflowNull:       "null",
+	OverflowDeadLetter: "dead_letter",
+}
+
+type replicaIdentityCheck int
+
+const (
+	// ReplicaIdentityError stops at the start if the replica identity of a table doesn't give the old rows its engine needs
+	ReplicaIdentityError replicaIdentityCheck = iota
+
+	// ReplicaIdentityWarn logs such tables and starts anyway
+	ReplicaIdentityWarn
+
+	// ReplicaIdentityAlter alters the replica identity of such tables before the start, the pg user must own them
+	ReplicaIdentityAlter
+)
+
+var replicaIdentityChecks = map[replicaIdentityCheck]string{
+	ReplicaIdentityError: "error",
+	ReplicaIdentityWarn:  "warn",
+	ReplicaIdentityAlter: "alter",
+}
+
+type enumMapping int
+
+const (
+	// EnumMappingEnum creates the clickhouse columns of the pg enums as Enum8 or Enum16 of the same labels
+	EnumMappingEnum enumMapping = iota
+
+	// EnumMappingLowCardinality creates them as LowCardinality(String)
+	EnumMappingLowCardinality
+)
+
+var enumMappings = map[enumMapping]string{
+	EnumMappingEnum:           "enum",
+	EnumMappingLowCardinality: "low_cardinality",
+}
+
+type decimalMode int
+
+const (
+	// DecimalFloat converts the values of the Decimal columns via float64, losing the digits beyond its precision
+	DecimalFloat decimalMode = iota
+
+	// DecimalExact converts the text of the numeric values into the Decimal(P, S) values rounded to the scale S
+	DecimalExact
+)
+
+var decimalModes = map[decimalMode]string{
+	DecimalFloat: "float",
+	DecimalExact: "exact",
+}
+
+type roundingMode int
+
+const (
+	// RoundHalfUp rounds the half away from zero, same as postgresql round() of numeric
+	RoundHalfUp roundingMode = iota
+
+	// RoundHalfEven rounds the half to the even digit
+	RoundHalfEven
+
+	// RoundTruncate drops the digits beyond the scale
+	RoundTruncate
+)
+
+var roundingModes = map[roundingMode]string{
+	RoundHalfUp:   "half_up",
+	RoundHalfEven: "half_even",
+	RoundTruncate: "truncate",
+}
+
+type rejectPolicy int
+
+const (
+	// RejectError stops the replication on the rows rejected by clickhouse
+	RejectError rejectPolicy = iota
+
+	// RejectDeadLetter writes the rejected rows to the dead letter file and the rest of the buffer to clickhouse
+	RejectDeadLetter
+)
+
+var rejectPolicies = map[rejectPolicy]string{
+	RejectError:      "error",
+	RejectDeadLetter: "dead_letter",
+}
+
+type slotMissingPolicy int
+
+const (
+	// SlotHalt stops the replication if the slot is missing after reconnect
+	SlotHalt slotMissingPolicy = iota
+
+	// SlotRecreate creates the slot again and resyncs the tables
+	SlotRecreate
+)
+
+var slotMissingPolicies = map[slotMissingPolicy]string{
+	SlotHalt:     "halt",
+	SlotRecreate: "recreate",
+}
+
+type truncatePolicy int
+
+const (
+	// TruncateIgnore leaves the main table as is on the replicated TRUNCATE in the restricted privileges mode
+	TruncateIgnore truncatePolicy = iota
+
+	// TruncateFail stops the replication on the replicated TRUNCATE unless the main table is empty
+	TruncateFail
+)
+
+var truncatePolicies = map[truncatePolicy]string{
+	TruncateIgnore: "ignore",
+	TruncateFail:   "fail",
+}
+
+type logLevel int
+
+const (
+	// LogInfo logs the regular operation messages, warnings and errors
+	LogInfo logLevel = iota
+
+	// LogDebug logs the detailed messages too
+	LogDebug
+
+	// LogWarn logs the warnings and errors only
+	LogWarn
+
+	// LogError logs the errors only
+	LogError
+)
+
+var logLevels = map[logLevel]string{
+	LogInfo:  "info",
+	LogDebug: "debug",
+	LogWarn:  "warn",
+	LogError: "error",
+}
+
+var slogLevels = map[logLevel]slog.Level{
+	LogInfo:  slog.LevelInfo,
+	LogDebug: slog.LevelDebug,
+	LogWarn:  slog.LevelWarn,
+	LogError: slog.LevelError,
+}
+
+type logFormat int
+
+const (
+	// LogText writes the log records as key=value lines
+	LogText logFormat = iota
+
+	// LogJSON writes the log records as JSON lines
+	LogJSON
+)
+
+var logFormats = map[logFormat]string{
+	LogText: "text",
+	LogJSON: "json",
+}
+
+type copyFormat int
+
+const (
+	// CopyText copies the table in the text format of COPY
+	CopyText copyFormat = iota
+
+	// CopyBinary copies the table in the binary format of COPY, skipping the text escaping
+	CopyBinary
+)
+
+var copyFormats = map[copyFormat]string{
+	CopyText:   "text",
+	CopyBinary: "binary",
+}
+
+type syncOptimize int
+
+const (
+	// OptimizeNone leaves merging the parts of the synced table to clickhouse
+	OptimizeNone syncOptimize = iota
+
+	// OptimizeFinal runs OPTIMIZE TABLE ... FINAL once the initial sync is finished
+	OptimizeFinal
+
+	// OptimizeDeduplicate runs OPTIMIZE TABLE ... FINAL DEDUPLICATE once the initial sync is finished
+	OptimizeDeduplicate
+
+	// OptimizePartitions runs OPTIMIZE TABLE ... PARTITION ... FINAL for each partition in turn
+	OptimizePartitions
+)
+
+var syncOptimizes = map[syncOptimize]string{
+	OptimizeNone:        "none",
+	OptimizeFinal:       "final",
+	OptimizeDeduplicate: "deduplicate",
+	OptimizePartitions:  "partitions",
+}
+
+type snapshotAgePolicy int
+
+const (
+	// SnapshotWarn logs a warning when the snapshot transaction gets too old
+	SnapshotWarn snapshotAgePolicy = iota
+
+	// SnapshotAbort aborts the initial sync when the snapshot transaction gets too old
+	SnapshotAbort
+)
+
+var snapshotAgePolicies = map[snapshotAgePolicy]string{
+	SnapshotWarn:  "warn",
+	SnapshotAbort: "abort",
+}
+
+type ackMode int
+
+const (
+	// AckBufferWrite advances the slot once the transaction is written to the memory buffers
+	AckBufferWrite ackMode = iota
+
+	// AckBufferFlush advances the slot once the memory buffers are flushed to the buffer/main tables
+	AckBufferFlush
+
+	// AckMainTable advances the slot once the rows are moved to the main tables
+	AckMainTable
+)
+
+var ackModes = map[ackMode]string{
+	AckBufferWrite: "buffer_write",
+	AckBufferFlush: "buffer_flush",
+	AckMainTable:   "main_table",
 }
 
 type pgConnConfig struct {
 	pgx.ConnConfig `yaml:",inline"`
 
-	ReplicationSlotName string `yaml:"replication_slot_name"`
-	PublicationName     string `yaml:"publication_name"`
+	ReplicationSlotName  string            `yaml:"replication_slot_name"`
+	PublicationName      string            `yaml:"publication_name"`
+	SlotMissingPolicy    slotMissingPolicy `yaml:"slot_missing_policy"`
+	ReconnectInterval    time.Duration     `yaml:"reconnect_interval"`
+	MaxReconnectAttempts int               `yaml:"max_reconnect_attempts"` // 0 means unlimited
+	Hosts                []string          `yaml:"hosts"`                  // host[:port] candidates, like the libpq multi-host dsn
+	TargetSessionAttrs   string            `yaml:"target_session_attrs"`   // any or read-write
+	PatroniURLs          []string          `yaml:"patroni_urls"`           // patroni rest api endpoints to discover the leader
+	SnapshotMaxAge       time.Duration     `yaml:"snapshot_max_age"`       // max age of the initial sync snapshot transaction
+	SnapshotAgePolicy    snapshotAgePolicy `yaml:"snapshot_age_policy"`
+	FailoverSlot         bool              `yaml:"failover_slot"` // synchronize the slot to the standbys, postgresql 17+
+
+	Origins []string `yaml:"origins"` // replication origins or subscriptions the replicated transactions come from, all if not set
+
+	SSLMode     string            `yaml:"sslmode"`     // disable, allow, prefer, require, verify-ca or verify-full, like libpq
+	SSLRootCert string            `yaml:"sslrootcert"` // CA bundle the server certificate is verified with
+	SSLCert     string            `yaml:"sslcert"`     // client certificate
+	SSLKey      string            `yaml:"sslkey"`      // private key of the client certificate
+	Params      map[string]string `yaml:"params"`      // connect_timeout and the run-time parameters, e.g. search_path
 }
 
 // PgTableName represents namespaced name
@@ -63,12 +474,16 @@ type PgTableName struct {
 // Table contains information about the table
 type Table struct {
 	BufferTableRowIdColumn  string            `yaml:"buffer_table_row_id"`
+	BufferTableLSNColumn    string            `yaml:"buffer_table_lsn_column"`
+	BufferOrderBy           []string          `yaml:"buffer_order_by"` // order of the rows moved from the buffer table, e.g. "lsn", "row_id DESC"
 	ChBufferTable           string            `yaml:"buffer_table"`
 	ChMainTable             string            `yaml:"main_table"`
 	MaxBufferLength         int               `yaml:"max_buffer_length"`
 	VerColumn               string            `yaml:"ver_column"`
 	IsDeletedColumn         string            `yaml:"is_deleted_column"`
 	SignColumn              string            `yaml:"sign_column"`
+	SignColumnType          string            `yaml:"sign_column_type"`
+	SignInverted            bool              `yaml:"sign_inverted"` // -1 for the inserted rows, 1 for the deleted ones
 	GenerationColumn        string            `yaml:"generation_column"`
 	Engine                  tableEngine       `yaml:"engine"`
 	FlushThreshold          int               `yaml:"flush_threshold"`
@@ -77,10 +492,146 @@ type Table struct {
 	InitSyncSkipTruncate    bool              `yaml:"init_sync_skip_truncate"`
 	Columns                 map[string]string `yaml:"columns"`
 
-	PgTableName   PgTableName         `yaml:"-"`
-	TupleColumns  []message.Column    `yaml:"-"` // columns in the order they are in the table
-	PgColumns     map[string]PgColumn `yaml:"-"`
-	ColumnMapping map[string]ChColumn `yaml:"-"`
+	ColumnProperties  map[string]ColumnProperty `yaml:"column_properties"`  // [pg column name]properties
+	ColumnExpressions map[string]string         `yaml:"column_expressions"` // [ch column name]expression over the pg columns
+	RowFilter         string                    `yaml:"row_filter"`         // condition over the pg columns the replicated rows match
+
+	SerialGapColumn    string `yaml:"serial_gap_column"`    // serial pk column to monitor for gaps
+	SerialGapThreshold int64  `yaml:"serial_gap_threshold"` // report gaps bigger than the threshold
+
+	MaxPartsPerPartition int           `yaml:"max_parts_per_partition"` // delay the flush to the main table if exceeded
+	PartsMaxDelay        time.Duration `yaml:"parts_max_delay"`         // flush anyway after waiting that long
+
+	FlushSettings  map[string]string `yaml:"flush_settings"`   // clickhouse settings of the buffer to main table queries
+	MergeBatchSize int               `yaml:"merge_batch_size"` // move rows from the buffer table in batches of that many rows
+	MergeTimeout   time.Duration     `yaml:"merge_timeout"`    // max execution time of the buffer to main table queries
+
+	RejectedRows rejectPolicy `yaml:"rejected_rows"` // what to do with the rows clickhouse rejects on the flush
+
+	ShadowOf string `yaml:"shadow_of"` // production table the main table is a shadow of, periodically compared
+
+	LocalTable  string `yaml:"local_table"`  // local table of the Distributed main table, truncated on the cluster
+	ShardingKey string `yaml:"sharding_key"` // clickhouse column picking the shard the row is written to directly
+
+	AddColumns       bool        `yaml:"add_columns"`       // add the columns added to the pg table to the clickhouse tables on the fly
+	EnumMapping      enumMapping `yaml:"enum_mapping"`      // type of the clickhouse columns of the pg enums in the generated DDL
+	IncludeInherited bool        `yaml:"include_inherited"` // replicate the inheritance children of the table into the same table
+
+	RowImageCache int `yaml:"row_image_cache"` // recent rows kept to complete the key-only old rows of the updates and deletes
+
+	ReplicaIdentityIndex string `yaml:"replica_identity_index"` // unique index the ALTERs of the replica identity use instead of FULL
+
+	RowLookupBatchSize    int `yaml:"row_lookup_batch_size"`     // max keys per lookup of the rows missing in the cache, 0 - none
+	RowLookupMaxPerSecond int `yaml:"row_lookup_max_per_second"` // pacing of the lookups, 0 means unlimited
+
+	SyncMaxRowsPerSecond  int `yaml:"sync_max_rows_per_second"`  // pacing of the initial sync, 0 means unlimited
+	SyncMaxBytesPerSecond int `yaml:"sync_max_bytes_per_second"` // pacing of the initial sync, 0 means unlimited
+	SyncFetchSize         int `yaml:"sync_fetch_size"`           // read the table via cursor in chunks instead of COPY
+	SyncChunkRows         int `yaml:"sync_chunk_rows"`           // commit the initial sync in chunks, re-uploading the failed one
+	SyncChunks            int `yaml:"sync_chunks"`               // split the initial sync into that many ctid ranges
+	SyncChunkWorkers      int `yaml:"sync_chunk_workers"`        // number of ctid ranges copied concurrently
+	SyncPartitionWorkers  int `yaml:"sync_partition_workers"`    // number of partitions of a partitioned table copied concurrently
+
+	SyncCopyFormat copyFormat   `yaml:"sync_copy_format"` // format of COPY of the initial sync
+	SyncOptimize   syncOptimize `yaml:"sync_optimize"`    // merge the parts of the main table once the initial sync is finished
+
+	ExtraTargets []Table `yaml:"extra_targets"` // more clickhouse tables fed from the same decoded changes, e.g. redacted copies
+
+	PgTableName          PgTableName         `yaml:"-"`
+	TupleColumns         []message.Column    `yaml:"-"` // columns in the order they are in the table
+	PgColumns            map[string]PgColumn `yaml:"-"`
+	ColumnMapping        map[string]ChColumn `yaml:"-"`
+	Derived              []DerivedColumn     `yaml:"-"` // parsed column expressions ordered by the ch column name
+	RowFilterExpr        expr.Expr           `yaml:"-"` // parsed row filter, nil if not set
+	Inspect              bool                `yaml:"-"` // convert the data, but never write it to clickhouse
+	RestrictedPrivileges bool                `yaml:"-"` // never truncate the main table, only append to the empty one
+	RestrictedTruncate   truncatePolicy      `yaml:"-"` // what the replicated TRUNCATE does with the restricted privileges
+	LogComment           bool                `yaml:"-"` // set log_comment of the insert queries
+	InsertDeduplication  bool                `yaml:"-"` // set insert_deduplication_token of the insert queries
+	Partitioned          bool                `yaml:"-"` // the postgres table is partitioned, its partitions are synced
+	PubRowFilter         string              `yaml:"-"` // row filter of the publication, the initial sync copies the same rows
+	PubColumns           []string            `yaml:"-"` // column list of the publication, nil if all the columns are published
+	Cluster              string              `yaml:"-"` // clickhouse cluster the local table is truncated on
+
+	Tokenizers map[string]*tokenizer.Tokenizer `yaml:"-"` // [pg column name]tokenizer of the column
+	DeadLetter *deadletter.Writer              `yaml:"-"` // where the rows with the dead_letter overflow policy go
+}
+
+// DerivedColumn is a clickhouse column computed from the pg columns by pg2ch, for both sync and streaming
+type DerivedColumn struct {
+	ChColumn
+	Expr expr.Expr
+}
+
+// ColumnProperty contains per column settings
+type ColumnProperty struct {
+	Trim      trimPolicy     `yaml:"trim"`      // trailing spaces policy for the char(n) columns
+	Delta     bool           `yaml:"delta"`     // write the change of the numeric value instead of the value, for the summing engines
+	Encrypt   encryptionMode `yaml:"encrypt"`   // encrypt the value before writing it to clickhouse
+	KeyEnv    string         `yaml:"key_env"`   // environment variable with the base64 encoded AES key of the encryption
+	Tokenizer string         `yaml:"tokenizer"` // name of the tokenizer replacing the value with its token
+	Overflow  overflowPolicy `yaml:"overflow"`  // what to do with the numeric value not fitting the clickhouse column
+	Decimal   decimalMode    `yaml:"decimal"`   // how the values of the Decimal columns are converted
+	Rounding  roundingMode   `yaml:"rounding"`  // how the exact decimal values are rounded to the scale of the column
+	Transform string         `yaml:"transform"` // expression over the pg columns written instead of the value
+	Mask      maskMode       `yaml:"mask"`      // mask the value before writing it to clickhouse
+	SaltEnv   string         `yaml:"salt_env"`  // environment variable with the salt of the hash mask
+	MaskKeep  int            `yaml:"mask_keep"` // number of the last characters the partial mask keeps
+	JSON      jsonTarget     `yaml:"json"`      // how the json and jsonb values are written
+	Timezone  string         `yaml:"timezone"`  // timezone the timestamptz values of the DateTime64 column are written in
+
+	JSONPaths map[string]string `yaml:"json_paths"` // [ch column name]dot separated path of the value, e.g. address.city
+
+	HStore        hstoreTarget      `yaml:"hstore"`         // how the hstore values are written
+	HStoreKeys    []string          `yaml:"hstore_keys"`    // keys kept in the map and the arrays, all if not set
+	HStoreColumns map[string]string `yaml:"hstore_columns"` // [ch column name]key of the value
+
+	Cipher        *colcrypt.Cipher `yaml:"-"`
+	TransformExpr expr.Expr        `yaml:"-"` // parsed transform, nil if not set
+	Location      *time.Location   `yaml:"-"` // loaded timezone, nil if not set
+	Salt          []byte           `yaml:"-"` // salt of the hash mask
+}
+
+// Tokenizer is the external tokenization service replacing the values of the columns with the tokens
+type Tokenizer struct {
+	URL       string        `yaml:"url"`        // endpoint the values are POSTed to
+	BatchSize int           `yaml:"batch_size"` // max number of values per request
+	CacheSize int           `yaml:"cache_size"` // number of the recently used tokens cached
+	Timeout   time.Duration `yaml:"timeout"`    // timeout of the request
+}
+
+// SystemTables contains settings of the clickhouse tables pg2ch keeps its own data in
+type SystemTables struct {
+	Database   string        `yaml:"database"`
+	Prefix     string        `yaml:"prefix"`
+	TTL        time.Duration `yaml:"ttl"`
+	Watermarks bool          `yaml:"watermarks"`  // store lsn watermarks of the tables flushed to the main tables
+	PublishIDs bool          `yaml:"publish_ids"` // store publish id to lsn mapping for each flush to the main tables
+}
+
+// Metrics is the prometheus metrics endpoint config
+type Metrics struct {
+	Bind   string            `yaml:"bind"`   // address of the http listener serving /metrics
+	Labels map[string]string `yaml:"labels"` // constant labels added to every metric
+}
+
+// GRPC is the gRPC service streaming the row changes to the downstream consumers
+type GRPC struct {
+	Bind           string `yaml:"bind"`            // address of the gRPC listener
+	RetainedEvents int    `yaml:"retained_events"` // row changes kept for the subscribers to resume from
+	TLSCert        string `yaml:"tls_cert"`        // certificate file of the server, plaintext if not set
+	TLSKey         string `yaml:"tls_key"`         // private key file of the certificate
+	TLSClientCA    string `yaml:"tls_client_ca"`   // CA certificate file the client certificates are verified with
+	TokenEnv       string `yaml:"token_env"`       // environment variable with the token the subscribers have to send
+
+	Token string `yaml:"-"` // value of the TokenEnv variable
+}
+
+// TableGroup is a set of tables flushed to the main tables in the listed order, e.g. parents before children
+type TableGroup struct {
+	Name        string        `yaml:"name"`
+	Tables      []PgTableName `yaml:"tables"`
+	CommitOrder bool          `yaml:"commit_order"` // the tables are flushed all at once, at the same commit
 }
 
 type chConnConfig struct {
@@ -90,6 +641,22 @@ type chConnConfig struct {
 	User     string            `yaml:"username"`
 	Password string            `yaml:"password"`
 	Params   map[string]string `yaml:"params"`
+
+	MaxIdleConns    int           `yaml:"max_idle_conns"`    // connections kept open between the flushes
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"` // connections are reopened after that time, 0 - never
+	PingInterval    time.Duration `yaml:"ping_interval"`     // how often idle connections are probed
+
+	Secure     bool `yaml:"secure"`      // connect over TLS
+	SkipVerify bool `yaml:"skip_verify"` // do not verify the server certificate, for testing only
+
+	Cluster string    `yaml:"cluster"` // cluster of the Distributed main tables, their local tables are truncated on it
+	Shards  []ChShard `yaml:"shards"`  // shards the tables with sharding_key are written to directly
+}
+
+// ChShard is a shard of the clickhouse cluster written directly, bypassing the Distributed tables
+type ChShard struct {
+	Hosts  []string `yaml:"hosts"`  // host:port of the replicas, the next one is tried if the connection fails
+	Weight int      `yaml:"weight"` // share of the rows written to the shard, default 1
 }
 
 // Config contains config
@@ -100,6 +667,46 @@ type Config struct {
 	InactivityFlushTimeout time.Duration         `yaml:"inactivity_flush_timeout"`
 	PersStoragePath        string                `yaml:"db_path"`
 	RedisBind              string                `yaml:"redis_bind"`
+	AdminBind              string                `yaml:"admin_bind"`
+	HealthFlushRetries     int                   `yaml:"health_flush_retries"` // failed flush attempts in a row failing /healthz
+	SerialGapCheckInterval time.Duration         `yaml:"serial_gap_check_interval"`
+	SystemTables           SystemTables          `yaml:"system_tables"`
+	ShadowCompareInterval  time.Duration         `yaml:"shadow_compare_interval"`
+	IdleTableTimeout       time.Duration         `yaml:"idle_table_timeout"`        // tables with no changes for that long release their resources
+	DiagnosticsDir         string                `yaml:"diagnostics_dir"`           // where SIGUSR1 diagnostics dumps are written
+	SyncMaxRowsPerSecond   int                   `yaml:"sync_max_rows_per_second"`  // default pacing of the tables' initial sync
+	SyncMaxBytesPerSecond  int                   `yaml:"sync_max_bytes_per_second"` // default pacing of the tables' initial sync
+	SyncWorkers            int                   `yaml:"sync_workers"`              // number of tables synced concurrently
+	ApplyWorkers           int                   `yaml:"apply_workers"`             // goroutines applying the changes of the tables
+	LogComment             bool                  `yaml:"log_comment"`               // identify insert queries in the clickhouse query log
+	InsertDeduplication    bool                  `yaml:"insert_deduplication"`      // replayed inserts are deduplicated by clickhouse
+	TableGroups            []TableGroup          `yaml:"table_groups"`              // flush ordering constraints
+	NameVariables          map[string]string     `yaml:"name_variables"`            // variables of the ${name} templates in the clickhouse names
+	RestrictedPrivileges   bool                  `yaml:"restricted_privileges"`     // never issue TRUNCATE or DDL in clickhouse
+	RestrictedTruncate     truncatePolicy        `yaml:"restricted_truncate"`       // replicated TRUNCATE with the restricted privileges
+	ResyncConfirmBytes     int64                 `yaml:"resync_confirm_bytes"`      // sync of bigger tables needs confirmation
+	AckMode                ackMode               `yaml:"ack_mode"`                  // when the replication slot is advanced
+	ReplicaIdentityCheck   replicaIdentityCheck  `yaml:"replica_identity_check"`    // what to do with the tables lacking the old rows
+	Metrics                Metrics               `yaml:"metrics"`
+	GRPC                   GRPC                  `yaml:"grpc"`
+	JSONLOutput            string                `yaml:"jsonl_output"`     // file to write the row changes to as JSON lines, "-" for stdout
+	DeadLetterPath         string                `yaml:"dead_letter_path"` // file the rows skipped by the overflow policies are written to
+	Tokenizers             map[string]Tokenizer  `yaml:"tokenizers"`
+	LogLevel               logLevel              `yaml:"log_level"`
+	LogFormat              logFormat             `yaml:"log_format"`
+
+	ReplicaIdentityAlterInterval time.Duration `yaml:"replica_identity_alter_interval"` // pause between the ALTERs of the alter check
+
+	ForceStart bool `yaml:"-"` // start even if the replication slot is ahead of the tables' state
+	Inspect    bool `yaml:"-"` // consume and convert the stream without writing to clickhouse and persisting lsn positions
+
+	ConfirmResync []string  `yaml:"-"` // tables allowed to be synced regardless of the size, "all" for any table
+	StartFrom     time.Time `yaml:"-"` // stream the not synced tables from the first commit after that time instead of syncing
+	Progress      bool      `yaml:"-"` // show the progress of the initial sync on the terminal
+	Resync        []string  `yaml:"-"` // tables to be synced again from scratch at the start
+
+	raw   []byte   // contents of the config file, merged with the overlays if any
+	files []string // config file and the overlays, read again on reload
 }
 
 type Column struct {
@@ -107,6 +714,8 @@ type Column struct {
 	IsArray    bool
 	IsNullable bool
 	Ext        []int
+	Timezone   string   // of the clickhouse DateTime64 columns, empty for the server one
+	Labels     []string // of the pg enum types and the clickhouse Enum8 and Enum16 columns, in the order of the values
 }
 
 type PgColumn struct {
@@ -117,7 +726,9 @@ type PgColumn struct {
 // ChColumn describes ClickHouse column
 type ChColumn struct {
 	Column
-	Name string
+	Name        string
+	DefaultKind string // DEFAULT, MATERIALIZED, ALIAS or empty
+	DefaultExpr string
 }
 
 func (t tableEngine) String() string {
@@ -146,106 +757,1210 @@ func (t *tableEngine) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return fmt.Errorf("unknown table engine: %q", val)
 }
 
-func (tn *PgTableName) Parse(val string) error {
-	parts := strings.Split(val, ".")
-	if ln := len(parts); ln == 2 {
-		*tn = PgTableName{
-			SchemaName: parts[0],
-			TableName:  parts[1],
-		}
-	} else if ln == 1 {
-		*tn = PgTableName{
-			SchemaName: publicSchema,
-			TableName:  parts[0],
-		}
-	} else {
-		return fmt.Errorf("invalid table name: %q", val)
-	}
+func (t trimPolicy) String() string {
+	return trimPolicies[t]
+}
 
-	return nil
+// MarshalYAML ...
+func (t trimPolicy) MarshalYAML() (interface{}, error) {
+	return trimPolicies[t], nil
 }
 
-func (tn *PgTableName) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	//TODO: improve parser, use regexp
+// UnmarshalYAML ...
+func (t *trimPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var val string
-
 	if err := unmarshal(&val); err != nil {
 		return err
 	}
 
-	return tn.Parse(val)
-}
+	for k, v := range trimPolicies {
+		if strings.ToLower(val) == v {
+			*t = k
+			return nil
+		}
+	}
 
-func (tn PgTableName) MarshalYAML() (interface{}, error) {
-	return tn.String(), nil
+	return fmt.Errorf("unknown trim policy: %q", val)
 }
 
-func (tn *PgTableName) String() string {
-	if tn.SchemaName == publicSchema {
-		return fmt.Sprintf("%s", tn.TableName)
-	}
-
-	return fmt.Sprintf(`%s.%s`, tn.SchemaName, tn.TableName)
+func (m encryptionMode) String() string {
+	return encryptionModes[m]
 }
 
-// New instantiates config
-func New(filepath string) (*Config, error) {
-	var cfg Config
+// MarshalYAML ...
+func (m encryptionMode) MarshalYAML() (interface{}, error) {
+	return encryptionModes[m], nil
+}
 
-	fp, err := os.Open(filepath)
-	if err != nil {
-		return nil, fmt.Errorf("could not open file: %v", err)
+// UnmarshalYAML ...
+func (m *encryptionMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
 	}
-	defer func() {
-		if err := fp.Close(); err != nil {
-			log.Printf("could not close config file: %v", err)
-		}
-	}()
 
-	if err := yaml.NewDecoder(fp).Decode(&cfg); err != nil {
-		return nil, fmt.Errorf("could not decode yaml: %v", err)
+	for k, v := range encryptionModes {
+		if strings.ToLower(val) == v {
+			*m = k
+			return nil
+		}
 	}
 
-	if cfg.Postgres.PublicationName == "" {
-		return nil, fmt.Errorf("publication name is not specified")
-	}
+	return fmt.Errorf("unknown encryption mode: %q", val)
+}
 
-	if cfg.Postgres.ReplicationSlotName == "" {
-		return nil, fmt.Errorf("replication slot name is not specified")
+func (j jsonTarget) String() string {
+	return jsonTargets[j]
+}
+
+// MarshalYAML ...
+func (j jsonTarget) MarshalYAML() (interface{}, error) {
+	return jsonTargets[j], nil
+}
+
+// UnmarshalYAML ...
+func (j *jsonTarget) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	for k, v := range jsonTargets {
+		if strings.ToLower(val) == v {
+			*j = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown json target: %q", val)
+}
+
+func (h hstoreTarget) String() string {
+	return hstoreTargets[h]
+}
+
+// MarshalYAML ...
+func (h hstoreTarget) MarshalYAML() (interface{}, error) {
+	return hstoreTargets[h], nil
+}
+
+// UnmarshalYAML ...
+func (h *hstoreTarget) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	for k, v := range hstoreTargets {
+		if strings.ToLower(val) == v {
+			*h = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown hstore target: %q", val)
+}
+
+// Flattened checks if the column is written only into the columns derived from it
+func (p ColumnProperty) Flattened() bool {
+	return p.JSON == JSONFlatten || p.HStore == HStoreArrays || p.HStore == HStoreFlatten
+}
+
+func (m maskMode) String() string {
+	return maskModes[m]
+}
+
+// MarshalYAML ...
+func (m maskMode) MarshalYAML() (interface{}, error) {
+	return maskModes[m], nil
+}
+
+// UnmarshalYAML ...
+func (m *maskMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	for k, v := range maskModes {
+		if strings.ToLower(val) == v {
+			*m = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown mask mode: %q", val)
+}
+
+func (p overflowPolicy) String() string {
+	return overflowPolicies[p]
+}
+
+// MarshalYAML ...
+func (p overflowPolicy) MarshalYAML() (interface{}, error) {
+	return overflowPolicies[p], nil
+}
+
+// UnmarshalYAML ...
+func (p *overflowPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	for k, v := range overflowPolicies {
+		if strings.ToLower(val) == v {
+			*p = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown overflow policy: %q", val)
+}
+
+func (m enumMapping) String() string {
+	return enumMappings[m]
+}
+
+// MarshalYAML ...
+func (m enumMapping) MarshalYAML() (interface{}, error) {
+	return enumMappings[m], nil
+}
+
+// UnmarshalYAML ...
+func (m *enumMapping) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	for k, v := range enumMappings {
+		if strings.ToLower(val) == v {
+			*m = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown enum mapping: %q", val)
+}
+
+func (c replicaIdentityCheck) String() string {
+	return replicaIdentityChecks[c]
+}
+
+// MarshalYAML ...
+func (c replicaIdentityCheck) MarshalYAML() (interface{}, error) {
+	return replicaIdentityChecks[c], nil
+}
+
+// UnmarshalYAML ...
+func (c *replicaIdentityCheck) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	for k, v := range replicaIdentityChecks {
+		if strings.ToLower(val) == v {
+			*c = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown replica identity check: %q", val)
+}
+
+func (d decimalMode) String() string {
+	return decimalModes[d]
+}
+
+// MarshalYAML ...
+func (d decimalMode) MarshalYAML() (interface{}, error) {
+	return decimalModes[d], nil
+}
+
+// UnmarshalYAML ...
+func (d *decimalMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	for k, v := range decimalModes {
+		if strings.ToLower(val) == v {
+			*d = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown decimal mode: %q", val)
+}
+
+func (r roundingMode) String() string {
+	return roundingModes[r]
+}
+
+// MarshalYAML ...
+func (r roundingMode) MarshalYAML() (interface{}, error) {
+	return roundingModes[r], nil
+}
+
+// UnmarshalYAML ...
+func (r *roundingMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	for k, v := range roundingModes {
+		if strings.ToLower(val) == v {
+			*r = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown rounding mode: %q", val)
+}
+
+func (p rejectPolicy) String() string {
+	return rejectPolicies[p]
+}
+
+// MarshalYAML ...
+func (p rejectPolicy) MarshalYAML() (interface{}, error) {
+	return rejectPolicies[p], nil
+}
+
+// UnmarshalYAML ...
+func (p *rejectPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	for k, v := range rejectPolicies {
+		if strings.ToLower(val) == v {
+			*p = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown rejected rows policy: %q", val)
+}
+
+func (p slotMissingPolicy) String() string {
+	return slotMissingPolicies[p]
+}
+
+// MarshalYAML ...
+func (p slotMissingPolicy) MarshalYAML() (interface{}, error) {
+	return slotMissingPolicies[p], nil
+}
+
+// UnmarshalYAML ...
+func (p *slotMissingPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	for k, v := range slotMissingPolicies {
+		if strings.ToLower(val) == v {
+			*p = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown slot missing policy: %q", val)
+}
+
+func (p truncatePolicy) String() string {
+	return truncatePolicies[p]
+}
+
+// MarshalYAML ...
+func (p truncatePolicy) MarshalYAML() (interface{}, error) {
+	return truncatePolicies[p], nil
+}
+
+// UnmarshalYAML ...
+func (p *truncatePolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	for k, v := range truncatePolicies {
+		if strings.ToLower(val) == v {
+			*p = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown restricted truncate policy: %q", val)
+}
+
+func (l logLevel) String() string {
+	return logLevels[l]
+}
+
+// Level returns the slog level of the log level
+func (l logLevel) Level() slog.Level {
+	return slogLevels[l]
+}
+
+// MarshalYAML ...
+func (l logLevel) MarshalYAML() (interface{}, error) {
+	return logLevels[l], nil
+}
+
+// UnmarshalYAML ...
+func (l *logLevel) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	for k, v := range logLevels {
+		if strings.ToLower(val) == v {
+			*l = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown log level: %q", val)
+}
+
+func (f copyFormat) String() string {
+	return copyFormats[f]
+}
+
+// MarshalYAML ...
+func (f copyFormat) MarshalYAML() (interface{}, error) {
+	return copyFormats[f], nil
+}
+
+// UnmarshalYAML ...
+func (f *copyFormat) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	for k, v := range copyFormats {
+		if strings.ToLower(val) == v {
+			*f = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown copy format: %q", val)
+}
+
+func (o syncOptimize) String() string {
+	return syncOptimizes[o]
+}
+
+// MarshalYAML ...
+func (o syncOptimize) MarshalYAML() (interface{}, error) {
+	return syncOptimizes[o], nil
+}
+
+// UnmarshalYAML ...
+func (o *syncOptimize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	for k, v := range syncOptimizes {
+		if strings.ToLower(val) == v {
+			*o = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown sync optimize mode: %q", val)
+}
+
+func (f logFormat) String() string {
+	return logFormats[f]
+}
+
+// MarshalYAML ...
+func (f logFormat) MarshalYAML() (interface{}, error) {
+	return logFormats[f], nil
+}
+
+// UnmarshalYAML ...
+func (f *logFormat) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	for k, v := range logFormats {
+		if strings.ToLower(val) == v {
+			*f = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown log format: %q", val)
+}
+
+func (p snapshotAgePolicy) String() string {
+	return snapshotAgePolicies[p]
+}
+
+// MarshalYAML ...
+func (p snapshotAgePolicy) MarshalYAML() (interface{}, error) {
+	return snapshotAgePolicies[p], nil
+}
+
+// UnmarshalYAML ...
+func (p *snapshotAgePolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	for k, v := range snapshotAgePolicies {
+		if strings.ToLower(val) == v {
+			*p = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown snapshot age policy: %q", val)
+}
+
+func (m ackMode) String() string {
+	return ackModes[m]
+}
+
+// MarshalYAML ...
+func (m ackMode) MarshalYAML() (interface{}, error) {
+	return ackModes[m], nil
+}
+
+// UnmarshalYAML ...
+func (m *ackMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var val string
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	for k, v := range ackModes {
+		if strings.ToLower(val) == v {
+			*m = k
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown ack mode: %q", val)
+}
+
+func (tn *PgTableName) Parse(val string) error {
+	parts := strings.Split(val, ".")
+	if ln := len(parts); ln == 2 {
+		*tn = PgTableName{
+			SchemaName: parts[0],
+			TableName:  parts[1],
+		}
+	} else if ln == 1 {
+		*tn = PgTableName{
+			SchemaName: publicSchema,
+			TableName:  parts[0],
+		}
+	} else {
+		return fmt.Errorf("invalid table name: %q", val)
+	}
+
+	return nil
+}
+
+func (tn *PgTableName) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	//TODO: improve parser, use regexp
+	var val string
+
+	if err := unmarshal(&val); err != nil {
+		return err
+	}
+
+	return tn.Parse(val)
+}
+
+func (tn PgTableName) MarshalYAML() (interface{}, error) {
+	return tn.String(), nil
+}
+
+func (tn *PgTableName) String() string {
+	if tn.SchemaName == publicSchema {
+		return fmt.Sprintf("%s", tn.TableName)
+	}
+
+	return fmt.Sprintf(`%s.%s`, tn.SchemaName, tn.TableName)
+}
+
+// New instantiates config; the files following the first one are overlays merged on top of it in order
+func New(filepaths ...string) (*Config, error) {
+	var cfg Config
+
+	if len(filepaths) == 0 {
+		return nil, fmt.Errorf("config file is not specified")
+	}
+
+	docs := make([][]byte, 0, len(filepaths))
+	for _, filepath := range filepaths {
+		doc, err := readFile(filepath)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath, err)
+		}
+		docs = append(docs, doc)
+	}
+
+	merged, err := mergeDocs(docs)
+	if err != nil {
+		return nil, err
+	}
+	cfg.raw = merged
+	cfg.files = filepaths
+
+	if err := yaml.Unmarshal(cfg.raw, &cfg); err != nil {
+		return nil, fmt.Errorf("could not decode yaml: %w", err)
+	}
+
+	if cfg.Postgres.PublicationName == "" {
+		return nil, fmt.Errorf("publication name is not specified")
+	}
+
+	for _, origin := range cfg.Postgres.Origins {
+		if origin == "" {
+			return nil, fmt.Errorf("origins must not be empty")
+		}
+	}
+
+	if cfg.Postgres.ReplicationSlotName == "" {
+		return nil, fmt.Errorf("replication slot name is not specified")
+	}
+
+	connCfg, err := pgx.ParseEnvLibpq()
+	if err != nil {
+		return nil, fmt.Errorf("could not parse lib pq env variabels: %w", err)
+	}
+
+	if cfg.InactivityFlushTimeout.Seconds() == 0 {
+		cfg.InactivityFlushTimeout = defaultInactivityMergeTimeout
+	}
+
+	if cfg.SerialGapCheckInterval.Seconds() == 0 {
+		cfg.SerialGapCheckInterval = defaultSerialGapCheckInterval
+	}
+
+	if cfg.ShadowCompareInterval.Seconds() == 0 {
+		cfg.ShadowCompareInterval = defaultShadowCompareInterval
+	}
+
+	if cfg.SyncWorkers < 0 {
+		return nil, fmt.Errorf("sync_workers must not be negative")
+	} else if cfg.SyncWorkers == 0 {
+		cfg.SyncWorkers = defaultSyncWorkers
+	}
+
+	if cfg.ApplyWorkers < 0 {
+		return nil, fmt.Errorf("apply_workers must not be negative")
+	}
+
+	if cfg.GRPC.RetainedEvents < 0 {
+		return nil, fmt.Errorf("grpc retained_events must not be negative")
+	} else if cfg.GRPC.RetainedEvents == 0 {
+		cfg.GRPC.RetainedEvents = defaultGRPCRetainedEvents
+	}
+
+	if (cfg.GRPC.TLSCert == "") != (cfg.GRPC.TLSKey == "") {
+		return nil, fmt.Errorf("grpc tls_cert and tls_key must be set together")
+	}
+
+	if cfg.GRPC.TLSClientCA != "" && cfg.GRPC.TLSCert == "" {
+		return nil, fmt.Errorf("grpc tls_client_ca needs tls_cert and tls_key")
+	}
+
+	if cfg.GRPC.TokenEnv != "" {
+		token, ok := os.LookupEnv(cfg.GRPC.TokenEnv)
+		if !ok || token == "" {
+			return nil, fmt.Errorf("grpc: %s environment variable with the token is not set", cfg.GRPC.TokenEnv)
+		}
+		cfg.GRPC.Token = token
+	}
+
+	if cfg.ReplicaIdentityAlterInterval < 0 {
+		return nil, fmt.Errorf("replica_identity_alter_interval must not be negative")
+	} else if cfg.ReplicaIdentityAlterInterval == 0 {
+		cfg.ReplicaIdentityAlterInterval = defaultReplicaIdentityAlterInterval
+	}
+
+	if cfg.DiagnosticsDir == "" {
+		cfg.DiagnosticsDir = os.TempDir()
+	}
+
+	if cfg.SystemTables.Database == "" {
+		cfg.SystemTables.Database = defaultSystemDatabase
+	}
+
+	if cfg.SystemTables.TTL.Seconds() == 0 {
+		cfg.SystemTables.TTL = defaultSystemTablesTTL
+	}
+
+	cfg.Postgres.ConnConfig = cfg.Postgres.ConnConfig.Merge(connCfg)
+
+	if cfg.Postgres.Port == 0 {
+		cfg.Postgres.Port = defaultPostgresPort
+	}
+
+	if cfg.Postgres.Host == "" {
+		cfg.Postgres.Host = defaultPostgresHost
+	}
+
+	if err := cfg.Postgres.applyConnParams(); err != nil {
+		return nil, fmt.Errorf("invalid postgres connection params: %w", err)
+	}
+
+	if err := cfg.resolveNames(); err != nil {
+		return nil, fmt.Errorf("could not resolve clickhouse names: %w", err)
+	}
+
+	switch cfg.Postgres.TargetSessionAttrs {
+	case "", "any", "read-write":
+	default:
+		return nil, fmt.Errorf("unknown target_session_attrs: %q", cfg.Postgres.TargetSessionAttrs)
+	}
+
+	if cfg.Postgres.ReconnectInterval.Seconds() == 0 {
+		cfg.Postgres.ReconnectInterval = defaultReconnectInterval
+	}
+
+	if cfg.ClickHouse.Port == 0 {
+		cfg.ClickHouse.Port = defaultClickHousePort
+	}
+
+	if cfg.ClickHouse.Host == "" {
+		cfg.ClickHouse.Host = defaultClickHouseHost
+	}
+
+	if cfg.ClickHouse.MaxIdleConns == 0 {
+		cfg.ClickHouse.MaxIdleConns = defaultChMaxIdleConns
+	}
+
+	if cfg.ClickHouse.PingInterval.Seconds() == 0 {
+		cfg.ClickHouse.PingInterval = defaultChPingInterval
+	}
+
+	if cfg.HealthFlushRetries == 0 {
+		cfg.HealthFlushRetries = defaultHealthFlushRetries
+	}
+
+	if cfg.PersStoragePath == "" {
+		return nil, fmt.Errorf("db_filepath is not set")
+	}
+
+	if err := cfg.validateChTableNames(); err != nil {
+		return nil, fmt.Errorf("invalid clickhouse table names: %w", err)
+	}
+
+	if err := cfg.validateTableGroups(); err != nil {
+		return nil, fmt.Errorf("invalid table groups: %w", err)
+	}
+
+	if err := cfg.validateCluster(); err != nil {
+		return nil, fmt.Errorf("invalid cluster config: %w", err)
+	}
+
+	if err := cfg.validateExtraTargets(); err != nil {
+		return nil, fmt.Errorf("invalid extra targets: %w", err)
+	}
+
+	if err := cfg.loadEncryptionKeys(); err != nil {
+		return nil, fmt.Errorf("could not load encryption keys: %w", err)
+	}
+
+	if err := cfg.validateTokenizers(); err != nil {
+		return nil, fmt.Errorf("invalid tokenizers: %w", err)
+	}
+
+	if err := cfg.validateMasks(); err != nil {
+		return nil, fmt.Errorf("invalid masks: %w", err)
+	}
+
+	if err := cfg.validateOverflowPolicies(); err != nil {
+		return nil, fmt.Errorf("invalid overflow policies: %w", err)
+	}
+
+	if err := cfg.validateRestrictedPrivileges(); err != nil {
+		return nil, fmt.Errorf("restricted_privileges: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// Reload reads the config files again, the settings given by the command line flags are kept
+func (c *Config) Reload() (*Config, error) {
+	cfg, err := New(c.files...)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ForceStart = c.ForceStart
+	cfg.Inspect = c.Inspect
+	cfg.ConfirmResync = c.ConfirmResync
+	cfg.StartFrom = c.StartFrom
+	cfg.Progress = c.Progress
+
+	return cfg, nil
+}
+
+func readFile(filepath string) ([]byte, error) {
+	fp, err := os.Open(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file: %w", err)
+	}
+	defer func() {
+		if err := fp.Close(); err != nil {
+			slog.Error("could not close config file", "file", filepath, "error", err)
+		}
+	}()
+
+	data, err := ioutil.ReadAll(fp)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file: %w", err)
+	}
+
+	return data, nil
+}
+
+// mergeDocs merges the overlay yaml documents on top of the base one: mappings are merged key by key recursively,
+// any other value of the overlay, including lists, replaces the base value; a null value removes the key
+func mergeDocs(docs [][]byte) ([]byte, error) {
+	if len(docs) == 1 {
+		return docs[0], nil
+	}
+
+	var merged interface{}
+	for i, doc := range docs {
+		var val interface{}
+
+		if err := yaml.Unmarshal(doc, &val); err != nil {
+			return nil, fmt.Errorf("could not decode yaml of config file #%d: %w", i+1, err)
+		}
+		merged = mergeValues(merged, val)
+	}
+
+	data, err := yaml.Marshal(merged)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode merged config: %w", err)
+	}
+
+	return data, nil
+}
+
+func mergeValues(base, overlay interface{}) interface{} {
+	if overlay == nil { // empty overlay document
+		return base
+	}
+
+	baseMap, ok := base.(map[interface{}]interface{})
+	if !ok {
+		return overlay
+	}
+
+	overlayMap, ok := overlay.(map[interface{}]interface{})
+	if !ok {
+		return overlay
+	}
+
+	for key, val := range overlayMap {
+		if val == nil {
+			delete(baseMap, key)
+			continue
+		}
+		baseMap[key] = mergeValues(baseMap[key], val)
+	}
+
+	return baseMap
+}
+
+// resolveNames substitutes ${name} variables in the clickhouse database and table names; the values are taken
+// from the PG2CH_VAR_{NAME} environment variables, then from name_variables, source_db is the postgres database name
+func (c *Config) resolveNames() error {
+	var unknown []string
+
+	expand := func(val string) string {
+		return os.Expand(val, func(name string) string {
+			if v, ok := os.LookupEnv(nameVariableEnvPrefix + strings.ToUpper(name)); ok {
+				return v
+			}
+
+			if v, ok := c.NameVariables[name]; ok {
+				return v
+			}
+
+			if name == sourceDBVariable {
+				return c.Postgres.Database
+			}
+			unknown = append(unknown, name)
+
+			return ""
+		})
 	}
 
-	connCfg, err := pgx.ParseEnvLibpq()
-	if err != nil {
-		return nil, fmt.Errorf("could not parse lib pq env variabels: %v", err)
+	c.ClickHouse.Database = expand(c.ClickHouse.Database)
+	c.SystemTables.Database = expand(c.SystemTables.Database)
+	c.SystemTables.Prefix = expand(c.SystemTables.Prefix)
+	for tblName, tbl := range c.Tables {
+		tbl.ChMainTable = expand(tbl.ChMainTable)
+		tbl.ChBufferTable = expand(tbl.ChBufferTable)
+		tbl.ShadowOf = expand(tbl.ShadowOf)
+		for i := range tbl.ExtraTargets {
+			tbl.ExtraTargets[i].ChMainTable = expand(tbl.ExtraTargets[i].ChMainTable)
+			tbl.ExtraTargets[i].ChBufferTable = expand(tbl.ExtraTargets[i].ChBufferTable)
+		}
+		c.Tables[tblName] = tbl
 	}
 
-	if cfg.InactivityFlushTimeout.Seconds() == 0 {
-		cfg.InactivityFlushTimeout = defaultInactivityMergeTimeout
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown variables: %s", strings.Join(unknown, ", "))
 	}
 
-	cfg.Postgres.ConnConfig = cfg.Postgres.ConnConfig.Merge(connCfg)
+	return nil
+}
 
-	if cfg.Postgres.Port == 0 {
-		cfg.Postgres.Port = defaultPostgresPort
+// validateRestrictedPrivileges rejects the features which need TRUNCATE or DDL privileges in the restricted mode
+func (c *Config) validateRestrictedPrivileges() error {
+	if !c.RestrictedPrivileges {
+		return nil
 	}
 
-	if cfg.Postgres.Host == "" {
-		cfg.Postgres.Host = defaultPostgresHost
+	problems := make([]string, 0)
+	for tblName, tbl := range c.Tables {
+		if tbl.ChBufferTable != "" {
+			problems = append(problems, fmt.Sprintf("table %s: buffer_table needs TRUNCATE on %q after each flush to the main table",
+				tblName.String(), tbl.ChBufferTable))
+		}
+		if tbl.AddColumns {
+			problems = append(problems, fmt.Sprintf("table %s: add_columns needs ALTER on %q", tblName.String(), tbl.ChMainTable))
+		}
 	}
 
-	if cfg.ClickHouse.Port == 0 {
-		cfg.ClickHouse.Port = defaultClickHousePort
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
 	}
 
-	if cfg.ClickHouse.Host == "" {
-		cfg.ClickHouse.Host = defaultClickHouseHost
+	return nil
+}
+
+// SplitChTableName splits the clickhouse table name optionally qualified with the database name,
+// database is empty for the unqualified name
+func SplitChTableName(name string) (database, table string) {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[:i], name[i+1:]
 	}
 
-	if cfg.PersStoragePath == "" {
-		return nil, fmt.Errorf("db_filepath is not set")
+	return "", name
+}
+
+// validateChTableNames checks the database qualified names of the main, buffer and shadowed tables,
+// which may live in different databases, e.g. the buffer tables in a staging one
+func (c *Config) validateChTableNames() error {
+	qualified := func(name string) string {
+		if database, table := SplitChTableName(name); database == "" {
+			return c.ClickHouse.Database + "." + table
+		}
+
+		return name
 	}
 
-	return &cfg, nil
+	for tblName, tbl := range c.Tables {
+		names := []string{tbl.ChMainTable, tbl.ChBufferTable, tbl.ShadowOf}
+		for _, target := range tbl.ExtraTargets {
+			names = append(names, target.ChMainTable, target.ChBufferTable)
+		}
+
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+
+			if database, table := SplitChTableName(name); strings.Contains(table, ".") || table == "" ||
+				strings.Contains(name, ".") && database == "" {
+				return fmt.Errorf("table %s: invalid clickhouse table name %q, expected \"table\" or \"database.table\"",
+					tblName.String(), name)
+			}
+		}
+
+		if tbl.ChBufferTable != "" && qualified(tbl.ChBufferTable) == qualified(tbl.ChMainTable) {
+			return fmt.Errorf("table %s: buffer_table and main_table are the same %q table", tblName.String(), tbl.ChMainTable)
+		}
+
+		// the main and buffer tables of the extra targets must not be shared with the table or each other
+		written := map[string]bool{qualified(tbl.ChMainTable): true}
+		if tbl.ChBufferTable != "" {
+			written[qualified(tbl.ChBufferTable)] = true
+		}
+		for _, target := range tbl.ExtraTargets {
+			for _, name := range []string{target.ChMainTable, target.ChBufferTable} {
+				if name == "" {
+					continue
+				}
+
+				if written[qualified(name)] {
+					return fmt.Errorf("table %s: %q table is written by more than one target", tblName.String(), name)
+				}
+				written[qualified(name)] = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateExtraTargets checks the extra targets of the tables: each one is a plain table of its own
+// written along with the table, the features bound to the source table are set on the table itself
+func (c *Config) validateExtraTargets() error {
+	for tblName, tbl := range c.Tables {
+		for _, target := range tbl.ExtraTargets {
+			if target.ChMainTable == "" {
+				return fmt.Errorf("table %s: main_table of the extra target is not set", tblName.String())
+			}
+
+			switch {
+			case len(target.ExtraTargets) > 0:
+				return fmt.Errorf("table %s: extra target %q can not have extra targets", tblName.String(), target.ChMainTable)
+			case target.ShadowOf != "", target.SerialGapColumn != "", target.AddColumns, target.IncludeInherited,
+				target.RowImageCache != 0, target.RowLookupBatchSize != 0:
+				return fmt.Errorf("table %s: shadow_of, serial_gap_column, add_columns, include_inherited, "+
+					"row_image_cache and row_lookup_batch_size are not supported for extra target %q",
+					tblName.String(), target.ChMainTable)
+			case target.LocalTable != "", target.ShardingKey != "":
+				return fmt.Errorf("table %s: local_table and sharding_key are not supported for extra target %q",
+					tblName.String(), target.ChMainTable)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateCluster checks the Distributed main tables and the tables written directly to the shards; the latter
+// are written without the buffer tables and the features reading the main table from the single host
+func (c *Config) validateCluster() error {
+	for i := range c.ClickHouse.Shards {
+		shard := &c.ClickHouse.Shards[i]
+		if len(shard.Hosts) == 0 {
+			return fmt.Errorf("shard %d has no hosts", i+1)
+		}
+
+		if shard.Weight < 0 {
+			return fmt.Errorf("shard %d has negative weight", i+1)
+		} else if shard.Weight == 0 {
+			shard.Weight = 1
+		}
+	}
+
+	for tblName, tbl := range c.Tables {
+		if tbl.LocalTable != "" && c.ClickHouse.Cluster == "" {
+			return fmt.Errorf("table %s: local_table needs clickhouse cluster to be set", tblName.String())
+		}
+
+		if tbl.LocalTable != "" && tbl.AddColumns {
+			return fmt.Errorf("table %s: add_columns is not supported for the Distributed main tables", tblName.String())
+		}
+
+		if tbl.ShardingKey == "" {
+			continue
+		}
+
+		if len(c.ClickHouse.Shards) == 0 {
+			return fmt.Errorf("table %s: sharding_key needs clickhouse shards to be set", tblName.String())
+		}
+
+		switch {
+		case tbl.LocalTable != "":
+			return fmt.Errorf("table %s: sharding_key and local_table are mutually exclusive", tblName.String())
+		case tbl.ChBufferTable != "":
+			return fmt.Errorf("table %s: buffer_table is not supported with sharding_key", tblName.String())
+		case tbl.ShadowOf != "", tbl.SerialGapColumn != "", tbl.AddColumns, tbl.SyncChunkRows > 0:
+			return fmt.Errorf("table %s: shadow_of, serial_gap_column, add_columns and sync_chunk_rows "+
+				"are not supported with sharding_key", tblName.String())
+		}
+	}
+
+	return nil
+}
+
+// loadEncryptionKeys instantiates the ciphers of the encrypted columns with the keys taken from the environment
+func (c *Config) loadEncryptionKeys() error {
+	for tblName, tbl := range c.Tables {
+		for _, target := range tbl.targets() {
+			for pgColName, prop := range target.ColumnProperties {
+				if prop.Encrypt == EncryptNone {
+					continue
+				}
+
+				if prop.KeyEnv == "" {
+					return fmt.Errorf("table %s: key_env of the encrypted %q column is not set", tblName.String(), pgColName)
+				}
+
+				encoded, ok := os.LookupEnv(prop.KeyEnv)
+				if !ok {
+					return fmt.Errorf("table %s: %s environment variable with the key of %q column is not set",
+						tblName.String(), prop.KeyEnv, pgColName)
+				}
+
+				key, err := colcrypt.ParseKey(encoded)
+				if err != nil {
+					return fmt.Errorf("table %s: invalid key of %q column in %s: %w", tblName.String(), pgColName, prop.KeyEnv, err)
+				}
+
+				prop.Cipher, err = colcrypt.New(key, prop.Encrypt == EncryptDeterministic)
+				if err != nil {
+					return fmt.Errorf("table %s: could not instantiate cipher of %q column: %w", tblName.String(), pgColName, err)
+				}
+				target.ColumnProperties[pgColName] = prop
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateTokenizers checks the tokenizers and their use by the columns, setting the defaults
+func (c *Config) validateTokenizers() error {
+	for name, tok := range c.Tokenizers {
+		if tok.URL == "" {
+			return fmt.Errorf("url of %q tokenizer is not set", name)
+		}
+
+		if tok.BatchSize == 0 {
+			tok.BatchSize = defaultTokenizerBatchSize
+		}
+		if tok.CacheSize == 0 {
+			tok.CacheSize = defaultTokenizerCacheSize
+		}
+		if tok.Timeout == 0 {
+			tok.Timeout = defaultTokenizerTimeout
+		}
+		c.Tokenizers[name] = tok
+	}
+
+	for tblName, tbl := range c.Tables {
+		for _, target := range tbl.targets() {
+			for pgColName, prop := range target.ColumnProperties {
+				if prop.Tokenizer == "" {
+					continue
+				}
+
+				if _, ok := c.Tokenizers[prop.Tokenizer]; !ok {
+					return fmt.Errorf("table %s: unknown tokenizer %q of %q column", tblName.String(), prop.Tokenizer, pgColName)
+				}
+
+				if prop.Encrypt != EncryptNone {
+					return fmt.Errorf("table %s: %q column can not be both tokenized and encrypted", tblName.String(), pgColName)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateMasks checks the masked columns, loading the salts of the hashed ones from the environment
+func (c *Config) validateMasks() error {
+	for tblName, tbl := range c.Tables {
+		for _, target := range tbl.targets() {
+			for pgColName, prop := range target.ColumnProperties {
+				if prop.Mask == MaskNone {
+					continue
+				}
+
+				if prop.Encrypt != EncryptNone || prop.Tokenizer != "" {
+					return fmt.Errorf("table %s: masked %q column can not be encrypted or tokenized", tblName.String(), pgColName)
+				}
+
+				switch prop.Mask {
+				case MaskHash:
+					if prop.SaltEnv == "" {
+						return fmt.Errorf("table %s: salt_env of the hashed %q column is not set", tblName.String(), pgColName)
+					}
+
+					salt, ok := os.LookupEnv(prop.SaltEnv)
+					if !ok || salt == "" {
+						return fmt.Errorf("table %s: %s environment variable with the salt of %q column is not set",
+							tblName.String(), prop.SaltEnv, pgColName)
+					}
+					prop.Salt = []byte(salt)
+				case MaskPartial:
+					if prop.MaskKeep < 0 {
+						return fmt.Errorf("table %s: mask_keep of %q column can not be negative", tblName.String(), pgColName)
+					} else if prop.MaskKeep == 0 {
+						prop.MaskKeep = defaultMaskKeep
+					}
+				}
+				target.ColumnProperties[pgColName] = prop
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateOverflowPolicies checks that the rows with the dead_letter overflow and rejected rows policies
+// have somewhere to go
+func (c *Config) validateOverflowPolicies() error {
+	if c.DeadLetterPath != "" {
+		return nil
+	}
+
+	for tblName, tbl := range c.Tables {
+		for _, target := range tbl.targets() {
+			if target.RejectedRows == RejectDeadLetter {
+				return fmt.Errorf("table %s: dead_letter rejected rows policy needs dead_letter_path to be set",
+					tblName.String())
+			}
+
+			for pgColName, prop := range target.ColumnProperties {
+				if prop.Overflow == OverflowDeadLetter {
+					return fmt.Errorf("table %s: dead_letter overflow policy of %q column needs dead_letter_path to be set",
+						tblName.String(), pgColName)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) validateTableGroups() error {
+	grouped := make(map[PgTableName]string)
+
+	for _, group := range c.TableGroups {
+		for _, tblName := range group.Tables {
+			if _, ok := c.Tables[tblName]; !ok {
+				return fmt.Errorf("table %s of %q group is not configured", tblName.String(), group.Name)
+			}
+
+			if name, ok := grouped[tblName]; ok {
+				return fmt.Errorf("table %s is in both %q and %q groups", tblName.String(), name, group.Name)
+			}
+			grouped[tblName] = group.Name
+		}
+	}
+
+	return nil
+}
+
+// targets returns the table followed by its extra targets
+func (t Table) targets() []Table {
+	return append([]Table{t}, t.ExtraTargets...)
 }
 
 // UnmarshalYAML ...
@@ -261,10 +1976,18 @@ func (t *Table) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		val.BufferTableRowIdColumn = defaultRowIdColumn
 	}
 
+	if val.ChBufferTable != "" && len(val.BufferOrderBy) == 0 {
+		val.BufferOrderBy = []string{val.BufferTableRowIdColumn}
+	}
+
 	if val.SignColumn == "" && val.Engine == CollapsingMergeTree {
 		val.SignColumn = defaultSignColumn
 	}
 
+	if val.SignColumnType == "" && val.Engine == CollapsingMergeTree {
+		val.SignColumnType = defaultSignColumnType
+	}
+
 	if val.IsDeletedColumn == "" && val.Engine == ReplacingMergeTree {
 		val.IsDeletedColumn = defaultIsDeletedColumn
 	}
@@ -277,11 +2000,338 @@ func (t *Table) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		val.MaxBufferLength = defaultMaxBufferLength
 	}
 
+	if val.Engine == SummingMergeTree || val.Engine == AggregatingMergeTree {
+		hasDelta := false
+		for _, prop := range val.ColumnProperties {
+			hasDelta = hasDelta || prop.Delta
+		}
+
+		if !hasDelta {
+			return fmt.Errorf("%s engine needs at least one column with delta in column_properties", val.Engine)
+		}
+	}
+
+	for pgColName, prop := range val.ColumnProperties {
+		if prop.Delta && val.Engine != SummingMergeTree && val.Engine != AggregatingMergeTree {
+			return fmt.Errorf("delta of %q column needs SummingMergeTree or AggregatingMergeTree engine, got %s",
+				pgColName, val.Engine)
+		}
+
+		if prop.JSON == JSONObject {
+			if val.ChBufferTable == "" || val.InitSyncSkipBufferTable {
+				return fmt.Errorf("json object of %q column needs buffer_table, also for the initial sync", pgColName)
+			}
+
+			if prop.Encrypt != EncryptNone || prop.Tokenizer != "" || prop.Mask != MaskNone || prop.Transform != "" {
+				return fmt.Errorf("json object of %q column can not be encrypted, tokenized, masked or transformed",
+					pgColName)
+			}
+		}
+
+		if prop.HStore != HStoreText && (prop.JSON != JSONString || len(prop.JSONPaths) > 0) {
+			return fmt.Errorf("%q column can not be both json and hstore", pgColName)
+		}
+
+		if prop.HStore == HStoreMap {
+			if val.ChBufferTable == "" || val.InitSyncSkipBufferTable {
+				return fmt.Errorf("hstore map of %q column needs buffer_table, also for the initial sync", pgColName)
+			}
+
+			if prop.Encrypt != EncryptNone || prop.Tokenizer != "" || prop.Mask != MaskNone || prop.Transform != "" {
+				return fmt.Errorf("hstore map of %q column can not be encrypted, tokenized, masked or transformed",
+					pgColName)
+			}
+		}
+
+		if prop.Rounding != RoundHalfUp && prop.Decimal != DecimalExact {
+			return fmt.Errorf("rounding of %q column needs decimal: exact", pgColName)
+		}
+
+		if len(prop.HStoreKeys) > 0 && prop.HStore != HStoreMap && prop.HStore != HStoreArrays {
+			return fmt.Errorf("hstore_keys of %q column need hstore map or arrays", pgColName)
+		}
+
+		if prop.Timezone != "" {
+			loc, err := time.LoadLocation(prop.Timezone)
+			if err != nil {
+				return fmt.Errorf("could not load timezone of %q column: %w", pgColName, err)
+			}
+			prop.Location = loc
+			val.ColumnProperties[pgColName] = prop
+		}
+
+		if prop.Transform != "" {
+			e, err := expr.Parse(prop.Transform)
+			if err != nil {
+				return fmt.Errorf("could not parse transform of %q column: %w", pgColName, err)
+			}
+			prop.TransformExpr = e
+			val.ColumnProperties[pgColName] = prop
+		}
+	}
+
+	for name := range val.FlushSettings {
+		if !isSettingName(name) {
+			return fmt.Errorf("invalid flush setting name: %q", name)
+		}
+	}
+
+	derived := make(map[string]expr.Expr, len(val.ColumnExpressions))
+	for chColumn, src := range val.ColumnExpressions {
+		e, err := expr.Parse(src)
+		if err != nil {
+			return fmt.Errorf("could not parse expression of %q column: %w", chColumn, err)
+		}
+		derived[chColumn] = e
+	}
+
+	for pgColName, prop := range val.ColumnProperties {
+		if prop.JSON == JSONFlatten && len(prop.JSONPaths) == 0 {
+			return fmt.Errorf("json_paths of the flattened %q column are not set", pgColName)
+		}
+
+		for chColumn, path := range prop.JSONPaths {
+			keys := strings.Split(path, ".")
+			for _, key := range keys {
+				if key == "" {
+					return fmt.Errorf("invalid json path %q of %q column", path, pgColName)
+				}
+			}
+
+			if _, ok := derived[chColumn]; ok {
+				return fmt.Errorf("%q column has both an expression and a json path", chColumn)
+			}
+			derived[chColumn] = expr.JSONPath(pgColName, keys)
+		}
+
+		if prop.HStore == HStoreFlatten && len(prop.HStoreColumns) == 0 {
+			return fmt.Errorf("hstore_columns of the flattened %q column are not set", pgColName)
+		}
+
+		hstoreColumns := make(map[string]expr.Expr, len(prop.HStoreColumns)+2)
+		for chColumn, key := range prop.HStoreColumns {
+			hstoreColumns[chColumn] = expr.HStoreValue(pgColName, key)
+		}
+		if prop.HStore == HStoreArrays {
+			hstoreColumns[pgColName+".keys"] = expr.HStoreKeys(pgColName, prop.HStoreKeys)
+			hstoreColumns[pgColName+".values"] = expr.HStoreValues(pgColName, prop.HStoreKeys)
+		}
+
+		for chColumn, e := range hstoreColumns {
+			if _, ok := derived[chColumn]; ok {
+				return fmt.Errorf("%q column has both an expression and an hstore key", chColumn)
+			}
+			derived[chColumn] = e
+		}
+	}
+
+	chColumns := make([]string, 0, len(derived))
+	for chColumn := range derived {
+		chColumns = append(chColumns, chColumn)
+	}
+	sort.Strings(chColumns)
+
+	for _, chColumn := range chColumns {
+		val.Derived = append(val.Derived, DerivedColumn{ChColumn: ChColumn{Name: chColumn}, Expr: derived[chColumn]})
+	}
+
+	if val.RowFilter != "" {
+		e, err := expr.Parse(val.RowFilter)
+		if err != nil {
+			return fmt.Errorf("could not parse row filter: %w", err)
+		}
+		val.RowFilterExpr = e
+	}
+
+	if val.SyncChunks < 0 || val.SyncChunkWorkers < 0 || val.SyncPartitionWorkers < 0 {
+		return fmt.Errorf("sync_chunks, sync_chunk_workers and sync_partition_workers must not be negative")
+	}
+
+	if val.SyncChunks > 1 && val.SyncChunkWorkers == 0 {
+		val.SyncChunkWorkers = val.SyncChunks
+	}
+
+	if val.SyncCopyFormat == CopyBinary && val.SyncFetchSize > 0 {
+		return fmt.Errorf("binary sync_copy_format and sync_fetch_size are mutually exclusive")
+	}
+
+	if val.SyncOptimize != OptimizeNone && val.Engine != ReplacingMergeTree && val.Engine != CollapsingMergeTree {
+		return fmt.Errorf("sync_optimize needs ReplacingMergeTree or CollapsingMergeTree engine, got %s", val.Engine)
+	}
+
+	if val.MaxPartsPerPartition > 0 && val.PartsMaxDelay == 0 {
+		val.PartsMaxDelay = defaultPartsMaxDelay
+	}
+
+	if val.RowImageCache < 0 {
+		return fmt.Errorf("row_image_cache must not be negative")
+	}
+
+	if val.RowLookupBatchSize < 0 || val.RowLookupMaxPerSecond < 0 {
+		return fmt.Errorf("row_lookup_batch_size and row_lookup_max_per_second must not be negative")
+	}
+
+	if val.RowLookupBatchSize > 0 && val.RowImageCache == 0 {
+		return fmt.Errorf("row_lookup_batch_size needs row_image_cache, the lookups complete the rows missing in it")
+	}
+
 	*t = Table(val)
 
 	return nil
 }
 
+// Fingerprint returns hash of the effective config: contents of the config file merged with the overlays,
+// postgres connection parameters taken from the environment and the command line flags
+func (c *Config) Fingerprint() string {
+	h := sha256.New()
+
+	h.Write(c.raw)
+	fmt.Fprintf(h, "\n%s:%d/%s@%s force=%t inspect=%t",
+		c.Postgres.Host, c.Postgres.Port, c.Postgres.Database, c.Postgres.User, c.ForceStart, c.Inspect)
+
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// Features returns names of the enabled optional features
+func (c *Config) Features() []string {
+	features := make([]string, 0)
+
+	add := func(enabled bool, name string) {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+
+	add(c.RedisBind != "", "redis_api")
+	add(c.AdminBind != "", "admin_api")
+	add(c.Metrics.Bind != "", "metrics")
+	add(c.SystemTables.Watermarks, "watermarks")
+	add(c.SystemTables.PublishIDs, "publish_ids")
+	add(c.ForceStart, "force_start")
+	add(c.Inspect, "inspect")
+	add(len(c.Postgres.Hosts) > 0, "multi_host")
+	add(len(c.Postgres.PatroniURLs) > 0, "patroni")
+	add(c.Postgres.SlotMissingPolicy == SlotRecreate, "slot_recreate")
+	add(len(c.TableGroups) > 0, "table_groups")
+
+	commitOrder := false
+	for _, group := range c.TableGroups {
+		commitOrder = commitOrder || group.CommitOrder
+	}
+	add(commitOrder, "table_group_commit_order")
+	add(c.RestrictedPrivileges, "restricted_privileges")
+	add(c.Postgres.FailoverSlot, "failover_slot")
+	add(len(c.Postgres.Origins) > 0, "origin_filter")
+	add(c.Postgres.SSLMode != "", "postgres_ssl")
+	add(c.SyncWorkers > 1, "parallel_sync")
+	add(c.ApplyWorkers > 1, "apply_workers")
+	add(c.JSONLOutput != "", "jsonl_output")
+	add(c.GRPC.Bind != "", "grpc_stream")
+	add(c.DeadLetterPath != "", "dead_letter")
+	add(c.LogFormat == LogJSON, "log_json")
+	add(c.InsertDeduplication, "insert_deduplication")
+	add(len(c.ClickHouse.Shards) > 0, "shards")
+	add(c.ClickHouse.Secure, "clickhouse_tls")
+	add(c.IdleTableTimeout > 0, "idle_table_reaping")
+	add(c.ReplicaIdentityCheck == ReplicaIdentityWarn, "replica_identity_warn")
+	add(c.ReplicaIdentityCheck == ReplicaIdentityAlter, "replica_identity_alter")
+
+	var serialGap, shadow, partsGating, addColumns, inherited, encryption, masking, jsonColumns, extraTargets, rowFilter,
+		rowImages, rowLookups, hstoreColumns, exactDecimals, lowCardinalityEnums bool
+	for _, tbl := range c.Tables {
+		for _, target := range tbl.targets() {
+			for _, prop := range target.ColumnProperties {
+				encryption = encryption || prop.Encrypt != EncryptNone
+				masking = masking || prop.Mask != MaskNone
+				jsonColumns = jsonColumns || prop.JSON != JSONString || len(prop.JSONPaths) > 0
+				hstoreColumns = hstoreColumns || prop.HStore != HStoreText || len(prop.HStoreColumns) > 0
+				exactDecimals = exactDecimals || prop.Decimal == DecimalExact
+			}
+			rowFilter = rowFilter || target.RowFilter != ""
+		}
+		extraTargets = extraTargets || len(tbl.ExtraTargets) > 0
+		serialGap = serialGap || tbl.SerialGapColumn != ""
+		shadow = shadow || tbl.ShadowOf != ""
+		partsGating = partsGating || tbl.MaxPartsPerPartition > 0
+		addColumns = addColumns || tbl.AddColumns
+		inherited = inherited || tbl.IncludeInherited
+		rowImages = rowImages || tbl.RowImageCache > 0
+		rowLookups = rowLookups || tbl.RowLookupBatchSize > 0
+		lowCardinalityEnums = lowCardinalityEnums || tbl.EnumMapping == EnumMappingLowCardinality
+	}
+	add(serialGap, "serial_gap_check")
+	add(shadow, "shadow_compare")
+	add(partsGating, "parts_gating")
+	add(addColumns, "add_columns")
+	add(inherited, "include_inherited")
+	add(rowImages, "row_image_cache")
+	add(rowLookups, "row_lookup")
+	add(encryption, "column_encryption")
+	add(masking, "column_masking")
+	add(jsonColumns, "json_columns")
+	add(hstoreColumns, "hstore_columns")
+	add(exactDecimals, "decimal_exact")
+	add(lowCardinalityEnums, "enum_low_cardinality")
+	add(extraTargets, "extra_targets")
+	add(rowFilter, "row_filter")
+	add(len(c.Tokenizers) > 0, "tokenizers")
+
+	return features
+}
+
+// applyConnParams sets up TLS and the extra params of the postgres connections the libpq way; the ssl settings
+// take precedence over the PGSSL* environment variables
+func (c *pgConnConfig) applyConnParams() error {
+	if c.SSLMode == "" && c.SSLRootCert == "" && c.SSLCert == "" && c.SSLKey == "" && len(c.Params) == 0 {
+		return nil
+	}
+
+	query := url.Values{}
+	for param, value := range c.Params {
+		query.Set(param, value)
+	}
+	query.Set("host", c.Host)
+	for param, value := range map[string]string{
+		"sslmode":     c.SSLMode,
+		"sslrootcert": c.SSLRootCert,
+		"sslcert":     c.SSLCert,
+		"sslkey":      c.SSLKey,
+	} {
+		if value != "" {
+			query.Set(param, value)
+		}
+	}
+
+	parsed, err := pgx.ParseURI("postgres:///?" + query.Encode())
+	if err != nil {
+		return err
+	}
+
+	if parsed.Dial != nil {
+		c.Dial = parsed.Dial // connect_timeout
+	}
+
+	if c.RuntimeParams == nil {
+		c.RuntimeParams = make(map[string]string)
+	}
+	for param, value := range parsed.RuntimeParams {
+		c.RuntimeParams[param] = value
+	}
+
+	if c.SSLMode == "" && c.SSLRootCert == "" && c.SSLCert == "" && c.SSLKey == "" {
+		return nil
+	}
+
+	if parsed.TLSConfig != nil && !parsed.TLSConfig.InsecureSkipVerify {
+		parsed.TLSConfig.ServerName = c.Host
+	}
+	c.TLSConfig = parsed.TLSConfig
+	c.UseFallbackTLS = parsed.UseFallbackTLS
+	c.FallbackTLSConfig = parsed.FallbackTLSConfig
+
+	return nil
+}
+
 // ConnectionString returns clickhouse connection string
 func (c *chConnConfig) ConnectionString() string {
 	connStr := url.Values{}
@@ -289,6 +2339,7 @@ func (c *chConnConfig) ConnectionString() string {
 	connStr.Add("username", c.User)
 	connStr.Add("password", c.Password)
 	connStr.Add("database", c.Database)
+	c.addTLSParams(connStr)
 
 	for param, value := range c.Params {
 		connStr.Add(param, value)
@@ -296,3 +2347,49 @@ func (c *chConnConfig) ConnectionString() string {
 
 	return fmt.Sprintf("tcp://%s:%d?%s", c.Host, c.Port, connStr.Encode())
 }
+
+// addTLSParams sets the TLS params of the connection; the driver skips the verification
+// of the server certificate unless told otherwise, so it is set explicitly
+func (c *chConnConfig) addTLSParams(connStr url.Values) {
+	if !c.Secure {
+		return
+	}
+
+	connStr.Add("secure", "true")
+	connStr.Add("skip_verify", strconv.FormatBool(c.SkipVerify))
+}
+
+// ShardConnectionString returns connection string of the shard, the other replicas are the alternative hosts
+func (c *chConnConfig) ShardConnectionString(shard ChShard) string {
+	connStr := url.Values{}
+
+	connStr.Add("username", c.User)
+	connStr.Add("password", c.Password)
+	connStr.Add("database", c.Database)
+	c.addTLSParams(connStr)
+	if len(shard.Hosts) > 1 {
+		connStr.Add("alt_hosts", strings.Join(shard.Hosts[1:], ","))
+		connStr.Add("connection_open_strategy", "in_order")
+	}
+
+	for param, value := range c.Params {
+		connStr.Add(param, value)
+	}
+
+	return fmt.Sprintf("tcp://%s?%s", shard.Hosts[0], connStr.Encode())
+}
+
+// isSettingName checks if the clickhouse setting name is an identifier
+func isSettingName(name string) bool {
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+
+	return true
+}
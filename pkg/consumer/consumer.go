@@ -2,26 +2,44 @@ package consumer
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx"
 
 	"github.com/mkabilov/pg2ch/pkg/decoder"
+	"github.com/mkabilov/pg2ch/pkg/discovery"
 	"github.com/mkabilov/pg2ch/pkg/message"
 	"github.com/mkabilov/pg2ch/pkg/utils"
+	"github.com/mkabilov/pg2ch/pkg/utils/logger"
 )
 
 const (
-	statusTimeout   = time.Second * 10
-	replWaitTimeout = time.Second * 10
+	statusTimeout     = time.Second * 10
+	replWaitTimeout   = time.Second * 10
+	pausePollInterval = time.Second
+)
+
+var (
+	// ErrSlotMissing is reported when the replication slot is not found on the server after reconnect
+	ErrSlotMissing = errors.New("replication slot does not exist")
+
+	// ErrSlotAhead is reported when the slot found after reconnect, e.g. the one synchronized to the new primary
+	// after failover, has confirmed position ahead of the consumer's one: the changes in between are lost
+	ErrSlotAhead = errors.New("replication slot is ahead of the consumer position")
 )
 
 // Handler represents interface for processing logical replication messages
 type Handler interface {
 	HandleMessage(utils.LSN, message.Message) error
+	// HandleReconnect is called once the replication is restarted after the reconnect, before the messages
+	// following it: the transaction interrupted by the reconnect is sent again from its beginning
+	HandleReconnect() error
 }
 
 // Interface represents interface for the consumer
@@ -29,36 +47,78 @@ type Interface interface {
 	SendStatus() error
 	Run(Handler) error
 	AdvanceLSN(utils.LSN)
+	Connected() bool
+	Pause()
+	Resume()
 	Wait()
+	Failed() <-chan error
 }
 
 type consumer struct {
-	waitGr          *sync.WaitGroup
-	ctx             context.Context
-	conn            *pgx.ReplicationConn
-	dbCfg           pgx.ConnConfig
-	slotName        string
-	publicationName string
-	currentLSN      utils.LSN
-	errCh           chan error
+	waitGr            *sync.WaitGroup
+	ctx               context.Context
+	conn              *pgx.ReplicationConn
+	dbCfg             pgx.ConnConfig
+	discoverer        *discovery.Discoverer
+	slotName          string
+	publicationName   string
+	currentLSN        uint64     // lsn the slot is confirmed up to, accessed atomically
+	confirmedLSN      utils.LSN  // max lsn the slot could have been confirmed up to: by the previous runs or this one
+	failCh            chan error // receives the error the consumer gave up with
+	reconnectInterval time.Duration
+	maxReconnects     int   // 0 means unlimited
+	paused            int32 // messages are not read while paused, only the status is sent; accessed atomically
+	connected         int32 // replication connection is up, accessed atomically
+	inspect           bool  // the slot is never advanced: the status is only sent on the request of the server
+	log               *slog.Logger
 }
 
 // New instantiates the consumer
-func New(ctx context.Context, errCh chan error, dbCfg pgx.ConnConfig, slotName, publicationName string, startLSN utils.LSN) *consumer {
+func New(ctx context.Context, dbCfg pgx.ConnConfig, discoverer *discovery.Discoverer, slotName, publicationName string, startLSN utils.LSN,
+	reconnectInterval time.Duration, maxReconnects int, inspect bool) *consumer {
 	return &consumer{
-		waitGr:          &sync.WaitGroup{},
-		ctx:             ctx,
-		dbCfg:           dbCfg,
-		slotName:        slotName,
-		publicationName: publicationName,
-		currentLSN:      startLSN,
-		errCh:           errCh,
+		waitGr:            &sync.WaitGroup{},
+		ctx:               ctx,
+		dbCfg:             dbCfg,
+		discoverer:        discoverer,
+		slotName:          slotName,
+		publicationName:   publicationName,
+		currentLSN:        uint64(startLSN),
+		failCh:            make(chan error, 1),
+		reconnectInterval: reconnectInterval,
+		maxReconnects:     maxReconnects,
+		inspect:           inspect,
+		log:               logger.For("consumer").With("slot", slotName),
 	}
 }
 
-// AdvanceLSN advances lsn position
+// Failed returns channel which receives the error in case consumer stopped because of it
+func (c *consumer) Failed() <-chan error {
+	return c.failCh
+}
+
+// AdvanceLSN advances lsn position, ignored in the inspection mode
 func (c *consumer) AdvanceLSN(lsn utils.LSN) {
-	c.currentLSN = lsn
+	if c.inspect {
+		return
+	}
+
+	atomic.StoreUint64(&c.currentLSN, uint64(lsn))
+}
+
+// Connected checks if the replication connection is up, false while reconnecting
+func (c *consumer) Connected() bool {
+	return atomic.LoadInt32(&c.connected) == 1
+}
+
+// Pause stops reading the replication messages; the status is still sent, so the connection is kept
+func (c *consumer) Pause() {
+	atomic.StoreInt32(&c.paused, 1)
+}
+
+// Resume resumes reading the replication messages
+func (c *consumer) Resume() {
+	atomic.StoreInt32(&c.paused, 0)
 }
 
 // Wait waits for the goroutines
@@ -66,30 +126,36 @@ func (c *consumer) Wait() {
 	c.waitGr.Wait()
 }
 
-func (c *consumer) close(err error) {
-	select {
-	case c.errCh <- err:
-	default:
-	}
-}
-
 // Run runs consumer
 func (c *consumer) Run(handler Handler) error {
-	rc, err := pgx.ReplicationConnect(c.dbCfg)
+	dbCfg, err := c.discoverer.Primary(c.dbCfg)
+	if err != nil {
+		return fmt.Errorf("could not discover the server: %w", err)
+	}
+
+	_, c.confirmedLSN, err = c.slotPosition(dbCfg)
+	if err != nil {
+		return fmt.Errorf("could not get slot position: %w", err)
+	}
+
+	rc, err := pgx.ReplicationConnect(dbCfg)
 	if err != nil {
-		return fmt.Errorf("could not connect using replication protocol: %v", err)
+		return fmt.Errorf("could not connect using replication protocol: %w", err)
 	}
 
 	c.conn = rc
 
 	if err := c.startDecoding(); err != nil {
-		return fmt.Errorf("could not start replication slot: %v", err)
+		return fmt.Errorf("could not start replication slot: %w", err)
 	}
 
 	// we may have flushed the final segment at shutdown without bothering to advance the slot LSN.
-	if err := c.SendStatus(); err != nil {
-		return fmt.Errorf("could not send replay progress: %v", err)
+	if !c.inspect {
+		if err := c.SendStatus(); err != nil {
+			return fmt.Errorf("could not send replay progress: %w", err)
+		}
 	}
+	atomic.StoreInt32(&c.connected, 1)
 
 	c.waitGr.Add(1)
 	go c.processReplicationMessage(handler)
@@ -98,22 +164,147 @@ func (c *consumer) Run(handler Handler) error {
 }
 
 func (c *consumer) startDecoding() error {
-	log.Printf("Starting from %s lsn", c.currentLSN)
+	lsn := utils.LSN(atomic.LoadUint64(&c.currentLSN))
+	c.log.Info("starting replication", "lsn", lsn)
 
-	err := c.conn.StartReplication(c.slotName, uint64(c.currentLSN), -1,
+	err := c.conn.StartReplication(c.slotName, uint64(lsn), -1,
 		`"proto_version" '1'`, fmt.Sprintf(`"publication_names" '%s'`, c.publicationName))
 
 	if err != nil {
 		c.closeDbConnection()
-		return fmt.Errorf("failed to start decoding logical replication messages: %v", err)
+		return fmt.Errorf("failed to start decoding logical replication messages: %w", err)
 	}
 
 	return nil
 }
 
+func (c *consumer) fail(err error) {
+	select {
+	case c.failCh <- err:
+	default:
+	}
+}
+
+// slotPosition checks if the slot exists on the primary server and returns its confirmed lsn
+func (c *consumer) slotPosition(dbCfg pgx.ConnConfig) (bool, utils.LSN, error) {
+	var (
+		exists, inRecovery bool
+		confirmed          sql.NullString
+	)
+
+	conn, err := pgx.Connect(dbCfg)
+	if err != nil {
+		return false, utils.InvalidLSN, fmt.Errorf("could not connect: %w", err)
+	}
+	defer conn.Close()
+
+	err = conn.QueryRow("select exists(select 1 from pg_replication_slots where slot_name = $1), "+
+		"(select confirmed_flush_lsn::text from pg_replication_slots where slot_name = $1), pg_is_in_recovery()",
+		c.slotName).Scan(&exists, &confirmed, &inRecovery)
+	if err != nil {
+		return false, utils.InvalidLSN, fmt.Errorf("could not query: %w", err)
+	}
+
+	if inRecovery {
+		return false, utils.InvalidLSN, fmt.Errorf("server is in recovery")
+	}
+
+	lsn := utils.InvalidLSN
+	if confirmed.Valid {
+		if err := lsn.Parse(confirmed.String); err != nil {
+			return false, utils.InvalidLSN, fmt.Errorf("could not parse confirmed lsn: %w", err)
+		}
+	}
+
+	return exists, lsn, nil
+}
+
+// reconnect establishes replication connection again, host name is resolved on each attempt
+func (c *consumer) reconnect() error {
+	c.closeDbConnection()
+
+	for attempt := 1; c.maxReconnects == 0 || attempt <= c.maxReconnects; attempt++ {
+		select {
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		case <-time.After(c.reconnectInterval):
+		}
+		dbCfg, err := c.discoverer.Primary(c.dbCfg)
+		if err != nil {
+			c.log.Warn("could not discover the server", "attempt", attempt, "error", err)
+			continue
+		}
+		c.log.Info("reconnecting", "host", dbCfg.Host, "port", dbCfg.Port, "attempt", attempt)
+
+		exists, confirmedLSN, err := c.slotPosition(dbCfg)
+		if err != nil {
+			c.log.Warn("could not check replication slot", "attempt", attempt, "error", err)
+			continue
+		}
+
+		if !exists {
+			return ErrSlotMissing
+		}
+
+		if confirmedLSN > c.confirmedLSN {
+			return fmt.Errorf("%w: slot confirmed lsn %v, confirmed by the consumer %v", ErrSlotAhead, confirmedLSN, c.confirmedLSN)
+		}
+		c.log.Info("replication slot position checked",
+			"slot_lsn", confirmedLSN, "consumer_lsn", c.confirmedLSN)
+
+		rc, err := pgx.ReplicationConnect(dbCfg)
+		if err != nil {
+			c.log.Warn("could not connect using replication protocol", "attempt", attempt, "error", err)
+			continue
+		}
+		c.conn = rc
+
+		if err := c.startDecoding(); err != nil {
+			c.log.Warn("could not start replication slot", "attempt", attempt, "error", err)
+			continue
+		}
+
+		if !c.inspect {
+			if err := c.SendStatus(); err != nil {
+				c.log.Warn("could not send replay progress", "attempt", attempt, "error", err)
+				c.closeDbConnection()
+				continue
+			}
+		}
+
+		c.log.Info("reconnected", "host", dbCfg.Host, "port", dbCfg.Port, "attempt", attempt)
+		atomic.StoreInt32(&c.connected, 1)
+		return nil
+	}
+
+	return fmt.Errorf("could not reconnect after %d attempts", c.maxReconnects)
+}
+
+// handleFailure tries to recover the replication, returns false if consumer must stop
+func (c *consumer) handleFailure(handler Handler, err error) bool {
+	c.log.Error("replication failed", "error", err)
+	atomic.StoreInt32(&c.connected, 0)
+
+	if err := c.reconnect(); err != nil {
+		if err != context.Canceled {
+			c.fail(err)
+		}
+
+		return false
+	}
+
+	if err := handler.HandleReconnect(); err != nil {
+		c.fail(fmt.Errorf("could not handle reconnect: %w", err))
+
+		return false
+	}
+
+	return true
+}
+
 func (c *consumer) closeDbConnection() {
 	if err := c.conn.Close(); err != nil {
-		log.Printf("could not close replication connection: %v", err)
+		c.log.Warn("could not close replication connection", "error", err)
 	}
 }
 
@@ -128,11 +319,24 @@ func (c *consumer) processReplicationMessage(handler Handler) {
 			c.closeDbConnection()
 			return
 		case <-statusTicker.C:
+			if c.inspect {
+				continue
+			}
 			if err := c.SendStatus(); err != nil {
-				c.close(fmt.Errorf("could not send replay progress: %v", err))
-				return
+				if !c.handleFailure(handler, fmt.Errorf("could not send replay progress: %w", err)) {
+					statusTicker.Stop()
+					return
+				}
 			}
 		default:
+			if atomic.LoadInt32(&c.paused) == 1 {
+				select {
+				case <-c.ctx.Done():
+				case <-time.After(pausePollInterval):
+				}
+				continue
+			}
+
 			wctx, cancel := context.WithTimeout(c.ctx, replWaitTimeout)
 			repMsg, err := c.conn.WaitForReplicationMessage(wctx)
 			cancel()
@@ -140,54 +344,67 @@ func (c *consumer) processReplicationMessage(handler Handler) {
 			if err == context.DeadlineExceeded {
 				continue
 			} else if err == context.Canceled {
-				log.Printf("received shutdown request: decoding terminated")
+				c.log.Info("received shutdown request: decoding terminated")
 				return
 			} else if err != nil {
-				// TODO: make sure we retry and cleanup after ourselves afterwards
-				c.close(fmt.Errorf("replication failed: %v", err))
-				return
+				if !c.handleFailure(handler, err) {
+					statusTicker.Stop()
+					return
+				}
+				continue
 			}
 
 			if repMsg == nil {
-				log.Printf("received null replication message")
+				c.log.Debug("received null replication message")
 				continue
 			}
 
 			if repMsg.WalMessage != nil {
 				msg, err := decoder.Parse(repMsg.WalMessage.WalData)
 				if err != nil {
-					c.close(fmt.Errorf("invalid pgoutput message: %s", err))
+					c.fail(fmt.Errorf("invalid pgoutput message: %w", err))
 					return
 				}
 
 				if err := handler.HandleMessage(utils.LSN(repMsg.WalMessage.WalStart), msg); err != nil {
-					c.close(fmt.Errorf("error handling waldata: %s", err))
+					c.fail(fmt.Errorf("error handling waldata: %w", err))
 					return
 				}
 			}
 
 			if repMsg.ServerHeartbeat != nil && repMsg.ServerHeartbeat.ReplyRequested == 1 {
-				log.Println("server wants a reply")
+				c.log.Debug("server wants a reply")
 				if err := c.SendStatus(); err != nil {
-					c.close(fmt.Errorf("could not send replay progress: %v", err))
-					return
+					if !c.handleFailure(handler, fmt.Errorf("could not send replay progress: %w", err)) {
+						statusTicker.Stop()
+						return
+					}
 				}
 			}
 		}
 	}
 }
 
-// SendStatus sends the status
+// SendStatus sends the status; in the inspection mode it carries no lsn, so the server keeps the connection
+// without advancing the slot
 func (c *consumer) SendStatus() error {
-	// log.Printf("sending status: %v", c.currentLSN) //TODO: move to debug log level
-	status, err := pgx.NewStandbyStatus(uint64(c.currentLSN))
+	lsn := utils.LSN(atomic.LoadUint64(&c.currentLSN))
+	if c.inspect {
+		lsn = utils.InvalidLSN
+	}
+	c.log.Debug("sending status", "lsn", lsn)
+	status, err := pgx.NewStandbyStatus(uint64(lsn))
 
 	if err != nil {
-		return fmt.Errorf("error creating standby status: %s", err)
+		return fmt.Errorf("error creating standby status: %w", err)
 	}
 
 	if err := c.conn.SendStandbyStatus(status); err != nil {
-		return fmt.Errorf("failed to send standy status: %s", err)
+		return fmt.Errorf("failed to send standy status: %w", err)
+	}
+
+	if lsn > c.confirmedLSN {
+		c.confirmedLSN = lsn
 	}
 
 	return nil
@@ -0,0 +1,185 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"github.com/mkabilov/pg2ch/pkg/utils/logger"
+)
+
+const (
+	// TargetAny accepts any server, the first one we could connect to is used
+	TargetAny = "any"
+
+	// TargetReadWrite accepts only the primary server
+	TargetReadWrite = "read-write"
+
+	patroniTimeout = 5 * time.Second
+)
+
+// Discoverer finds the server to connect to
+type Discoverer struct {
+	hosts              []string // host[:port] candidates
+	targetSessionAttrs string
+	patroniURLs        []string // patroni REST API endpoints
+	httpClient         *http.Client
+	log                *slog.Logger
+}
+
+type patroniMember struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+	Host string `json:"host"`
+	Port uint16 `json:"port"`
+}
+
+type patroniCluster struct {
+	Members []patroniMember `json:"members"`
+}
+
+// New instantiates discoverer
+func New(hosts []string, targetSessionAttrs string, patroniURLs []string) *Discoverer {
+	if targetSessionAttrs == "" {
+		targetSessionAttrs = TargetAny
+	}
+
+	return &Discoverer{
+		hosts:              hosts,
+		targetSessionAttrs: targetSessionAttrs,
+		patroniURLs:        patroniURLs,
+		httpClient:         &http.Client{Timeout: patroniTimeout},
+		log:                logger.For("discovery"),
+	}
+}
+
+// Primary returns connection config of the server to connect to
+func (d *Discoverer) Primary(connCfg pgx.ConnConfig) (pgx.ConnConfig, error) {
+	if d == nil {
+		return connCfg, nil
+	}
+
+	if len(d.patroniURLs) > 0 {
+		return d.patroniLeader(connCfg)
+	}
+
+	if len(d.hosts) > 0 {
+		return d.multiHost(connCfg)
+	}
+
+	return connCfg, nil
+}
+
+func (d *Discoverer) patroniLeader(connCfg pgx.ConnConfig) (pgx.ConnConfig, error) {
+	for _, url := range d.patroniURLs {
+		member, err := d.fetchPatroniLeader(url)
+		if err != nil {
+			d.log.Warn("could not get leader from patroni", "url", url, "error", err)
+			continue
+		}
+
+		connCfg.Host = member.Host
+		if member.Port != 0 {
+			connCfg.Port = member.Port
+		}
+
+		return connCfg, nil
+	}
+
+	return connCfg, fmt.Errorf("could not find leader using patroni api")
+}
+
+func (d *Discoverer) fetchPatroniLeader(url string) (*patroniMember, error) {
+	var cluster patroniCluster
+
+	resp, err := d.httpClient.Get(url + "/cluster")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&cluster); err != nil {
+		return nil, fmt.Errorf("could not decode: %w", err)
+	}
+
+	for _, member := range cluster.Members {
+		if member.Role == "leader" || member.Role == "master" {
+			return &member, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no leader in the cluster")
+}
+
+func (d *Discoverer) multiHost(connCfg pgx.ConnConfig) (pgx.ConnConfig, error) {
+	for _, hostPort := range d.hosts {
+		cfg, err := withHost(connCfg, hostPort)
+		if err != nil {
+			return connCfg, err
+		}
+
+		ok, err := d.acceptable(cfg)
+		if err != nil {
+			d.log.Warn("could not check server", "host", cfg.Host, "port", cfg.Port, "error", err)
+			continue
+		}
+
+		if ok {
+			return cfg, nil
+		}
+	}
+
+	return connCfg, fmt.Errorf("could not find %s server among %v", d.targetSessionAttrs, d.hosts)
+}
+
+// acceptable checks if the server matches target session attributes
+func (d *Discoverer) acceptable(cfg pgx.ConnConfig) (bool, error) {
+	var inRecovery bool
+
+	conn, err := pgx.Connect(cfg)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if d.targetSessionAttrs == TargetAny {
+		return true, nil
+	}
+
+	if err := conn.QueryRow("select pg_is_in_recovery()").Scan(&inRecovery); err != nil {
+		return false, err
+	}
+
+	return !inRecovery, nil
+}
+
+func withHost(connCfg pgx.ConnConfig, hostPort string) (pgx.ConnConfig, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	} else {
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return connCfg, fmt.Errorf("invalid port in %q: %w", hostPort, err)
+		}
+		connCfg.Port = uint16(port)
+	}
+
+	connCfg.Host = host
+	if connCfg.TLSConfig != nil && connCfg.TLSConfig.ServerName != "" {
+		connCfg.TLSConfig = connCfg.TLSConfig.Clone() // verify the certificate of the host connected to
+		connCfg.TLSConfig.ServerName = host
+	}
+
+	return connCfg, nil
+}
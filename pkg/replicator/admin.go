@@ -0,0 +1,248 @@
+package replicator
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/stats"
+)
+
+const expvarName = "pg2ch"
+
+func (r *Replicator) adminServer() {
+	expvar.Publish(expvarName, expvar.Func(func() interface{} {
+		return r.stats.Snapshot()
+	}))
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/stats", r.statsHandler)
+	mux.HandleFunc("/sync_reports", r.syncReportsHandler)
+	mux.HandleFunc("/version", r.versionHandler)
+	mux.HandleFunc("/reload", r.reloadHandler)
+	mux.HandleFunc("/resync", r.resyncHandler)
+	mux.HandleFunc("/pause", r.pauseHandler)
+	mux.HandleFunc("/resume", r.resumeHandler)
+	mux.HandleFunc("/flush", r.flushHandler)
+	mux.HandleFunc("/freeze", r.freezeHandler)
+	mux.HandleFunc("/thaw", r.thawHandler)
+	mux.HandleFunc("/healthz", r.healthzHandler)
+	mux.HandleFunc("/readyz", r.readyzHandler)
+
+	if err := http.ListenAndServe(r.cfg.AdminBind, mux); err != nil {
+		select {
+		case r.errCh <- err:
+		default:
+		}
+	}
+}
+
+func (r *Replicator) statsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(r.stats.Snapshot()); err != nil {
+		r.log.Warn("could not write stats", "error", err)
+	}
+}
+
+func (r *Replicator) syncReportsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(r.stats.SyncReports()); err != nil {
+		r.log.Warn("could not write sync reports", "error", err)
+	}
+}
+
+func (r *Replicator) versionHandler(w http.ResponseWriter, req *http.Request) {
+	info := struct {
+		BuildInfo
+		ConfigFingerprint string   `json:"config_fingerprint"`
+		Features          []string `json:"features"`
+	}{
+		BuildInfo:         r.buildInfo,
+		ConfigFingerprint: r.cfg.Fingerprint(),
+		Features:          r.cfg.Features(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		r.log.Warn("could not write version", "error", err)
+	}
+}
+
+// reloadHandler starts the reload of the tables from the config files, same as SIGHUP
+func (r *Replicator) reloadHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !r.startTablesChange(r.reloadTables) {
+		http.Error(w, "change of the tables is already running", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// resyncHandler starts the sync of the table given by the table parameter from scratch
+func (r *Replicator) resyncHandler(w http.ResponseWriter, req *http.Request) {
+	var tblName config.PgTableName
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := tblName.Parse(req.URL.Query().Get("table")); err != nil {
+		http.Error(w, fmt.Sprintf("could not parse table name: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if tblCfg, ok := r.tableConfig(tblName); !ok {
+		http.Error(w, fmt.Sprintf("table %s is not replicated", tblName.String()), http.StatusNotFound)
+		return
+	} else if tblCfg.ChBufferTable == "" {
+		http.Error(w, "online resync needs buffer_table, use --resync at the start", http.StatusBadRequest)
+		return
+	}
+
+	if !r.startTablesChange(func() error { return r.resyncTable(tblName) }) {
+		http.Error(w, "change of the tables is already running", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// pauseHandler stops consuming the stream, the connection and the replication slot are kept;
+// the buffered changes are flushed by the inactivity timeout as usual
+func (r *Replicator) pauseHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !r.stats.SwapState(stats.StateStreaming, stats.StatePaused) {
+		http.Error(w, fmt.Sprintf("replication is %s, not streaming", r.stats.State()), http.StatusConflict)
+		return
+	}
+	r.consumer.Pause()
+	r.log.Info("replication is paused via the admin api")
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// resumeHandler resumes consuming the stream paused by pauseHandler
+func (r *Replicator) resumeHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !r.stats.SwapState(stats.StatePaused, stats.StateStreaming) {
+		http.Error(w, fmt.Sprintf("replication is %s, not paused", r.stats.State()), http.StatusConflict)
+		return
+	}
+	r.consumer.Resume()
+	r.log.Info("replication is resumed via the admin api")
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// flushHandler requests the flush of the buffered changes to the main tables, done right away between the
+// transactions or at the end of the current one
+func (r *Replicator) flushHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if state := r.stats.State(); state != stats.StateStreaming && state != stats.StatePaused {
+		http.Error(w, fmt.Sprintf("replication is %s, not streaming", state), http.StatusConflict)
+		return
+	}
+
+	atomic.StoreInt32(&r.flushRequested, 1)
+	go r.requestedFlush()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// freezeHandler stops applying the changes of the table given by the table parameter, e.g. for the maintenance
+// of its clickhouse table; the changes are kept on disk until the table is thawed
+func (r *Replicator) freezeHandler(w http.ResponseWriter, req *http.Request) {
+	tblName, ok := r.streamingTableParam(w, req)
+	if !ok {
+		return
+	}
+
+	if err := r.freezeTable(tblName); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// thawHandler starts applying the changes of the frozen table kept on disk, then the table is replicated as usual
+func (r *Replicator) thawHandler(w http.ResponseWriter, req *http.Request) {
+	tblName, ok := r.streamingTableParam(w, req)
+	if !ok {
+		return
+	}
+
+	if !r.startTablesChange(func() error { return r.thawTable(tblName) }) {
+		http.Error(w, "change of the tables is already running", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// streamingTableParam parses the table parameter of the POST request changing the replicated table while streaming,
+// writes the error response if it is invalid
+func (r *Replicator) streamingTableParam(w http.ResponseWriter, req *http.Request) (config.PgTableName, bool) {
+	var tblName config.PgTableName
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return tblName, false
+	}
+
+	if state := r.stats.State(); state != stats.StateStreaming && state != stats.StatePaused {
+		http.Error(w, fmt.Sprintf("replication is %s, not streaming", state), http.StatusConflict)
+		return tblName, false
+	}
+
+	if err := tblName.Parse(req.URL.Query().Get("table")); err != nil {
+		http.Error(w, fmt.Sprintf("could not parse table name: %v", err), http.StatusBadRequest)
+		return tblName, false
+	}
+
+	if _, ok := r.tableConfig(tblName); !ok {
+		http.Error(w, fmt.Sprintf("table %s is not replicated", tblName.String()), http.StatusNotFound)
+		return tblName, false
+	}
+
+	return tblName, true
+}
+
+// requestedFlush flushes the tables if requested and not inside a transaction, otherwise it is done on the commit
+func (r *Replicator) requestedFlush() {
+	r.tablesToMergeMutex.Lock()
+	defer r.tablesToMergeMutex.Unlock()
+
+	if r.inTx || atomic.SwapInt32(&r.flushRequested, 0) == 0 {
+		return
+	}
+
+	if err := r.mergeTables(); err != nil {
+		select {
+		case r.errCh <- fmt.Errorf("could not merge tables: %w", err):
+		default:
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package replicator
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/stats"
+)
+
+const (
+	phaseRead    = "read"
+	phaseConvert = "convert"
+	phaseUpload  = "upload"
+
+	// phase is considered the bottleneck if it takes more than this share of the sync time
+	bottleneckShare = 0.5
+
+	defaultCHBlockSize = 1000000
+)
+
+// syncReport builds the tuning report of the table's initial sync based on the per-phase metrics
+func (r *Replicator) syncReport(tblName config.PgTableName, tblCfg config.Table) (stats.SyncReport, bool) {
+	snap := r.stats.Table(tblName.String()).SyncSnapshot()
+	if snap == nil {
+		return stats.SyncReport{}, false
+	}
+
+	report := stats.SyncReport{
+		Table:       tblName.String(),
+		Sync:        *snap,
+		Suggestions: make([]string, 0),
+	}
+
+	phases := map[string]float64{
+		phaseRead:    snap.Read.Seconds,
+		phaseConvert: snap.Convert.Seconds,
+		phaseUpload:  snap.Upload.Seconds,
+	}
+
+	total := 0.0
+	for _, seconds := range phases {
+		total += seconds
+	}
+	if total == 0 {
+		return report, true
+	}
+
+	for _, phase := range []string{phaseRead, phaseConvert, phaseUpload} {
+		if phases[phase]/total > bottleneckShare {
+			report.Bottleneck = phase
+		}
+	}
+
+	switch report.Bottleneck {
+	case phaseRead:
+		report.Suggestions = append(report.Suggestions,
+			"postgres COPY is the bottleneck: check the network bandwidth to the source and its load")
+		if len(tblCfg.Columns) >= len(tblCfg.PgColumns) {
+			report.Suggestions = append(report.Suggestions,
+				"all the columns of the table are copied: map only the needed ones in the columns section")
+		}
+	case phaseConvert:
+		report.Suggestions = append(report.Suggestions,
+			"conversion is the bottleneck: it is cpu bound, make sure GOMAXPROCS allows using more cores")
+		for _, prop := range tblCfg.ColumnProperties {
+			if prop.Trim == config.TrimRight {
+				report.Suggestions = append(report.Suggestions,
+					"trim of the char columns adds to the conversion cost, consider keeping the trailing spaces")
+				break
+			}
+		}
+	case phaseUpload:
+		report.Suggestions = append(report.Suggestions,
+			"clickhouse ingest is the bottleneck")
+		if compress, err := strconv.ParseBool(r.cfg.ClickHouse.Params["compress"]); err != nil || !compress {
+			report.Suggestions = append(report.Suggestions,
+				"enable compression of the data sent to clickhouse: set compress: true in the clickhouse params")
+		}
+		if blockSize, err := strconv.Atoi(r.cfg.ClickHouse.Params["block_size"]); err != nil || blockSize <= defaultCHBlockSize {
+			report.Suggestions = append(report.Suggestions,
+				"increase block_size in the clickhouse params to send fewer, bigger blocks")
+		}
+		if tblCfg.ChBufferTable != "" && !tblCfg.InitSyncSkipBufferTable {
+			report.Suggestions = append(report.Suggestions,
+				"data is written twice via the buffer table, consider init_sync_skip_buffer_table: true")
+		}
+	}
+
+	return report, true
+}
+
+// reportSync logs and stores the tuning report of the table's initial sync
+func (r *Replicator) reportSync(tblName config.PgTableName, tblCfg config.Table) {
+	report, ok := r.syncReport(tblName, tblCfg)
+	if !ok {
+		return
+	}
+	r.stats.SetSyncReport(report)
+
+	if report.Bottleneck != "" {
+		r.log.Info("initial sync bottleneck", "table", tblName.String(), "bottleneck", report.Bottleneck)
+	}
+	for _, suggestion := range report.Suggestions {
+		r.log.Info("initial sync suggestion", "table", tblName.String(), "suggestion", suggestion)
+	}
+
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		r.log.Warn("could not marshal sync report", "table", tblName.String(), "error", err)
+		return
+	}
+	r.log.Info("sync report", "table", tblName.String(), "report", json.RawMessage(reportJSON))
+}
@@ -0,0 +1,70 @@
+package replicator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/utils/chutils"
+)
+
+// chRequirement is the configured feature available since the clickhouse version
+type chRequirement struct {
+	feature string
+	major   int
+	minor   int
+	used    func(cfg *config.Config) bool
+}
+
+// configured features the older clickhouse servers reject: they fail the startup instead of each flush
+var chRequirements = []chRequirement{
+	{"log_comment", 21, 2, func(cfg *config.Config) bool { return cfg.LogComment }},
+	{"insert_deduplication", 22, 2, func(cfg *config.Config) bool { return cfg.InsertDeduplication }},
+}
+
+// chProbeVersion fetches the version of the clickhouse server and of the shards, the oldest one is used
+func (r *Replicator) chProbeVersion() error {
+	version, err := chutils.ServerVersion(r.chConn)
+	if err != nil {
+		return err
+	}
+
+	for i, conn := range r.chShards {
+		shardVersion, err := chutils.ServerVersion(conn)
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", i+1, err)
+		}
+
+		if shardVersion.Less(version) {
+			version = shardVersion
+		}
+	}
+	r.chVersion = version
+	r.log.Info("clickhouse server version", "version", version.String())
+
+	return r.checkChVersion()
+}
+
+// checkChVersion checks that the server supports the configured features
+func (r *Replicator) checkChVersion() error {
+	unsupported := make([]string, 0)
+
+	for _, req := range chRequirements {
+		if req.used(&r.cfg) && !r.chVersion.AtLeast(req.major, req.minor) {
+			unsupported = append(unsupported, fmt.Sprintf("%s requires %d.%d", req.feature, req.major, req.minor))
+		}
+	}
+
+	if len(unsupported) > 0 {
+		return fmt.Errorf("clickhouse server version %s does not support configured features: %s",
+			r.chVersion, strings.Join(unsupported, ", "))
+	}
+
+	return nil
+}
+
+// chSupportsTTL checks if the server supports the TTL of the MergeTree tables, the system tables are created
+// without it on the older servers
+func (r *Replicator) chSupportsTTL() bool {
+	return r.chVersion.AtLeast(19, 6)
+}
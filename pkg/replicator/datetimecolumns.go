@@ -0,0 +1,86 @@
+package replicator
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+// resolveDateTime64Columns checks the timestamp and timestamptz columns written into the DateTime64 ones
+// and sets the location of the timestamptz values
+func (r *Replicator) resolveDateTime64Columns(tblName config.PgTableName, cfg *config.Table) error {
+	for pgColName, prop := range cfg.ColumnProperties {
+		chCol, ok := cfg.ColumnMapping[pgColName]
+		if prop.Timezone != "" && (!ok || chCol.BaseType != utils.ChDateTime64) {
+			return fmt.Errorf("timezone of %q column needs DateTime64 column in clickhouse", pgColName)
+		}
+	}
+
+	for pgColName, chCol := range cfg.ColumnMapping {
+		if chCol.BaseType != utils.ChDateTime64 {
+			continue
+		}
+
+		pgCol := cfg.PgColumns[pgColName]
+		switch pgCol.BaseType {
+		case utils.PgTimestamp, utils.PgTimestampWithoutTimeZone, utils.PgTimestampWithTimeZone:
+		default:
+			return fmt.Errorf("%w: %q column of %s postgres table must be of timestamp type for DateTime64, got %s",
+				utils.ErrSchemaMismatch, pgColName, tblName.String(), pgCol.BaseType)
+		}
+
+		if pgCol.IsArray || chCol.IsArray || len(chCol.Ext) != 1 {
+			return fmt.Errorf("%w: %q column must be of DateTime64(P[, timezone]) type in clickhouse, arrays are not supported",
+				utils.ErrSchemaMismatch, chCol.Name)
+		}
+
+		prop := cfg.ColumnProperties[pgColName]
+		if pgCol.BaseType != utils.PgTimestampWithTimeZone {
+			if prop.Timezone != "" {
+				return fmt.Errorf("timezone of %q column needs timestamp with time zone, the timestamps are written as they are",
+					pgColName)
+			}
+		} else if prop.Timezone == "" {
+			if chCol.Timezone == "" {
+				return fmt.Errorf("timezone of %q column is set neither in the DateTime64 type of %q clickhouse column "+
+					"nor in column_properties", pgColName, chCol.Name)
+			}
+
+			loc, err := time.LoadLocation(chCol.Timezone)
+			if err != nil {
+				return fmt.Errorf("could not load timezone of %q clickhouse column: %w", chCol.Name, err)
+			}
+			prop.Location = loc
+
+			if cfg.ColumnProperties == nil {
+				cfg.ColumnProperties = make(map[string]config.ColumnProperty)
+			}
+			cfg.ColumnProperties[pgColName] = prop
+		} else if chCol.Timezone != "" && chCol.Timezone != prop.Timezone {
+			return fmt.Errorf("%w: timezone of %q column is %s, its DateTime64 clickhouse column is in %s",
+				utils.ErrSchemaMismatch, pgColName, prop.Timezone, chCol.Timezone)
+		}
+
+		// the driver can't write DateTime64, the text is cast to it when moved from the buffer table
+		if cfg.ChBufferTable == "" || cfg.InitSyncSkipBufferTable {
+			return fmt.Errorf("DateTime64 column %q needs buffer_table, also for the initial sync", chCol.Name)
+		}
+
+		bufColumns, err := r.chSchema.Columns(cfg.ChBufferTable)
+		if err != nil {
+			return fmt.Errorf("could not get columns for %q clickhouse table: %w", cfg.ChBufferTable, err)
+		}
+
+		if bufCol, ok := bufColumns[chCol.Name]; !ok {
+			return fmt.Errorf("%w: could not find %q column in %q clickhouse table",
+				utils.ErrSchemaMismatch, chCol.Name, cfg.ChBufferTable)
+		} else if bufCol.BaseType != utils.ChString {
+			return fmt.Errorf("%w: %q column of DateTime64 type must be of %s type in %q buffer table, got %s",
+				utils.ErrSchemaMismatch, chCol.Name, utils.ChString, cfg.ChBufferTable, bufCol.BaseType)
+		}
+	}
+
+	return nil
+}
@@ -9,16 +9,25 @@ import (
 	"github.com/mkabilov/pg2ch/pkg/utils/tableinfo"
 )
 
+// number of the recent inserts the generated tables keep the hashes of with insert_deduplication
+const ddlDeduplicationWindow = 1000
+
 //GenerateChDDL generates clickhouse table DDLs
 //TODO: refactor me
 func (r *Replicator) GenerateChDDL() error {
 	if err := r.pgConnect(); err != nil {
-		return fmt.Errorf("could not connect to pg: %v", err)
+		return fmt.Errorf("could not connect to pg: %w", err)
 	}
 
 	tx, err := r.pgBegin()
 	if err != nil {
-		return fmt.Errorf("could not start transaction on pg side: %v", err)
+		return fmt.Errorf("could not start transaction on pg side: %w", err)
+	}
+
+	settings := ""
+	if r.cfg.InsertDeduplication {
+		// the non-replicated tables keep no hashes of the inserted blocks by default
+		settings = fmt.Sprintf(" SETTINGS non_replicated_deduplication_window = %d", ddlDeduplicationWindow)
 	}
 
 	for tblName := range r.cfg.Tables {
@@ -26,13 +35,14 @@ func (r *Replicator) GenerateChDDL() error {
 			pkColumnNumb int
 			engineParams string
 			orderBy      string
+			deltaColumns []string
 		)
 
 		tblCfg := r.cfg.Tables[tblName]
 
 		tblCfg.TupleColumns, tblCfg.PgColumns, err = tableinfo.TablePgColumns(tx, tblName)
 		if err != nil {
-			return fmt.Errorf("could not get columns for %s postgres table: %v", tblName.String(), err)
+			return fmt.Errorf("could not get columns for %s postgres table: %w", tblName.String(), err)
 		}
 
 		if len(tblCfg.Columns) == 0 {
@@ -43,21 +53,42 @@ func (r *Replicator) GenerateChDDL() error {
 		}
 
 		chColumnDDLs := make([]string, 0)
+		bufTypes := make(map[int]string) // [position of the column]type the driver can write into the buffer table
 		for _, pgCol := range tblCfg.TupleColumns {
 			chColName, ok := tblCfg.Columns[pgCol.Name]
 			if !ok {
 				continue
 			}
 
+			delta := tblCfg.ColumnProperties[pgCol.Name].Delta
 			pgCol := tblCfg.PgColumns[pgCol.Name]
-			chColDDL, err := chutils.ToClickHouseType(pgCol)
+			chColDDL, err := chutils.ToClickHouseType(pgCol, tblCfg.EnumMapping == config.EnumMappingLowCardinality)
 			if err != nil {
-				return fmt.Errorf("could not get clickhouse column definition: %v", err)
+				return fmt.Errorf("could not get clickhouse column definition: %w", err)
 			}
 			if pgCol.PkCol > 0 && pgCol.PkCol > pkColumnNumb {
 				pkColumnNumb = pgCol.PkCol
 			}
 
+			if delta {
+				deltaColumns = append(deltaColumns, chColName)
+			}
+			if tblCfg.Engine == config.AggregatingMergeTree && pgCol.PkCol < 1 {
+				if delta {
+					chColDDL = fmt.Sprintf("SimpleAggregateFunction(sum, %s)", chColDDL)
+				} else {
+					chColDDL = fmt.Sprintf("SimpleAggregateFunction(anyLast, %s)", chColDDL)
+				}
+			}
+
+			if writable := chutils.WritableType(chColDDL); writable != chColDDL {
+				if tblCfg.ChBufferTable == "" {
+					chColDDL = writable
+				} else {
+					bufTypes[len(chColumnDDLs)] = fmt.Sprintf("    %s %s", chColName, writable)
+				}
+			}
+
 			chColumnDDLs = append(chColumnDDLs, fmt.Sprintf("    %s %s", chColName, chColDDL))
 		}
 		pkColumns := make([]string, pkColumnNumb)
@@ -87,27 +118,38 @@ func (r *Replicator) GenerateChDDL() error {
 			chColumnDDLs = append(chColumnDDLs, fmt.Sprintf("    %s UInt8", tblCfg.IsDeletedColumn))
 		case config.CollapsingMergeTree:
 			engineParams = tblCfg.SignColumn
-			chColumnDDLs = append(chColumnDDLs, fmt.Sprintf("    %s Int8", engineParams))
+			chColumnDDLs = append(chColumnDDLs, fmt.Sprintf("    %s %s", engineParams, tblCfg.SignColumnType))
+		case config.SummingMergeTree:
+			if len(deltaColumns) > 0 {
+				engineParams = fmt.Sprintf("(%s)", strings.Join(deltaColumns, ", "))
+			}
 		}
 
-		tableDDL := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n%s\n) Engine = %s(%s)",
-			tblCfg.ChMainTable,
+		tableDDL := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s%s (\n%s\n) Engine = %s(%s)",
+			tblCfg.ChMainTable, chutils.OnCluster(r.cfg.ClickHouse.Cluster),
 			strings.Join(chColumnDDLs, ",\n"),
 			tblCfg.Engine.String(), engineParams)
 
 		if len(pkColumns) > 0 {
 			orderBy = fmt.Sprintf(" ORDER BY(%s)", strings.Join(pkColumns, ", "))
 		}
-		tableDDL += orderBy + ";"
+		tableDDL += orderBy + settings + ";"
 
 		fmt.Println(tableDDL)
 
 		if tblCfg.ChBufferTable != "" {
-			fmt.Println(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n%s\n) Engine = MergeTree()%s;",
-				tblCfg.ChBufferTable,
-				strings.Join(
-					append(chColumnDDLs, fmt.Sprintf("    %s UInt64", tblCfg.BufferTableRowIdColumn)), ",\n"),
-				orderBy))
+			bufColumnDDLs := append(append([]string{}, chColumnDDLs...), fmt.Sprintf("    %s UInt64", tblCfg.BufferTableRowIdColumn))
+			for i, colDDL := range bufTypes {
+				bufColumnDDLs[i] = colDDL
+			}
+			if tblCfg.BufferTableLSNColumn != "" {
+				bufColumnDDLs = append(bufColumnDDLs, fmt.Sprintf("    %s UInt64", tblCfg.BufferTableLSNColumn))
+			}
+
+			fmt.Println(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s%s (\n%s\n) Engine = MergeTree()%s%s;",
+				tblCfg.ChBufferTable, chutils.OnCluster(r.cfg.ClickHouse.Cluster),
+				strings.Join(bufColumnDDLs, ",\n"),
+				orderBy, settings))
 		}
 
 	}
@@ -0,0 +1,35 @@
+package replicator
+
+import (
+	"sync/atomic"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+	"github.com/mkabilov/pg2ch/pkg/utils/deadletter"
+)
+
+// writeDeadLetter writes the row change skipped by the dead_letter overflow policy to the dead letter file
+func (r *Replicator) writeDeadLetter(oid utils.OID, tblName config.PgTableName, op string, newRow, oldRow message.Row,
+	reason error) error {
+	return r.writeDeadLetterRow(r.finalLSN, r.relColumns[oid], tblName, op, newRow, oldRow, reason)
+}
+
+// writeDeadLetterRow is writeDeadLetter of the change at the lsn with the tuple columns, called by the apply workers
+func (r *Replicator) writeDeadLetterRow(lsn utils.LSN, columns []message.Column, tblName config.PgTableName, op string,
+	newRow, oldRow message.Row, reason error) error {
+	if err := r.deadLetter.Write(deadletter.Record{
+		Table:  tblName.String(),
+		LSN:    lsn.String(),
+		Op:     op,
+		Reason: reason.Error(),
+		Row:    rowValues(columns, newRow),
+		Old:    rowValues(columns, oldRow),
+	}); err != nil {
+		return err
+	}
+	atomic.AddUint64(&r.stats.Table(tblName.String()).DeadLetterRows, 1)
+	r.log.Warn("row is written to the dead letter file", "table", tblName.String(), "lsn", lsn, "op", op, "reason", reason)
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package replicator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/pprof"
+	"syscall"
+	"time"
+)
+
+const diagQueryTimeout = 5 * time.Second
+
+// diagnosticsOnSignal dumps the diagnostics on SIGUSR1 until the context is cancelled
+func (r *Replicator) diagnosticsOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-sigs:
+			fileName, err := r.dumpDiagnostics()
+			if err != nil {
+				r.log.Error("could not dump diagnostics", "error", err)
+				continue
+			}
+			r.log.Info("diagnostics dumped", "file", fileName)
+		}
+	}
+}
+
+// dumpDiagnostics writes state snapshot, in-flight clickhouse queries and goroutine stacks to a file
+func (r *Replicator) dumpDiagnostics() (string, error) {
+	fileName := filepath.Join(r.cfg.DiagnosticsDir,
+		fmt.Sprintf("pg2ch-diag-%s.txt", time.Now().Format("20060102-150405")))
+
+	fp, err := os.Create(fileName)
+	if err != nil {
+		return "", fmt.Errorf("could not create file: %w", err)
+	}
+	defer func() {
+		if err := fp.Close(); err != nil {
+			r.log.Warn("could not close diagnostics file", "error", err)
+		}
+	}()
+
+	fmt.Fprintf(fp, "pg2ch %s git revision %s go version %s, config fingerprint %s\n\n",
+		r.buildInfo.Version, r.buildInfo.Revision, r.buildInfo.GoVersion, r.cfg.Fingerprint())
+
+	fmt.Fprintf(fp, "=== state\n")
+	enc := json.NewEncoder(fp)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r.stats.Snapshot()); err != nil {
+		return "", fmt.Errorf("could not write state: %w", err)
+	}
+
+	fmt.Fprintf(fp, "\n=== clickhouse queries in flight\n")
+	r.dumpChQueries(fp)
+
+	fmt.Fprintf(fp, "\n=== goroutines\n")
+	if err := pprof.Lookup("goroutine").WriteTo(fp, 2); err != nil {
+		return "", fmt.Errorf("could not write goroutine stacks: %w", err)
+	}
+
+	return fileName, nil
+}
+
+func (r *Replicator) dumpChQueries(fp *os.File) {
+	ctx, cancel := context.WithTimeout(context.Background(), diagQueryTimeout)
+	defer cancel()
+
+	rows, err := r.chConn.QueryContext(ctx,
+		"SELECT query_id, toFloat64(elapsed), query FROM system.processes WHERE query NOT LIKE '%system.processes%'")
+	if err != nil {
+		fmt.Fprintf(fp, "could not query: %v\n", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			queryID, query string
+			elapsed        float64
+		)
+
+		if err := rows.Scan(&queryID, &elapsed, &query); err != nil {
+			fmt.Fprintf(fp, "could not scan: %v\n", err)
+			return
+		}
+		fmt.Fprintf(fp, "%s (%.1fs): %s\n", queryID, elapsed, query)
+	}
+
+	if err := rows.Err(); err != nil {
+		fmt.Fprintf(fp, "could not read: %v\n", err)
+	}
+}
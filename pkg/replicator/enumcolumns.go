@@ -0,0 +1,48 @@
+package replicator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+// resolveEnumColumns checks that the Enum8 and Enum16 clickhouse columns of the pg enums have all of their labels,
+// otherwise the rows with the missing ones are rejected when converted
+func resolveEnumColumns(tblName config.PgTableName, cfg *config.Table) error {
+	for pgColName, chCol := range cfg.ColumnMapping {
+		if chCol.BaseType != utils.ChEnum8 && chCol.BaseType != utils.ChEnum16 {
+			continue
+		}
+
+		pgCol := cfg.PgColumns[pgColName]
+		if pgCol.Labels == nil {
+			continue // not an enum, e.g. text, the values are checked when converted
+		}
+
+		chLabels := make(map[string]struct{}, len(chCol.Labels))
+		for _, label := range chCol.Labels {
+			chLabels[label] = struct{}{}
+		}
+
+		missing := make([]string, 0)
+		for _, label := range pgCol.Labels {
+			if strings.ContainsAny(label, `',=\`) {
+				return fmt.Errorf("label %q of %q column of %s postgres table can not be written into %s column, "+
+					"use String or LowCardinality(String) instead", label, pgColName, tblName.String(), chCol.BaseType)
+			}
+
+			if _, ok := chLabels[label]; !ok {
+				missing = append(missing, "'"+label+"'")
+			}
+		}
+
+		if len(missing) > 0 {
+			return fmt.Errorf("%w: labels %s of %q column of %s postgres table are missing in %s type of %q clickhouse column",
+				utils.ErrSchemaMismatch, strings.Join(missing, ", "), pgColName, tblName.String(), chCol.BaseType, chCol.Name)
+		}
+	}
+
+	return nil
+}
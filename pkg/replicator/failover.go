@@ -0,0 +1,52 @@
+package replicator
+
+import (
+	"fmt"
+)
+
+// slotCreateOptions returns options of the CREATE_REPLICATION_SLOT command for the main replication slot
+func (r *Replicator) slotCreateOptions() string {
+	if !r.cfg.Postgres.FailoverSlot {
+		return ""
+	}
+
+	return " (FAILOVER)"
+}
+
+// checkFailoverSlot makes sure the replication slot is synchronized to the standbys, so that after a physical
+// failover it exists on the new primary and the replication continues without resync
+func (r *Replicator) checkFailoverSlot() error {
+	var (
+		failover     bool
+		standbySlots string
+	)
+
+	if !r.cfg.Postgres.FailoverSlot {
+		return nil
+	}
+
+	err := r.pgConn.QueryRow("select failover from pg_replication_slots where slot_name = $1",
+		r.cfg.Postgres.ReplicationSlotName).Scan(&failover)
+	if err != nil {
+		return fmt.Errorf("could not query slot: %w", err)
+	}
+
+	if !failover {
+		r.log.Info("enabling failover of the replication slot", "slot", r.cfg.Postgres.ReplicationSlotName)
+		if _, err := r.pgConn.Exec(fmt.Sprintf("ALTER_REPLICATION_SLOT %s (FAILOVER)", r.cfg.Postgres.ReplicationSlotName)); err != nil {
+			return fmt.Errorf("could not enable failover of the slot: %w", err)
+		}
+	}
+
+	err = r.pgConn.QueryRow("select coalesce(current_setting('synchronized_standby_slots', true), '')").Scan(&standbySlots)
+	if err != nil {
+		return fmt.Errorf("could not query synchronized_standby_slots: %w", err)
+	}
+
+	if standbySlots == "" {
+		r.log.Warn("synchronized_standby_slots is not set on the primary: the slot may get ahead of the standbys "+
+			"and the changes confirmed in between are lost after failover", "slot", r.cfg.Postgres.ReplicationSlotName)
+	}
+
+	return nil
+}
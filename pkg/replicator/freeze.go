@@ -0,0 +1,321 @@
+package replicator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+const frozenDir = "frozen" // spool files of the frozen tables, inside db_path
+
+// spool only operations
+const (
+	opRelation = "relation"
+	opCommit   = "commit"
+)
+
+// frozenChange is the change of the frozen table kept on disk as a line of JSON; the changes of each transaction
+// are followed by its commit line, so that the changes of the transaction interrupted by a crash are dropped
+type frozenChange struct {
+	LSN     string           `json:"lsn"`
+	Op      string           `json:"op"`
+	OID     utils.OID        `json:"oid,omitempty"`     // relation of the relation change
+	Columns []message.Column `json:"columns,omitempty"` // tuple columns of the relation change
+	New     message.Row      `json:"new,omitempty"`
+	Old     message.Row      `json:"old,omitempty"`
+}
+
+// frozenSpool keeps the changes of the frozen table on disk until it is thawed
+type frozenSpool struct {
+	path    string
+	fp      *os.File
+	pending []frozenChange // changes of the current transaction
+	lastLSN utils.LSN      // lsn of the last transaction on disk, the replayed ones are skipped
+}
+
+func (r *Replicator) frozenSpoolPath(tblName config.PgTableName) string {
+	return filepath.Join(r.cfg.PersStoragePath, frozenDir, url.PathEscape(tblName.String())+".jsonl")
+}
+
+// openFrozenSpool opens the spool file, dropping the changes of the last transaction if its commit line is missing
+func openFrozenSpool(path string) (*frozenSpool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("could not create directory: %w", err)
+	}
+
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file: %w", err)
+	}
+
+	s := &frozenSpool{path: path, fp: fp, lastLSN: utils.InvalidLSN}
+	size, err := s.readCommitted(nil)
+	if err == nil {
+		err = fp.Truncate(size)
+	}
+	if err == nil {
+		_, err = fp.Seek(size, 0)
+	}
+	if err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("could not read %s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+// readCommitted passes the changes of the committed transactions to apply, returns the size of them in the file
+func (s *frozenSpool) readCommitted(apply func(utils.LSN, frozenChange) error) (int64, error) {
+	if _, err := s.fp.Seek(0, 0); err != nil {
+		return 0, err
+	}
+
+	var (
+		pos, committed int64
+		tx             []frozenChange
+	)
+
+	rd := bufio.NewReader(s.fp)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return committed, nil // a torn line is left by the crash, dropped with its transaction
+		} else if err != nil {
+			return 0, err
+		}
+		pos += int64(len(line))
+
+		var change frozenChange
+		if err := json.Unmarshal(line, &change); err != nil {
+			return 0, fmt.Errorf("could not parse change: %w", err)
+		}
+
+		if change.Op != opCommit {
+			tx = append(tx, change)
+			continue
+		}
+
+		lsn := utils.InvalidLSN
+		if err := lsn.Parse(change.LSN); err != nil {
+			return 0, fmt.Errorf("could not parse lsn %q: %w", change.LSN, err)
+		}
+
+		if apply != nil {
+			for _, txChange := range tx {
+				if err := apply(lsn, txChange); err != nil {
+					return 0, err
+				}
+			}
+		}
+		tx = tx[:0]
+		committed, s.lastLSN = pos, lsn
+	}
+}
+
+// commit writes the changes of the transaction followed by its commit line and syncs the file,
+// so that the slot can be advanced past them
+func (s *frozenSpool) commit(lsn utils.LSN) error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, change := range append(s.pending, frozenChange{LSN: lsn.String(), Op: opCommit}) {
+		if err := enc.Encode(change); err != nil {
+			return fmt.Errorf("could not encode change: %w", err)
+		}
+	}
+	s.pending = s.pending[:0]
+
+	if _, err := s.fp.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("could not write %s: %w", s.path, err)
+	}
+	if err := s.fp.Sync(); err != nil {
+		return fmt.Errorf("could not sync %s: %w", s.path, err)
+	}
+	s.lastLSN = lsn
+
+	return nil
+}
+
+// spoolChange keeps the change of the frozen table on disk, skipping the transactions already there
+func (r *Replicator) spoolChange(spool *frozenSpool, change frozenChange) {
+	if spool.lastLSN.IsValid() && r.finalLSN <= spool.lastLSN {
+		return
+	}
+
+	change.LSN = r.finalLSN.String()
+	spool.pending = append(spool.pending, change)
+}
+
+// commitFrozen writes the changes of the frozen tables of the transaction to their spool files
+func (r *Replicator) commitFrozen() error {
+	for tblName, spool := range r.frozen {
+		if err := spool.commit(r.finalLSN); err != nil {
+			return fmt.Errorf("could not spool changes of frozen %s table: %w", tblName.String(), err)
+		}
+	}
+
+	return nil
+}
+
+// loadFrozen opens the spool files of the tables frozen before the restart
+func (r *Replicator) loadFrozen(names []string) error {
+	for _, name := range names {
+		var tblName config.PgTableName
+
+		if err := tblName.Parse(name); err != nil {
+			return err
+		}
+
+		if _, ok := r.cfg.Tables[tblName]; !ok {
+			r.log.Warn("frozen table is not in the config, its spooled changes are ignored", "table", name,
+				"path", r.frozenSpoolPath(tblName))
+			continue
+		}
+
+		spool, err := openFrozenSpool(r.frozenSpoolPath(tblName))
+		if err != nil {
+			return fmt.Errorf("could not open spool of frozen %s table: %w", name, err)
+		}
+		r.frozen[tblName] = spool
+		r.log.Info("table is frozen, its changes are kept on disk until it is thawed", "table", name,
+			"spooled_lsn", spool.lastLSN)
+	}
+
+	return nil
+}
+
+// freezeTable stops applying the changes of the table, they are kept on disk until the table is thawed;
+// the buffered changes of the table are flushed to its main table first
+func (r *Replicator) freezeTable(tblName config.PgTableName) error {
+	if err := r.lockOutsideTx(); err != nil {
+		return err
+	}
+	defer r.tablesToMergeMutex.Unlock()
+
+	chTbl, ok := r.chTables[tblName]
+	if !ok {
+		return fmt.Errorf("table %s is not replicated", tblName.String())
+	}
+	if _, ok := r.syncingTables[tblName]; ok {
+		return fmt.Errorf("table %s is being synced", tblName.String())
+	}
+	if _, ok := r.frozen[tblName]; ok {
+		return fmt.Errorf("table %s is already frozen", tblName.String())
+	}
+
+	if _, ok := r.tablesToMerge[tblName]; ok {
+		if err := chTbl.FlushToMainTable(); err != nil {
+			return fmt.Errorf("could not flush: %w", err)
+		}
+		delete(r.tablesToMerge, tblName)
+		r.applyTableLSN(tblName, r.finalLSN)
+	}
+
+	path := r.frozenSpoolPath(tblName)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) { // left by the earlier freeze
+		return fmt.Errorf("could not remove stale spool: %w", err)
+	}
+
+	spool, err := openFrozenSpool(path)
+	if err != nil {
+		return fmt.Errorf("could not open spool: %w", err)
+	}
+	r.frozen[tblName] = spool
+
+	if err := r.saveState(); err != nil {
+		delete(r.frozen, tblName)
+		spool.fp.Close()
+		return err
+	}
+	r.log.Info("table is frozen, its changes are kept on disk until it is thawed", "table", tblName.String(),
+		"lsn", r.tableLSN[tblName])
+
+	return nil
+}
+
+// thawTable applies the changes of the frozen table kept on disk and resumes applying its changes
+func (r *Replicator) thawTable(tblName config.PgTableName) error {
+	if err := r.lockOutsideTx(); err != nil {
+		return err
+	}
+	defer r.tablesToMergeMutex.Unlock()
+
+	spool, ok := r.frozen[tblName]
+	if !ok {
+		return fmt.Errorf("table %s is not frozen", tblName.String())
+	}
+	chTbl := r.chTables[tblName]
+
+	oid := r.tupleColumnsOID[tblName]
+	changes := 0
+	_, err := spool.readCommitted(func(lsn utils.LSN, change frozenChange) error {
+		var err error
+
+		switch change.Op {
+		case opRelation:
+			oid = change.OID
+			err = r.applyRelation(oid, tblName, chTbl, change.Columns)
+		case opInsert:
+			_, err = chTbl.Insert(lsn, change.New)
+		case opUpdate:
+			_, err = chTbl.Update(lsn, change.Old, change.New)
+		case opDelete:
+			_, err = chTbl.Delete(lsn, change.Old)
+		case opTruncate:
+			err = chTbl.Truncate()
+		default:
+			err = fmt.Errorf("unknown operation %q", change.Op)
+		}
+
+		if errors.Is(err, utils.ErrDeadLetter) {
+			err = r.writeDeadLetter(oid, tblName, change.Op, change.New, change.Old, err)
+		}
+		changes++
+
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not apply spooled changes of %s table: %w", tblName.String(), err)
+	}
+
+	if err := chTbl.FlushToMainTable(); err != nil {
+		return fmt.Errorf("could not flush %s table: %w", tblName.String(), err)
+	}
+	if spool.lastLSN.IsValid() {
+		r.applyTableLSN(tblName, spool.lastLSN)
+	}
+	delete(r.frozen, tblName)
+
+	if err := r.saveState(); err != nil {
+		return err
+	}
+	r.discardSpool(tblName, spool)
+	r.log.Info("table is thawed, the spooled changes are applied", "table", tblName.String(), "changes", changes,
+		"lsn", r.tableLSN[tblName])
+
+	return nil
+}
+
+// discardSpool closes and removes the spool file
+func (r *Replicator) discardSpool(tblName config.PgTableName, spool *frozenSpool) {
+	if err := spool.fp.Close(); err != nil {
+		r.log.Warn("could not close spool file", "table", tblName.String(), "error", err)
+	}
+
+	if err := os.Remove(spool.path); err != nil {
+		r.log.Warn("could not remove spool file", "table", tblName.String(), "path", spool.path, "error", err)
+	}
+}
@@ -0,0 +1,173 @@
+package replicator
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/rowstream"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+const rowStreamLog = "rowstream.log" // event log of the gRPC stream, inside db_path
+
+var streamOps = map[string]rowstream.Op{
+	opInsert:   rowstream.Op_OP_INSERT,
+	opUpdate:   rowstream.Op_OP_UPDATE,
+	opDelete:   rowstream.Op_OP_DELETE,
+	opTruncate: rowstream.Op_OP_TRUNCATE,
+}
+
+func (r *Replicator) grpcServer() {
+	srv, err := r.newGRPCServer()
+	if err != nil {
+		select {
+		case r.errCh <- err:
+		default:
+		}
+		return
+	}
+
+	lis, err := net.Listen("tcp", r.cfg.GRPC.Bind)
+	if err != nil {
+		select {
+		case r.errCh <- err:
+		default:
+		}
+		return
+	}
+
+	rowstream.RegisterRowStreamServer(srv, r.rowStream)
+	go func() {
+		<-r.ctx.Done()
+		srv.Stop()
+	}()
+
+	if err := srv.Serve(lis); err != nil {
+		select {
+		case r.errCh <- err:
+		default:
+		}
+	}
+}
+
+// newGRPCServer sets up the TLS and the token check of the subscribers, if configured
+func (r *Replicator) newGRPCServer() (*grpc.Server, error) {
+	var opts []grpc.ServerOption
+
+	if r.cfg.GRPC.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(r.cfg.GRPC.TLSCert, r.cfg.GRPC.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not load grpc certificate: %w", err)
+		}
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+		if r.cfg.GRPC.TLSClientCA != "" {
+			pem, err := os.ReadFile(r.cfg.GRPC.TLSClientCA)
+			if err != nil {
+				return nil, fmt.Errorf("could not read grpc client CA: %w", err)
+			}
+
+			tlsConfig.ClientCAs = x509.NewCertPool()
+			if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in grpc client CA %s", r.cfg.GRPC.TLSClientCA)
+			}
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	if r.cfg.GRPC.Token != "" {
+		opts = append(opts, grpc.StreamInterceptor(tokenInterceptor(r.cfg.GRPC.Token)))
+	}
+
+	return grpc.NewServer(opts...), nil
+}
+
+// tokenInterceptor rejects the streams without the "authorization: Bearer <token>" metadata
+func tokenInterceptor(token string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !validToken(ss.Context(), token) {
+			return status.Error(codes.Unauthenticated, "invalid or missing token")
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+func validToken(ctx context.Context, token string) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, val := range md.Get("authorization") {
+		if got := strings.TrimPrefix(val, "Bearer "); got != val &&
+			subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// streamRowChange adds the row change to the events of the transaction, published to the subscribers on the commit.
+// The values are the ones written to clickhouse, so the masked, encrypted and tokenized columns stay protected
+func (r *Replicator) streamRowChange(lsn utils.LSN, index int, tblName config.PgTableName, op string,
+	newRow, oldRow message.Row) error {
+	conv := r.chTables[tblName].RowConverter()
+
+	newValues, err := conv.Convert(newRow, oldRow)
+	var oldValues map[string]*string
+	if err == nil {
+		oldValues, err = conv.Convert(oldRow, nil)
+	}
+	if errors.Is(err, utils.ErrDeadLetter) { // the row is not written to clickhouse, so it is not streamed either
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not convert row of %s for the row stream: %w", tblName.String(), err)
+	}
+
+	r.streamEvents = append(r.streamEvents, &rowstream.RowEvent{
+		Offset:     &rowstream.Offset{CommitLsn: uint64(r.finalLSN), Lsn: uint64(lsn), Index: uint32(index)},
+		CommitTime: timestamppb.New(r.streamCommitTime),
+		Table:      tblName.String(),
+		Op:         streamOps[op],
+		Columns:    streamColumns(newValues),
+		Old:        streamColumns(oldValues),
+	})
+
+	return nil
+}
+
+func streamColumns(values map[string]*string) []*rowstream.Column {
+	if values == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := make([]*rowstream.Column, 0, len(values))
+	for _, name := range names {
+		res = append(res, &rowstream.Column{Name: name, Value: values[name]})
+	}
+
+	return res
+}
@@ -0,0 +1,113 @@
+package replicator
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+	"github.com/mkabilov/pg2ch/pkg/utils/chutils"
+)
+
+// confirmAllResyncs confirms the resync of any table when passed in the confirmed tables list
+const confirmAllResyncs = "all"
+
+// resyncCost is the estimated amount of data affected by the table's sync
+type resyncCost struct {
+	tblName config.PgTableName
+	pgBytes int64 // size of the postgres table to be copied
+	chBytes int64 // size of the clickhouse main table to be truncated
+}
+
+func (c resyncCost) String() string {
+	return fmt.Sprintf("%s (copy %s from postgres, truncate %s in clickhouse)",
+		c.tblName.String(), formatBytes(c.pgBytes), formatBytes(c.chBytes))
+}
+
+// checkResyncCost refuses to sync the tables bigger than the confirm threshold unless the resync
+// is explicitly confirmed, so that a typo in the config does not trigger re-copying of huge tables
+func (r *Replicator) checkResyncCost(tables []config.PgTableName) error {
+	if r.cfg.ResyncConfirmBytes <= 0 || r.cfg.Inspect {
+		return nil
+	}
+
+	confirmed := make(map[string]struct{}, len(r.cfg.ConfirmResync))
+	for _, name := range r.cfg.ConfirmResync {
+		confirmed[name] = struct{}{}
+	}
+	if _, ok := confirmed[confirmAllResyncs]; ok {
+		return nil
+	}
+
+	unconfirmed := make([]string, 0)
+	for _, tblName := range tables {
+		tblCfg := r.cfg.Tables[tblName]
+		if tblCfg.InitSyncSkip {
+			continue
+		}
+
+		cost, err := r.estimateResyncCost(tblName, tblCfg)
+		if err != nil {
+			return fmt.Errorf("could not estimate sync cost of %s: %w", tblName.String(), err)
+		}
+
+		if cost.pgBytes < r.cfg.ResyncConfirmBytes && cost.chBytes < r.cfg.ResyncConfirmBytes {
+			continue
+		}
+
+		if _, ok := confirmed[tblName.String()]; ok {
+			r.log.Info("confirmed resync", "table", tblName.String(), "cost", cost.String())
+			continue
+		}
+		unconfirmed = append(unconfirmed, cost.String())
+	}
+
+	if len(unconfirmed) > 0 {
+		return fmt.Errorf("resync of the tables above %s needs confirmation via --confirm-resync: %s",
+			formatBytes(r.cfg.ResyncConfirmBytes), strings.Join(unconfirmed, ", "))
+	}
+
+	return nil
+}
+
+func (r *Replicator) estimateResyncCost(tblName config.PgTableName, tblCfg config.Table) (resyncCost, error) {
+	var chBytes sql.NullInt64
+
+	cost := resyncCost{tblName: tblName}
+	err := r.pgConn.QueryRow("select sum(pg_total_relation_size(relid))::bigint from ("+utils.PartitionTreeQuery+") t",
+		tblName.String()).Scan(&cost.pgBytes)
+	if err != nil {
+		return cost, fmt.Errorf("could not query postgres table size: %w", err)
+	}
+
+	if tblCfg.InitSyncSkipTruncate {
+		return cost, nil
+	}
+
+	filter, args := chutils.SystemTableFilter(tblCfg.ChMainTable)
+	err = r.chConn.QueryRow(`SELECT toInt64(sum(bytes_on_disk)) FROM system.parts
+		WHERE `+filter+` AND active`, args...).Scan(&chBytes)
+	if err != nil {
+		return cost, fmt.Errorf("could not query clickhouse table size: %w", err)
+	}
+	cost.chBytes = chBytes.Int64
+
+	return cost, nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,74 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mkabilov/pg2ch/pkg/stats"
+	"github.com/mkabilov/pg2ch/pkg/utils/chutils"
+)
+
+const healthPingTimeout = 5 * time.Second
+
+// healthzHandler is the liveness probe: fails once the replication is halted or a flush is stuck retrying,
+// so the replicator is restarted
+func (r *Replicator) healthzHandler(w http.ResponseWriter, req *http.Request) {
+	writeProbe(w, r.healthProblems())
+}
+
+// readyzHandler is the readiness probe: additionally fails while the tables are synced,
+// the replication connection is being reestablished or clickhouse does not respond
+func (r *Replicator) readyzHandler(w http.ResponseWriter, req *http.Request) {
+	problems := r.healthProblems()
+
+	if state := r.stats.State(); state != stats.StateStreaming && state != stats.StatePaused {
+		problems = append(problems, fmt.Sprintf("replication is %s", state))
+	} else {
+		if !r.consumer.Connected() {
+			problems = append(problems, "replication connection is down")
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), healthPingTimeout)
+		defer cancel()
+		if err := r.chConn.PingContext(ctx); err != nil {
+			problems = append(problems, fmt.Sprintf("clickhouse ping failed: %v", chutils.ClassifyError(err)))
+		}
+	}
+
+	writeProbe(w, problems)
+}
+
+// healthProblems returns the reasons the replicator needs to be restarted
+func (r *Replicator) healthProblems() []string {
+	problems := make([]string, 0)
+
+	snapshot := r.stats.Snapshot()
+	if snapshot.State == stats.StateHalted {
+		problems = append(problems, "replication is halted")
+	}
+
+	for tblName, tbl := range snapshot.Tables {
+		if tbl.FailingFlushes >= int64(r.cfg.HealthFlushRetries) {
+			problems = append(problems, fmt.Sprintf("%s: %d failed flush attempts in a row", tblName, tbl.FailingFlushes))
+		}
+	}
+	sort.Strings(problems)
+
+	return problems
+}
+
+func writeProbe(w http.ResponseWriter, problems []string) {
+	w.Header().Set("Content-Type", "text/plain")
+
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,73 @@
+package replicator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+// clickhouse type of the hstore maps
+const chMap = "Map("
+
+// resolveHStoreColumns checks the hstore columns written as the maps, the arrays or flattened into the keys
+func (r *Replicator) resolveHStoreColumns(tblName config.PgTableName, cfg *config.Table) error {
+	for pgColName, prop := range cfg.ColumnProperties {
+		if prop.HStore == config.HStoreText && len(prop.HStoreColumns) == 0 {
+			continue
+		}
+
+		pgCol, ok := cfg.PgColumns[pgColName]
+		if !ok {
+			return fmt.Errorf("%w: could not find %q hstore column in %s postgres table",
+				utils.ErrSchemaMismatch, pgColName, tblName.String())
+		} else if !isPgHStore(pgCol.BaseType) || pgCol.IsArray {
+			return fmt.Errorf("%w: %q column must be of %s type, got %s",
+				utils.ErrSchemaMismatch, pgColName, utils.PgHstore, pgCol.BaseType)
+		}
+
+		switch prop.HStore {
+		case config.HStoreArrays:
+			for _, derived := range cfg.Derived {
+				if derived.Name != pgColName+".keys" && derived.Name != pgColName+".values" {
+					continue
+				}
+
+				if !derived.IsArray || derived.IsNullable || derived.BaseType != utils.ChString {
+					return fmt.Errorf("%w: %q column of the hstore arrays must be of Array(%s) type in clickhouse",
+						utils.ErrSchemaMismatch, derived.Name, utils.ChString)
+				}
+			}
+		case config.HStoreMap:
+			chCol, ok := cfg.ColumnMapping[pgColName]
+			if !ok {
+				return fmt.Errorf("hstore map column %q is not replicated", pgColName)
+			} else if !strings.HasPrefix(chCol.BaseType, chMap) || chCol.IsNullable {
+				return fmt.Errorf("%w: hstore map column %q must be of Map(String, String) type in clickhouse, got %s",
+					utils.ErrSchemaMismatch, chCol.Name, chCol.BaseType)
+			}
+
+			// the driver can't write the maps, the text is cast to them when moved from the buffer table
+			bufColumns, err := r.chSchema.Columns(cfg.ChBufferTable)
+			if err != nil {
+				return fmt.Errorf("could not get columns for %q clickhouse table: %w", cfg.ChBufferTable, err)
+			}
+
+			if bufCol, ok := bufColumns[chCol.Name]; !ok {
+				return fmt.Errorf("%w: could not find %q column in %q clickhouse table",
+					utils.ErrSchemaMismatch, chCol.Name, cfg.ChBufferTable)
+			} else if bufCol.BaseType != utils.ChString {
+				return fmt.Errorf("%w: %q column of the hstore map must be of %s type in %q buffer table, got %s",
+					utils.ErrSchemaMismatch, chCol.Name, utils.ChString, cfg.ChBufferTable, bufCol.BaseType)
+			}
+		}
+	}
+
+	return nil
+}
+
+// isPgHStore checks the type name of the hstore extension, qualified if its schema is not in the search path
+func isPgHStore(pgType string) bool {
+	return pgType == utils.PgHstore || strings.HasSuffix(pgType, "."+utils.PgHstore)
+}
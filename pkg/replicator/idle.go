@@ -0,0 +1,78 @@
+package replicator
+
+import (
+	"time"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+)
+
+// touchTable marks the table as active, its resources are allocated again on the change if they were released
+func (r *Replicator) touchTable(tblName config.PgTableName) {
+	r.lastChange[tblName] = time.Now()
+	delete(r.released, tblName)
+}
+
+// idleReaper periodically releases the resources of the tables with no changes for idle_table_timeout,
+// so that the memory use follows the tables actually changing rather than all the replicated ones
+func (r *Replicator) idleReaper() {
+	ticker := time.NewTicker(r.cfg.IdleTableTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			r.reapIdleTables()
+		}
+	}
+}
+
+// reapIdleTables releases the resources of the idle tables; the tables with the rows waiting for the merge,
+// being synced or frozen are left as they are
+func (r *Replicator) reapIdleTables() {
+	r.tablesToMergeMutex.Lock()
+	defer r.tablesToMergeMutex.Unlock()
+
+	if err := r.drainWorkers(); err != nil {
+		r.log.Warn("could not release resources of the idle tables", "error", err)
+		return
+	}
+
+	now := time.Now()
+	reaped := 0
+	for tblName, chTbl := range r.chTables {
+		if _, ok := r.released[tblName]; ok {
+			continue
+		}
+
+		lastChange, ok := r.lastChange[tblName]
+		if !ok { // no changes since the start, idle from now on
+			r.lastChange[tblName] = now
+			continue
+		}
+		if now.Sub(lastChange) < r.cfg.IdleTableTimeout {
+			continue
+		}
+
+		if _, ok := r.tablesToMerge[tblName]; ok {
+			continue
+		}
+		if _, ok := r.syncingTables[tblName]; ok {
+			continue
+		}
+		if _, ok := r.frozen[tblName]; ok {
+			continue
+		}
+
+		if chTbl.Release() {
+			r.released[tblName] = struct{}{}
+			reaped++
+		}
+	}
+
+	if reaped > 0 {
+		r.log.Debug("resources of the idle tables released", "tables", reaped, "idle", len(r.released),
+			"total", len(r.chTables))
+	}
+}
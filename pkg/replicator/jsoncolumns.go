@@ -0,0 +1,65 @@
+package replicator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+// clickhouse types of the json objects: JSON of 24.8+ and the older experimental Object('json')
+const (
+	chJSON       = "JSON"
+	chJSONObject = "Object("
+)
+
+// resolveJSONColumns checks the json and jsonb columns written as the json objects or flattened into the paths
+func (r *Replicator) resolveJSONColumns(tblName config.PgTableName, cfg *config.Table) error {
+	for pgColName, prop := range cfg.ColumnProperties {
+		if prop.JSON == config.JSONString && len(prop.JSONPaths) == 0 {
+			continue
+		}
+
+		pgCol, ok := cfg.PgColumns[pgColName]
+		if !ok {
+			return fmt.Errorf("%w: could not find %q json column in %s postgres table",
+				utils.ErrSchemaMismatch, pgColName, tblName.String())
+		} else if pgCol.BaseType != utils.PgJson && pgCol.BaseType != utils.PgJsonb || pgCol.IsArray {
+			return fmt.Errorf("%w: %q column must be of json or jsonb type, got %s",
+				utils.ErrSchemaMismatch, pgColName, pgCol.BaseType)
+		}
+
+		if prop.JSON != config.JSONObject {
+			continue
+		}
+
+		chCol, ok := cfg.ColumnMapping[pgColName]
+		if !ok {
+			return fmt.Errorf("json object column %q is not replicated", pgColName)
+		} else if !isChJSON(chCol.BaseType) {
+			return fmt.Errorf("%w: json object column %q must be of %s type in clickhouse, got %s",
+				utils.ErrSchemaMismatch, chCol.Name, chJSON, chCol.BaseType)
+		}
+
+		// the driver can't write the json objects, the text is cast to them when moved from the buffer table
+		bufColumns, err := r.chSchema.Columns(cfg.ChBufferTable)
+		if err != nil {
+			return fmt.Errorf("could not get columns for %q clickhouse table: %w", cfg.ChBufferTable, err)
+		}
+
+		if bufCol, ok := bufColumns[chCol.Name]; !ok {
+			return fmt.Errorf("%w: could not find %q column in %q clickhouse table",
+				utils.ErrSchemaMismatch, chCol.Name, cfg.ChBufferTable)
+		} else if bufCol.BaseType != utils.ChString {
+			return fmt.Errorf("%w: %q column of the json object must be of %s type in %q buffer table, got %s",
+				utils.ErrSchemaMismatch, chCol.Name, utils.ChString, cfg.ChBufferTable, bufCol.BaseType)
+		}
+	}
+
+	return nil
+}
+
+func isChJSON(chType string) bool {
+	return chType == chJSON || strings.HasPrefix(chType, chJSON+"(") || strings.HasPrefix(chType, chJSONObject)
+}
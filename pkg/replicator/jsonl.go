@@ -0,0 +1,152 @@
+package replicator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+const jsonlStdout = "-"
+
+// row change operations of the JSON lines output
+const (
+	opInsert   = "insert"
+	opUpdate   = "update"
+	opDelete   = "delete"
+	opTruncate = "truncate"
+)
+
+// jsonlEvent is a row change written as a line of the JSON lines output; column values are in the postgres
+// text format, null for NULL; unchanged TOASTed values are not sent by postgres, so these columns are omitted
+type jsonlEvent struct {
+	LSN        string             `json:"lsn"`
+	CommitTime time.Time          `json:"commit_time"`
+	Table      string             `json:"table"`
+	Op         string             `json:"op"`
+	Columns    map[string]*string `json:"columns,omitempty"`
+	Old        map[string]*string `json:"old,omitempty"`
+}
+
+// jsonlSink writes the row changes of the replicated tables as JSON lines, flushed on each commit
+type jsonlSink struct {
+	w          *bufio.Writer
+	tx         bytes.Buffer // lines of the current transaction, written on the commit
+	enc        *json.Encoder
+	closer     io.Closer // nil for stdout
+	commitTime time.Time
+}
+
+func newJSONLSink(path string) (*jsonlSink, error) {
+	s := &jsonlSink{}
+
+	if path == jsonlStdout {
+		s.w = bufio.NewWriter(os.Stdout)
+	} else {
+		fp, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("could not open file: %w", err)
+		}
+		s.w = bufio.NewWriter(fp)
+		s.closer = fp
+	}
+	s.enc = json.NewEncoder(&s.tx)
+
+	return s, nil
+}
+
+func (s *jsonlSink) write(event jsonlEvent) error {
+	event.CommitTime = s.commitTime
+
+	if err := s.enc.Encode(event); err != nil {
+		return fmt.Errorf("could not write json lines output: %w", err)
+	}
+
+	return nil
+}
+
+// discard drops the lines of the transaction interrupted by the reconnect
+func (s *jsonlSink) discard() {
+	s.tx.Reset()
+}
+
+func (s *jsonlSink) flush() error {
+	if _, err := s.tx.WriteTo(s.w); err != nil {
+		return fmt.Errorf("could not write json lines output: %w", err)
+	}
+
+	if err := s.w.Flush(); err != nil {
+		return fmt.Errorf("could not flush json lines output: %w", err)
+	}
+
+	return nil
+}
+
+// close drops the lines of the transaction not committed, it is sent again after the restart
+func (s *jsonlSink) close() error {
+	s.discard()
+	if err := s.flush(); err != nil {
+		return err
+	}
+
+	if s.closer == nil {
+		return nil
+	}
+
+	return s.closer.Close()
+}
+
+// emitRowChange writes the row change to the JSON lines output and the gRPC stream, if enabled;
+// lsn is the one of the change, index is the one of the table of the truncate
+func (r *Replicator) emitRowChange(lsn utils.LSN, index int, oid utils.OID, tblName config.PgTableName, op string,
+	newRow, oldRow message.Row) error {
+	columns := r.relColumns[oid]
+
+	if r.rowStream != nil {
+		if err := r.streamRowChange(lsn, index, tblName, op, newRow, oldRow); err != nil {
+			return err
+		}
+	}
+
+	if r.jsonl == nil {
+		return nil
+	}
+
+	return r.jsonl.write(jsonlEvent{
+		LSN:     r.finalLSN.String(),
+		Table:   tblName.String(),
+		Op:      op,
+		Columns: rowValues(columns, newRow),
+		Old:     rowValues(columns, oldRow),
+	})
+}
+
+func rowValues(columns []message.Column, row message.Row) map[string]*string {
+	if row == nil {
+		return nil
+	}
+
+	res := make(map[string]*string, len(row))
+	for i, col := range columns {
+		if i >= len(row) {
+			break
+		}
+
+		switch row[i].Kind {
+		case message.TupleNull:
+			res[col.Name] = nil
+		case message.TupleText:
+			val := string(row[i].Value)
+			res[col.Name] = &val
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,24 @@
+package replicator
+
+import (
+	"net/http"
+)
+
+func (r *Replicator) metricsServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", r.metricsHandler)
+
+	if err := http.ListenAndServe(r.cfg.Metrics.Bind, mux); err != nil {
+		select {
+		case r.errCh <- err:
+		default:
+		}
+	}
+}
+
+func (r *Replicator) metricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := r.stats.WritePrometheus(w, r.cfg.Metrics.Labels); err != nil {
+		r.log.Warn("could not write metrics", "error", err)
+	}
+}
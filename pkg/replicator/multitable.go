@@ -0,0 +1,219 @@
+package replicator
+
+import (
+	"database/sql"
+
+	"github.com/jackc/pgx"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/tableengines"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+// multiTable writes the changes of the pg table, decoded once, into the table and its extra targets,
+// e.g. the copies with a different set of columns or masked values for the other audiences
+type multiTable struct {
+	primary clickHouseTable
+	extra   []clickHouseTable
+}
+
+func newMultiTable(targets []clickHouseTable) *multiTable {
+	return &multiTable{
+		primary: targets[0],
+		extra:   targets[1:],
+	}
+}
+
+func (t *multiTable) all() []clickHouseTable {
+	return append([]clickHouseTable{t.primary}, t.extra...)
+}
+
+// Insert handles incoming insert DML operation
+func (t *multiTable) Insert(lsn utils.LSN, new message.Row) (bool, error) {
+	return t.each(func(tbl clickHouseTable) (bool, error) {
+		return tbl.Insert(lsn, new)
+	})
+}
+
+// Update handles incoming update DML operation
+func (t *multiTable) Update(lsn utils.LSN, old, new message.Row) (bool, error) {
+	return t.each(func(tbl clickHouseTable) (bool, error) {
+		return tbl.Update(lsn, old, new)
+	})
+}
+
+// Delete handles incoming delete DML operation
+func (t *multiTable) Delete(lsn utils.LSN, old message.Row) (bool, error) {
+	return t.each(func(tbl clickHouseTable) (bool, error) {
+		return tbl.Delete(lsn, old)
+	})
+}
+
+// each applies the change to all the targets, the merge is needed if any of them needs it
+func (t *multiTable) each(apply func(clickHouseTable) (bool, error)) (bool, error) {
+	mergeIsNeeded := false
+
+	for _, tbl := range t.all() {
+		needed, err := apply(tbl)
+		if err != nil {
+			return false, err
+		}
+		mergeIsNeeded = mergeIsNeeded || needed
+	}
+
+	return mergeIsNeeded, nil
+}
+
+// SetTupleColumns sets the tuple columns of all the targets
+func (t *multiTable) SetTupleColumns(columns []message.Column) {
+	for _, tbl := range t.all() {
+		tbl.SetTupleColumns(columns)
+	}
+}
+
+// NewColumns returns the tuple columns unknown to the table
+func (t *multiTable) NewColumns(columns []message.Column) []string {
+	return t.primary.NewColumns(columns)
+}
+
+// AddColumns registers the new pg columns; they are added to the clickhouse table of the primary target only,
+// the extra targets never get the columns they were not configured with
+func (t *multiTable) AddColumns(pgColumns map[string]config.PgColumn, chColumns map[string]config.ChColumn) error {
+	if err := t.primary.AddColumns(pgColumns, chColumns); err != nil {
+		return err
+	}
+
+	for _, tbl := range t.extra {
+		if err := tbl.AddColumns(pgColumns, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetMergeProgressFunc sets the merge progress function of the primary target, which is flushed last,
+// see FlushToMainTable
+func (t *multiTable) SetMergeProgressFunc(fn func(utils.LSN) error) {
+	t.primary.SetMergeProgressFunc(fn)
+}
+
+// SetSyncConnFunc sets the function opening the connections of the initial sync of all the targets
+func (t *multiTable) SetSyncConnFunc(fn func() (*pgx.Conn, error)) {
+	for _, tbl := range t.all() {
+		tbl.SetSyncConnFunc(fn)
+	}
+}
+
+// Truncate truncates all the targets
+func (t *multiTable) Truncate() error {
+	for _, tbl := range t.all() {
+		if err := tbl.Truncate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sync syncs all the targets one by one within the snapshot of pgTx; each target reads the pg table itself,
+// so the table is read once per target
+func (t *multiTable) Sync(pgTx *pgx.Tx) error {
+	for _, tbl := range t.all() {
+		if err := tbl.Sync(pgTx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Init initializes all the targets
+func (t *multiTable) Init() error {
+	for _, tbl := range t.all() {
+		if err := tbl.Init(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reconcile handles the buffer table leftovers of all the targets. The targets are flushed one after another,
+// not atomically, so a restart may leave them with different leftovers; the max lsn of the rows moved
+// by any of them is returned
+func (t *multiTable) Reconcile(tableLSN, confirmedLSN utils.LSN) (utils.LSN, error) {
+	movedLSN := utils.InvalidLSN
+
+	for _, tbl := range t.all() {
+		lsn, err := tbl.Reconcile(tableLSN, confirmedLSN)
+		if err != nil {
+			return utils.InvalidLSN, err
+		}
+
+		if lsn > movedLSN {
+			movedLSN = lsn
+		}
+	}
+
+	return movedLSN, nil
+}
+
+// FlushToMainTable flushes the extra targets and then the primary one: the merge progress is stored
+// by the primary target only, so a restart in the middle of the flush may apply the changes to the extra
+// targets twice, but never loses them
+func (t *multiTable) FlushToMainTable() error {
+	for _, tbl := range t.extra {
+		if err := tbl.FlushToMainTable(); err != nil {
+			return err
+		}
+	}
+
+	return t.primary.FlushToMainTable()
+}
+
+// WaitForMerges waits for the merges of all the targets
+func (t *multiTable) WaitForMerges() {
+	for _, tbl := range t.extra {
+		tbl.WaitForMerges()
+	}
+	t.primary.WaitForMerges()
+}
+
+// DiscardTx drops the changes of the interrupted transaction from all the targets
+func (t *multiTable) DiscardTx(lsn utils.LSN) {
+	for _, tbl := range t.all() {
+		tbl.DiscardTx(lsn)
+	}
+}
+
+// RowConverter returns the converter of the rows of the primary target
+func (t *multiTable) RowConverter() *tableengines.RowConverter {
+	return t.primary.RowConverter()
+}
+
+// Release releases the resources of all the targets, reports if all of them are released
+func (t *multiTable) Release() bool {
+	released := true
+	for _, tbl := range t.all() {
+		released = tbl.Release() && released
+	}
+
+	return released
+}
+
+// SerialGap returns the serial gap of the primary target
+func (t *multiTable) SerialGap() (int64, error) {
+	return t.primary.SerialGap()
+}
+
+// CompareShadow compares the primary target with the production table it is a shadow of
+func (t *multiTable) CompareShadow() (uint64, uint64, bool, error) {
+	return t.primary.CompareShadow()
+}
+
+// SetShards sets the shards of the primary target, the extra targets are never written to the shards directly
+func (t *multiTable) SetShards(conns []*sql.DB, weights []int) error {
+	return t.primary.SetShards(conns, weights)
+}
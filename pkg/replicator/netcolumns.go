@@ -0,0 +1,65 @@
+package replicator
+
+import (
+	"fmt"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+// clickhouse types the inet, cidr and macaddr values can be written into
+var (
+	ipChTypes  = map[string]bool{utils.ChIPv4: true, utils.ChIPv6: true, utils.ChUint32: true, utils.ChFixedString: true, utils.ChString: true}
+	macChTypes = map[string]bool{utils.ChUint64: true, utils.ChFixedString: true, utils.ChString: true}
+)
+
+// resolveNetColumns checks the clickhouse columns of the inet, cidr and macaddr columns and the IPv4 and IPv6 ones
+func (r *Replicator) resolveNetColumns(tblName config.PgTableName, cfg *config.Table) error {
+	for pgColName, chCol := range cfg.ColumnMapping {
+		pgCol := cfg.PgColumns[pgColName]
+
+		switch pgCol.BaseType {
+		case utils.PgInet, utils.PgCidr:
+			if !ipChTypes[chCol.BaseType] {
+				return fmt.Errorf("%w: %q column of %s type must be IPv4, IPv6, UInt32, FixedString(16) or String "+
+					"in clickhouse, got %s", utils.ErrSchemaMismatch, pgColName, pgCol.BaseType, chCol.BaseType)
+			}
+		case utils.PgMacaddr, utils.PgMacaddr8:
+			if !macChTypes[chCol.BaseType] {
+				return fmt.Errorf("%w: %q column of %s type must be UInt64, FixedString or String in clickhouse, got %s",
+					utils.ErrSchemaMismatch, pgColName, pgCol.BaseType, chCol.BaseType)
+			}
+		}
+
+		if chCol.BaseType != utils.ChIPv4 && chCol.BaseType != utils.ChIPv6 {
+			continue
+		}
+
+		switch pgCol.BaseType {
+		case utils.PgInet, utils.PgCidr, utils.PgText, utils.PgCharacterVarying, utils.PgVarchar:
+		default:
+			return fmt.Errorf("%w: %q column of %s postgres table must be of inet, cidr or text type for %s, got %s",
+				utils.ErrSchemaMismatch, pgColName, tblName.String(), chCol.BaseType, pgCol.BaseType)
+		}
+
+		// the driver can't write IPv4 and IPv6, the text is cast to them when moved from the buffer table
+		if cfg.ChBufferTable == "" || cfg.InitSyncSkipBufferTable {
+			return fmt.Errorf("%s column %q needs buffer_table, also for the initial sync", chCol.BaseType, chCol.Name)
+		}
+
+		bufColumns, err := r.chSchema.Columns(cfg.ChBufferTable)
+		if err != nil {
+			return fmt.Errorf("could not get columns for %q clickhouse table: %w", cfg.ChBufferTable, err)
+		}
+
+		if bufCol, ok := bufColumns[chCol.Name]; !ok {
+			return fmt.Errorf("%w: could not find %q column in %q clickhouse table",
+				utils.ErrSchemaMismatch, chCol.Name, cfg.ChBufferTable)
+		} else if bufCol.BaseType != utils.ChString {
+			return fmt.Errorf("%w: %q column of %s type must be of %s type in %q buffer table, got %s",
+				utils.ErrSchemaMismatch, chCol.Name, chCol.BaseType, utils.ChString, cfg.ChBufferTable, bufCol.BaseType)
+		}
+	}
+
+	return nil
+}
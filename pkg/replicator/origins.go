@@ -0,0 +1,63 @@
+package replicator
+
+import (
+	"fmt"
+
+	"github.com/jackc/pgx"
+)
+
+// localOrigin is the origins entry of the transactions made on the node itself, they have no replication origin
+const localOrigin = "local"
+
+// resolveOrigins resolves the origins of the config into the replication origins the transactions are replicated
+// from: the subscriptions of the current database are replaced by their origins, named pg_<subscription oid>,
+// the other names are taken as the replication origins themselves, e.g. the ones of the other replication tools
+func (r *Replicator) resolveOrigins(tx *pgx.Tx) error {
+	if len(r.cfg.Postgres.Origins) == 0 {
+		r.origins = nil
+		return nil
+	}
+
+	r.origins = make(map[string]struct{}, len(r.cfg.Postgres.Origins))
+	for _, name := range r.cfg.Postgres.Origins {
+		if name == localOrigin {
+			r.origins[""] = struct{}{}
+			continue
+		}
+
+		var origin string
+		err := tx.QueryRow(`select 'pg_' || s.oid
+			from pg_subscription s
+				join pg_database d on d.oid = s.subdbid
+			where s.subname = $1 and d.datname = current_database()`, name).Scan(&origin)
+		if err == pgx.ErrNoRows {
+			origin = name
+		} else if err != nil {
+			return fmt.Errorf("could not query subscription %q: %w", name, err)
+		}
+
+		var exists bool
+		if err := tx.QueryRow("select exists(select 1 from pg_replication_origin where roname = $1)",
+			origin).Scan(&exists); err != nil {
+			return fmt.Errorf("could not query replication origin %q: %w", origin, err)
+		}
+		if !exists {
+			r.log.Warn("replication origin does not exist, no transactions come from it yet", "origin", origin)
+		}
+
+		r.origins[origin] = struct{}{}
+		r.log.Info("replicating transactions of the origin", "origin", name, "replication_origin", origin)
+	}
+
+	return nil
+}
+
+// skipOrigin checks if the transactions of the replication origin, empty for the local ones, are skipped
+func (r *Replicator) skipOrigin(origin string) bool {
+	if r.origins == nil {
+		return false
+	}
+	_, ok := r.origins[origin]
+
+	return !ok
+}
@@ -0,0 +1,307 @@
+package replicator
+
+import (
+	"fmt"
+
+	"github.com/jackc/pgx"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+// fetchPartitions maps the leaf partitions of the configured partitioned tables to the tables, so that
+// the changes published per partition, i.e. without publish_via_partition_root, go to the single clickhouse table
+func (r *Replicator) fetchPartitions(tx *pgx.Tx) error {
+	roots := make(map[utils.OID]config.PgTableName)
+	r.partitionRoots = roots
+	r.partitionOf = make(map[utils.OID]config.PgTableName)
+	r.partitionCount = make(map[config.PgTableName]int)
+
+	rows, err := tx.Query(`
+			select c.oid, n.nspname, c.relname
+			from pg_class c
+				   join pg_namespace n on n.oid = c.relnamespace
+			where c.relkind = 'p' and not c.relispartition`)
+	if err != nil {
+		return fmt.Errorf("could not query partitioned tables: %w", err)
+	}
+
+	for rows.Next() {
+		var (
+			oid     utils.OID
+			tblName config.PgTableName
+		)
+
+		if err := rows.Scan(&oid, &tblName.SchemaName, &tblName.TableName); err != nil {
+			rows.Close()
+			return fmt.Errorf("could not scan: %w", err)
+		}
+
+		if _, ok := r.cfg.Tables[tblName]; ok {
+			roots[oid] = tblName
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not query partitioned tables: %w", err)
+	}
+
+	if len(roots) == 0 {
+		return nil
+	}
+
+	type partition struct {
+		parent          utils.OID
+		leaf            bool
+		name            config.PgTableName
+		replicaIdentity message.ReplicaIdentity
+	}
+	partitions := make(map[utils.OID]partition)
+
+	rows, err = tx.Query(`
+			select c.oid, i.inhparent, c.relkind = 'r', n.nspname, c.relname, c.relreplident
+			from pg_class c
+				   join pg_namespace n on n.oid = c.relnamespace
+				   join pg_inherits i on i.inhrelid = c.oid
+			where c.relispartition`)
+	if err != nil {
+		return fmt.Errorf("could not query partitions: %w", err)
+	}
+
+	for rows.Next() {
+		var (
+			oid utils.OID
+			p   partition
+		)
+
+		if err := rows.Scan(&oid, &p.parent, &p.leaf, &p.name.SchemaName, &p.name.TableName, &p.replicaIdentity); err != nil {
+			rows.Close()
+			return fmt.Errorf("could not scan: %w", err)
+		}
+		partitions[oid] = p
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not query partitions: %w", err)
+	}
+
+	for oid, p := range partitions {
+		if !p.leaf {
+			continue
+		}
+
+		root := p.parent
+		for {
+			parent, ok := partitions[root]
+			if !ok {
+				break
+			}
+			root = parent.parent
+		}
+
+		tblName, ok := roots[root]
+		if !ok {
+			continue
+		}
+
+		r.checkReplicaIdentity(tblName, p.name, p.replicaIdentity)
+
+		r.oidName[oid] = tblName
+		r.partitionOf[oid] = tblName
+		r.partitionCount[tblName]++
+	}
+
+	for _, tblName := range roots {
+		r.log.Info("table is partitioned, changes of its partitions go to the same clickhouse table",
+			"table", tblName.String(), "partitions", r.partitionCount[tblName])
+	}
+
+	return nil
+}
+
+// fetchInheritedTables maps the inheritance children of the tables with include_inherited to the tables,
+// for the legacy partitioning schemes based on the table inheritance
+func (r *Replicator) fetchInheritedTables(tx *pgx.Tx) error {
+	r.inheritRoots = make(map[utils.OID]config.PgTableName)
+	r.inheritedOf = make(map[utils.OID]config.PgTableName)
+
+	for tblName, tblCfg := range r.cfg.Tables {
+		if !tblCfg.IncludeInherited {
+			continue
+		}
+
+		var oid utils.OID
+		if err := tx.QueryRow("select $1::regclass::oid", tblName.String()).Scan(&oid); err != nil {
+			return fmt.Errorf("could not get oid of %s table: %w", tblName.String(), err)
+		}
+		r.inheritRoots[oid] = tblName
+
+		rows, err := tx.Query(`
+				with recursive children(relid) as (
+					select inhrelid from pg_inherits where inhparent = $1
+					union all
+					select i.inhrelid from pg_inherits i join children ch on i.inhparent = ch.relid)
+				select c.oid, n.nspname, c.relname, c.relreplident
+				from children ch
+					   join pg_class c on c.oid = ch.relid
+					   join pg_namespace n on n.oid = c.relnamespace
+				where not c.relispartition`, uint32(oid))
+		if err != nil {
+			return fmt.Errorf("could not query inheritance children of %s: %w", tblName.String(), err)
+		}
+
+		children := 0
+		for rows.Next() {
+			var (
+				childOID        utils.OID
+				childName       config.PgTableName
+				replicaIdentity message.ReplicaIdentity
+			)
+
+			if err := rows.Scan(&childOID, &childName.SchemaName, &childName.TableName, &replicaIdentity); err != nil {
+				rows.Close()
+				return fmt.Errorf("could not scan: %w", err)
+			}
+
+			r.checkReplicaIdentity(tblName, childName, replicaIdentity)
+
+			r.oidName[childOID] = tblName
+			r.inheritedOf[childOID] = tblName
+			children++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("could not query inheritance children of %s: %w", tblName.String(), err)
+		}
+
+		r.log.Info("table is replicated along with its inheritance children", "table", tblName.String(), "children", children)
+	}
+
+	return nil
+}
+
+// attachPartition maps the relation not known at startup, e.g. a partition created since, to the partitioned table
+func (r *Replicator) attachPartition(rel message.Relation) error {
+	if len(r.partitionRoots) == 0 && len(r.inheritRoots) == 0 {
+		return nil
+	}
+
+	rows, err := r.pgConn.Query(`
+			with recursive ancestors(relid) as (
+				select inhparent from pg_inherits where inhrelid = $1
+				union all
+				select i.inhparent from pg_inherits i join ancestors a on i.inhrelid = a.relid)
+			select relid from ancestors`, uint32(rel.OID))
+	if err != nil {
+		return fmt.Errorf("could not query ancestors of %s: %w", rel.NamespacedName.String(), err)
+	}
+	defer rows.Close()
+
+	relName := config.PgTableName{SchemaName: rel.Namespace, TableName: rel.Name}
+	for rows.Next() {
+		var relID utils.OID
+
+		if err := rows.Scan(&relID); err != nil {
+			return fmt.Errorf("could not scan: %w", err)
+		}
+
+		if tblName, ok := r.inheritRoots[relID]; ok {
+			r.checkReplicaIdentity(tblName, relName, rel.ReplicaIdentity)
+			if err := r.replicaIdentityError(); err != nil {
+				return err
+			}
+
+			r.oidName[rel.OID] = tblName
+			r.inheritedOf[rel.OID] = tblName
+			r.log.Info("new inheritance child, its changes go to the same clickhouse table",
+				"table", tblName.String(), "child", rel.NamespacedName.String())
+
+			return nil
+		}
+
+		tblName, ok := r.partitionRoots[relID]
+		if !ok {
+			continue
+		}
+
+		r.checkReplicaIdentity(tblName, relName, rel.ReplicaIdentity)
+		if err := r.replicaIdentityError(); err != nil {
+			return err
+		}
+
+		r.oidName[rel.OID] = tblName
+		r.partitionOf[rel.OID] = tblName
+		r.partitionCount[tblName]++
+		r.log.Info("new partition, its changes go to the same clickhouse table",
+			"table", tblName.String(), "partition", rel.NamespacedName.String())
+
+		return nil
+	}
+
+	return rows.Err()
+}
+
+// relationColumns switches the tuple columns of the table to the ones of the relation the change comes from;
+// partitions of a table may have their columns in a different order
+func (r *Replicator) relationColumns(oid utils.OID, tblName config.PgTableName, chTbl clickHouseTable) error {
+	if r.tupleColumnsOID[tblName] == oid {
+		return nil
+	}
+
+	columns, ok := r.relColumns[oid]
+	if !ok {
+		return nil
+	}
+	r.tupleColumnsOID[tblName] = oid
+
+	return r.onTable(tblName, func() (bool, error) {
+		chTbl.SetTupleColumns(columns)
+
+		return false, nil
+	})
+}
+
+// truncatedOIDs returns the relations of the truncate message to be truncated: the partitioned table
+// is truncated once all its partitions are, truncation of only some of them is not replicated
+func (r *Replicator) truncatedOIDs(oids []utils.OID) []utils.OID {
+	res := make([]utils.OID, 0, len(oids))
+	truncated := make(map[config.PgTableName]int)
+
+	rootTruncated := make(map[config.PgTableName]bool)
+	for _, oid := range oids {
+		if tblName, ok := r.inheritRoots[oid]; ok {
+			rootTruncated[tblName] = true
+		}
+	}
+
+	for _, oid := range oids {
+		if tblName, ok := r.inheritedOf[oid]; ok {
+			if !rootTruncated[tblName] {
+				r.log.Warn("truncate of inheritance child is not replicated, the rows are kept in clickhouse",
+					"table", tblName.String(), "oid", oid.String())
+			}
+			continue
+		}
+
+		tblName, ok := r.partitionOf[oid]
+		if !ok {
+			res = append(res, oid)
+			continue
+		}
+
+		truncated[tblName]++
+		if truncated[tblName] == r.partitionCount[tblName] {
+			res = append(res, oid)
+		}
+	}
+
+	for tblName, cnt := range truncated {
+		if cnt < r.partitionCount[tblName] {
+			r.log.Warn("truncate of some of the partitions is not replicated, the rows are kept in clickhouse",
+				"table", tblName.String(), "truncated", cnt, "partitions", r.partitionCount[tblName])
+		}
+	}
+
+	return res
+}
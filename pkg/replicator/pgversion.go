@@ -0,0 +1,65 @@
+package replicator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+)
+
+// postgresql versions, as in server_version_num, the features are supported since
+const (
+	minPgVersion           = 100000 // logical replication with pgoutput
+	minPartitionedVersion  = 130000 // partitioned tables in the publication
+	minPubFiltersVersion   = 150000 // row filters and column lists of the publication
+	minFailoverSlotVersion = 170000 // failover of the logical replication slots
+)
+
+// pgRequirement is the configured feature available since the postgresql version
+type pgRequirement struct {
+	feature string
+	version int
+	used    func(cfg *config.Config) bool
+}
+
+// configured features the older postgresql servers reject: they fail the startup instead of failing
+// with the protocol errors later on
+var pgRequirements = []pgRequirement{
+	{"failover_slot", minFailoverSlotVersion, func(cfg *config.Config) bool { return cfg.Postgres.FailoverSlot }},
+}
+
+// pgProbeVersion fetches the version of the postgresql server and checks that it supports the configured features
+func (r *Replicator) pgProbeVersion() error {
+	if err := r.pgConn.QueryRow("select current_setting('server_version_num')::int").Scan(&r.pgVersion); err != nil {
+		return fmt.Errorf("could not get postgresql server version: %w", err)
+	}
+	r.log.Info("postgresql server version", "version", pgVersionString(r.pgVersion))
+
+	if r.pgVersion < minPgVersion {
+		return fmt.Errorf("logical replication needs postgresql 10 or newer, server version is %s",
+			pgVersionString(r.pgVersion))
+	}
+
+	unsupported := make([]string, 0)
+	for _, req := range pgRequirements {
+		if req.used(&r.cfg) && r.pgVersion < req.version {
+			unsupported = append(unsupported, fmt.Sprintf("%s requires %s", req.feature, pgVersionString(req.version)))
+		}
+	}
+
+	if len(unsupported) > 0 {
+		return fmt.Errorf("postgresql server version %s does not support configured features: %s",
+			pgVersionString(r.pgVersion), strings.Join(unsupported, ", "))
+	}
+
+	return nil
+}
+
+// pgVersionString formats server_version_num, e.g. 170002 as 17.2 and 90605 as 9.6.5
+func pgVersionString(version int) string {
+	if version >= 100000 {
+		return fmt.Sprintf("%d.%d", version/10000, version%10000)
+	}
+
+	return fmt.Sprintf("%d.%d.%d", version/10000, version/100%100, version%100)
+}
@@ -0,0 +1,153 @@
+package replicator
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+const (
+	progressInterval = time.Second
+	progressBarWidth = 20
+)
+
+// showSyncProgress redraws the line with the progress of the initial sync of the tables on stderr every second,
+// for the operators running the sync by hand; returned func stops it
+func (r *Replicator) showSyncProgress(tables []config.PgTableName) func() {
+	if !r.cfg.Progress || len(tables) == 0 {
+		return func() {}
+	}
+
+	estimates := r.estimateRows(tables)
+	start := time.Now()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				fmt.Fprintf(os.Stderr, "\r%s\x1b[K\n", r.syncProgressLine(tables, estimates, time.Since(start)))
+				return
+			case <-ticker.C:
+				fmt.Fprintf(os.Stderr, "\r%s\x1b[K", r.syncProgressLine(tables, estimates, time.Since(start)))
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// estimateRows returns the planner estimates of the number of rows of the tables, for the overall ETA
+// before the sync of each table starts
+func (r *Replicator) estimateRows(tables []config.PgTableName) map[config.PgTableName]int64 {
+	res := make(map[config.PgTableName]int64, len(tables))
+
+	for _, tblName := range tables {
+		var rows int64
+
+		err := r.pgConn.QueryRow("select coalesce(sum(greatest(reltuples, 0)), 0)::bigint from pg_class where oid in ("+
+			utils.PartitionTreeQuery+")", tblName.String()).Scan(&rows)
+		if err != nil {
+			r.log.Warn("could not estimate number of rows", "table", tblName.String(), "error", err)
+			continue
+		}
+		res[tblName] = rows
+	}
+
+	return res
+}
+
+// syncProgressLine renders the overall progress bar, rate and ETA followed by the progress of the running syncs
+func (r *Replicator) syncProgressLine(tables []config.PgTableName, estimates map[config.PgTableName]int64,
+	elapsed time.Duration) string {
+	var (
+		rows, expected int64
+		finished       int
+	)
+
+	running := make([]string, 0)
+	for _, tblName := range tables {
+		progress := r.stats.Table(tblName.String()).SyncProgress()
+		if !progress.Started {
+			expected += estimates[tblName]
+			continue
+		}
+
+		tblExpected := progress.ExpectedRows
+		if int64(progress.Rows) > tblExpected { // the estimates may be off
+			tblExpected = int64(progress.Rows)
+		}
+		rows += int64(progress.Rows)
+		expected += tblExpected
+
+		if progress.Finished {
+			finished++
+			continue
+		}
+		running = append(running, fmt.Sprintf("%s %.0f%%", tblName.String(), percent(int64(progress.Rows), tblExpected)))
+	}
+
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(rows) / elapsed.Seconds()
+	}
+
+	eta := "?"
+	if rate > 0 && expected >= rows {
+		eta = time.Duration(float64(expected-rows) / rate * float64(time.Second)).Truncate(time.Second).String()
+	}
+
+	pct := percent(rows, expected)
+	filled := int(pct) * progressBarWidth / 100
+	line := fmt.Sprintf("[%s%s] %5.1f%% %d/%d tables, %s/~%s rows, %s rows/s, elapsed %v, ETA %s",
+		strings.Repeat("#", filled), strings.Repeat(".", progressBarWidth-filled), pct,
+		finished, len(tables), formatCount(rows), formatCount(expected), formatCount(int64(rate)),
+		elapsed.Truncate(time.Second), eta)
+
+	if len(running) > 0 {
+		line += " | " + strings.Join(running, ", ")
+	}
+
+	return line
+}
+
+func percent(n, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+
+	if n >= total {
+		return 100
+	}
+
+	return float64(n) * 100 / float64(total)
+}
+
+func formatCount(n int64) string {
+	const unit = 1000
+
+	if n < unit {
+		return fmt.Sprintf("%d", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "kMGTPE"[exp])
+}
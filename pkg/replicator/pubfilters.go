@@ -0,0 +1,68 @@
+package replicator
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jackc/pgx"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/message"
+)
+
+// applyPublicationFilters restricts the table to the rows and columns published: the changes of the others are
+// never streamed, so the initial sync skips them as well and the snapshot matches the stream
+func (r *Replicator) applyPublicationFilters(tx *pgx.Tx, tblName config.PgTableName, cfg *config.Table) error {
+	var (
+		attNames  []string
+		rowFilter sql.NullString
+	)
+
+	if r.pgVersion < minPubFiltersVersion {
+		return nil
+	}
+
+	err := tx.QueryRow("select attnames::text[], rowfilter from pg_publication_tables "+
+		"where pubname = $1 and schemaname = $2 and tablename = $3",
+		r.cfg.Postgres.PublicationName, tblName.SchemaName, tblName.TableName).Scan(&attNames, &rowFilter)
+	if err == pgx.ErrNoRows { // e.g. partitioned table published via its partitions
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not query: %w", err)
+	}
+
+	if rowFilter.Valid {
+		cfg.PubRowFilter = rowFilter.String
+		r.log.Info("publication has row filter, the initial sync copies the matching rows",
+			"table", tblName.String(), "row_filter", cfg.PubRowFilter)
+	}
+
+	if len(attNames) >= len(cfg.TupleColumns) {
+		return nil
+	}
+
+	published := make(map[string]struct{}, len(attNames))
+	for _, name := range attNames {
+		published[name] = struct{}{}
+	}
+
+	tupleColumns := make([]message.Column, 0, len(attNames))
+	for _, col := range cfg.TupleColumns {
+		if _, ok := published[col.Name]; ok {
+			tupleColumns = append(tupleColumns, col)
+		}
+	}
+	for name := range cfg.PgColumns {
+		if _, ok := published[name]; !ok {
+			delete(cfg.PgColumns, name)
+		}
+	}
+
+	cfg.TupleColumns = tupleColumns
+	cfg.PubColumns = attNames
+	r.log.Info("publication has column list, the other columns are not replicated",
+		"table", tblName.String(), "columns", attNames)
+
+	return nil
+}
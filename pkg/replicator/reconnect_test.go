@@ -0,0 +1,78 @@
+package replicator
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/consumer"
+	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/tableengines"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+type fakeConsumer struct {
+	consumer.Interface
+	lsn utils.LSN
+}
+
+func (c *fakeConsumer) AdvanceLSN(lsn utils.LSN) {
+	c.lsn = lsn
+}
+
+func insertOf(id string) message.Insert {
+	return message.Insert{RelationOID: 1, NewRow: message.Row{{Kind: message.TupleText, Value: []byte(id)}}}
+}
+
+// TestReconnectMidTransaction cuts the connection after the memory buffer of the table is flushed in the middle
+// of the transaction: the transaction sent again after the reconnect must be applied exactly once
+func TestReconnectMidTransaction(t *testing.T) {
+	tblName := config.PgTableName{SchemaName: "public", TableName: "t"}
+	tblCfg := config.Table{
+		PgTableName:     tblName,
+		ChMainTable:     "t",
+		Engine:          config.MergeTree,
+		MaxBufferLength: 2,
+		Inspect:         true, // the flushes are not written to clickhouse
+		TupleColumns:    []message.Column{{IsKey: true, Name: "id"}},
+		ColumnMapping: map[string]config.ChColumn{
+			"id": {Column: config.Column{BaseType: utils.ChInt64}, Name: "id"},
+		},
+	}
+
+	r := New(config.Config{Inspect: true}, BuildInfo{})
+	r.consumer = &fakeConsumer{}
+	tblStats := r.stats.Table(tblName.String())
+	r.chTables[tblName] = tableengines.NewMergeTree(r.ctx, nil, tblCfg, &r.generationID, tblStats)
+	r.oidName[1] = tblName
+
+	handle := func(msgs ...message.Message) {
+		t.Helper()
+		for _, msg := range msgs {
+			if err := r.HandleMessage(utils.InvalidLSN, msg); err != nil {
+				t.Fatalf("could not handle %v: %v", msg, err)
+			}
+		}
+	}
+
+	handle(message.Begin{FinalLSN: 100}, insertOf("1"), message.Commit{})
+	handle(message.Begin{FinalLSN: 200}, insertOf("2"), insertOf("3"))
+	if err := r.HandleReconnect(); err != nil {
+		t.Fatalf("could not handle reconnect: %v", err)
+	}
+	if r.inTx || len(r.inTxTables) > 0 {
+		t.Fatalf("transaction is still open after the reconnect")
+	}
+
+	// the committed transaction is sent again as the slot was not advanced past it
+	handle(message.Begin{FinalLSN: 100}, insertOf("1"), message.Commit{})
+	handle(message.Begin{FinalLSN: 200}, insertOf("2"), insertOf("3"), message.Commit{})
+
+	flushed, buffered := atomic.LoadUint64(&tblStats.FlushedRows), atomic.LoadInt64(&tblStats.BufferedRows)
+	if flushed+uint64(buffered) != 3 {
+		t.Fatalf("want 3 rows applied, got %d flushed and %d buffered", flushed, buffered)
+	}
+	if flushed != 2 {
+		t.Fatalf("want the rows flushed before the reconnect to stay flushed, got %d flushed", flushed)
+	}
+}
@@ -2,13 +2,12 @@ package replicator
 
 import (
 	"fmt"
-	"log"
 	"strings"
 
 	"github.com/tidwall/redcon"
 )
 
-const forbiddenError = "cannot modify '" + tableLSNKeyPrefix + "*' keys"
+const forbiddenError = "cannot modify '" + stateKey + "', '" + generationIDKey + "' and '" + tableLSNKeyPrefix + "*' keys"
 
 func (r *Replicator) redisServer() {
 	err := redcon.ListenAndServe(r.cfg.RedisBind,
@@ -19,7 +18,7 @@ func (r *Replicator) redisServer() {
 			case "quit":
 				conn.WriteString("OK")
 				if err := conn.Close(); err != nil {
-					log.Printf("could not close redis connection: %v", err)
+					r.log.Warn("could not close redis connection", "error", err)
 				}
 			case "set":
 				if len(cmd.Args) != 3 {
@@ -29,7 +28,7 @@ func (r *Replicator) redisServer() {
 				key := string(cmd.Args[1])
 				value := cmd.Args[2]
 
-				if strings.HasPrefix(key, tableLSNKeyPrefix) {
+				if isStateKey(key) {
 					conn.WriteString(fmt.Sprintf("ERR: %s", forbiddenError))
 					return
 				}
@@ -71,6 +70,10 @@ func (r *Replicator) redisServer() {
 					return
 				}
 				key := string(cmd.Args[1])
+				if isStateKey(key) {
+					conn.WriteString(fmt.Sprintf("ERR: %s", forbiddenError))
+					return
+				}
 
 				err := r.persStorage.Erase(key)
 				if err != nil {
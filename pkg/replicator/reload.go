@@ -0,0 +1,378 @@
+package replicator
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+const lockOutsideTxInterval = 100 * time.Millisecond
+
+// reloadOnSignal reloads the tables on SIGHUP until the context is cancelled
+func (r *Replicator) reloadOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-sigs:
+			if !r.startTablesChange(r.reloadTables) {
+				r.log.Warn("change of the tables is already running")
+			}
+		}
+	}
+}
+
+// startTablesChange runs the change of the tables in background unless another one is already running
+func (r *Replicator) startTablesChange(change func() error) bool {
+	if !atomic.CompareAndSwapInt32(&r.reloading, 0, 1) {
+		return false
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&r.reloading, 0)
+
+		if err := change(); err != nil {
+			r.log.Error("could not change tables", "error", err)
+		}
+	}()
+
+	return true
+}
+
+// reloadTables applies the changes of the table list in the config files: the removed tables stop being
+// replicated, the added ones are synced while the other tables keep streaming; other changes need a restart
+func (r *Replicator) reloadTables() error {
+	cfg, err := r.cfg.Reload()
+	if err != nil {
+		return fmt.Errorf("could not load config: %w", err)
+	}
+	r.chSchema.Reset()
+
+	for tblName := range r.cfg.Tables {
+		if _, ok := cfg.Tables[tblName]; ok {
+			continue
+		}
+
+		if err := r.removeTable(tblName); err != nil {
+			return fmt.Errorf("could not remove %s table: %w", tblName.String(), err)
+		}
+		r.log.Info("table is removed, it is not replicated anymore", "table", tblName.String())
+	}
+
+	for tblName, tblCfg := range cfg.Tables {
+		if _, ok := r.cfg.Tables[tblName]; ok {
+			continue
+		}
+
+		if err := r.addTable(tblName, tblCfg); err != nil {
+			return fmt.Errorf("could not add %s table: %w", tblName.String(), err)
+		}
+	}
+
+	return nil
+}
+
+// resyncTable syncs the table again from scratch while the other tables keep streaming
+func (r *Replicator) resyncTable(tblName config.PgTableName) error {
+	tblCfg := r.cfg.Tables[tblName]
+	r.chSchema.Reset() // the clickhouse tables may have been recreated for the resync
+
+	if err := r.removeTable(tblName); err != nil {
+		return fmt.Errorf("could not remove %s table: %w", tblName.String(), err)
+	}
+
+	if err := r.addTable(tblName, tblCfg); err != nil {
+		return fmt.Errorf("could not add %s table: %w", tblName.String(), err)
+	}
+
+	return nil
+}
+
+// resetResyncTables forgets the stored lsn positions of the tables passed via --resync, so that they are
+// synced again at the start, while the other tables continue streaming from their positions
+func (r *Replicator) resetResyncTables() error {
+	if len(r.cfg.Resync) == 0 {
+		return nil
+	}
+
+	if !r.cfg.StartFrom.IsZero() {
+		return fmt.Errorf("resync and start-from are mutually exclusive")
+	}
+
+	for _, name := range r.cfg.Resync {
+		var tblName config.PgTableName
+
+		if err := tblName.Parse(name); err != nil {
+			return fmt.Errorf("could not parse %q table name: %w", name, err)
+		}
+
+		if _, ok := r.cfg.Tables[tblName]; !ok {
+			return fmt.Errorf("table %s is not in the config", tblName.String())
+		}
+
+		if err := r.forgetTableLSN(tblName); err != nil {
+			return fmt.Errorf("could not erase lsn of %s table: %w", tblName.String(), err)
+		}
+		r.cfg.ConfirmResync = append(r.cfg.ConfirmResync, tblName.String()) // asked explicitly
+		r.log.Info("table is going to be synced again", "table", tblName.String())
+	}
+
+	return nil
+}
+
+// lockOutsideTx locks the tables between the transactions of the stream
+func (r *Replicator) lockOutsideTx() error {
+	for {
+		r.tablesToMergeMutex.Lock()
+		if !r.inTx {
+			if err := r.drainWorkers(); err != nil {
+				r.tablesToMergeMutex.Unlock()
+				return err
+			}
+
+			return nil
+		}
+		r.tablesToMergeMutex.Unlock()
+
+		select {
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		case <-time.After(lockOutsideTxInterval):
+		}
+	}
+}
+
+// tableConfig returns the config of the table, false if it is not replicated; for the readers outside
+// of the replication loop, e.g. the admin api, as the tables config map is replaced by setTableConfig
+func (r *Replicator) tableConfig(tblName config.PgTableName) (config.Table, bool) {
+	r.tablesToMergeMutex.Lock()
+	defer r.tablesToMergeMutex.Unlock()
+
+	tblCfg, ok := r.cfg.Tables[tblName]
+
+	return tblCfg, ok
+}
+
+// setTableConfig replaces the tables config map, so that the readers of the previous one are not affected;
+// nil tblCfg removes the table. Must be called with the tables locked
+func (r *Replicator) setTableConfig(tblName config.PgTableName, tblCfg *config.Table) {
+	tables := make(map[config.PgTableName]config.Table, len(r.cfg.Tables)+1)
+	for name, cfg := range r.cfg.Tables {
+		tables[name] = cfg
+	}
+
+	if tblCfg == nil {
+		delete(tables, tblName)
+	} else {
+		tables[tblName] = *tblCfg
+	}
+	r.cfg.Tables = tables
+}
+
+// removeTable flushes the table to the main table and stops replicating it
+func (r *Replicator) removeTable(tblName config.PgTableName) error {
+	if err := r.lockOutsideTx(); err != nil {
+		return err
+	}
+	defer r.tablesToMergeMutex.Unlock()
+
+	if _, ok := r.syncingTables[tblName]; ok {
+		return fmt.Errorf("table is being synced")
+	}
+
+	if tbl, ok := r.chTables[tblName]; ok {
+		if err := tbl.FlushToMainTable(); err != nil {
+			return fmt.Errorf("could not flush: %w", err)
+		}
+	}
+	r.dropTable(tblName)
+
+	spool, frozen := r.frozen[tblName]
+	delete(r.frozen, tblName)
+	if err := r.forgetTableLSN(tblName); err != nil {
+		return fmt.Errorf("could not erase lsn: %w", err)
+	}
+	if frozen {
+		r.discardSpool(tblName, spool)
+	}
+
+	return nil
+}
+
+// dropTable forgets the table. Must be called with the tables locked
+func (r *Replicator) dropTable(tblName config.PgTableName) {
+	delete(r.chTables, tblName)
+	delete(r.tableLSN, tblName)
+	delete(r.tablesToMerge, tblName)
+	delete(r.inTxTables, tblName)
+	delete(r.syncingTables, tblName)
+	delete(r.lastChange, tblName)
+	delete(r.released, tblName)
+	delete(r.tupleColumnsOID, tblName)
+	delete(r.partitionCount, tblName)
+
+	for _, oids := range []map[utils.OID]config.PgTableName{r.oidName, r.partitionOf, r.partitionRoots,
+		r.inheritedOf, r.inheritRoots} {
+		for oid, name := range oids {
+			if name == tblName {
+				delete(oids, oid)
+			}
+		}
+	}
+
+	r.setTableConfig(tblName, nil)
+}
+
+// addTable syncs the table within the snapshot of a temporary replication slot while the other tables are streamed.
+// The table joins the stream at the snapshot lsn right away, its changes are kept in the buffer table
+// and moved to the main table only after the sync
+func (r *Replicator) addTable(tblName config.PgTableName, tblCfg config.Table) error {
+	if tblCfg.ChBufferTable == "" {
+		return fmt.Errorf("buffer_table is needed to keep the changes streamed during the sync, restart to add the table")
+	}
+
+	conn, err := r.pgReplicationConn()
+	if err != nil {
+		return fmt.Errorf("could not connect to postgresql: %w", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			r.log.Warn("could not close connection to postgresql", "error", err)
+		}
+	}()
+
+	tx, err := r.pgBeginConn(conn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err := r.lockOutsideTx(); err != nil {
+		return err
+	}
+	r.setTableConfig(tblName, &tblCfg)
+	slotName, lsn, syncTbl, err := r.joinStream(tx, tblName)
+	if err != nil {
+		r.dropTable(tblName)
+	}
+	r.tablesToMergeMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	r.log.Info("table is added, syncing it; its changes after the lsn are kept in the buffer table meanwhile",
+		"table", tblName.String(), "lsn", lsn)
+
+	stopWatch := r.watchSnapshotAge(tblName)
+	err = syncTbl.Sync(tx)
+	if abortErr := stopWatch(); abortErr != nil {
+		err = abortErr
+	}
+	if err == nil {
+		err = r.pgDropRepSlot(tx, slotName)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if lockErr := r.lockOutsideTx(); lockErr != nil {
+		return lockErr
+	}
+	defer r.tablesToMergeMutex.Unlock()
+
+	if err != nil {
+		r.dropTable(tblName)
+		return fmt.Errorf("could not sync: %w", err)
+	}
+	r.reportSync(tblName, r.cfg.Tables[tblName])
+
+	delete(r.syncingTables, tblName)
+	r.tablesToMerge[tblName] = struct{}{}
+
+	return r.storeTableLSN(tblName, lsn)
+}
+
+// joinStream creates the temporary replication slot, which must be the first command in tx, and adds the table
+// to the stream at its lsn; returns the instance of the table to sync into the main table directly.
+// Must be called with the tables locked
+func (r *Replicator) joinStream(tx *pgx.Tx, tblName config.PgTableName) (string, utils.LSN, clickHouseTable, error) {
+	if err := r.checkResyncCost([]config.PgTableName{tblName}); err != nil {
+		return "", utils.InvalidLSN, nil, err
+	}
+
+	slotName, lsn, err := r.pgCreateTempRepSlot(tx, tblName)
+	if err != nil {
+		return "", utils.InvalidLSN, nil, fmt.Errorf("could not create temporary replication slot: %w", err)
+	}
+
+	tblConfig, err := r.fetchTableConfig(tx, tblName)
+	if err != nil {
+		return "", utils.InvalidLSN, nil, fmt.Errorf("could not get table config: %w", err)
+	}
+	tblConfig.PgTableName = tblName
+
+	tbl, err := r.newTable(tblName, tblConfig)
+	if err != nil {
+		return "", utils.InvalidLSN, nil, fmt.Errorf("could not instantiate table: %w", err)
+	}
+
+	if err := tbl.Init(); err != nil {
+		return "", utils.InvalidLSN, nil, fmt.Errorf("could not init: %w", err)
+	}
+	tbl.SetMergeProgressFunc(r.mergeProgressFunc(tblName))
+
+	syncConfig := directSyncConfig(tblConfig)
+	syncConfig.ExtraTargets = make([]config.Table, 0, len(tblConfig.ExtraTargets))
+	for _, target := range tblConfig.ExtraTargets {
+		syncConfig.ExtraTargets = append(syncConfig.ExtraTargets, directSyncConfig(target))
+	}
+
+	syncTbl, err := r.newTable(tblName, syncConfig)
+	if err != nil {
+		return "", utils.InvalidLSN, nil, fmt.Errorf("could not instantiate table: %w", err)
+	}
+	syncTbl.SetSyncConnFunc(r.pgSyncConn)
+
+	if err := r.fetchPgTablesInfo(tx); err != nil {
+		return "", utils.InvalidLSN, nil, fmt.Errorf("table check failed: %w", err)
+	}
+
+	published := false
+	for _, name := range r.oidName {
+		published = published || name == tblName
+	}
+	if !published {
+		return "", utils.InvalidLSN, nil, fmt.Errorf("table is not in %q publication", r.cfg.Postgres.PublicationName)
+	}
+
+	r.chTables[tblName] = tbl
+	r.tableLSN[tblName] = lsn
+	r.syncingTables[tblName] = struct{}{}
+
+	return slotName, lsn, syncTbl, nil
+}
+
+// directSyncConfig returns the copy of the table config syncing into the main table directly
+func directSyncConfig(tblConfig config.Table) config.Table {
+	syncConfig := tblConfig
+	syncConfig.InitSyncSkipBufferTable = true
+	syncConfig.PgColumns = make(map[string]config.PgColumn, len(tblConfig.PgColumns))
+	for name, pgCol := range tblConfig.PgColumns {
+		syncConfig.PgColumns[name] = pgCol
+	}
+
+	return syncConfig
+}
@@ -0,0 +1,174 @@
+package replicator
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/message"
+)
+
+// max time the ALTER of the replica identity waits for the lock of the table
+const replicaIdentityLockTimeout = "5s"
+
+// identityNeed is what the engines of the table need of the old rows of the updates and deletes
+type identityNeed int
+
+const (
+	needNothing identityNeed = iota // MergeTree: the old rows are not written
+	needKey                         // ReplacingMergeTree: the deleted rows are replaced by the key
+	needFullRow                     // CollapsingMergeTree, SummingMergeTree, AggregatingMergeTree: the old rows are cancelled
+)
+
+// identityNeed returns the most any of the clickhouse tables fed from the table needs of the old rows
+func (r *Replicator) identityNeed(tblName config.PgTableName) identityNeed {
+	tblCfg := r.cfg.Tables[tblName]
+
+	need := needNothing
+	for _, target := range append([]config.Table{tblCfg}, tblCfg.ExtraTargets...) {
+		switch target.Engine {
+		case config.CollapsingMergeTree, config.SummingMergeTree, config.AggregatingMergeTree:
+			return needFullRow
+		case config.ReplacingMergeTree:
+			need = needKey
+		}
+	}
+
+	return need
+}
+
+// replicaIdentityOK checks if the replica identity of the table, its partition or inheritance child gives the old rows
+// the engines of the table need: FULL, or the key the rest of the row is completed by from the row image cache,
+// the key alone for ReplacingMergeTree
+func (r *Replicator) replicaIdentityOK(tblName config.PgTableName, identity message.ReplicaIdentity) bool {
+	switch r.identityNeed(tblName) {
+	case needFullRow:
+		if identity == message.ReplicaIdentityFull {
+			return true
+		}
+
+		return identity != message.ReplicaIdentityNothing && r.cfg.Tables[tblName].RowImageCache > 0
+	case needKey:
+		return identity != message.ReplicaIdentityNothing
+	}
+
+	return true
+}
+
+// checkReplicaIdentity checks the replica identity of the relation, the table or its partition or inheritance child;
+// the ALTER TABLE statement fixing the one not good enough for the engines is kept for replicaIdentityError,
+// or only logged if replica_identity_check is warn
+func (r *Replicator) checkReplicaIdentity(tblName, relName config.PgTableName, identity message.ReplicaIdentity) {
+	if !r.replicaIdentityOK(tblName, identity) {
+		alter := fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY FULL;", relName.String())
+		// the index is of the table itself, its partitions and inheritance children have their own ones
+		if index := r.cfg.Tables[tblName].ReplicaIdentityIndex; index != "" && relName == tblName &&
+			r.replicaIdentityOK(tblName, message.ReplicaIdentityIndex) {
+			alter = fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY USING INDEX %s;", relName.String(), index)
+		}
+
+		if r.cfg.ReplicaIdentityCheck == config.ReplicaIdentityWarn {
+			r.log.Warn("replica identity does not give the old rows the engine needs, the updates and deletes are applied wrong",
+				"table", tblName.String(), "relation", relName.String(), "replica_identity", identity.String(),
+				"engine", r.cfg.Tables[tblName].Engine.String(), "run", alter)
+			return
+		}
+
+		r.identityAlters = append(r.identityAlters, alter)
+		return
+	}
+
+	if identity == message.ReplicaIdentityNothing {
+		r.log.Warn("table has NOTHING replica identity, postgres rejects its updates and deletes",
+			"table", tblName.String(), "relation", relName.String(),
+			"run", fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY DEFAULT;", relName.String()))
+	}
+}
+
+// identityError lists the ALTER TABLE statements fixing the replica identity of the relations
+type identityError struct {
+	alters []string
+}
+
+func (e *identityError) Error() string {
+	return fmt.Sprintf("replica identity of %d tables does not give the old rows their engines need, run:\n%s\n"+
+		"or set row_image_cache of the tables, replica_identity_check: alter to let pg2ch run them "+
+		"or replica_identity_check: warn to replicate the tables anyway", len(e.alters), strings.Join(e.alters, "\n"))
+}
+
+// replicaIdentityError returns the error listing the ALTER TABLE statements of the relations checked since
+// the last call the replica identity of which does not give the old rows the engines need
+func (r *Replicator) replicaIdentityError() error {
+	if len(r.identityAlters) == 0 {
+		return nil
+	}
+	alters := r.identityAlters
+	r.identityAlters = nil
+
+	return &identityError{alters: alters}
+}
+
+// alterReplicaIdentities runs the ALTER TABLE statements of the tables, partitions and inheritance children
+// lacking the replica identity before the start, so that their changes from then on have the old rows;
+// each one waits for the lock no longer than replicaIdentityLockTimeout, not to block the queries queued behind it
+func (r *Replicator) alterReplicaIdentities() error {
+	tx, err := r.pgBegin()
+	if err != nil {
+		return err
+	}
+
+	checkErr := r.fetchPgTablesInfo(tx)
+	if err := r.pgCommit(tx); err != nil {
+		return err
+	}
+
+	var idErr *identityError
+	if !errors.As(checkErr, &idErr) {
+		return checkErr
+	}
+
+	conn, err := r.pgSyncConn()
+	if err != nil {
+		return fmt.Errorf("could not connect to pg: %w", err)
+	}
+	defer conn.Close()
+
+	for i, alter := range idErr.alters {
+		if i > 0 {
+			select {
+			case <-r.ctx.Done():
+				return r.ctx.Err()
+			case <-time.After(r.cfg.ReplicaIdentityAlterInterval):
+			}
+		}
+
+		if err := alterReplicaIdentity(conn, alter); err != nil {
+			return fmt.Errorf("could not run %q, the pg user must own the table: %w", alter, err)
+		}
+		r.log.Info("altered replica identity", "query", alter)
+	}
+
+	return nil
+}
+
+func alterReplicaIdentity(conn *pgx.Conn, alter string) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("SET LOCAL lock_timeout = '%s'", replicaIdentityLockTimeout)); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(alter); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
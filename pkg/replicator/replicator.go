@@ -3,13 +3,16 @@ package replicator
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
-	"strconv"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,9 +22,17 @@ import (
 
 	"github.com/mkabilov/pg2ch/pkg/config"
 	"github.com/mkabilov/pg2ch/pkg/consumer"
+	"github.com/mkabilov/pg2ch/pkg/discovery"
 	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/rowstream"
+	"github.com/mkabilov/pg2ch/pkg/stats"
 	"github.com/mkabilov/pg2ch/pkg/tableengines"
+	"github.com/mkabilov/pg2ch/pkg/tokenizer"
 	"github.com/mkabilov/pg2ch/pkg/utils"
+	"github.com/mkabilov/pg2ch/pkg/utils/chutils"
+	"github.com/mkabilov/pg2ch/pkg/utils/deadletter"
+	"github.com/mkabilov/pg2ch/pkg/utils/expr"
+	"github.com/mkabilov/pg2ch/pkg/utils/logger"
 	"github.com/mkabilov/pg2ch/pkg/utils/tableinfo"
 )
 
@@ -31,78 +42,282 @@ const (
 	generationIDKey   = "generation_id"
 )
 
+var shutdownSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGABRT, syscall.SIGQUIT}
+
+var errSnapshotTooOld = errors.New("snapshot transaction of the sync is too old")
+
 type clickHouseTable interface {
 	Insert(lsn utils.LSN, new message.Row) (mergeIsNeeded bool, err error)
 	Update(lsn utils.LSN, old message.Row, new message.Row) (mergeIsNeeded bool, err error)
 	Delete(lsn utils.LSN, old message.Row) (mergeIsNeeded bool, err error)
 	SetTupleColumns([]message.Column)
+	NewColumns([]message.Column) []string
+	AddColumns(map[string]config.PgColumn, map[string]config.ChColumn) error
+	SetMergeProgressFunc(func(utils.LSN) error)
+	SetSyncConnFunc(func() (*pgx.Conn, error))
 	Truncate() error
 	Sync(*pgx.Tx) error
 	Init() error
+	Reconcile(tableLSN, confirmedLSN utils.LSN) (utils.LSN, error)
 	FlushToMainTable() error
+	WaitForMerges()
+	Release() bool
+	SerialGap() (int64, error)
+	CompareShadow() (rows, shadowOfRows uint64, match bool, err error)
+	SetShards(conns []*sql.DB, weights []int) error
+	DiscardTx(lsn utils.LSN)
+	RowConverter() *tableengines.RowConverter
+}
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision"`
+	GoVersion string `json:"go_version"`
 }
 
 type Replicator struct {
+	buildInfo BuildInfo
+
 	ctx      context.Context
 	cancel   context.CancelFunc
 	consumer consumer.Interface
 	cfg      config.Config
 	errCh    chan error
 
-	pgConn *pgx.Conn
-	chConn *sql.DB
+	pgConn     *pgx.Conn
+	chConn     *sql.DB
+	chShards   []*sql.DB // connections of the shards written directly
+	tokenizers map[string]*tokenizer.Tokenizer
+	discoverer *discovery.Discoverer
 
 	persStorage *diskv.Diskv
-
-	chTables     map[config.PgTableName]clickHouseTable
-	oidName      map[utils.OID]config.PgTableName
-	tempSlotName string
-
-	finalLSN utils.LSN
-	tableLSN map[config.PgTableName]utils.LSN
+	stats       *stats.Registry
+
+	chTables map[config.PgTableName]clickHouseTable
+	oidName  map[utils.OID]config.PgTableName
+
+	partitionRoots  map[utils.OID]config.PgTableName // configured partitioned tables
+	partitionOf     map[utils.OID]config.PgTableName // leaf partitions of the partitioned tables
+	partitionCount  map[config.PgTableName]int       // number of leaf partitions of the partitioned tables
+	inheritRoots    map[utils.OID]config.PgTableName // configured tables replicated with their inheritance children
+	inheritedOf     map[utils.OID]config.PgTableName // inheritance children of those tables
+	relColumns      map[utils.OID][]message.Column   // tuple columns of the relations from the relation messages
+	tupleColumnsOID map[config.PgTableName]utils.OID // relation the current tuple columns of the table come from
+
+	workers          []*applyWorker                   // apply workers of the tables, nil if the changes are applied in place
+	generations      map[config.PgTableName]*uint64   // generation ids read by the tables applied by the workers
+	dispatched       map[config.PgTableName]utils.LSN // lsn of the last change of the table passed to its worker
+	pendingCommits   []*pendingCommit                 // transactions being applied by the workers, in the commit order
+	appliedLSN       utils.LSN                        // last transaction applied by all the workers
+	groupMergeNeeded bool                             // tables of the groups are to be flushed after the commit
+	apply            applyState
+
+	finalLSN         utils.LSN
+	committedLSN     utils.LSN // final lsn of the last committed transaction, the ones sent again after the reconnect are skipped
+	tableLSN         map[config.PgTableName]utils.LSN
+	slotConfirmedLSN utils.LSN // confirmed flush lsn of the replication slot at startup
+	slotLSN          utils.LSN // lsn the replication slot was last advanced to
+	savedSlotLSN     utils.LSN // slot lsn of the last saved state, the slot is confirmed up to it only
+	stateMutex       sync.Mutex
+	stateSeq         uint64 // sequence number of the last written state
+	legacyState      bool   // the state is in the per table keys of the older versions
 
 	inTx               bool // indicates if we're inside tx
 	tablesToMergeMutex *sync.Mutex
-	tablesToMerge      map[config.PgTableName]struct{} // tables to be merged
-	inTxTables         map[config.PgTableName]struct{} // tables inside running tx
-	curTxMergeIsNeeded bool                            // if tables in the current transaction are needed to be merged
-	generationID       uint64
+	syncMutex          *sync.Mutex                         // guards chTables and tableLSN during the concurrent initial sync
+	tablesToMerge      map[config.PgTableName]struct{}     // tables to be merged
+	inTxTables         map[config.PgTableName]struct{}     // tables inside running tx
+	syncingTables      map[config.PgTableName]struct{}     // tables added at runtime, streamed to the buffer table during the sync
+	frozen             map[config.PgTableName]*frozenSpool // tables the changes of which are kept on disk, not applied
+	lastChange         map[config.PgTableName]time.Time    // time of the last change of the tables, for the idle reaping
+	released           map[config.PgTableName]struct{}     // idle tables with the resources released
+	reloading          int32                               // reload of the tables is running, accessed atomically
+	flushRequested     int32                               // flush of the tables is requested via the admin api, accessed atomically
+	curTxMergeIsNeeded bool                                // if tables in the current transaction are needed to be merged
+	generationID       uint64                              // accessed atomically, the tables being synced read it
+	publishID          uint64                              // id of the last flush to the main tables stored in the publish ids system table
+	jsonl              *jsonlSink                          // JSON lines output of the row changes, nil if disabled
+	rowStream          *rowstream.Server                   // gRPC stream of the row changes, nil if disabled
+	streamEvents       []*rowstream.RowEvent               // row changes of the current transaction published on the commit
+	streamCommitTime   time.Time                           // commit time of the current transaction
+	deadLetter         *deadletter.Writer                  // rows skipped by the dead_letter overflow policy, nil if disabled
+	chSchema           *tableinfo.ChSchema                 // columns of the clickhouse tables, fetched at startup and after the DDL
+	identityAlters     []string                            // ALTER TABLE statements of the relations lacking the replica identity
+	chVersion          chutils.Version                     // version of the clickhouse server, the oldest one of the shards
+	pgVersion          int                                 // server_version_num of the postgresql server
 	isEmptyTx          bool
+	origins            map[string]struct{} // replication origins the transactions are replicated from, nil for all
+	skipTx             bool                // the transaction comes from the origin not replicated
+	log                *slog.Logger
 }
 
-func New(cfg config.Config) *Replicator {
+func New(cfg config.Config, buildInfo BuildInfo) *Replicator {
 	r := Replicator{
 		cfg:      cfg,
 		chTables: make(map[config.PgTableName]clickHouseTable),
 		oidName:  make(map[utils.OID]config.PgTableName),
 		errCh:    make(chan error),
+		stats:    stats.New(),
+		discoverer: discovery.New(cfg.Postgres.Hosts, cfg.Postgres.TargetSessionAttrs,
+			cfg.Postgres.PatroniURLs),
 
 		tablesToMergeMutex: &sync.Mutex{},
+		syncMutex:          &sync.Mutex{},
 		tablesToMerge:      make(map[config.PgTableName]struct{}),
 		inTxTables:         make(map[config.PgTableName]struct{}),
+		syncingTables:      make(map[config.PgTableName]struct{}),
+		frozen:             make(map[config.PgTableName]*frozenSpool),
+		lastChange:         make(map[config.PgTableName]time.Time),
+		released:           make(map[config.PgTableName]struct{}),
 		tableLSN:           make(map[config.PgTableName]utils.LSN),
+
+		partitionOf:     make(map[utils.OID]config.PgTableName),
+		partitionCount:  make(map[config.PgTableName]int),
+		inheritedOf:     make(map[utils.OID]config.PgTableName),
+		relColumns:      make(map[utils.OID][]message.Column),
+		tupleColumnsOID: make(map[config.PgTableName]utils.OID),
+
+		workers:     newApplyWorkers(cfg.ApplyWorkers),
+		generations: make(map[config.PgTableName]*uint64),
+		dispatched:  make(map[config.PgTableName]utils.LSN),
+		appliedLSN:  utils.InvalidLSN,
+
+		buildInfo: buildInfo,
+		log:       logger.For("replicator"),
 	}
 	r.ctx, r.cancel = context.WithCancel(context.Background())
 
+	r.tokenizers = make(map[string]*tokenizer.Tokenizer, len(cfg.Tokenizers))
+	for name, tok := range cfg.Tokenizers {
+		r.tokenizers[name] = tokenizer.New(tok.URL, tok.BatchSize, tok.CacheSize, tok.Timeout)
+	}
+
 	return &r
 }
 
 func (r *Replicator) newTable(tblName config.PgTableName, tblConfig config.Table) (clickHouseTable, error) {
+	tbl, err := r.newSourceTable(tblName, tblConfig)
+	if err != nil || tblConfig.RowImageCache == 0 {
+		return tbl, err
+	}
+
+	var lookup *rowLookup
+	if tblConfig.RowLookupBatchSize > 0 {
+		lookup = newRowLookup(r.ctx, tblName, tblConfig, r.stats.Table(tblName.String()))
+	}
+
+	return newRowImageTable(tbl, tblConfig.RowImageCache, r.stats.Table(tblName.String()), lookup), nil
+}
+
+// newSourceTable instantiates the table writing into the main table and the extra targets
+func (r *Replicator) newSourceTable(tblName config.PgTableName, tblConfig config.Table) (clickHouseTable, error) {
+	generationID := r.generationOf(tblName)
+
+	tbl, err := r.newTargetTable(tblName.String(), tblConfig, generationID)
+	if err != nil || len(tblConfig.ExtraTargets) == 0 {
+		return tbl, err
+	}
+
+	targets := []clickHouseTable{tbl}
+	for _, targetConfig := range tblConfig.ExtraTargets {
+		target, err := r.newTargetTable(tblName.String()+"@"+targetConfig.ChMainTable, targetConfig, generationID)
+		if err != nil {
+			return nil, fmt.Errorf("extra target %q: %w", targetConfig.ChMainTable, err)
+		}
+		targets = append(targets, target)
+	}
+
+	return newMultiTable(targets), nil
+}
+
+// newTargetTable instantiates the table writing into a single main table, its stats are kept under statsName
+func (r *Replicator) newTargetTable(statsName string, tblConfig config.Table, generationID *uint64) (clickHouseTable, error) {
+	tbl, err := r.newEngineTable(statsName, tblConfig, generationID)
+	if err != nil {
+		return nil, err
+	}
+
+	if tblConfig.ShardingKey != "" {
+		weights := make([]int, len(r.cfg.ClickHouse.Shards))
+		for i, shard := range r.cfg.ClickHouse.Shards {
+			weights[i] = shard.Weight
+		}
+
+		if err := tbl.SetShards(r.chShards, weights); err != nil {
+			return nil, err
+		}
+	}
+
+	if tblConfig.RowFilterExpr != nil {
+		tbl = newFilteredTable(tbl, tblConfig.RowFilterExpr)
+	}
+
+	return tbl, nil
+}
+
+func (r *Replicator) newEngineTable(statsName string, tblConfig config.Table, generationID *uint64) (clickHouseTable,
+	error) {
+	tblStats := r.stats.Table(statsName)
+
 	switch tblConfig.Engine {
 	case config.ReplacingMergeTree:
 		if tblConfig.VerColumn == "" && tblConfig.GenerationColumn == "" {
 			return nil, fmt.Errorf("ReplacingMergeTree requires either version or generation column to be set")
 		}
 
-		return tableengines.NewReplacingMergeTree(r.ctx, r.chConn, tblConfig, &r.generationID), nil
+		return tableengines.NewReplacingMergeTree(r.ctx, r.chConn, tblConfig, generationID, tblStats), nil
 	case config.CollapsingMergeTree:
 		if tblConfig.SignColumn == "" {
 			return nil, fmt.Errorf("CollapsingMergeTree requires sign column to be set")
 		}
 
-		return tableengines.NewCollapsingMergeTree(r.ctx, r.chConn, tblConfig, &r.generationID), nil
+		switch tblConfig.SignColumnType {
+		case utils.ChInt8, utils.ChInt16, utils.ChInt32, utils.ChInt64:
+		default:
+			return nil, fmt.Errorf("sign column must be of signed integer type, got %q", tblConfig.SignColumnType)
+		}
+
+		return tableengines.NewCollapsingMergeTree(r.ctx, r.chConn, tblConfig, generationID, tblStats), nil
 	case config.MergeTree:
-		return tableengines.NewMergeTree(r.ctx, r.chConn, tblConfig, &r.generationID), nil
+		return tableengines.NewMergeTree(r.ctx, r.chConn, tblConfig, generationID, tblStats), nil
+	case config.SummingMergeTree, config.AggregatingMergeTree:
+		for pgColName, prop := range tblConfig.ColumnProperties {
+			if !prop.Delta {
+				continue
+			}
+
+			chCol, ok := tblConfig.ColumnMapping[pgColName]
+			if !ok {
+				return nil, fmt.Errorf("delta column %q is not replicated", pgColName)
+			}
+
+			switch chCol.BaseType {
+			case utils.ChInt8, utils.ChInt16, utils.ChInt32, utils.ChInt64, utils.ChFloat32, utils.ChFloat64, utils.ChDecimal:
+			default:
+				return nil, fmt.Errorf("delta column %q must be of signed numeric type, got %q", pgColName, chCol.BaseType)
+			}
+		}
+
+		if tblConfig.Engine == config.SummingMergeTree {
+			// SummingMergeTree keeps the values of an arbitrary row for the columns it does not sum
+			pgColNames := make([]string, 0, len(tblConfig.ColumnMapping))
+			for pgColName := range tblConfig.ColumnMapping {
+				pgColNames = append(pgColNames, pgColName)
+			}
+			sort.Strings(pgColNames)
+
+			for _, pgColName := range pgColNames {
+				if tblConfig.PgColumns[pgColName].PkCol > 0 || tblConfig.ColumnProperties[pgColName].Delta {
+					continue
+				}
+
+				return nil, fmt.Errorf("column %q of SummingMergeTree table is neither a key nor a delta column, "+
+					"use AggregatingMergeTree with SimpleAggregateFunction(anyLast, T) column for it", pgColName)
+			}
+		}
+
+		return tableengines.NewSummingMergeTree(r.ctx, r.chConn, tblConfig, generationID, tblStats), nil
 	}
 
 	return nil, fmt.Errorf("%s table engine is not implemented", tblConfig.Engine)
@@ -117,7 +332,7 @@ func (r *Replicator) checkPgSlotAndPub(tx *pgx.Tx) error {
 		r.cfg.Postgres.ReplicationSlotName, r.cfg.Postgres.PublicationName).Scan(&slotExists, &pubExists)
 
 	if err != nil {
-		return fmt.Errorf("could not query: %v", err)
+		return fmt.Errorf("could not query: %w", err)
 	}
 
 	errMsg := ""
@@ -134,84 +349,195 @@ func (r *Replicator) checkPgSlotAndPub(tx *pgx.Tx) error {
 	}
 
 	if errMsg != "" {
-		return fmt.Errorf(errMsg)
+		return fmt.Errorf("%s", errMsg)
 	}
 
 	return nil
 }
 
+// initAndSyncTables instantiates the tables and syncs the ones without a stored lsn position;
+// up to sync_workers tables are synced concurrently, each extra worker uses its own replication connection
 func (r *Replicator) initAndSyncTables() error {
-	for tblName := range r.cfg.Tables {
-		var (
-			lsn utils.LSN
-			err error
-		)
+	defer r.cancelOnSignal()()
 
-		tx, err := r.pgBegin()
-		if err != nil {
-			return err
-		}
+	var (
+		wg       sync.WaitGroup
+		errMutex sync.Mutex
+		syncErr  error
+	)
 
-		if _, ok := r.tableLSN[tblName]; !ok {
-			lsn, err = r.pgCreateTempRepSlot(tx, tblName) // create temp repl slot must the first command in the tx
-			if err != nil {
-				return fmt.Errorf("could not create temporary replication slot: %v", err)
-			}
-		}
+	setErr := func(err error) {
+		errMutex.Lock()
+		defer errMutex.Unlock()
 
-		tblConfig, err := r.fetchTableConfig(tx, tblName)
-		if err != nil {
-			return fmt.Errorf("could not get %s table config: %v", tblName.String(), err)
+		// the syncs of the other tables fail with the cancellation, maybe first, once one is aborted
+		if syncErr == nil || errors.Is(err, errSnapshotTooOld) && !errors.Is(syncErr, errSnapshotTooOld) {
+			syncErr = err
 		}
-		tblConfig.PgTableName = tblName
+	}
+	failed := func() bool {
+		errMutex.Lock()
+		defer errMutex.Unlock()
 
-		tbl, err := r.newTable(tblName, tblConfig)
-		if err != nil {
-			return fmt.Errorf("could not instantiate table: %v", err)
-		}
+		return syncErr != nil
+	}
+
+	workers := r.cfg.SyncWorkers
+	if workers > len(r.cfg.Tables) {
+		workers = len(r.cfg.Tables)
+	}
+	if workers > 1 {
+		r.log.Info("syncing tables concurrently", "tables", len(r.cfg.Tables), "workers", workers)
+	}
 
-		if err := tbl.Init(); err != nil {
-			return fmt.Errorf("could not init %s: %v", tblName.String(), err)
+	notSynced := make([]config.PgTableName, 0)
+	for tblName := range r.cfg.Tables {
+		if _, ok := r.tableLSN[tblName]; !ok {
+			notSynced = append(notSynced, tblName)
 		}
+	}
+	defer r.showSyncProgress(notSynced)()
 
-		r.chTables[tblName] = tbl
+	tables := make(chan config.PgTableName)
+	for i := 0; i < workers; i++ {
+		conn := r.pgConn
+		if i > 0 {
+			var err error
 
-		if _, ok := r.tableLSN[tblName]; ok {
-			if err := tx.Commit(); err != nil {
-				return err
+			if conn, err = r.pgReplicationConn(); err != nil {
+				setErr(fmt.Errorf("could not connect to postgresql: %w", err))
+				break
 			}
-
-			continue
 		}
 
-		if err := tbl.Sync(tx); err != nil {
-			return fmt.Errorf("could not sync %s: %v", tblName.String(), err)
-		}
+		wg.Add(1)
+		go func(conn *pgx.Conn, closeConn bool) {
+			defer wg.Done()
+			if closeConn {
+				defer func() {
+					if err := conn.Close(); err != nil {
+						r.log.Warn("could not close connection to postgresql", "error", err)
+					}
+				}()
+			}
 
-		r.tableLSN[tblName] = lsn
-		if err := r.persStorage.Write(tableLSNKeyPrefix+tblName.String(), lsn.Bytes()); err != nil {
-			return fmt.Errorf("could not store lsn for table %s", tblName.String())
-		}
+			for tblName := range tables {
+				if err := r.initAndSyncTable(conn, tblName); err != nil {
+					setErr(err)
+				}
+			}
+		}(conn, i > 0)
+	}
 
-		if err := r.pgDropRepSlot(tx); err != nil {
-			return fmt.Errorf("could not drop replication slot: %v", err)
+	for tblName := range r.cfg.Tables {
+		if failed() {
+			break
 		}
 
-		if err := tx.Commit(); err != nil {
-			return err
+		if err := r.ctx.Err(); err != nil {
+			setErr(fmt.Errorf("sync interrupted: %w", err))
+			break
 		}
+
+		tables <- tblName
+	}
+	close(tables)
+	wg.Wait()
+
+	if syncErr != nil {
+		return syncErr
 	}
 	r.incrementGeneration()
 
 	return nil
 }
 
+// initAndSyncTable instantiates the table and syncs it within the snapshot of a temporary replication slot
+// created on conn, unless the table already has a stored lsn position
+func (r *Replicator) initAndSyncTable(conn *pgx.Conn, tblName config.PgTableName) error {
+	var (
+		lsn      utils.LSN
+		slotName string
+	)
+
+	r.syncMutex.Lock()
+	_, synced := r.tableLSN[tblName]
+	r.syncMutex.Unlock()
+
+	tx, err := r.pgBeginConn(conn)
+	if err != nil {
+		return err
+	}
+
+	if !synced {
+		slotName, lsn, err = r.pgCreateTempRepSlot(tx, tblName) // create temp repl slot must the first command in the tx
+		if err != nil {
+			return fmt.Errorf("could not create temporary replication slot: %w", err)
+		}
+	}
+
+	tblConfig, err := r.fetchTableConfig(tx, tblName)
+	if err != nil {
+		return fmt.Errorf("could not get %s table config: %w", tblName.String(), err)
+	}
+	tblConfig.PgTableName = tblName
+
+	tbl, err := r.newTable(tblName, tblConfig)
+	if err != nil {
+		return fmt.Errorf("could not instantiate table: %w", err)
+	}
+
+	r.syncMutex.Lock()
+	err = r.initTable(tblName, tbl)
+	r.syncMutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("could not init %s: %w", tblName.String(), err)
+	}
+	tbl.SetMergeProgressFunc(r.mergeProgressFunc(tblName))
+	tbl.SetSyncConnFunc(r.pgSyncConn)
+
+	r.syncMutex.Lock()
+	r.chTables[tblName] = tbl
+	r.syncMutex.Unlock()
+
+	if synced {
+		return tx.Commit()
+	}
+
+	stopWatch := r.watchSnapshotAge(tblName)
+	err = tbl.Sync(tx)
+	if abortErr := stopWatch(); abortErr != nil {
+		err = abortErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not sync %s: %w", tblName.String(), err)
+	}
+	r.reportSync(tblName, tblConfig)
+
+	r.syncMutex.Lock()
+	err = r.storeTableLSN(tblName, lsn)
+	r.syncMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := r.pgDropRepSlot(tx, slotName); err != nil {
+		return fmt.Errorf("could not drop replication slot: %w", err)
+	}
+
+	return tx.Commit()
+}
+
 func (r *Replicator) pgBegin() (*pgx.Tx, error) {
-	tx, err := r.pgConn.BeginEx(r.ctx, &pgx.TxOptions{
+	return r.pgBeginConn(r.pgConn)
+}
+
+func (r *Replicator) pgBeginConn(conn *pgx.Conn) (*pgx.Tx, error) {
+	tx, err := conn.BeginEx(r.ctx, &pgx.TxOptions{
 		IsoLevel:   pgx.RepeatableRead,
 		AccessMode: pgx.ReadOnly})
 	if err != nil {
-		return nil, fmt.Errorf("could not start pg transaction: %v", err)
+		return nil, fmt.Errorf("could not start pg transaction: %w", err)
 	}
 
 	return tx, nil
@@ -221,76 +547,139 @@ func (r *Replicator) pgCommit(tx *pgx.Tx) error {
 	return tx.Commit()
 }
 
-func (r *Replicator) readPersStorage() error {
-	for key := range r.persStorage.Keys(nil) {
-		if !strings.HasPrefix(key, tableLSNKeyPrefix) {
-			continue
-		}
-		if !r.persStorage.Has(key) {
-			continue
-		}
-		val, err := r.persStorage.Read(key)
+func (r *Replicator) initTables(tx *pgx.Tx) error {
+	for tblName := range r.cfg.Tables {
+		tblConfig, err := r.fetchTableConfig(tx, tblName)
 		if err != nil {
-			return fmt.Errorf("could not read %v key: %v", err)
+			return fmt.Errorf("could not get %s table config: %w", tblName.String(), err)
 		}
+		tblConfig.PgTableName = tblName
 
-		tblName := &config.PgTableName{}
-		if err := tblName.Parse(key[len(tableLSNKeyPrefix):]); err != nil {
-			return err
+		tbl, err := r.newTable(tblName, tblConfig)
+		if err != nil {
+			return fmt.Errorf("could not instantiate table: %w", err)
 		}
 
-		lsn := utils.InvalidLSN
-		if err := lsn.Parse(string(val)); err != nil {
-			return fmt.Errorf("could not parse lsn %q: %v", string(val), err)
+		if err := r.initTable(tblName, tbl); err != nil {
+			return fmt.Errorf("could not init %s: %w", tblName.String(), err)
 		}
+		tbl.SetMergeProgressFunc(r.mergeProgressFunc(tblName))
 
-		r.tableLSN[*tblName] = lsn
-		log.Printf("consuming changes for table %s starting from %v lsn position", tblName.String(), lsn)
+		r.chTables[tblName] = tbl
 	}
 
-	if !r.persStorage.Has(generationIDKey) {
-		return nil
+	return nil
+}
+
+// initTable initializes the table; for the already synced tables leftovers of the buffer table are reconciled
+func (r *Replicator) initTable(tblName config.PgTableName, tbl clickHouseTable) error {
+	lsn, ok := r.tableLSN[tblName]
+	if !ok {
+		return tbl.Init()
 	}
 
-	val, err := r.persStorage.Read(generationIDKey)
+	movedLSN, err := tbl.Reconcile(lsn, r.slotConfirmedLSN)
 	if err != nil {
-		return fmt.Errorf("could not read generation id: %v", err)
+		return fmt.Errorf("could not reconcile buffer table: %w", err)
 	}
 
-	genID, err := strconv.ParseUint(string(val), 10, 32)
-	if err != nil {
-		log.Printf("incorrect value for generation_id in the pers storage: %v", err)
+	if movedLSN <= lsn {
+		return nil
+	}
+
+	return r.storeTableLSN(tblName, movedLSN)
+}
+
+// mergeProgressFunc returns function storing the lsn up to which the buffer table rows are moved to the main table,
+// so the merge interrupted by a restart is not applied twice: the stream is skipped up to the table lsn
+func (r *Replicator) mergeProgressFunc(tblName config.PgTableName) func(utils.LSN) error {
+	return func(lsn utils.LSN) error {
+		return r.persistTableLSN(tblName, lsn)
 	}
+}
+
+// storeTableLSN sets the lsn the table is consistent with and saves it to the persistent storage,
+// all the seen changes of the table are considered applied
+func (r *Replicator) storeTableLSN(tblName config.PgTableName, lsn utils.LSN) error {
+	r.stats.Table(tblName.String()).CommitApplied()
+
+	return r.persistTableLSN(tblName, lsn)
+}
+
+// applyTableLSN is storeTableLSN of the tables saved at once with the next state
+func (r *Replicator) applyTableLSN(tblName config.PgTableName, lsn utils.LSN) {
+	r.stats.Table(tblName.String()).CommitApplied()
+	r.setTableLSN(tblName, lsn)
+}
+
+// persistTableLSN sets the lsn the table is consistent with and saves it to the persistent storage
+func (r *Replicator) persistTableLSN(tblName config.PgTableName, lsn utils.LSN) error {
+	r.setTableLSN(tblName, lsn)
 
-	r.generationID = uint64(genID)
-	log.Printf("generation_id: %v", r.generationID)
+	if err := r.saveState(); err != nil {
+		return fmt.Errorf("could not store lsn for table %s: %w", tblName.String(), err)
+	}
 
 	return nil
 }
 
-func (r *Replicator) initTables(tx *pgx.Tx) error {
-	for tblName := range r.cfg.Tables {
-		tblConfig, err := r.fetchTableConfig(tx, tblName)
-		if err != nil {
-			return fmt.Errorf("could not get %s table config: %v", tblName.String(), err)
-		}
-		tblConfig.PgTableName = tblName
+// setTableLSN sets the lsn the table is consistent with, it is saved with the next state
+func (r *Replicator) setTableLSN(tblName config.PgTableName, lsn utils.LSN) {
+	r.stateMutex.Lock()
+	r.tableLSN[tblName] = lsn
+	r.stateMutex.Unlock()
+	atomic.StoreUint64(&r.stats.Table(tblName.String()).LSN, uint64(lsn))
+}
 
-		tbl, err := r.newTable(tblName, tblConfig)
-		if err != nil {
-			return fmt.Errorf("could not instantiate table: %v", err)
-		}
+// forgetTableLSN drops the lsn of the table, so it is synced again, and saves the state
+func (r *Replicator) forgetTableLSN(tblName config.PgTableName) error {
+	delete(r.tableLSN, tblName)
 
-		if err := tbl.Init(); err != nil {
-			return fmt.Errorf("could not init %s: %v", tblName.String(), err)
-		}
+	return r.saveState()
+}
 
-		r.chTables[tblName] = tbl
+func (r *Replicator) fetchSlotConfirmedLSN(tx *pgx.Tx) error {
+	var confirmedLSN sql.NullString
+
+	err := tx.QueryRow("select confirmed_flush_lsn::text from pg_replication_slots where slot_name = $1",
+		r.cfg.Postgres.ReplicationSlotName).Scan(&confirmedLSN)
+	if err != nil {
+		return fmt.Errorf("could not query: %w", err)
+	}
+
+	if !confirmedLSN.Valid {
+		r.slotConfirmedLSN = utils.InvalidLSN
+		return nil
+	}
+
+	if err := r.slotConfirmedLSN.Parse(confirmedLSN.String); err != nil {
+		return fmt.Errorf("could not parse confirmed flush lsn %q: %w", confirmedLSN.String, err)
 	}
 
 	return nil
 }
 
+// checkSlotPosition makes sure the slot is not ahead of the lsn it was last advanced to by pg2ch, as stored
+// in the state, e.g. after the slot was recreated manually, otherwise the changes in between would be silently lost
+func (r *Replicator) checkSlotPosition() error {
+	if !r.slotConfirmedLSN.IsValid() || !r.slotLSN.IsValid() || r.cfg.Inspect {
+		return nil
+	}
+
+	if r.slotConfirmedLSN <= r.slotLSN {
+		return nil
+	}
+
+	msg := fmt.Sprintf("confirmed lsn %v of the %q slot is ahead of the lsn %v it was advanced to by pg2ch",
+		r.slotConfirmedLSN, r.cfg.Postgres.ReplicationSlotName, r.slotLSN)
+	if r.cfg.ForceStart {
+		r.log.Warn(msg + ", starting anyway")
+		return nil
+	}
+
+	return fmt.Errorf("%s, changes in between are lost; run with --force to start anyway", msg)
+}
+
 func (r *Replicator) minLSN() utils.LSN {
 	result := utils.InvalidLSN
 	if len(r.tableLSN) == 0 {
@@ -309,15 +698,23 @@ func (r *Replicator) minLSN() utils.LSN {
 func (r *Replicator) pgCheck() error {
 	tx, err := r.pgBegin()
 	if err != nil {
-		return fmt.Errorf("could not begin: %v", err)
+		return fmt.Errorf("could not begin: %w", err)
 	}
 
 	if err := r.checkPgSlotAndPub(tx); err != nil {
 		return err
 	}
 
+	if err := r.fetchSlotConfirmedLSN(tx); err != nil {
+		return fmt.Errorf("could not get confirmed lsn of the slot: %w", err)
+	}
+
+	if err := r.resolveOrigins(tx); err != nil {
+		return fmt.Errorf("could not resolve origins: %w", err)
+	}
+
 	if err := r.pgCommit(tx); err != nil {
-		return fmt.Errorf("could not commit: %v", err)
+		return fmt.Errorf("could not commit: %w", err)
 	}
 
 	return nil
@@ -329,40 +726,108 @@ func (r *Replicator) Run() error {
 		err error
 	)
 
-	r.persStorage = diskv.New(diskv.Options{
-		BasePath:     r.cfg.PersStoragePath,
-		CacheSizeMax: 1024 * 1024, // 1MB
-	})
+	r.persStorage = openPersStorage(r.cfg.PersStoragePath)
+
+	r.log.Info("starting pg2ch", "version", r.buildInfo.Version, "revision", r.buildInfo.Revision,
+		"go_version", r.buildInfo.GoVersion, "config_fingerprint", r.cfg.Fingerprint(),
+		"features", strings.Join(r.cfg.Features(), ", "))
+
+	if r.cfg.Inspect {
+		r.log.Warn("inspection mode: nothing is written to clickhouse and the replication slot is not advanced")
+	}
+
+	if r.cfg.DeadLetterPath != "" {
+		if r.deadLetter, err = deadletter.Open(r.cfg.DeadLetterPath); err != nil {
+			return fmt.Errorf("could not open dead letter file: %w", err)
+		}
+		defer func() {
+			if err := r.deadLetter.Close(); err != nil {
+				r.log.Warn("could not close dead letter file", "error", err)
+			}
+		}()
+	}
 
 	if err := r.pgConnect(); err != nil {
-		return fmt.Errorf("could not connect to postgresql: %v", err)
+		return fmt.Errorf("could not connect to postgresql: %w", err)
 	}
 	defer r.pgDisconnect()
+	if err := r.pgProbeVersion(); err != nil {
+		return err
+	}
 	if err := r.pgCheck(); err != nil {
 		return err
 	}
+	if r.cfg.ReplicaIdentityCheck == config.ReplicaIdentityAlter {
+		if err := r.alterReplicaIdentities(); err != nil {
+			return fmt.Errorf("could not alter replica identity: %w", err)
+		}
+	}
+
+	if err := r.checkFailoverSlot(); err != nil {
+		return fmt.Errorf("failover slot check failed: %w", err)
+	}
+
+	if err := r.readState(); err != nil {
+		return fmt.Errorf("could not get start lsn positions: %w", err)
+	}
+
+	// before anything is written to clickhouse
+	if err := r.checkSlotPosition(); err != nil {
+		return err
+	}
 
 	if err := r.chConnect(); err != nil {
-		return fmt.Errorf("could not connect to clickhouse: %v", err)
+		return fmt.Errorf("could not connect to clickhouse: %w", err)
 	}
 	defer r.chDisconnect()
+	go r.diagnosticsOnSignal()
 
-	if err := r.readPersStorage(); err != nil {
-		return fmt.Errorf("could not get start lsn positions: %v", err)
+	if err := r.createSystemTables(); err != nil {
+		return fmt.Errorf("could not create system tables: %w", err)
+	}
+
+	if err := r.chSchema.Load(r.chTableNames()); err != nil {
+		return fmt.Errorf("could not load clickhouse tables schema: %w", err)
+	}
+
+	if err := r.loadPublishID(); err != nil {
+		return fmt.Errorf("could not load last publish id: %w", err)
+	}
+
+	if err := r.resetResyncTables(); err != nil {
+		return fmt.Errorf("could not reset tables to resync: %w", err)
+	}
+
+	if err := r.startFromTimestamp(); err != nil {
+		return fmt.Errorf("could not find start position: %w", err)
 	}
 
 	syncNeeded := false
 	for tblName := range r.cfg.Tables {
 		if _, ok := r.tableLSN[tblName]; !ok {
 			syncNeeded = true
-			break
 		}
 	}
 
 	if syncNeeded {
+		notSynced := make([]config.PgTableName, 0)
+		for tblName := range r.cfg.Tables {
+			if _, ok := r.tableLSN[tblName]; !ok {
+				notSynced = append(notSynced, tblName)
+			}
+		}
+
+		if err := r.checkResyncCost(notSynced); err != nil {
+			return err
+		}
+
+		r.stats.SetState(stats.StateSyncing)
 		// in case of init sync, the replication slot must be created, which must be called before any query
 		if err := r.initAndSyncTables(); err != nil {
-			return fmt.Errorf("could not sync tables: %v", err)
+			if r.ctx.Err() != nil {
+				r.log.Warn("initial sync aborted, not synced tables will be synced again on the next start")
+			}
+			return fmt.Errorf("could not sync tables: %w", err)
 		}
 
 		tx, err = r.pgBegin()
@@ -376,52 +841,219 @@ func (r *Replicator) Run() error {
 		}
 
 		if err := r.initTables(tx); err != nil {
-			return fmt.Errorf("could not init tables: %v", err)
+			return fmt.Errorf("could not init tables: %w", err)
 		}
 	}
 
 	if err := r.fetchPgTablesInfo(tx); err != nil {
-		return fmt.Errorf("table check failed: %v", err)
+		return fmt.Errorf("table check failed: %w", err)
 	}
 
 	if err := r.pgCommit(tx); err != nil {
 		return err
 	}
 
-	r.finalLSN = r.minLSN()
-	r.consumer = consumer.New(r.ctx, r.errCh, r.cfg.Postgres.ConnConfig,
-		r.cfg.Postgres.ReplicationSlotName, r.cfg.Postgres.PublicationName, r.finalLSN)
+	if r.cfg.JSONLOutput != "" {
+		if r.jsonl, err = newJSONLSink(r.cfg.JSONLOutput); err != nil {
+			return fmt.Errorf("could not open json lines output: %w", err)
+		}
+		defer func() {
+			if err := r.jsonl.close(); err != nil {
+				r.log.Warn("could not close json lines output", "error", err)
+			}
+		}()
+	}
 
-	if err := r.consumer.Run(r); err != nil {
+	if r.cfg.GRPC.Bind != "" {
+		if r.rowStream, err = rowstream.NewServer(r.cfg.GRPC.RetainedEvents,
+			filepath.Join(r.cfg.PersStoragePath, rowStreamLog)); err != nil {
+			return fmt.Errorf("could not start row stream: %w", err)
+		}
+		defer func() {
+			if err := r.rowStream.Close(); err != nil {
+				r.log.Warn("could not close row stream event log", "error", err)
+			}
+		}()
+	}
+
+	r.finalLSN = r.minLSN()
+	if err := r.startConsumer(); err != nil {
 		return err
 	}
 
 	go r.logErrCh()
 	go r.inactivityMerge()
+	go r.chPing()
+	r.startApplyWorkers()
+	defer r.stopApplyWorkers()
 
-	if r.cfg.RedisBind != "" {
-		go r.redisServer()
+	if r.cfg.IdleTableTimeout > 0 {
+		go r.idleReaper()
 	}
 
-	r.waitForShutdown()
-	r.cancel()
-	r.consumer.Wait()
-
-	for tblName, tbl := range r.chTables {
+	for _, tblCfg := range r.cfg.Tables {
+		if tblCfg.SerialGapColumn != "" {
+			go r.serialGapCheck()
+			break
+		}
+	}
+
+	for _, tblCfg := range r.cfg.Tables {
+		if tblCfg.ShadowOf != "" {
+			go r.shadowCompare()
+			break
+		}
+	}
+
+	if r.cfg.RedisBind != "" {
+		go r.redisServer()
+	}
+
+	if r.cfg.AdminBind != "" {
+		go r.adminServer()
+	}
+
+	if r.cfg.Metrics.Bind != "" {
+		go r.metricsServer()
+	}
+
+	if r.rowStream != nil {
+		go r.grpcServer()
+	}
+	go r.reloadOnSignal()
+
+	for {
+		err := r.waitForShutdown()
+		if err == nil {
+			break
+		}
+
+		if err == consumer.ErrSlotMissing && r.cfg.Postgres.SlotMissingPolicy == config.SlotRecreate {
+			r.log.Warn("replication slot is missing, recreating it and resyncing the tables",
+				"slot", r.cfg.Postgres.ReplicationSlotName)
+
+			if err = r.recreateSlotAndResync(); err == nil {
+				continue
+			}
+		}
+
+		r.stats.SetState(stats.StateHalted)
+		r.cancel()
+		r.consumer.Wait()
+
+		return fmt.Errorf("replication halted: %w", err)
+	}
+
+	r.cancel()
+	r.consumer.Wait()
+
+	// the consumer is stopped, nothing is dispatched anymore and the workers are still running
+	if err := r.drainWorkersCtx(context.Background()); err != nil {
+		return fmt.Errorf("could not apply changes: %w", err)
+	}
+
+	for tblName, tbl := range r.chTables {
+		if _, ok := r.syncingTables[tblName]; ok {
+			r.log.Warn("sync of the table is interrupted, it will be synced again on the next start", "table", tblName.String())
+			continue
+		}
+
 		if err := tbl.FlushToMainTable(); err != nil {
-			log.Printf("could not flush %s table: %v", tblName.String(), err)
+			r.log.Error("could not flush table", "table", tblName.String(), "error", err)
 		}
 
-		if err := r.persStorage.Write(tableLSNKeyPrefix+tblName.String(), r.finalLSN.Bytes()); err != nil {
-			return fmt.Errorf("could not store lsn for table %s", tblName.String())
+		r.applyTableLSN(tblName, r.finalLSN)
+	}
+
+	r.setSlotLSN(r.finalLSN)
+
+	return r.saveState()
+}
+
+func (r *Replicator) startConsumer() error {
+	if r.finalLSN > r.slotLSN { // the consumer confirms the start position right away
+		r.setSlotLSN(r.finalLSN)
+		if err := r.saveState(); err != nil {
+			return err
 		}
 	}
 
-	r.consumer.AdvanceLSN(r.finalLSN)
+	r.consumer = consumer.New(r.ctx, r.cfg.Postgres.ConnConfig, r.discoverer,
+		r.cfg.Postgres.ReplicationSlotName, r.cfg.Postgres.PublicationName, r.finalLSN,
+		r.cfg.Postgres.ReconnectInterval, r.cfg.Postgres.MaxReconnectAttempts, r.cfg.Inspect)
+
+	if err := r.consumer.Run(r); err != nil {
+		return err
+	}
+	r.stats.SetState(stats.StateStreaming)
 
 	return nil
 }
 
+// recreateSlotAndResync creates missing replication slot, e.g. after failover, and syncs all the tables from scratch
+func (r *Replicator) recreateSlotAndResync() error {
+	r.tablesToMergeMutex.Lock()
+	defer r.tablesToMergeMutex.Unlock()
+
+	r.stats.SetState(stats.StateResyncing)
+
+	if err := r.drainWorkers(); err != nil {
+		return fmt.Errorf("could not apply changes: %w", err)
+	}
+	r.resetApplyWorkers()
+
+	r.pgDisconnect()
+	if err := r.pgConnect(); err != nil {
+		return fmt.Errorf("could not connect to postgresql: %w", err)
+	}
+
+	allTables := make([]config.PgTableName, 0, len(r.cfg.Tables))
+	for tblName := range r.cfg.Tables {
+		allTables = append(allTables, tblName)
+	}
+
+	if err := r.checkResyncCost(allTables); err != nil {
+		return err
+	}
+
+	if _, err := r.pgConn.Exec(fmt.Sprintf("CREATE_REPLICATION_SLOT %s LOGICAL %s%s",
+		r.cfg.Postgres.ReplicationSlotName, utils.OutputPlugin, r.slotCreateOptions())); err != nil {
+		return fmt.Errorf("could not create replication slot: %w", err)
+	}
+
+	r.tableLSN = make(map[config.PgTableName]utils.LSN)
+	r.setSlotLSN(utils.InvalidLSN) // the new slot is not advanced by pg2ch yet
+	if err := r.saveState(); err != nil {
+		return fmt.Errorf("could not erase lsn of the tables: %w", err)
+	}
+	r.chTables = make(map[config.PgTableName]clickHouseTable)
+	r.tablesToMerge = make(map[config.PgTableName]struct{})
+	r.inTxTables = make(map[config.PgTableName]struct{})
+	r.syncingTables = make(map[config.PgTableName]struct{})
+	r.inTx = false
+
+	if err := r.initAndSyncTables(); err != nil {
+		return fmt.Errorf("could not sync tables: %w", err)
+	}
+
+	tx, err := r.pgBegin()
+	if err != nil {
+		return err
+	}
+
+	if err := r.fetchPgTablesInfo(tx); err != nil {
+		return fmt.Errorf("table check failed: %w", err)
+	}
+
+	if err := r.pgCommit(tx); err != nil {
+		return err
+	}
+
+	r.finalLSN = r.minLSN()
+
+	return r.startConsumer()
+}
+
 func (r *Replicator) inactivityMerge() {
 	ticker := time.NewTicker(r.cfg.InactivityFlushTimeout)
 
@@ -430,10 +1062,12 @@ func (r *Replicator) inactivityMerge() {
 			return
 		}
 
+		r.waitForMerges(true)
+
 		r.tablesToMergeMutex.Lock()
 		if err := r.mergeTables(); err != nil {
 			select {
-			case r.errCh <- fmt.Errorf("could not backgound merge tables: %v", err):
+			case r.errCh <- fmt.Errorf("could not backgound merge tables: %w", err):
 			default:
 			}
 		}
@@ -450,13 +1084,91 @@ func (r *Replicator) inactivityMerge() {
 	}
 }
 
+func (r *Replicator) serialGapCheck() {
+	ticker := time.NewTicker(r.cfg.SerialGapCheckInterval)
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			r.tablesToMergeMutex.Lock()
+			tables := make(map[config.PgTableName]clickHouseTable, len(r.chTables))
+			for tblName, tbl := range r.chTables {
+				tables[tblName] = tbl
+			}
+			r.tablesToMergeMutex.Unlock()
+
+			for tblName, tbl := range tables {
+				tblCfg := r.cfg.Tables[tblName]
+				if tblCfg.SerialGapColumn == "" {
+					continue
+				}
+
+				gap, err := tbl.SerialGap()
+				if err != nil {
+					r.log.Warn("could not check serial gap", "table", tblName.String(), "error", err)
+					continue
+				}
+
+				if gap > tblCfg.SerialGapThreshold {
+					r.log.Warn("serial gap: max value in clickhouse is behind the stream",
+						"table", tblName.String(), "column", tblCfg.SerialGapColumn, "gap", gap)
+				}
+			}
+		}
+	}
+}
+
+// shadowCompare periodically compares the shadow tables with the production ones
+func (r *Replicator) shadowCompare() {
+	ticker := time.NewTicker(r.cfg.ShadowCompareInterval)
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			r.tablesToMergeMutex.Lock()
+			tables := make(map[config.PgTableName]clickHouseTable, len(r.chTables))
+			for tblName, tbl := range r.chTables {
+				tables[tblName] = tbl
+			}
+			r.tablesToMergeMutex.Unlock()
+
+			for tblName, tbl := range tables {
+				tblCfg := r.cfg.Tables[tblName]
+				if tblCfg.ShadowOf == "" {
+					continue
+				}
+
+				rows, shadowOfRows, match, err := tbl.CompareShadow()
+				if err != nil {
+					r.log.Warn("could not compare shadow table", "table", tblName.String(), "shadow_of", tblCfg.ShadowOf, "error", err)
+					continue
+				}
+
+				tblStats := r.stats.Table(tblName.String())
+				atomic.AddUint64(&tblStats.ShadowChecks, 1)
+				if match {
+					continue
+				}
+
+				atomic.AddUint64(&tblStats.ShadowMismatches, 1)
+				r.log.Warn("shadow table differs", "table", tblName.String(), "ch_table", tblCfg.ChMainTable,
+					"shadow_of", tblCfg.ShadowOf, "rows", rows, "shadow_of_rows", shadowOfRows)
+			}
+		}
+	}
+}
+
 func (r *Replicator) logErrCh() {
 	for {
 		select {
 		case <-r.ctx.Done():
 			return
 		case err := <-r.errCh:
-			log.Println(err)
+			r.log.Error("replication error", "error", err)
 		}
 	}
 }
@@ -466,16 +1178,17 @@ func (r *Replicator) fetchPgTablesInfo(tx *pgx.Tx) error {
 			select c.oid,
 				   n.nspname,
 				   c.relname,
-				   c.relreplident
+				   c.relreplident,
+				   c.relkind = 'p'
 			from pg_class c
 				   join pg_namespace n on n.oid = c.relnamespace
       			   join pg_publication_tables pub on (c.relname = pub.tablename and n.nspname = pub.schemaname)
 			where
-				c.relkind = 'r'
+				c.relkind in ('r', 'p')
 				and pub.pubname = $1`, r.cfg.Postgres.PublicationName)
 
 	if err != nil {
-		return fmt.Errorf("could not exec: %v", err)
+		return fmt.Errorf("could not exec: %w", err)
 	}
 
 	for rows.Next() {
@@ -483,22 +1196,32 @@ func (r *Replicator) fetchPgTablesInfo(tx *pgx.Tx) error {
 			oid                   utils.OID
 			schemaName, tableName string
 			replicaIdentity       message.ReplicaIdentity
+			partitioned           bool
 		)
 
-		if err := rows.Scan(&oid, &schemaName, &tableName, &replicaIdentity); err != nil {
-			return fmt.Errorf("could not scan: %v", err)
+		if err := rows.Scan(&oid, &schemaName, &tableName, &replicaIdentity, &partitioned); err != nil {
+			return fmt.Errorf("could not scan: %w", err)
 		}
 
 		fqName := config.PgTableName{SchemaName: schemaName, TableName: tableName}
 
-		if _, ok := r.cfg.Tables[fqName]; ok && replicaIdentity != message.ReplicaIdentityFull {
-			return fmt.Errorf("table %s must have FULL replica identity(currently it is %q)", tableName, replicaIdentity)
+		// replica identity of the partitioned table is checked per partition
+		if _, ok := r.cfg.Tables[fqName]; ok && !partitioned {
+			r.checkReplicaIdentity(fqName, fqName, replicaIdentity)
 		}
 
 		r.oidName[oid] = fqName
 	}
 
-	return nil
+	if err := r.fetchPartitions(tx); err != nil {
+		return err
+	}
+
+	if err := r.fetchInheritedTables(tx); err != nil {
+		return err
+	}
+
+	return r.replicaIdentityError()
 }
 
 func (r *Replicator) chConnect() error {
@@ -506,58 +1229,128 @@ func (r *Replicator) chConnect() error {
 
 	r.chConn, err = sql.Open("clickhouse", r.cfg.ClickHouse.ConnectionString())
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("could not open connection: %w", err)
 	}
+	r.chSchema = tableinfo.NewChSchema(r.chConn, r.cfg.ClickHouse.Database)
+	// keep the connections open between the flushes instead of reconnecting on each one
+	r.chConn.SetMaxIdleConns(r.cfg.ClickHouse.MaxIdleConns)
+	r.chConn.SetConnMaxLifetime(r.cfg.ClickHouse.ConnMaxLifetime)
+	r.chConn.SetConnMaxIdleTime(r.cfg.IdleTableTimeout) // the connections of the flush bursts are closed once idle
 	if err := r.chConn.Ping(); err != nil {
 		if exception, ok := err.(*clickhouse.Exception); ok {
 			return fmt.Errorf("[%d] %s %s", exception.Code, exception.Message, exception.StackTrace)
 		}
 
-		return fmt.Errorf("could not ping: %v", err)
+		return fmt.Errorf("could not ping: %w", chutils.ClassifyError(err))
 	}
 
-	return nil
+	for i, shard := range r.cfg.ClickHouse.Shards {
+		conn, err := sql.Open("clickhouse", r.cfg.ClickHouse.ShardConnectionString(shard))
+		if err != nil {
+			return fmt.Errorf("could not open connection to shard %d: %w", i+1, err)
+		}
+		r.chShards = append(r.chShards, conn)
+		conn.SetMaxIdleConns(r.cfg.ClickHouse.MaxIdleConns)
+		conn.SetConnMaxLifetime(r.cfg.ClickHouse.ConnMaxLifetime)
+		conn.SetConnMaxIdleTime(r.cfg.IdleTableTimeout)
+
+		if err := conn.Ping(); err != nil {
+			return fmt.Errorf("could not ping shard %d: %w", i+1, chutils.ClassifyError(err))
+		}
+	}
+
+	return r.chProbeVersion()
+}
+
+// chPing probes the clickhouse connection periodically, so that the broken idle connections
+// are discarded before the flush needs them
+func (r *Replicator) chPing() {
+	ticker := time.NewTicker(r.cfg.ClickHouse.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.chConn.PingContext(r.ctx); err != nil && r.ctx.Err() == nil {
+				r.log.Warn("clickhouse ping failed", "error", chutils.ClassifyError(err))
+			}
+		}
+	}
 }
 
 func (r *Replicator) chDisconnect() {
 	if err := r.chConn.Close(); err != nil {
-		log.Printf("could not close connection to clickhouse: %v", err)
+		r.log.Warn("could not close connection to clickhouse", "error", err)
 	}
+
+	for i, conn := range r.chShards {
+		if err := conn.Close(); err != nil {
+			r.log.Warn("could not close connection to shard", "shard", i+1, "error", err)
+		}
+	}
+	r.chShards = nil
 }
 
 func (r *Replicator) pgConnect() error {
 	var err error
 
-	r.pgConn, err = pgx.Connect(r.cfg.Postgres.Merge(pgx.ConnConfig{
+	r.pgConn, err = r.pgReplicationConn()
+
+	return err
+}
+
+// pgReplicationConn opens a new replication connection to the discovered server
+func (r *Replicator) pgReplicationConn() (*pgx.Conn, error) {
+	connCfg, err := r.discoverer.Primary(r.cfg.Postgres.ConnConfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not discover the server: %w", err)
+	}
+
+	conn, err := pgx.Connect(connCfg.Merge(pgx.ConnConfig{
 		RuntimeParams:        map[string]string{"replication": "database", "application_name": applicationName},
 		PreferSimpleProtocol: true}))
 	if err != nil {
-		return fmt.Errorf("could not rep connect to pg: %v", err)
+		return nil, fmt.Errorf("could not rep connect to pg: %w", err)
 	}
 
-	connInfo, err := initPostgresql(r.pgConn)
+	connInfo, err := initPostgresql(conn)
 	if err != nil {
-		return fmt.Errorf("could not fetch conn info: %v", err)
+		conn.Close()
+		return nil, fmt.Errorf("could not fetch conn info: %w", err)
 	}
-	r.pgConn.ConnInfo = connInfo
+	conn.ConnInfo = connInfo
 
-	return nil
+	return conn, nil
+}
+
+// pgSyncConn opens a regular connection to the discovered server, used by the concurrent chunks of the table sync
+func (r *Replicator) pgSyncConn() (*pgx.Conn, error) {
+	connCfg, err := r.discoverer.Primary(r.cfg.Postgres.ConnConfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not discover the server: %w", err)
+	}
+
+	return pgx.Connect(connCfg.Merge(pgx.ConnConfig{
+		RuntimeParams: map[string]string{"application_name": applicationName}}))
 }
 
 func (r *Replicator) pgDisconnect() {
 	if err := r.pgConn.Close(); err != nil {
-		log.Printf("could not close connection to postgresql: %v", err)
+		r.log.Warn("could not close connection to postgresql", "error", err)
 	}
 }
 
-func (r *Replicator) pgDropRepSlot(tx *pgx.Tx) error {
-	_, err := tx.Exec(fmt.Sprintf("DROP_REPLICATION_SLOT %s", r.tempSlotName))
+func (r *Replicator) pgDropRepSlot(tx *pgx.Tx, slotName string) error {
+	_, err := tx.Exec(fmt.Sprintf("DROP_REPLICATION_SLOT %s", slotName))
 
 	return err
 }
 
-func (r *Replicator) pgCreateTempRepSlot(tx *pgx.Tx, tblName config.PgTableName) (utils.LSN, error) {
+func (r *Replicator) pgCreateTempRepSlot(tx *pgx.Tx, tblName config.PgTableName) (string, utils.LSN, error) {
 	var (
+		slotName                          string
 		snapshotLSN, snapshotName, plugin sql.NullString
 		lsn                               utils.LSN
 	)
@@ -565,24 +1358,94 @@ func (r *Replicator) pgCreateTempRepSlot(tx *pgx.Tx, tblName config.PgTableName)
 	row := tx.QueryRow(fmt.Sprintf("CREATE_REPLICATION_SLOT %s TEMPORARY LOGICAL %s USE_SNAPSHOT",
 		fmt.Sprintf("ch_tmp_%s_%s", tblName.SchemaName, tblName.TableName), utils.OutputPlugin))
 
-	if err := row.Scan(&r.tempSlotName, &snapshotLSN, &snapshotName, &plugin); err != nil {
-		return utils.InvalidLSN, fmt.Errorf("could not scan: %v", err)
+	if err := row.Scan(&slotName, &snapshotLSN, &snapshotName, &plugin); err != nil {
+		return "", utils.InvalidLSN, fmt.Errorf("could not scan: %w", err)
 	}
 
 	if err := lsn.Parse(snapshotLSN.String); err != nil {
-		return utils.InvalidLSN, fmt.Errorf("could not parse LSN: %v", err)
+		return "", utils.InvalidLSN, fmt.Errorf("could not parse LSN: %w", err)
+	}
+
+	return slotName, lsn, nil
+}
+
+// watchSnapshotAge warns or aborts the sync per policy each time the snapshot transaction
+// gets older by the max age; returned func stops watching and returns the error the sync was aborted with,
+// which is to be reported instead of the cancellation error of the sync
+func (r *Replicator) watchSnapshotAge(tblName config.PgTableName) func() error {
+	if r.cfg.Postgres.SnapshotMaxAge == 0 {
+		return func() error { return nil }
 	}
 
-	return lsn, nil
+	done := make(chan struct{})
+	abortErr := make(chan error, 1)
+	startTime := time.Now()
+
+	go func() {
+		ticker := time.NewTicker(r.cfg.Postgres.SnapshotMaxAge)
+		defer ticker.Stop()
+		defer close(abortErr)
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				age := time.Since(startTime).Truncate(time.Second)
+				if r.cfg.Postgres.SnapshotAgePolicy == config.SnapshotAbort {
+					r.log.Error("snapshot transaction of the table sync is too old, aborting the sync",
+						"table", tblName.String(), "age", age)
+					abortErr <- fmt.Errorf("%w: %v", errSnapshotTooOld, age)
+					r.cancel()
+					return
+				}
+
+				r.log.Warn("snapshot transaction of the table sync is too old, it holds back vacuum on the source database",
+					"table", tblName.String(), "age", age)
+			}
+		}
+	}()
+
+	return func() error {
+		close(done)
+
+		return <-abortErr
+	}
+}
+
+// cancelOnSignal cancels the context on the shutdown signal, e.g. to abort the initial sync;
+// returned func stops listening for the signals
+func (r *Replicator) cancelOnSignal() func() {
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigs, shutdownSignals...)
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			r.log.Info("got signal, aborting", "signal", sig.String())
+			r.cancel()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
 }
 
-func (r *Replicator) waitForShutdown() {
+// waitForShutdown waits for the shutdown signal or the consumer failure, returns the failure
+func (r *Replicator) waitForShutdown() error {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGABRT, syscall.SIGQUIT)
+	signal.Notify(sigs, shutdownSignals...)
+	defer signal.Stop(sigs)
 
 loop:
 	for {
 		select {
+		case err := <-r.consumer.Failed():
+			return err
 		case sig := <-sigs:
 			switch sig {
 			case syscall.SIGABRT:
@@ -594,15 +1457,23 @@ loop:
 			case syscall.SIGTERM:
 				break loop
 			default:
-				log.Printf("unhandled signal: %v", sig)
+				r.log.Warn("unhandled signal", "signal", sig.String())
 			}
 		}
 	}
+
+	return nil
 }
 
 // TODO: merge with getTable
 func (r *Replicator) skipTableMessage(tblName config.PgTableName) bool {
+	if r.skipTx || r.finalLSN <= r.committedLSN {
+		return true
+	}
+
+	r.stateMutex.Lock()
 	lsn, ok := r.tableLSN[tblName]
+	r.stateMutex.Unlock()
 	if !ok {
 		return false
 	}
@@ -626,57 +1497,234 @@ func (r *Replicator) getTable(oid utils.OID) (config.PgTableName, clickHouseTabl
 		r.inTxTables[tblName] = struct{}{}
 	}
 
-	if _, ok := r.tablesToMerge[tblName]; !ok {
+	if _, ok := r.tablesToMerge[tblName]; !ok && r.frozen[tblName] == nil {
 		r.tablesToMerge[tblName] = struct{}{}
 	}
 
+	if r.cfg.IdleTableTimeout > 0 {
+		r.touchTable(tblName)
+	}
+
 	return tblName, chTbl
 }
 
-func (r *Replicator) mergeTables() error {
+// mergeOrder returns the tables to be flushed to the main tables, tables of the groups go first in the group order;
+// if a table of a group can't be flushed yet, the following tables of the group wait for the next merge as well,
+// all the tables of the commit order group do
+func (r *Replicator) mergeOrder() []config.PgTableName {
+	tables := make([]config.PgTableName, 0, len(r.tablesToMerge))
+	grouped := make(map[config.PgTableName]struct{})
+
+	for _, group := range r.cfg.TableGroups {
+		blocked := group.CommitOrder && r.groupBlocked(group)
+		for _, tblName := range group.Tables {
+			grouped[tblName] = struct{}{}
+			if _, ok := r.inTxTables[tblName]; ok {
+				blocked = true
+			}
+			if _, ok := r.syncingTables[tblName]; ok {
+				blocked = true
+			}
+
+			if _, ok := r.tablesToMerge[tblName]; !ok || blocked {
+				continue
+			}
+			tables = append(tables, tblName)
+		}
+	}
+
 	for tblName := range r.tablesToMerge {
+		if _, ok := grouped[tblName]; ok {
+			continue
+		}
+
 		if _, ok := r.inTxTables[tblName]; ok {
 			continue
 		}
 
+		if _, ok := r.syncingTables[tblName]; ok {
+			continue
+		}
+		tables = append(tables, tblName)
+	}
+
+	return tables
+}
+
+// groupBlocked checks if any table of the group can't be flushed yet: it has changes of the not yet committed
+// transaction, is being synced or frozen
+func (r *Replicator) groupBlocked(group config.TableGroup) bool {
+	for _, tblName := range group.Tables {
+		if _, ok := r.inTxTables[tblName]; ok {
+			return true
+		}
+		if _, ok := r.syncingTables[tblName]; ok {
+			return true
+		}
+		if _, ok := r.frozen[tblName]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// waitForMerges waits for clickhouse to merge the parts of the main tables the next merge is going to flush to,
+// unless it is not going to happen at the commit; it does not hold the lock while waiting, so the admin api
+// and the background merges are not blocked. The workers wait before their merges themselves
+func (r *Replicator) waitForMerges(force bool) {
+	r.tablesToMergeMutex.Lock()
+	var tables []clickHouseTable
+	if r.workers == nil && (force || r.curTxMergeIsNeeded || r.groupMergeNeeded || atomic.LoadInt32(&r.flushRequested) == 1) {
+		for _, tblName := range r.mergeOrder() {
+			tables = append(tables, r.chTables[tblName])
+		}
+	}
+	r.tablesToMergeMutex.Unlock()
+
+	for _, tbl := range tables {
+		tbl.WaitForMerges()
+	}
+}
+
+func (r *Replicator) mergeTables() error {
+	if r.workers != nil {
+		return r.mergeTablesParallel()
+	}
+
+	merged := make([]string, 0)
+
+	for _, tblName := range r.mergeOrder() {
 		if err := r.chTables[tblName].FlushToMainTable(); err != nil {
-			return fmt.Errorf("could not commit %s table: %v", tblName.String(), err)
+			return fmt.Errorf("could not commit %s table: %w", tblName.String(), err)
 		}
 
 		delete(r.tablesToMerge, tblName)
-		r.tableLSN[tblName] = r.finalLSN
-		if err := r.persStorage.Write(tableLSNKeyPrefix+tblName.String(), r.finalLSN.Bytes()); err != nil {
-			return fmt.Errorf("could not store lsn for table %s", tblName.String())
-		}
+		r.applyTableLSN(tblName, r.finalLSN)
+		merged = append(merged, tblName.String())
 	}
 
 	r.advanceLSN()
+	if len(merged) > 0 || r.slotLSNUnsaved() {
+		if err := r.saveState(); err != nil {
+			return err
+		}
+	}
+
+	r.storeWatermarks(merged)
+	r.storePublishID(merged)
 
 	return nil
 }
 
 func (r *Replicator) incrementGeneration() {
-	r.generationID++
-	if err := r.persStorage.Write("generation_id", []byte(fmt.Sprintf("%v", r.generationID))); err != nil {
-		log.Printf("could not save generation id: %v", err)
+	r.stateMutex.Lock()
+	atomic.AddUint64(&r.generationID, 1)
+	r.stateMutex.Unlock()
+	if r.cfg.Inspect {
+		return
+	}
+
+	if err := r.saveState(); err != nil {
+		r.log.Error("could not save generation id", "error", err)
 	}
 }
 
+// HandleReconnect drops the changes of the transaction interrupted by the reconnect of the consumer, postgres sends
+// the transaction again from its beginning once the replication is restarted
+func (r *Replicator) HandleReconnect() error {
+	r.tablesToMergeMutex.Lock()
+	defer r.tablesToMergeMutex.Unlock()
+
+	if !r.inTx {
+		return nil
+	}
+	r.log.Info("dropping the changes of the interrupted transaction", "lsn", r.finalLSN)
+
+	for tblName := range r.inTxTables {
+		chTbl, ok := r.chTables[tblName]
+		if _, frozen := r.frozen[tblName]; !ok || frozen {
+			continue
+		}
+
+		lsn := r.finalLSN
+		if err := r.onTable(tblName, func() (bool, error) {
+			chTbl.DiscardTx(lsn)
+
+			return false, nil
+		}); err != nil {
+			return fmt.Errorf("could not discard changes of %s table: %w", tblName.String(), err)
+		}
+	}
+	for _, spool := range r.frozen {
+		spool.pending = spool.pending[:0]
+	}
+	if r.jsonl != nil {
+		r.jsonl.discard()
+	}
+
+	r.inTxTables = make(map[config.PgTableName]struct{})
+	r.inTx = false
+
+	return nil
+}
+
 // HandleMessage processes the incoming wal message
 func (r *Replicator) HandleMessage(lsn utils.LSN, msg message.Message) error {
+	if _, ok := msg.(message.Commit); ok {
+		r.waitForMerges(false)
+	}
+
 	r.tablesToMergeMutex.Lock()
 	defer r.tablesToMergeMutex.Unlock()
 
+	if r.workers != nil {
+		if err := r.applyError(); err != nil {
+			return fmt.Errorf("could not apply changes: %w", err)
+		}
+		if err := r.applyCompleted(); err != nil {
+			return err
+		}
+	}
+
 	switch v := msg.(type) {
 	case message.Begin:
 		r.inTx = true
 		r.finalLSN = v.FinalLSN
+		r.stats.SetLSN(v.FinalLSN)
 		r.curTxMergeIsNeeded = false
 		r.isEmptyTx = true
+		r.skipTx = r.skipOrigin("") // the origin message follows the begin of the replicated transactions
+		if r.jsonl != nil {
+			r.jsonl.commitTime = v.Timestamp
+		}
+		if r.rowStream != nil {
+			r.streamEvents, r.streamCommitTime = r.streamEvents[:0], v.Timestamp
+		}
+	case message.Origin:
+		r.skipTx = r.skipOrigin(v.Name)
 	case message.Commit:
-		if r.curTxMergeIsNeeded {
+		if err := r.commitFrozen(); err != nil {
+			return err
+		}
+		if r.jsonl != nil {
+			if err := r.jsonl.flush(); err != nil {
+				return err
+			}
+		}
+		if r.rowStream != nil {
+			if err := r.rowStream.Publish(r.streamEvents); err != nil {
+				return fmt.Errorf("could not publish row changes: %w", err)
+			}
+		}
+
+		if r.workers != nil {
+			if err := r.dispatchCommit(); err != nil {
+				return fmt.Errorf("could not commit tables: %w", err)
+			}
+		} else if r.curTxMergeIsNeeded {
 			if err := r.mergeTables(); err != nil {
-				return fmt.Errorf("could not merge tables: %v", err)
+				return fmt.Errorf("could not merge tables: %w", err)
 			}
 		} else {
 			r.advanceLSN()
@@ -684,57 +1732,109 @@ func (r *Replicator) HandleMessage(lsn utils.LSN, msg message.Message) error {
 		if !r.isEmptyTx {
 			r.incrementGeneration()
 		}
+		for tblName := range r.inTxTables {
+			r.stats.Table(tblName.String()).CommitSeen(v.Timestamp)
+		}
 		r.inTxTables = make(map[config.PgTableName]struct{})
 		r.inTx = false
+		r.committedLSN = r.finalLSN
+
+		if atomic.SwapInt32(&r.flushRequested, 0) == 1 || r.groupMergeNeeded {
+			if err := r.mergeTables(); err != nil {
+				return fmt.Errorf("could not merge tables: %w", err)
+			}
+		}
 	case message.Relation:
-		_, chTbl := r.getTable(v.OID)
+		if _, ok := r.oidName[v.OID]; !ok {
+			if err := r.attachPartition(v); err != nil {
+				return fmt.Errorf("could not check relation: %w", err)
+			}
+		}
+		// kept for all the relations, the tables added later get no relation message until the next session
+		r.relColumns[v.OID] = v.Columns
+
+		tblName, chTbl := r.getTable(v.OID)
 		if chTbl == nil {
 			break
 		}
 
-		chTbl.SetTupleColumns(v.Columns)
+		if spool, ok := r.frozen[tblName]; ok { // applied on thaw, no DDL during the maintenance
+			r.spoolChange(spool, frozenChange{Op: opRelation, OID: v.OID, Columns: v.Columns})
+		} else if err := r.drainWorkers(); err != nil { // the tables are altered with no changes in flight
+			return err
+		} else if err := r.applyRelation(v.OID, tblName, chTbl, v.Columns); err != nil {
+			return err
+		}
+		r.tupleColumnsOID[tblName] = v.OID
 	case message.Insert:
 		tblName, chTbl := r.getTable(v.RelationOID)
 		if chTbl == nil || r.skipTableMessage(tblName) {
 			break
 		}
+		if err := r.relationColumns(v.RelationOID, tblName, chTbl); err != nil {
+			return err
+		}
 
-		if mergeIsNeeded, err := chTbl.Insert(r.finalLSN, v.NewRow); err != nil {
-			return fmt.Errorf("could not insert: %v", err)
-		} else {
-			r.curTxMergeIsNeeded = r.curTxMergeIsNeeded || mergeIsNeeded
+		if spool, ok := r.frozen[tblName]; ok {
+			r.spoolChange(spool, frozenChange{Op: opInsert, New: v.NewRow})
+		} else if err := r.applyChange(v.RelationOID, tblName, chTbl, opInsert, v.NewRow, nil); err != nil {
+			return err
 		}
 		r.isEmptyTx = false
+
+		if err := r.emitRowChange(lsn, 0, v.RelationOID, tblName, opInsert, v.NewRow, nil); err != nil {
+			return err
+		}
 	case message.Update:
 		tblName, chTbl := r.getTable(v.RelationOID)
 		if chTbl == nil || r.skipTableMessage(tblName) {
 			break
 		}
+		if err := r.relationColumns(v.RelationOID, tblName, chTbl); err != nil {
+			return err
+		}
 
-		if mergeIsNeeded, err := chTbl.Update(r.finalLSN, v.OldRow, v.NewRow); err != nil {
-			return fmt.Errorf("could not update: %v", err)
-		} else {
-			r.curTxMergeIsNeeded = r.curTxMergeIsNeeded || mergeIsNeeded
+		if spool, ok := r.frozen[tblName]; ok {
+			r.spoolChange(spool, frozenChange{Op: opUpdate, New: v.NewRow, Old: v.OldRow})
+		} else if err := r.applyChange(v.RelationOID, tblName, chTbl, opUpdate, v.NewRow, v.OldRow); err != nil {
+			return err
 		}
 		r.isEmptyTx = false
+
+		if err := r.emitRowChange(lsn, 0, v.RelationOID, tblName, opUpdate, v.NewRow, v.OldRow); err != nil {
+			return err
+		}
 	case message.Delete:
 		tblName, chTbl := r.getTable(v.RelationOID)
 		if chTbl == nil || r.skipTableMessage(tblName) {
 			break
 		}
+		if err := r.relationColumns(v.RelationOID, tblName, chTbl); err != nil {
+			return err
+		}
 
-		if mergeIsNeeded, err := chTbl.Delete(r.finalLSN, v.OldRow); err != nil {
-			return fmt.Errorf("could not delete: %v", err)
-		} else {
-			r.curTxMergeIsNeeded = r.curTxMergeIsNeeded || mergeIsNeeded
+		if spool, ok := r.frozen[tblName]; ok {
+			r.spoolChange(spool, frozenChange{Op: opDelete, Old: v.OldRow})
+		} else if err := r.applyChange(v.RelationOID, tblName, chTbl, opDelete, nil, v.OldRow); err != nil {
+			return err
 		}
 		r.isEmptyTx = false
+
+		if err := r.emitRowChange(lsn, 0, v.RelationOID, tblName, opDelete, nil, v.OldRow); err != nil {
+			return err
+		}
 	case message.Truncate:
-		for _, oid := range v.RelationOIDs {
+		for i, oid := range r.truncatedOIDs(v.RelationOIDs) {
 			if tblName, chTbl := r.getTable(oid); chTbl == nil || r.skipTableMessage(tblName) {
 				continue
 			} else {
-				if err := chTbl.Truncate(); err != nil {
+				if spool, ok := r.frozen[tblName]; ok {
+					r.spoolChange(spool, frozenChange{Op: opTruncate})
+				} else if err := r.onTable(tblName, func() (bool, error) { return false, chTbl.Truncate() }); err != nil {
+					return err
+				}
+
+				if err := r.emitRowChange(lsn, i, oid, tblName, opTruncate, nil, nil); err != nil {
 					return err
 				}
 			}
@@ -745,42 +1845,458 @@ func (r *Replicator) HandleMessage(lsn utils.LSN, msg message.Message) error {
 	return nil
 }
 
+// advanceLSN advances the slot to the current transaction, unless the changes seen so far
+// are not yet written as far as the ack mode requires
 func (r *Replicator) advanceLSN() {
-	r.consumer.AdvanceLSN(r.finalLSN)
+	if !r.canAdvanceLSN() {
+		return
+	}
+
+	r.setSlotLSN(r.finalLSN)
+}
+
+// setSlotLSN sets the lsn the replication slot is advanced to; it is saved with the next state,
+// the slot is confirmed up to it once saved, so that the slot is never ahead of the stored position
+func (r *Replicator) setSlotLSN(lsn utils.LSN) {
+	r.stateMutex.Lock()
+	r.slotLSN = lsn
+	r.stateMutex.Unlock()
+}
+
+// slotLSNUnsaved checks if the slot is advanced past the lsn of the last saved state
+func (r *Replicator) slotLSNUnsaved() bool {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+
+	return r.slotLSN != r.savedSlotLSN
+}
+
+// canAdvanceLSN checks if the changes up to the final lsn are written as required by the ack mode
+func (r *Replicator) canAdvanceLSN() bool {
+	switch r.cfg.AckMode {
+	case config.AckBufferFlush:
+		for tblName := range r.tablesToMerge {
+			if atomic.LoadInt64(&r.stats.Table(tblName.String()).BufferedRows) > 0 {
+				return false
+			}
+		}
+	case config.AckMainTable:
+		if len(r.tablesToMerge) > 0 {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (r *Replicator) fetchTableConfig(tx *pgx.Tx, tblName config.PgTableName) (config.Table, error) {
 	var err error
 	cfg := r.cfg.Tables[tblName]
+	r.setRuntimeConfig(&cfg)
+
+	if err := tx.QueryRow("select relkind = 'p' from pg_class where oid = $1::regclass",
+		tblName.String()).Scan(&cfg.Partitioned); err != nil {
+		return cfg, fmt.Errorf("could not get kind of %s postgres table: %w", tblName.String(), err)
+	}
+	if cfg.Partitioned && r.pgVersion < minPartitionedVersion {
+		return cfg, fmt.Errorf("%s postgres table is partitioned: publishing partitioned tables needs postgresql 13 or newer, "+
+			"server version is %s", tblName.String(), pgVersionString(r.pgVersion))
+	}
 
 	cfg.TupleColumns, cfg.PgColumns, err = tableinfo.TablePgColumns(tx, tblName)
 	if err != nil {
-		return cfg, fmt.Errorf("could not get columns for %s postgres table: %v", tblName.String(), err)
+		return cfg, fmt.Errorf("could not get columns for %s postgres table: %w", tblName.String(), err)
+	}
+
+	if err := r.applyPublicationFilters(tx, tblName, &cfg); err != nil {
+		return cfg, fmt.Errorf("could not get publication filters of %s postgres table: %w", tblName.String(), err)
+	}
+
+	if err := r.resolveChConfig(tblName, &cfg); err != nil {
+		return cfg, err
+	}
+
+	extraTargets := make([]config.Table, 0, len(cfg.ExtraTargets))
+	for _, target := range cfg.ExtraTargets {
+		r.setRuntimeConfig(&target)
+		target.PgTableName = tblName
+		target.Partitioned = cfg.Partitioned
+		target.TupleColumns = cfg.TupleColumns
+		target.PubRowFilter = cfg.PubRowFilter
+		target.PubColumns = cfg.PubColumns
+		target.PgColumns = make(map[string]config.PgColumn, len(cfg.PgColumns))
+		for name, pgCol := range cfg.PgColumns {
+			target.PgColumns[name] = pgCol
+		}
+
+		if err := r.resolveChConfig(tblName, &target); err != nil {
+			return cfg, fmt.Errorf("extra target %q: %w", target.ChMainTable, err)
+		}
+		extraTargets = append(extraTargets, target)
 	}
+	cfg.ExtraTargets = extraTargets
 
-	chColumns, err := tableinfo.TableChColumns(r.chConn, r.cfg.ClickHouse.Database, cfg.ChMainTable)
+	return cfg, nil
+}
+
+// setRuntimeConfig sets the table settings coming from the command line flags and the global config
+func (r *Replicator) setRuntimeConfig(cfg *config.Table) {
+	cfg.Inspect = r.cfg.Inspect
+	cfg.LogComment = r.cfg.LogComment
+	cfg.InsertDeduplication = r.cfg.InsertDeduplication
+	cfg.RestrictedPrivileges = r.cfg.RestrictedPrivileges
+	cfg.RestrictedTruncate = r.cfg.RestrictedTruncate
+	cfg.Cluster = r.cfg.ClickHouse.Cluster
+	cfg.DeadLetter = r.deadLetter
+	if cfg.SyncMaxRowsPerSecond == 0 {
+		cfg.SyncMaxRowsPerSecond = r.cfg.SyncMaxRowsPerSecond
+	}
+	if cfg.SyncMaxBytesPerSecond == 0 {
+		cfg.SyncMaxBytesPerSecond = r.cfg.SyncMaxBytesPerSecond
+	}
+}
+
+// chTableNames returns the clickhouse tables of the replicated tables and their extra targets
+func (r *Replicator) chTableNames() []string {
+	names := make([]string, 0)
+
+	for _, tblCfg := range r.cfg.Tables {
+		for _, target := range append([]config.Table{tblCfg}, tblCfg.ExtraTargets...) {
+			for _, name := range []string{target.ChMainTable, target.ChBufferTable, target.ShadowOf} {
+				if name != "" {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+
+	return names
+}
+
+// resolveChConfig maps the pg columns of the table to the columns of its clickhouse tables and checks them
+func (r *Replicator) resolveChConfig(tblName config.PgTableName, cfg *config.Table) error {
+	chColumns, err := r.chSchema.Columns(cfg.ChMainTable)
 	if err != nil {
-		return cfg, fmt.Errorf("could not get columns for %q clickhouse table: %v", cfg.ChMainTable, err)
+		return fmt.Errorf("could not get columns for %q clickhouse table: %w", cfg.ChMainTable, err)
 	}
 
 	cfg.ColumnMapping = make(map[string]config.ChColumn)
 	if len(cfg.Columns) > 0 {
 		for pgCol, chCol := range cfg.Columns {
+			if cfg.ColumnProperties[pgCol].Flattened() {
+				return fmt.Errorf("flattened column %q can not be mapped, its derived columns are", pgCol)
+			}
+
+			if _, ok := cfg.PgColumns[pgCol]; !ok && cfg.PubColumns != nil {
+				return fmt.Errorf("%w: %q column of %s postgres table is not in the column list of %q publication",
+					utils.ErrSchemaMismatch, pgCol, tblName.String(), r.cfg.Postgres.PublicationName)
+			}
+
 			if chColCfg, ok := chColumns[chCol]; !ok {
-				return cfg, fmt.Errorf("could not find %q column in %q clickhouse table", chCol, cfg.ChMainTable)
+				return fmt.Errorf("%w: could not find %q column in %q clickhouse table",
+					utils.ErrSchemaMismatch, chCol, cfg.ChMainTable)
 			} else {
 				cfg.ColumnMapping[pgCol] = chColCfg
 			}
 		}
 	} else {
 		for _, pgCol := range cfg.TupleColumns {
+			if cfg.ColumnProperties[pgCol.Name].Flattened() {
+				continue
+			}
+
 			if chColCfg, ok := chColumns[pgCol.Name]; !ok {
-				return cfg, fmt.Errorf("could not find %q column in %q clickhouse table", pgCol.Name, cfg.ChMainTable)
+				return fmt.Errorf("%w: could not find %q column in %q clickhouse table",
+					utils.ErrSchemaMismatch, pgCol.Name, cfg.ChMainTable)
 			} else {
 				cfg.ColumnMapping[pgCol.Name] = chColCfg
 			}
 		}
 	}
 
-	return cfg, nil
+	for i, derived := range cfg.Derived {
+		chCol, ok := chColumns[derived.Name]
+		if !ok {
+			return fmt.Errorf("%w: could not find %q column in %q clickhouse table",
+				utils.ErrSchemaMismatch, derived.Name, cfg.ChMainTable)
+		}
+
+		for pgCol, mapped := range cfg.ColumnMapping {
+			if mapped.Name == derived.Name {
+				return fmt.Errorf("%q column is mapped to %q pg column and has an expression", derived.Name, pgCol)
+			}
+		}
+
+		for _, pgCol := range expr.Columns(derived.Expr) {
+			if _, ok := cfg.PgColumns[pgCol]; !ok {
+				return fmt.Errorf("%w: could not find %q column of %q column expression in %s postgres table",
+					utils.ErrSchemaMismatch, pgCol, derived.Name, tblName.String())
+			}
+		}
+
+		cfg.Derived[i].ChColumn = chCol
+	}
+
+	for pgColName, prop := range cfg.ColumnProperties {
+		if prop.TransformExpr == nil {
+			continue
+		}
+
+		if _, ok := cfg.ColumnMapping[pgColName]; !ok {
+			return fmt.Errorf("%q column with a transform is not replicated", pgColName)
+		}
+
+		for _, pgCol := range expr.Columns(prop.TransformExpr) {
+			if _, ok := cfg.PgColumns[pgCol]; !ok {
+				return fmt.Errorf("%w: could not find %q column of the transform of %q column in %s postgres table",
+					utils.ErrSchemaMismatch, pgCol, pgColName, tblName.String())
+			}
+		}
+	}
+
+	if cfg.RowFilterExpr != nil {
+		for _, pgCol := range expr.Columns(cfg.RowFilterExpr) {
+			if _, ok := cfg.PgColumns[pgCol]; !ok {
+				return fmt.Errorf("%w: could not find %q column of the row filter in %s postgres table",
+					utils.ErrSchemaMismatch, pgCol, tblName.String())
+			}
+		}
+	}
+
+	for pgColName, chCol := range cfg.ColumnMapping {
+		if !tableinfo.IsInsertable(chCol) {
+			return fmt.Errorf("%w: %s column %q of %q clickhouse table can not be inserted into",
+				utils.ErrSchemaMismatch, chCol.DefaultKind, chCol.Name, cfg.ChMainTable)
+		}
+
+		if cfg.PgColumns[pgColName].IsArray && chCol.IsArray && chCol.IsNullable {
+			return fmt.Errorf("%w: array column %q of %q clickhouse table can not have nullable elements, "+
+				"the NULL elements are written as the default values", utils.ErrSchemaMismatch, chCol.Name, cfg.ChMainTable)
+		}
+	}
+	for _, derived := range cfg.Derived {
+		if !tableinfo.IsInsertable(derived.ChColumn) {
+			return fmt.Errorf("%w: %s column %q of %q clickhouse table can not be inserted into",
+				utils.ErrSchemaMismatch, derived.ChColumn.DefaultKind, derived.Name, cfg.ChMainTable)
+		}
+	}
+
+	cfg.Tokenizers = make(map[string]*tokenizer.Tokenizer)
+	for pgColName, prop := range cfg.ColumnProperties {
+		if prop.Tokenizer == "" {
+			continue
+		}
+
+		tok, ok := r.tokenizers[prop.Tokenizer]
+		if !ok {
+			return fmt.Errorf("tokenizer %q of %q column is not running, restart to add it", prop.Tokenizer, pgColName)
+		}
+
+		if chCol, ok := cfg.ColumnMapping[pgColName]; !ok {
+			return fmt.Errorf("tokenized column %q is not replicated", pgColName)
+		} else if chCol.BaseType != utils.ChString {
+			return fmt.Errorf("%w: tokenized column %q must be of %s type in clickhouse, got %s",
+				utils.ErrSchemaMismatch, chCol.Name, utils.ChString, chCol.BaseType)
+		}
+
+		if cfg.PgColumns[pgColName].PkCol > 0 {
+			r.log.Warn("primary key column is tokenized, the tokenizer must return the same token for the same value",
+				"table", tblName.String(), "column", pgColName)
+		}
+		cfg.Tokenizers[pgColName] = tok
+	}
+
+	for pgColName, prop := range cfg.ColumnProperties {
+		if prop.Encrypt == config.EncryptNone {
+			continue
+		}
+
+		chCol, ok := cfg.ColumnMapping[pgColName]
+		if !ok {
+			return fmt.Errorf("encrypted column %q is not replicated", pgColName)
+		} else if chCol.BaseType != utils.ChString {
+			return fmt.Errorf("%w: encrypted column %q must be of %s type in clickhouse, got %s",
+				utils.ErrSchemaMismatch, chCol.Name, utils.ChString, chCol.BaseType)
+		}
+
+		if prop.Encrypt == config.EncryptRandomized && cfg.PgColumns[pgColName].PkCol > 0 {
+			return fmt.Errorf("primary key column %q can not be randomly encrypted, "+
+				"the updated and deleted rows would not match the stored ones; use deterministic encryption", pgColName)
+		}
+	}
+
+	if err := r.resolveJSONColumns(tblName, cfg); err != nil {
+		return err
+	}
+
+	if err := r.resolveHStoreColumns(tblName, cfg); err != nil {
+		return err
+	}
+
+	if err := r.resolveDateTime64Columns(tblName, cfg); err != nil {
+		return err
+	}
+
+	if err := resolveEnumColumns(tblName, cfg); err != nil {
+		return err
+	}
+
+	if err := r.resolveNetColumns(tblName, cfg); err != nil {
+		return err
+	}
+
+	for pgColName, prop := range cfg.ColumnProperties {
+		if prop.Decimal != config.DecimalExact {
+			continue
+		}
+
+		chCol, ok := cfg.ColumnMapping[pgColName]
+		if !ok {
+			return fmt.Errorf("exact decimal column %q is not replicated", pgColName)
+		} else if chCol.BaseType != utils.ChDecimal || chCol.IsArray || len(chCol.Ext) != 2 {
+			return fmt.Errorf("%w: exact decimal column %q must be of Decimal(P, S) type in clickhouse, got %s",
+				utils.ErrSchemaMismatch, chCol.Name, chCol.BaseType)
+		} else if chCol.Ext[0] > tableengines.MaxDecimalPrecision {
+			return fmt.Errorf("%w: precision of exact decimal column %q is %d, the driver can write up to %d",
+				utils.ErrSchemaMismatch, chCol.Name, chCol.Ext[0], tableengines.MaxDecimalPrecision)
+		}
+
+		pgCol := cfg.PgColumns[pgColName]
+		switch pgCol.BaseType {
+		case utils.PgNumeric, utils.PgDecimal, utils.PgSmallint, utils.PgInteger, utils.PgBigint:
+			if !pgCol.IsArray {
+				continue
+			}
+		}
+
+		return fmt.Errorf("%w: exact decimal column %q must be of numeric or integer type in postgres, got %s",
+			utils.ErrSchemaMismatch, pgColName, pgCol.BaseType)
+	}
+
+	for pgColName, prop := range cfg.ColumnProperties {
+		if prop.Mask == config.MaskNone {
+			continue
+		}
+
+		if prop.Tokenizer != "" || prop.Encrypt != config.EncryptNone {
+			return fmt.Errorf("masked column %q can not be tokenized or encrypted, "+
+				"mask, tokenizer and encrypt are mutually exclusive", pgColName)
+		}
+
+		chCol, ok := cfg.ColumnMapping[pgColName]
+		if !ok {
+			return fmt.Errorf("masked column %q is not replicated", pgColName)
+		}
+
+		if prop.Mask == config.MaskNull {
+			if !chCol.IsNullable {
+				return fmt.Errorf("%w: %q column masked with null must be nullable in clickhouse",
+					utils.ErrSchemaMismatch, chCol.Name)
+			}
+		} else if chCol.BaseType != utils.ChString {
+			return fmt.Errorf("%w: masked column %q must be of %s type in clickhouse, got %s",
+				utils.ErrSchemaMismatch, chCol.Name, utils.ChString, chCol.BaseType)
+		}
+
+		if prop.Mask != config.MaskHash && cfg.PgColumns[pgColName].PkCol > 0 {
+			return fmt.Errorf("primary key column %q can only be masked with hash, "+
+				"the updated and deleted rows would not match the stored ones", pgColName)
+		}
+	}
+
+	for pgColName, prop := range cfg.ColumnProperties {
+		if prop.Overflow != config.OverflowNull {
+			continue
+		}
+
+		if chCol, ok := cfg.ColumnMapping[pgColName]; ok && !chCol.IsNullable {
+			return fmt.Errorf("%w: %q column with null overflow policy must be nullable in clickhouse",
+				utils.ErrSchemaMismatch, chCol.Name)
+		}
+	}
+
+	if cfg.ChBufferTable != "" {
+		bufColumns, err := r.chSchema.Columns(cfg.ChBufferTable)
+		if err != nil {
+			return fmt.Errorf("could not get columns for %q clickhouse table: %w", cfg.ChBufferTable, err)
+		}
+
+		if chCol, ok := bufColumns[cfg.BufferTableRowIdColumn]; !ok {
+			return fmt.Errorf("%w: could not find %q row id column in %q clickhouse table", utils.ErrSchemaMismatch,
+				cfg.BufferTableRowIdColumn, cfg.ChBufferTable)
+		} else if chCol.BaseType != utils.ChUint64 {
+			return fmt.Errorf("%w: row id column %q must be of %s type, got %s", utils.ErrSchemaMismatch,
+				cfg.BufferTableRowIdColumn, utils.ChUint64, chCol.BaseType)
+		}
+
+		for _, orderBy := range cfg.BufferOrderBy {
+			parts := strings.Fields(orderBy)
+			if len(parts) == 0 || len(parts) > 2 ||
+				len(parts) == 2 && !strings.EqualFold(parts[1], "ASC") && !strings.EqualFold(parts[1], "DESC") {
+				return fmt.Errorf("invalid buffer_order_by item %q, expected \"column [ASC|DESC]\"", orderBy)
+			}
+
+			if _, ok := bufColumns[parts[0]]; !ok {
+				return fmt.Errorf("%w: could not find %q buffer_order_by column in %q clickhouse table",
+					utils.ErrSchemaMismatch, parts[0], cfg.ChBufferTable)
+			}
+		}
+
+		if cfg.BufferTableLSNColumn != "" {
+			if chCol, ok := bufColumns[cfg.BufferTableLSNColumn]; !ok {
+				return fmt.Errorf("%w: could not find %q lsn column in %q clickhouse table", utils.ErrSchemaMismatch,
+					cfg.BufferTableLSNColumn, cfg.ChBufferTable)
+			} else if chCol.BaseType != utils.ChUint64 {
+				return fmt.Errorf("%w: lsn column %q must be of %s type, got %s", utils.ErrSchemaMismatch,
+					cfg.BufferTableLSNColumn, utils.ChUint64, chCol.BaseType)
+			}
+		}
+	}
+
+	if cfg.Engine == config.CollapsingMergeTree {
+		if chCol, ok := chColumns[cfg.SignColumn]; !ok {
+			return fmt.Errorf("%w: could not find %q sign column in %q clickhouse table",
+				utils.ErrSchemaMismatch, cfg.SignColumn, cfg.ChMainTable)
+		} else if chCol.BaseType != cfg.SignColumnType {
+			return fmt.Errorf("%w: sign column %q is of %s type in clickhouse, %s expected", utils.ErrSchemaMismatch,
+				cfg.SignColumn, chCol.BaseType, cfg.SignColumnType)
+		}
+	}
+
+	if cfg.SerialGapColumn != "" {
+		pgCol, ok := cfg.PgColumns[cfg.SerialGapColumn]
+		if !ok || pgCol.PkCol < 1 {
+			return fmt.Errorf("serial gap column %q must be a primary key column", cfg.SerialGapColumn)
+		}
+
+		if pgCol.BaseType != utils.PgSmallint && pgCol.BaseType != utils.PgInteger && pgCol.BaseType != utils.PgBigint {
+			return fmt.Errorf("serial gap column %q must be of integer type", cfg.SerialGapColumn)
+		}
+
+		if _, ok := cfg.ColumnMapping[cfg.SerialGapColumn]; !ok {
+			return fmt.Errorf("serial gap column %q is not mapped to the clickhouse table", cfg.SerialGapColumn)
+		}
+	}
+
+	for pgCol := range cfg.ColumnProperties {
+		if _, ok := cfg.PgColumns[pgCol]; !ok {
+			return fmt.Errorf("column properties are set for unknown %q column", pgCol)
+		}
+	}
+
+	if cfg.ShadowOf != "" {
+		shadowOfColumns, err := r.chSchema.Columns(cfg.ShadowOf)
+		if err != nil {
+			return fmt.Errorf("could not get columns for %q clickhouse table: %w", cfg.ShadowOf, err)
+		}
+
+		for _, chCol := range cfg.ColumnMapping {
+			if _, ok := shadowOfColumns[chCol.Name]; !ok {
+				return fmt.Errorf("%w: could not find %q column in %q clickhouse table",
+					utils.ErrSchemaMismatch, chCol.Name, cfg.ShadowOf)
+			}
+		}
+	}
+
+	return nil
 }
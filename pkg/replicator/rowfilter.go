@@ -0,0 +1,124 @@
+package replicator
+
+import (
+	"fmt"
+
+	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+	"github.com/mkabilov/pg2ch/pkg/utils/expr"
+)
+
+// filteredTable writes only the changes of the rows matching the row filter of the table; the initial sync
+// copies the matching rows only, the filter being its WHERE clause
+type filteredTable struct {
+	clickHouseTable
+
+	filter  expr.Expr
+	columns []message.Column
+}
+
+func newFilteredTable(tbl clickHouseTable, filter expr.Expr) *filteredTable {
+	return &filteredTable{
+		clickHouseTable: tbl,
+		filter:          filter,
+	}
+}
+
+// SetTupleColumns sets the tuple columns the filter is evaluated over
+func (t *filteredTable) SetTupleColumns(columns []message.Column) {
+	t.columns = columns
+	t.clickHouseTable.SetTupleColumns(columns)
+}
+
+// eval evaluates the filter over the row, NULL if it is unknown. The unchanged TOASTed values are taken
+// from the old row if it has them, i.e. with FULL replica identity; the ones still unknown are NULL if
+// unknownNull is set, otherwise the filter referencing them fails instead of taking NULL
+func (t *filteredTable) eval(row, old message.Row, unknownNull bool) (expr.Value, error) {
+	env := make(expr.Env, len(t.columns))
+	for colID, col := range t.columns {
+		if colID >= len(row) {
+			break
+		}
+
+		tuple := row[colID]
+		if tuple.Kind == message.TupleUnchanged && colID < len(old) {
+			tuple = old[colID]
+		}
+		if tuple.Kind == message.TupleUnchanged && !unknownNull {
+			continue
+		}
+
+		env[col.Name] = expr.Value{Str: string(tuple.Value), Null: tuple.Kind != message.TupleText}
+	}
+
+	val, err := t.filter.Eval(env)
+	if err != nil {
+		return val, fmt.Errorf("%w: could not evaluate row filter: %v", utils.ErrConversion, err)
+	}
+
+	return val, nil
+}
+
+// matches checks if the row matches the filter, the old row fills its unchanged TOASTed values
+func (t *filteredTable) matches(row, old message.Row) (bool, error) {
+	val, err := t.eval(row, old, false)
+
+	return expr.IsTrue(val), err
+}
+
+// mayMatch checks if the old row could have been written: it is unless the filter is false, e.g. the old row
+// may miss the values of the columns not in the replica identity
+func (t *filteredTable) mayMatch(row message.Row) (bool, error) {
+	if len(row) == 0 {
+		return true, nil
+	}
+
+	val, err := t.eval(row, nil, true)
+
+	return val.Null || expr.IsTrue(val), err
+}
+
+// Insert handles incoming insert DML operation
+func (t *filteredTable) Insert(lsn utils.LSN, new message.Row) (bool, error) {
+	if ok, err := t.matches(new, nil); err != nil || !ok {
+		return false, err
+	}
+
+	return t.clickHouseTable.Insert(lsn, new)
+}
+
+// Update handles incoming update DML operation, the row moving out of the filter is deleted,
+// the one moving into it is inserted
+func (t *filteredTable) Update(lsn utils.LSN, old, new message.Row) (bool, error) {
+	newMatches, err := t.matches(new, old)
+	if err != nil {
+		return false, err
+	}
+
+	oldMatches, err := t.mayMatch(old)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case newMatches && oldMatches:
+		return t.clickHouseTable.Update(lsn, old, new)
+	case newMatches:
+		return t.clickHouseTable.Insert(lsn, new)
+	case oldMatches && len(old) == 0:
+		return t.clickHouseTable.Delete(lsn, new) // the key is not changed
+	case oldMatches:
+		return t.clickHouseTable.Delete(lsn, old)
+	}
+
+	return false, nil
+}
+
+// Delete handles incoming delete DML operation
+func (t *filteredTable) Delete(lsn utils.LSN, old message.Row) (bool, error) {
+	if ok, err := t.mayMatch(old); err != nil || !ok {
+		return false, err
+	}
+
+	return t.clickHouseTable.Delete(lsn, old)
+}
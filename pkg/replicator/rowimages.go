@@ -0,0 +1,435 @@
+package replicator
+
+import (
+	"container/list"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jackc/pgx"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/stats"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+// rowImageTable completes the old rows of the tables without FULL replica identity: postgres sends only the key
+// of the updated and deleted rows, the rest of the columns are taken from the recently seen images of the rows,
+// so that the engines writing the old rows, e.g. CollapsingMergeTree, cancel the right ones; with the lookup
+// the changes are held from the first old row missing in the cache on, until its current row is selected
+// from postgres along with the ones of the next changes
+type rowImageTable struct {
+	clickHouseTable
+
+	size    int
+	columns []message.Column
+	keyCols []int // positions of the key columns in the tuple columns, ordered by the column name
+	cache   map[string]*list.Element
+	lru     *list.List // of *rowImage, most recently used first
+	stats   *stats.Table
+
+	lookup  *rowLookup             // nil if the rows missing in the cache are not looked up
+	pending []pendingChange        // changes waiting for the lookup, in order
+	fetched map[string]message.Row // rows selected by the lookup, while the pending changes are applied
+	err     error                  // error of the lookup outside of the changes, returned by the next one
+}
+
+// pendingChange is the change held until the lookup of the old rows missing in the cache
+type pendingChange struct {
+	op       byte // 'I', 'U' or 'D'
+	lsn      utils.LSN
+	old, new message.Row
+}
+
+// rowImage is the last known row, its tuple columns may differ from the current ones, e.g. for partitions
+type rowImage struct {
+	key     string
+	columns []message.Column
+	row     message.Row
+}
+
+func newRowImageTable(tbl clickHouseTable, size int, tblStats *stats.Table, lookup *rowLookup) *rowImageTable {
+	return &rowImageTable{
+		clickHouseTable: tbl,
+		size:            size,
+		cache:           make(map[string]*list.Element),
+		lru:             list.New(),
+		stats:           tblStats,
+		lookup:          lookup,
+	}
+}
+
+// SetTupleColumns sets the tuple columns the keys of the rows are taken from, the pending changes
+// are applied with the previous ones
+func (t *rowImageTable) SetTupleColumns(columns []message.Column) {
+	if _, err := t.resolve(); err != nil && t.err == nil {
+		t.err = err
+	}
+
+	t.columns = columns
+	t.keyCols = t.keyCols[:0]
+	for colID, col := range columns {
+		if col.IsKey {
+			t.keyCols = append(t.keyCols, colID)
+		}
+	}
+	sort.Slice(t.keyCols, func(i, j int) bool { return columns[t.keyCols[i]].Name < columns[t.keyCols[j]].Name })
+
+	t.clickHouseTable.SetTupleColumns(columns)
+}
+
+// key returns the key of the row, false if the table has no key columns
+func (t *rowImageTable) key(row message.Row) (string, bool) {
+	if len(t.keyCols) == 0 {
+		return "", false
+	}
+
+	var sb strings.Builder
+	for _, colID := range t.keyCols {
+		if colID >= len(row) {
+			return "", false
+		}
+		sb.WriteByte(byte(row[colID].Kind))
+		sb.Write(row[colID].Value)
+		sb.WriteByte(0)
+	}
+
+	return sb.String(), true
+}
+
+// keyOnly checks if the old row has only the key columns: it is missing or all the other columns are NULL
+func (t *rowImageTable) keyOnly(row message.Row) bool {
+	if len(row) == 0 {
+		return true
+	}
+
+	for colID, col := range t.columns {
+		if !col.IsKey && colID < len(row) && row[colID].Kind != message.TupleNull {
+			return false
+		}
+	}
+
+	return true
+}
+
+// image returns the cached row of the key in the order of the current tuple columns
+func (t *rowImageTable) image(key string) (message.Row, bool) {
+	el, ok := t.cache[key]
+	if !ok {
+		return nil, false
+	}
+	t.lru.MoveToFront(el)
+
+	img := el.Value.(*rowImage)
+	if sameColumns(img.columns, t.columns) {
+		return img.row, true
+	}
+
+	positions := make(map[string]int, len(img.columns))
+	for colID, col := range img.columns {
+		positions[col.Name] = colID
+	}
+
+	row := make(message.Row, len(t.columns))
+	for colID, col := range t.columns {
+		pos, ok := positions[col.Name]
+		if !ok || pos >= len(img.row) {
+			return nil, false // the column is added after the row was seen
+		}
+		row[colID] = img.row[pos]
+	}
+
+	return row, true
+}
+
+func sameColumns(a, b []message.Column) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// store caches the row evicting the least recently used one
+func (t *rowImageTable) store(key string, row message.Row) {
+	if el, ok := t.cache[key]; ok {
+		img := el.Value.(*rowImage)
+		img.columns, img.row = t.columns, row
+		t.lru.MoveToFront(el)
+		return
+	}
+
+	t.cache[key] = t.lru.PushFront(&rowImage{key: key, columns: t.columns, row: row})
+	if t.lru.Len() > t.size {
+		oldest := t.lru.Back()
+		t.lru.Remove(oldest)
+		delete(t.cache, oldest.Value.(*rowImage).key)
+	}
+}
+
+func (t *rowImageTable) forget(key string) {
+	if el, ok := t.cache[key]; ok {
+		t.lru.Remove(el)
+		delete(t.cache, key)
+	}
+}
+
+// complete returns the old row completed from the cache if it has the key only
+func (t *rowImageTable) complete(old message.Row, key string) message.Row {
+	if !t.keyOnly(old) {
+		return old
+	}
+
+	if img, ok := t.image(key); ok {
+		atomic.AddUint64(&t.stats.RowImageHits, 1)
+		return img
+	}
+
+	if row, ok := t.fetched[key]; ok {
+		atomic.AddUint64(&t.stats.RowLookupHits, 1)
+		return row
+	}
+	atomic.AddUint64(&t.stats.RowImageMisses, 1)
+
+	return old
+}
+
+// withUnchanged fills the unchanged TOASTed values of the new row from the old one
+func withUnchanged(new, old message.Row) message.Row {
+	res := new
+	for colID, tuple := range new {
+		if tuple.Kind != message.TupleUnchanged || colID >= len(old) || old[colID].Kind == message.TupleUnchanged {
+			continue
+		}
+
+		if &res[0] == &new[0] {
+			res = append(message.Row(nil), new...)
+		}
+		res[colID] = old[colID]
+	}
+
+	return res
+}
+
+// missing checks if the old row of the change has the key only and its image is not in the cache
+func (t *rowImageTable) missing(old, new message.Row) bool {
+	if !t.keyOnly(old) {
+		return false
+	}
+
+	row := old
+	if len(row) == 0 {
+		row = new // the key is not changed
+	}
+
+	key, ok := t.key(row)
+	if !ok {
+		return false
+	}
+	_, ok = t.cache[key]
+
+	return !ok
+}
+
+// hold adds the change to the pending ones, looking them up once there are the batch size of them;
+// the pending changes count as buffered rows, so that the slot is not advanced past them
+func (t *rowImageTable) hold(change pendingChange) (bool, error) {
+	if t.err != nil {
+		return false, t.err
+	}
+
+	t.pending = append(t.pending, change)
+	t.stats.AddBuffered(1, 0)
+	if len(t.pending) < t.lookup.batchSize {
+		return false, nil
+	}
+
+	return t.resolve()
+}
+
+// resolve selects the current rows of the pending changes missing in the cache and applies the changes
+func (t *rowImageTable) resolve() (bool, error) {
+	if len(t.pending) == 0 {
+		return false, nil
+	}
+	pending := t.pending
+	t.pending = nil
+	t.stats.AddBuffered(-int64(len(pending)), 0)
+
+	keys := make([]message.Row, 0, len(pending))
+	seen := make(map[string]struct{}, len(pending))
+	for _, change := range pending {
+		if change.op == 'I' || !t.missing(change.old, change.new) {
+			continue
+		}
+
+		row := change.old
+		if len(row) == 0 {
+			row = change.new
+		}
+		key, _ := t.key(row)
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			keys = append(keys, row)
+		}
+	}
+
+	fetched, err := t.lookup.fetch(t.columns, t.keyCols, keys, t.key)
+	if err != nil {
+		return false, err
+	}
+	t.fetched = fetched
+	defer func() { t.fetched = nil }()
+
+	mergeIsNeeded := false
+	for _, change := range pending {
+		var merge bool
+		switch change.op {
+		case 'I':
+			merge, err = t.insert(change.lsn, change.new)
+		case 'U':
+			merge, err = t.update(change.lsn, change.old, change.new)
+		case 'D':
+			merge, err = t.delete(change.lsn, change.old)
+		}
+		if err != nil {
+			return false, err
+		}
+		mergeIsNeeded = mergeIsNeeded || merge
+	}
+
+	return mergeIsNeeded, nil
+}
+
+// Insert handles incoming insert DML operation
+func (t *rowImageTable) Insert(lsn utils.LSN, new message.Row) (bool, error) {
+	if t.lookup != nil && len(t.pending) > 0 {
+		return t.hold(pendingChange{op: 'I', lsn: lsn, new: new})
+	}
+
+	return t.insert(lsn, new)
+}
+
+func (t *rowImageTable) insert(lsn utils.LSN, new message.Row) (bool, error) {
+	if key, ok := t.key(new); ok {
+		t.store(key, new)
+	}
+
+	return t.clickHouseTable.Insert(lsn, new)
+}
+
+// Update handles incoming update DML operation, the key-only old row is completed from the cache
+func (t *rowImageTable) Update(lsn utils.LSN, old, new message.Row) (bool, error) {
+	if t.lookup != nil && (len(t.pending) > 0 || t.missing(old, new)) {
+		return t.hold(pendingChange{op: 'U', lsn: lsn, old: old, new: new})
+	}
+
+	return t.update(lsn, old, new)
+}
+
+func (t *rowImageTable) update(lsn utils.LSN, old, new message.Row) (bool, error) {
+	newKey, ok := t.key(new)
+	if !ok {
+		return t.clickHouseTable.Update(lsn, old, new)
+	}
+
+	oldKey := newKey
+	if len(old) > 0 {
+		oldKey, _ = t.key(old)
+	}
+
+	old = t.complete(old, oldKey)
+	new = withUnchanged(new, old)
+	if oldKey != newKey {
+		t.forget(oldKey)
+	}
+	t.store(newKey, new)
+
+	return t.clickHouseTable.Update(lsn, old, new)
+}
+
+// Delete handles incoming delete DML operation, the key-only old row is completed from the cache
+func (t *rowImageTable) Delete(lsn utils.LSN, old message.Row) (bool, error) {
+	if t.lookup != nil && (len(t.pending) > 0 || t.missing(old, nil)) {
+		return t.hold(pendingChange{op: 'D', lsn: lsn, old: old})
+	}
+
+	return t.delete(lsn, old)
+}
+
+func (t *rowImageTable) delete(lsn utils.LSN, old message.Row) (bool, error) {
+	key, ok := t.key(old)
+	if !ok {
+		return t.clickHouseTable.Delete(lsn, old)
+	}
+
+	old = t.complete(old, key)
+	t.forget(key)
+
+	return t.clickHouseTable.Delete(lsn, old)
+}
+
+// Truncate drops the cached rows along with the rows of the table
+func (t *rowImageTable) Truncate() error {
+	if _, err := t.resolve(); err != nil {
+		return err
+	}
+
+	t.cache = make(map[string]*list.Element)
+	t.lru.Init()
+
+	return t.clickHouseTable.Truncate()
+}
+
+// FlushToMainTable applies the pending changes before the flush
+func (t *rowImageTable) FlushToMainTable() error {
+	if t.err != nil {
+		return t.err
+	}
+
+	if _, err := t.resolve(); err != nil {
+		return err
+	}
+
+	return t.clickHouseTable.FlushToMainTable()
+}
+
+// AddColumns applies the pending changes before the columns are added
+func (t *rowImageTable) AddColumns(pgColumns map[string]config.PgColumn, chColumns map[string]config.ChColumn) error {
+	if _, err := t.resolve(); err != nil {
+		return err
+	}
+
+	return t.clickHouseTable.AddColumns(pgColumns, chColumns)
+}
+
+// SetSyncConnFunc sets the function opening the connection of the lookups too
+func (t *rowImageTable) SetSyncConnFunc(fn func() (*pgx.Conn, error)) {
+	if t.lookup != nil {
+		t.lookup.connFunc = fn
+	}
+
+	t.clickHouseTable.SetSyncConnFunc(fn)
+}
+
+// DiscardTx drops the pending changes of the interrupted transaction along with the buffered ones
+func (t *rowImageTable) DiscardTx(lsn utils.LSN) {
+	n := len(t.pending)
+	for n > 0 && t.pending[n-1].lsn == lsn {
+		n--
+	}
+	t.stats.AddBuffered(-int64(len(t.pending)-n), 0)
+	t.pending = t.pending[:n]
+
+	t.clickHouseTable.DiscardTx(lsn)
+}
+
+// Release closes the connection of the lookups, the table with pending changes is not released
+func (t *rowImageTable) Release() bool {
+	if len(t.pending) > 0 {
+		return false
+	}
+
+	if t.lookup != nil {
+		t.lookup.close()
+	}
+
+	return t.clickHouseTable.Release()
+}
@@ -0,0 +1,199 @@
+package replicator
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/stats"
+)
+
+// rowLookup selects the current rows of the keys missing in the row image cache from postgres, in batches
+// of the keys, paced to the max number of queries per second
+type rowLookup struct {
+	ctx          context.Context
+	tblName      config.PgTableName
+	pgColumns    map[string]config.PgColumn
+	batchSize    int
+	maxPerSecond int
+	stats        *stats.Table
+
+	connFunc  func() (*pgx.Conn, error)
+	conn      *pgx.Conn // opened on the first lookup, closed when the table is released
+	lastQuery time.Time
+}
+
+func newRowLookup(ctx context.Context, tblName config.PgTableName, tblConfig config.Table, tblStats *stats.Table) *rowLookup {
+	return &rowLookup{
+		ctx:          ctx,
+		tblName:      tblName,
+		pgColumns:    tblConfig.PgColumns,
+		batchSize:    tblConfig.RowLookupBatchSize,
+		maxPerSecond: tblConfig.RowLookupMaxPerSecond,
+		stats:        tblStats,
+	}
+}
+
+// fetch returns the rows of the keys, by the key; the rows deleted since are not there
+func (l *rowLookup) fetch(columns []message.Column, keyCols []int, keys []message.Row,
+	keyOf func(message.Row) (string, bool)) (map[string]message.Row, error) {
+	res := make(map[string]message.Row, len(keys))
+
+	for start := 0; start < len(keys); start += l.batchSize {
+		end := start + l.batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		if err := l.fetchBatch(columns, keyCols, keys[start:end], keyOf, res); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+func (l *rowLookup) fetchBatch(columns []message.Column, keyCols []int, keys []message.Row,
+	keyOf func(message.Row) (string, bool), res map[string]message.Row) error {
+	selectList := make([]string, len(columns))
+	for colID, col := range columns {
+		selectList[colID] = pgx.Identifier{col.Name}.Sanitize() + "::text"
+	}
+
+	keyList := make([]string, len(keyCols))
+	for i, colID := range keyCols {
+		keyList[i] = pgx.Identifier{columns[colID].Name}.Sanitize()
+	}
+
+	args := make([]interface{}, 0, len(keys)*len(keyCols))
+	tuples := make([]string, len(keys))
+	for i, key := range keys {
+		params := make([]string, len(keyCols))
+		for j, colID := range keyCols {
+			pgCol, ok := l.pgColumns[columns[colID].Name]
+			if !ok {
+				return fmt.Errorf("unknown type of %q key column", columns[colID].Name)
+			}
+
+			// the text of the key is cast to the column type, so that the key index is used
+			args = append(args, string(key[colID].Value))
+			params[j] = fmt.Sprintf("$%d::text::%s", len(args), pgTypeName(pgCol))
+		}
+		tuples[i] = "(" + strings.Join(params, ", ") + ")"
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE (%s) IN (%s)", strings.Join(selectList, ", "),
+		pgx.Identifier{l.tblName.SchemaName, l.tblName.TableName}.Sanitize(), strings.Join(keyList, ", "),
+		strings.Join(tuples, ", "))
+
+	if err := l.pace(); err != nil {
+		return err
+	}
+
+	conn, err := l.connection()
+	if err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&l.stats.RowLookups, 1)
+	rows, err := conn.Query(query, args...)
+	if err != nil {
+		l.close()
+		return fmt.Errorf("could not look up the rows: %w", err)
+	}
+	defer rows.Close()
+
+	fields := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range fields {
+		dest[i] = &fields[i]
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return fmt.Errorf("could not scan: %w", err)
+		}
+
+		row := make(message.Row, len(columns))
+		for colID, field := range fields {
+			if !field.Valid {
+				row[colID] = message.Tuple{Kind: message.TupleNull}
+				continue
+			}
+			row[colID] = message.Tuple{Kind: message.TupleText, Value: []byte(field.String)}
+		}
+
+		if key, ok := keyOf(row); ok {
+			res[key] = row
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		l.close()
+		return fmt.Errorf("could not look up the rows: %w", err)
+	}
+
+	return nil
+}
+
+// pace sleeps if the lookups go faster than allowed
+func (l *rowLookup) pace() error {
+	if l.maxPerSecond == 0 {
+		return nil
+	}
+
+	delay := time.Second/time.Duration(l.maxPerSecond) - time.Since(l.lastQuery)
+	if delay > 0 {
+		select {
+		case <-l.ctx.Done():
+			return l.ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	l.lastQuery = time.Now()
+
+	return nil
+}
+
+func (l *rowLookup) connection() (*pgx.Conn, error) {
+	if l.conn != nil {
+		return l.conn, nil
+	}
+
+	if l.connFunc == nil {
+		return nil, fmt.Errorf("no postgres connection for the row lookups")
+	}
+
+	conn, err := l.connFunc()
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to pg: %w", err)
+	}
+	l.conn = conn
+
+	return conn, nil
+}
+
+func (l *rowLookup) close() {
+	if l.conn == nil {
+		return
+	}
+
+	l.conn.Close()
+	l.conn = nil
+}
+
+// pgTypeName returns the name of the column type the text values are cast to
+func pgTypeName(pgCol config.PgColumn) string {
+	if pgCol.IsArray {
+		return pgCol.BaseType + "[]"
+	}
+
+	return pgCol.BaseType
+}
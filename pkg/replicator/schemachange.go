@@ -0,0 +1,153 @@
+package replicator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+	"github.com/mkabilov/pg2ch/pkg/utils/chutils"
+	"github.com/mkabilov/pg2ch/pkg/utils/tableinfo"
+)
+
+// applyRelation sets the tuple columns of the table from the relation message and handles the new columns
+func (r *Replicator) applyRelation(oid utils.OID, tblName config.PgTableName, chTbl clickHouseTable,
+	columns []message.Column) error {
+	chTbl.SetTupleColumns(columns)
+	if _, ok := r.inheritedOf[oid]; ok { // the columns of the children are a superset of the parent ones
+		return nil
+	}
+
+	if err := r.addNewColumns(tblName, chTbl, columns); err != nil {
+		return fmt.Errorf("could not add new columns of %s: %w", tblName.String(), err)
+	}
+
+	return nil
+}
+
+// addNewColumns handles the columns added to the pg table while replicating: they are mapped to the clickhouse
+// columns of the same name, created first with add_columns; the columns left unmapped are ignored with a warning
+func (r *Replicator) addNewColumns(tblName config.PgTableName, chTbl clickHouseTable, columns []message.Column) error {
+	newColumns := chTbl.NewColumns(columns)
+	if len(newColumns) == 0 {
+		return nil
+	}
+	tblCfg := r.cfg.Tables[tblName]
+
+	tx, err := r.pgBegin()
+	if err != nil {
+		return err
+	}
+	_, pgColumns, err := tableinfo.TablePgColumns(tx, tblName)
+	_ = tx.Rollback()
+	if err != nil {
+		return fmt.Errorf("could not get columns for %s postgres table: %w", tblName.String(), err)
+	}
+
+	addedColumns := make(map[string]config.PgColumn)
+	for _, colName := range newColumns {
+		if pgCol, ok := pgColumns[colName]; ok {
+			addedColumns[colName] = pgCol
+		} else {
+			r.log.Info("new column is already dropped, ignored", "table", tblName.String(), "column", colName)
+		}
+	}
+
+	chColumns := make(map[string]config.ChColumn)
+	if len(tblCfg.Columns) == 0 {
+		chColumns, err = r.chNewColumns(tblCfg, addedColumns)
+		if err != nil {
+			return err
+		}
+	}
+
+	for colName := range addedColumns {
+		if _, ok := chColumns[colName]; ok {
+			r.log.Info("new column is replicated", "table", tblName.String(), "column", colName,
+				"ch_table", tblCfg.ChMainTable)
+		} else {
+			r.log.Warn("new column is ignored: no such column in the clickhouse table "+
+				"or it is not in the columns of the table config", "table", tblName.String(), "column", colName,
+				"ch_table", tblCfg.ChMainTable)
+		}
+	}
+
+	return chTbl.AddColumns(addedColumns, chColumns)
+}
+
+// chNewColumns returns the clickhouse columns for the new pg columns; the column has to be
+// in both main and buffer tables to be replicated
+func (r *Replicator) chNewColumns(tblCfg config.Table, pgColumns map[string]config.PgColumn) (map[string]config.ChColumn, error) {
+	tables := []string{tblCfg.ChMainTable}
+	if tblCfg.ChBufferTable != "" {
+		tables = append(tables, tblCfg.ChBufferTable)
+	}
+
+	res := make(map[string]config.ChColumn)
+	for i, chTblName := range tables {
+		chColumns, err := r.chAddColumns(tblCfg, chTblName, pgColumns)
+		if err != nil {
+			return nil, err
+		}
+
+		for colName := range pgColumns {
+			chCol, ok := chColumns[colName]
+			if !ok {
+				delete(res, colName)
+			} else if i == 0 {
+				res[colName] = chCol
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// chAddColumns returns the columns of the clickhouse table, adding the missing pg columns first with add_columns
+func (r *Replicator) chAddColumns(tblCfg config.Table, chTblName string,
+	pgColumns map[string]config.PgColumn) (map[string]config.ChColumn, error) {
+	// the columns may have been added to the clickhouse table along with the pg ones
+	chColumns, err := r.chSchema.Refresh(chTblName)
+	if err != nil {
+		return nil, fmt.Errorf("could not get columns for %q clickhouse table: %w", chTblName, err)
+	}
+
+	if !tblCfg.AddColumns || r.cfg.Inspect {
+		return chColumns, nil
+	}
+
+	alters := make([]string, 0)
+	for colName, pgCol := range pgColumns {
+		if _, ok := chColumns[colName]; ok {
+			continue
+		}
+
+		chType, err := chutils.ToClickHouseType(pgCol, tblCfg.EnumMapping == config.EnumMappingLowCardinality)
+		if err != nil {
+			r.log.Warn("could not add column to the clickhouse table", "ch_table", chTblName, "column", colName, "error", err)
+			continue
+		}
+		if chTblName == tblCfg.ChBufferTable || tblCfg.ChBufferTable == "" {
+			chType = chutils.WritableType(chType)
+		}
+		alters = append(alters, fmt.Sprintf("ADD COLUMN IF NOT EXISTS %s %s", colName, chType))
+	}
+
+	if len(alters) == 0 {
+		return chColumns, nil
+	}
+
+	query := fmt.Sprintf("ALTER TABLE %s%s %s", chTblName, chutils.OnCluster(r.cfg.ClickHouse.Cluster), strings.Join(alters, ", "))
+	if _, err := r.chConn.Exec(query); err != nil {
+		return nil, fmt.Errorf("could not add columns to %q clickhouse table: %w", chTblName, err)
+	}
+	r.log.Info("executed", "query", query)
+
+	chColumns, err = r.chSchema.Refresh(chTblName)
+	if err != nil {
+		return nil, fmt.Errorf("could not get columns for %q clickhouse table: %w", chTblName, err)
+	}
+
+	return chColumns, nil
+}
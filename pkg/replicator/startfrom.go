@@ -0,0 +1,106 @@
+package replicator
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/decoder"
+	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+// startFromTimestamp sets the lsn of the tables having no stored lsn position, so that streaming starts from
+// the first transaction committed after the start-from timestamp instead of the initial sync;
+// the retained changes of the slot are scanned for the commit lsn
+func (r *Replicator) startFromTimestamp() error {
+	if r.cfg.StartFrom.IsZero() {
+		return nil
+	}
+
+	tables := make([]config.PgTableName, 0)
+	for tblName := range r.cfg.Tables {
+		if _, ok := r.tableLSN[tblName]; !ok {
+			tables = append(tables, tblName)
+		}
+	}
+
+	if len(tables) == 0 {
+		r.log.Info("all the tables have stored lsn positions, start-from timestamp is ignored")
+		return nil
+	}
+
+	lsn, err := r.lastCommitBefore(r.cfg.StartFrom)
+	if err != nil {
+		return err
+	}
+
+	for _, tblName := range tables {
+		r.log.Info("streaming starts after the last commit before the start-from time",
+			"table", tblName.String(), "lsn", lsn, "start_from", r.cfg.StartFrom.Format(time.RFC3339))
+		if err := r.storeTableLSN(tblName, lsn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lastCommitBefore returns the commit lsn of the last transaction retained by the slot committed not after ts
+func (r *Replicator) lastCommitBefore(ts time.Time) (utils.LSN, error) {
+	var (
+		found      bool
+		lsn        utils.LSN
+		oldestSeen time.Time
+	)
+
+	rows, err := r.pgConn.Query("select data from pg_logical_slot_peek_binary_changes($1, NULL, NULL, 'proto_version', '1', 'publication_names', $2)",
+		r.cfg.Postgres.ReplicationSlotName, r.cfg.Postgres.PublicationName)
+	if err != nil {
+		return utils.InvalidLSN, fmt.Errorf("could not peek slot changes: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+
+		if err := rows.Scan(&data); err != nil {
+			return utils.InvalidLSN, fmt.Errorf("could not scan: %w", err)
+		}
+
+		if len(data) == 0 || data[0] != 'C' {
+			continue
+		}
+
+		msg, err := decoder.Parse(data)
+		if err != nil {
+			return utils.InvalidLSN, fmt.Errorf("could not parse commit message: %w", err)
+		}
+
+		commit := msg.(message.Commit)
+		if oldestSeen.IsZero() {
+			oldestSeen = commit.Timestamp
+		}
+
+		if commit.Timestamp.After(ts) {
+			break
+		}
+		lsn, found = commit.LSN, true
+	}
+
+	if err := rows.Err(); err != nil {
+		return utils.InvalidLSN, fmt.Errorf("could not peek slot changes: %w", err)
+	}
+
+	if !found {
+		if oldestSeen.IsZero() {
+			return utils.InvalidLSN, fmt.Errorf("%q slot retains no transactions to find the start position in",
+				r.cfg.Postgres.ReplicationSlotName)
+		}
+
+		return utils.InvalidLSN, fmt.Errorf("%v is before the oldest transaction retained by %q slot committed at %v",
+			ts.Format(time.RFC3339), r.cfg.Postgres.ReplicationSlotName, oldestSeen.Format(time.RFC3339))
+	}
+
+	return lsn, nil
+}
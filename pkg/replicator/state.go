@@ -0,0 +1,215 @@
+package replicator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/peterbourgon/diskv"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+const (
+	stateKey     = "state"
+	stateVersion = 1
+	stateTempDir = "tmp" // temporary files of the atomic writes, on the same file system as the state
+)
+
+// persState is the snapshot of all the positions of the replication, stored at once, so that a crash never
+// leaves the tables at the positions stored at different moments
+type persState struct {
+	Version      int               `json:"version"`
+	Seq          uint64            `json:"seq"`      // incremented on each write
+	SlotLSN      string            `json:"slot_lsn"` // lsn the replication slot was last advanced to
+	GenerationID uint64            `json:"generation_id"`
+	Tables       map[string]string `json:"tables"`           // lsn each table is consistent with
+	Frozen       []string          `json:"frozen,omitempty"` // tables the changes of which are spooled to disk
+}
+
+// openPersStorage opens the persistent storage; the files are written to the temporary directory
+// and renamed, so the state is either the old or the new one after a crash
+func openPersStorage(path string) *diskv.Diskv {
+	return diskv.New(diskv.Options{
+		BasePath:     path,
+		TempDir:      filepath.Join(path, stateTempDir),
+		CacheSizeMax: 1024 * 1024, // 1MB
+	})
+}
+
+// isStateKey checks if the key belongs to the replication state, which is never modified via the redis api
+func isStateKey(key string) bool {
+	return key == stateKey || key == generationIDKey || strings.HasPrefix(key, tableLSNKeyPrefix)
+}
+
+// saveState writes the snapshot of the table lsns, the slot lsn and the generation id
+func (r *Replicator) saveState() error {
+	if r.cfg.Inspect {
+		return nil
+	}
+
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+
+	state := persState{
+		Version:      stateVersion,
+		Seq:          r.stateSeq + 1,
+		SlotLSN:      r.slotLSN.String(),
+		GenerationID: atomic.LoadUint64(&r.generationID),
+		Tables:       make(map[string]string, len(r.tableLSN)),
+	}
+	for tblName, lsn := range r.tableLSN {
+		state.Tables[tblName.String()] = lsn.String()
+	}
+	for tblName := range r.frozen {
+		state.Frozen = append(state.Frozen, tblName.String())
+	}
+	sort.Strings(state.Frozen)
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("could not marshal state: %w", err)
+	}
+
+	if err := r.persStorage.WriteStream(stateKey, bytes.NewReader(data), true); err != nil {
+		return fmt.Errorf("could not write state: %w", err)
+	}
+	r.stateSeq = state.Seq
+	r.savedSlotLSN = r.slotLSN
+	if r.consumer != nil && r.slotLSN.IsValid() {
+		r.consumer.AdvanceLSN(r.slotLSN)
+	}
+
+	if r.legacyState {
+		r.eraseLegacyState()
+	}
+
+	return nil
+}
+
+// readState loads the positions of the replication, falling back to the per table keys of the older versions
+func (r *Replicator) readState() error {
+	if !r.persStorage.Has(stateKey) {
+		return r.readLegacyState()
+	}
+
+	val, err := r.persStorage.Read(stateKey)
+	if err != nil {
+		return fmt.Errorf("could not read state: %w", err)
+	}
+
+	var state persState
+	if err := json.Unmarshal(val, &state); err != nil {
+		return fmt.Errorf("could not parse state: %w", err)
+	}
+
+	if state.Version > stateVersion {
+		return fmt.Errorf("state version %d is newer than the supported %d", state.Version, stateVersion)
+	}
+
+	for name, val := range state.Tables {
+		var tblName config.PgTableName
+
+		if err := tblName.Parse(name); err != nil {
+			return err
+		}
+
+		lsn := utils.InvalidLSN
+		if err := lsn.Parse(val); err != nil {
+			return fmt.Errorf("could not parse lsn %q of %s table: %w", val, name, err)
+		}
+
+		r.loadTableLSN(tblName, lsn)
+	}
+
+	if err := r.slotLSN.Parse(state.SlotLSN); err != nil {
+		return fmt.Errorf("could not parse slot lsn %q: %w", state.SlotLSN, err)
+	}
+
+	r.stateSeq = state.Seq
+	r.savedSlotLSN = r.slotLSN
+	atomic.StoreUint64(&r.generationID, state.GenerationID)
+	r.log.Info("state loaded", "seq", r.stateSeq, "slot_lsn", r.slotLSN, "generation_id", state.GenerationID)
+
+	return r.loadFrozen(state.Frozen)
+}
+
+// readLegacyState loads the positions stored by the older versions: each table lsn and the generation id
+// in their own keys; they are replaced by the state on its first write
+func (r *Replicator) readLegacyState() error {
+	for key := range r.persStorage.Keys(nil) {
+		if !strings.HasPrefix(key, tableLSNKeyPrefix) {
+			continue
+		}
+		if !r.persStorage.Has(key) {
+			continue
+		}
+		val, err := r.persStorage.Read(key)
+		if err != nil {
+			return fmt.Errorf("could not read %v key: %w", key, err)
+		}
+
+		tblName := &config.PgTableName{}
+		if err := tblName.Parse(key[len(tableLSNKeyPrefix):]); err != nil {
+			return err
+		}
+
+		lsn := utils.InvalidLSN
+		if err := lsn.Parse(string(val)); err != nil {
+			return fmt.Errorf("could not parse lsn %q: %w", string(val), err)
+		}
+
+		r.loadTableLSN(*tblName, lsn)
+		r.legacyState = true
+	}
+
+	if !r.persStorage.Has(generationIDKey) {
+		return nil
+	}
+	r.legacyState = true
+
+	val, err := r.persStorage.Read(generationIDKey)
+	if err != nil {
+		return fmt.Errorf("could not read generation id: %w", err)
+	}
+
+	genID, err := strconv.ParseUint(string(val), 10, 32)
+	if err != nil {
+		r.log.Warn("incorrect value for generation_id in the pers storage", "error", err)
+	}
+
+	atomic.StoreUint64(&r.generationID, uint64(genID))
+	r.log.Info("generation id loaded", "generation_id", genID)
+
+	return nil
+}
+
+// eraseLegacyState removes the per table keys once the state is written
+func (r *Replicator) eraseLegacyState() {
+	keys := make([]string, 0)
+	for key := range r.persStorage.Keys(nil) {
+		if key == generationIDKey || strings.HasPrefix(key, tableLSNKeyPrefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range keys {
+		if err := r.persStorage.Erase(key); err != nil {
+			r.log.Warn("could not erase legacy state key", "key", key, "error", err)
+			return
+		}
+	}
+	r.legacyState = false
+}
+
+func (r *Replicator) loadTableLSN(tblName config.PgTableName, lsn utils.LSN) {
+	r.tableLSN[tblName] = lsn
+	atomic.StoreUint64(&r.stats.Table(tblName.String()).LSN, uint64(lsn))
+	r.log.Info("consuming changes of the table", "table", tblName.String(), "lsn", lsn)
+}
@@ -0,0 +1,223 @@
+package replicator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mkabilov/pg2ch/pkg/utils/chutils"
+)
+
+const (
+	watermarksTable = "watermarks"
+	publishIDsTable = "publish_ids"
+)
+
+// systemTable describes clickhouse table pg2ch stores its own data in
+type systemTable struct {
+	columns  []string
+	orderBy  string
+	ttlField string
+}
+
+var systemTables = map[string]systemTable{
+	watermarksTable: {
+		columns: []string{
+			"table_name String",
+			"lsn UInt64",
+			"generation_id UInt64",
+			"created_at DateTime",
+		},
+		orderBy:  "(table_name, lsn)",
+		ttlField: "created_at",
+	},
+	publishIDsTable: {
+		columns: []string{
+			"publish_id UInt64",
+			"lsn UInt64",
+			"tables Array(String)",
+			"created_at DateTime",
+		},
+		orderBy:  "publish_id",
+		ttlField: "created_at",
+	},
+}
+
+// sysTableName returns fully qualified name of the system table
+func (r *Replicator) sysTableName(name string) string {
+	return fmt.Sprintf("%s.%s%s", r.cfg.SystemTables.Database, r.cfg.SystemTables.Prefix, name)
+}
+
+// usedSystemTables returns names of the system tables needed by the enabled features
+func (r *Replicator) usedSystemTables() []string {
+	tables := make([]string, 0)
+	if r.cfg.Inspect {
+		return tables
+	}
+
+	if r.cfg.SystemTables.Watermarks {
+		tables = append(tables, watermarksTable)
+	}
+
+	if r.cfg.SystemTables.PublishIDs {
+		tables = append(tables, publishIDsTable)
+	}
+
+	return tables
+}
+
+// createSystemTables creates system database and the system tables used
+func (r *Replicator) createSystemTables() error {
+	tables := r.usedSystemTables()
+	if len(tables) == 0 {
+		return nil
+	}
+
+	if r.cfg.RestrictedPrivileges {
+		return r.checkSystemTables(tables)
+	}
+
+	if !r.chSupportsTTL() {
+		r.log.Warn("clickhouse server does not support TTL, rows of the system tables are not expired",
+			"version", r.chVersion.String())
+	}
+
+	if _, err := r.chConn.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s%s",
+		r.cfg.SystemTables.Database, chutils.OnCluster(r.cfg.ClickHouse.Cluster))); err != nil {
+		return fmt.Errorf("could not create %q database: %w", r.cfg.SystemTables.Database, err)
+	}
+
+	for _, name := range tables {
+		if _, err := r.chConn.Exec(r.systemTableDDL(name)); err != nil {
+			return fmt.Errorf("could not create %q system table: %w", r.sysTableName(name), err)
+		}
+	}
+
+	return nil
+}
+
+func (r *Replicator) systemTableDDL(name string) string {
+	tbl := systemTables[name]
+
+	ddl := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s%s (%s) ENGINE = MergeTree() ORDER BY %s",
+		r.sysTableName(name), chutils.OnCluster(r.cfg.ClickHouse.Cluster), strings.Join(tbl.columns, ", "), tbl.orderBy)
+	if !r.chSupportsTTL() {
+		return ddl
+	}
+
+	return fmt.Sprintf("%s TTL %s + INTERVAL %d SECOND", ddl, tbl.ttlField, int64(r.cfg.SystemTables.TTL.Seconds()))
+}
+
+// checkSystemTables makes sure the system tables exist, in the restricted privileges mode they are not created
+func (r *Replicator) checkSystemTables(tables []string) error {
+	for _, name := range tables {
+		var exists uint8
+
+		if err := r.chConn.QueryRow("EXISTS TABLE " + r.sysTableName(name)).Scan(&exists); err != nil {
+			return fmt.Errorf("could not check %q system table: %w", r.sysTableName(name), err)
+		}
+
+		if exists == 0 {
+			return fmt.Errorf("%q system table does not exist; with restricted_privileges it has to be created beforehand: %s",
+				r.sysTableName(name), r.systemTableDDL(name))
+		}
+	}
+
+	return nil
+}
+
+// storeWatermarks saves lsn positions of the tables flushed to the main tables
+func (r *Replicator) storeWatermarks(tables []string) {
+	if !r.cfg.SystemTables.Watermarks || r.cfg.Inspect || len(tables) == 0 {
+		return
+	}
+
+	tx, err := r.chConn.Begin()
+	if err != nil {
+		r.log.Warn("could not begin watermarks transaction", "error", err)
+		return
+	}
+
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (table_name, lsn, generation_id, created_at) VALUES (?, ?, ?, ?)",
+		r.sysTableName(watermarksTable)))
+	if err != nil {
+		r.log.Warn("could not prepare watermarks statement", "error", err)
+		_ = tx.Rollback()
+		return
+	}
+
+	now := time.Now()
+	for _, tblName := range tables {
+		if _, err := stmt.Exec(tblName, uint64(r.finalLSN), atomic.LoadUint64(&r.generationID), now); err != nil {
+			r.log.Warn("could not insert watermark", "table", tblName, "error", err)
+			_ = tx.Rollback()
+			return
+		}
+	}
+
+	if err := stmt.Close(); err != nil {
+		r.log.Warn("could not close watermarks statement", "error", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		r.log.Warn("could not commit watermarks", "error", err)
+	}
+}
+
+// loadPublishID fetches the last publish id so the ids keep increasing after restart
+func (r *Replicator) loadPublishID() error {
+	if !r.cfg.SystemTables.PublishIDs || r.cfg.Inspect {
+		return nil
+	}
+
+	err := r.chConn.QueryRow(fmt.Sprintf("SELECT max(publish_id) FROM %s", r.sysTableName(publishIDsTable))).Scan(&r.publishID)
+	if err != nil {
+		return fmt.Errorf("could not query: %w", err)
+	}
+	r.log.Info("last publish id", "publish_id", r.publishID)
+
+	return nil
+}
+
+// storePublishID assigns the next publish id to the flush of the tables to the main tables,
+// so the readers can pin to the lsn watermark of the flush
+func (r *Replicator) storePublishID(tables []string) {
+	if !r.cfg.SystemTables.PublishIDs || r.cfg.Inspect || len(tables) == 0 {
+		return
+	}
+
+	sort.Strings(tables)
+
+	tx, err := r.chConn.Begin()
+	if err != nil {
+		r.log.Warn("could not begin publish id transaction", "error", err)
+		return
+	}
+
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (publish_id, lsn, tables, created_at) VALUES (?, ?, ?, ?)",
+		r.sysTableName(publishIDsTable)))
+	if err != nil {
+		r.log.Warn("could not prepare publish id statement", "error", err)
+		_ = tx.Rollback()
+		return
+	}
+
+	if _, err := stmt.Exec(r.publishID+1, uint64(r.finalLSN), tables, time.Now()); err != nil {
+		r.log.Warn("could not insert publish id", "error", err)
+		_ = tx.Rollback()
+		return
+	}
+
+	if err := stmt.Close(); err != nil {
+		r.log.Warn("could not close publish id statement", "error", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		r.log.Warn("could not commit publish id", "error", err)
+		return
+	}
+
+	r.publishID++
+}
@@ -0,0 +1,418 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+const applyQueueLength = 1024 // changes queued for the apply worker before the replication loop waits for it
+
+// applyTask is the change of the table applied by its worker, the task without apply is the barrier
+type applyTask struct {
+	generation   *uint64 // generation id cell of the table, see generationOf
+	generationID uint64  // generation id of the transaction of the change
+	apply        func() error
+	done         chan struct{} // closed once the task is applied
+}
+
+// applyWorker applies the changes of its tables in the commit order, so that a slow insert into one table
+// doesn't hold back the changes of the tables of the other workers
+type applyWorker struct {
+	tasks       chan applyTask
+	mergeNeeded map[config.PgTableName]struct{} // tables of the worker to be flushed to the main tables on the commit
+}
+
+// appliedCommit reports the transaction or the flush applied to the table by its worker
+type appliedCommit struct {
+	tblName     config.PgTableName
+	lsn         utils.LSN
+	commit      bool // the commit of the transaction, not the flush of mergeTables
+	merged      bool // the table is flushed to the main table
+	mergeNeeded bool // the table of the group is to be flushed with the other tables of the group
+}
+
+// pendingCommit is the transaction dispatched to the workers, the slot is advanced past it once all of them apply it
+type pendingCommit struct {
+	lsn       utils.LSN
+	remaining int
+}
+
+// applyState is the progress of the apply workers reported to the replication loop
+type applyState struct {
+	mutex   sync.Mutex
+	applied []appliedCommit
+	err     error // first error of the workers, the following changes are not applied
+}
+
+func newApplyWorkers(n int) []*applyWorker {
+	if n <= 1 {
+		return nil
+	}
+
+	workers := make([]*applyWorker, n)
+	for i := range workers {
+		workers[i] = &applyWorker{
+			tasks:       make(chan applyTask, applyQueueLength),
+			mergeNeeded: make(map[config.PgTableName]struct{}),
+		}
+	}
+
+	return workers
+}
+
+func (r *Replicator) startApplyWorkers() {
+	for _, w := range r.workers {
+		go r.runApplyWorker(w)
+	}
+}
+
+// stopApplyWorkers closes the queues of the workers, so that their goroutines exit once the queued tasks are done;
+// the changes are applied in place afterwards, e.g. by the flush on shutdown
+func (r *Replicator) stopApplyWorkers() {
+	r.tablesToMergeMutex.Lock()
+	defer r.tablesToMergeMutex.Unlock()
+
+	for _, w := range r.workers {
+		close(w.tasks)
+	}
+	r.workers = nil
+}
+
+func (r *Replicator) runApplyWorker(w *applyWorker) {
+	for task := range w.tasks {
+		if task.apply != nil && r.applyError() == nil {
+			atomic.StoreUint64(task.generation, task.generationID)
+			if err := task.apply(); err != nil {
+				r.apply.mutex.Lock()
+				r.apply.err = err
+				r.apply.mutex.Unlock()
+			}
+		}
+
+		if task.done != nil {
+			close(task.done)
+		}
+	}
+}
+
+func (r *Replicator) applyError() error {
+	r.apply.mutex.Lock()
+	defer r.apply.mutex.Unlock()
+
+	return r.apply.err
+}
+
+func (r *Replicator) reportApplied(applied appliedCommit) {
+	r.apply.mutex.Lock()
+	r.apply.applied = append(r.apply.applied, applied)
+	r.apply.mutex.Unlock()
+}
+
+// workerOf returns the worker of the table, the tables of a group share the worker to be flushed in the group order
+func (r *Replicator) workerOf(tblName config.PgTableName) *applyWorker {
+	key := tblName.String()
+	if group, ok := r.groupOf(tblName); ok {
+		key = "group " + group
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return r.workers[h.Sum32()%uint32(len(r.workers))]
+}
+
+func (r *Replicator) groupOf(tblName config.PgTableName) (string, bool) {
+	for _, group := range r.cfg.TableGroups {
+		for _, name := range group.Tables {
+			if name == tblName {
+				return group.Name, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// generationOf returns the generation id read by the table: the worker sets it to the generation of the change
+// being applied, as the replication loop may be transactions ahead
+func (r *Replicator) generationOf(tblName config.PgTableName) *uint64 {
+	if r.workers == nil {
+		return &r.generationID
+	}
+
+	r.syncMutex.Lock()
+	defer r.syncMutex.Unlock()
+
+	gen, ok := r.generations[tblName]
+	if !ok {
+		gen = new(uint64)
+		*gen = atomic.LoadUint64(&r.generationID)
+		r.generations[tblName] = gen
+	}
+
+	return gen
+}
+
+// onTable applies the change to the table, by its worker if any; apply reports if the table is to be merged.
+// The tables being synced are applied in place, their merges wait for the end of the sync anyway
+func (r *Replicator) onTable(tblName config.PgTableName, apply func() (bool, error)) error {
+	if _, ok := r.syncingTables[tblName]; r.workers == nil || ok {
+		if r.workers != nil {
+			atomic.StoreUint64(r.generationOf(tblName), atomic.LoadUint64(&r.generationID))
+		}
+
+		mergeIsNeeded, err := apply()
+		r.curTxMergeIsNeeded = r.curTxMergeIsNeeded || mergeIsNeeded
+
+		return err
+	}
+
+	w := r.workerOf(tblName)
+	r.dispatched[tblName] = r.finalLSN
+
+	return r.dispatch(w, tblName, func() error {
+		mergeIsNeeded, err := apply()
+		if mergeIsNeeded {
+			w.mergeNeeded[tblName] = struct{}{}
+		}
+
+		return err
+	})
+}
+
+func (r *Replicator) dispatch(w *applyWorker, tblName config.PgTableName, apply func() error) error {
+	task := applyTask{generation: r.generationOf(tblName), generationID: atomic.LoadUint64(&r.generationID), apply: apply}
+
+	select {
+	case w.tasks <- task:
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+// applyChange applies the row change to the table, the rows rejected by the overflow policy go to the dead letter file
+func (r *Replicator) applyChange(oid utils.OID, tblName config.PgTableName, chTbl clickHouseTable, op string,
+	newRow, oldRow message.Row) error {
+	lsn, columns := r.finalLSN, r.relColumns[oid]
+
+	return r.onTable(tblName, func() (bool, error) {
+		var (
+			mergeIsNeeded bool
+			err           error
+		)
+
+		switch op {
+		case opInsert:
+			mergeIsNeeded, err = chTbl.Insert(lsn, newRow)
+		case opUpdate:
+			mergeIsNeeded, err = chTbl.Update(lsn, oldRow, newRow)
+		case opDelete:
+			mergeIsNeeded, err = chTbl.Delete(lsn, oldRow)
+		}
+
+		if errors.Is(err, utils.ErrDeadLetter) {
+			return false, r.writeDeadLetterRow(lsn, columns, tblName, op, newRow, oldRow, err)
+		} else if err != nil {
+			return false, fmt.Errorf("could not %s: %w", op, err)
+		}
+
+		return mergeIsNeeded, nil
+	})
+}
+
+// dispatchCommit passes the commit to the workers of the tables of the transaction: the tables to be merged
+// are flushed to the main tables by their workers, except for the tables of the groups flushed by mergeTables
+func (r *Replicator) dispatchCommit() error {
+	pending := &pendingCommit{lsn: r.finalLSN}
+	r.pendingCommits = append(r.pendingCommits, pending)
+
+	for tblName := range r.inTxTables {
+		if _, ok := r.frozen[tblName]; ok {
+			continue
+		}
+		if _, ok := r.syncingTables[tblName]; ok {
+			continue
+		}
+
+		chTbl, ok := r.chTables[tblName]
+		if !ok {
+			continue
+		}
+
+		tblName, lsn, w := tblName, r.finalLSN, r.workerOf(tblName)
+		_, grouped := r.groupOf(tblName)
+
+		pending.remaining++
+		if err := r.dispatch(w, tblName, func() error {
+			_, mergeIsNeeded := w.mergeNeeded[tblName]
+			delete(w.mergeNeeded, tblName)
+
+			if mergeIsNeeded && !grouped {
+				chTbl.WaitForMerges()
+				if err := chTbl.FlushToMainTable(); err != nil {
+					return fmt.Errorf("could not commit %s table: %w", tblName.String(), err)
+				}
+			}
+			r.reportApplied(appliedCommit{tblName: tblName, lsn: lsn, commit: true,
+				merged: mergeIsNeeded && !grouped, mergeNeeded: mergeIsNeeded && grouped})
+
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	return r.applyCompleted()
+}
+
+// drainWorkers waits for the workers to apply all the dispatched changes and collects their progress
+func (r *Replicator) drainWorkers() error {
+	return r.drainWorkersCtx(r.ctx)
+}
+
+// drainWorkersCtx is drainWorkers giving up once the ctx is done; the shutdown drains the workers
+// after the replication context is cancelled
+func (r *Replicator) drainWorkersCtx(ctx context.Context) error {
+	if r.workers == nil {
+		return nil
+	}
+
+	barriers := make([]chan struct{}, len(r.workers))
+	for i, w := range r.workers {
+		barriers[i] = make(chan struct{})
+
+		select {
+		case w.tasks <- applyTask{done: barriers[i]}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for _, done := range barriers {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := r.applyError(); err != nil {
+		return err
+	}
+
+	return r.applyCompleted()
+}
+
+// applyCompleted takes the progress reported by the workers: the flushed tables get the lsn of the flush,
+// the slot is advanced past the transactions applied by all the workers
+func (r *Replicator) applyCompleted() error {
+	r.apply.mutex.Lock()
+	applied := r.apply.applied
+	r.apply.applied = nil
+	r.apply.mutex.Unlock()
+
+	var merged []string
+	for _, a := range applied {
+		if a.merged {
+			if r.dispatched[a.tblName] <= a.lsn { // the later changes of the table are still to be merged
+				delete(r.tablesToMerge, a.tblName)
+			}
+			r.applyTableLSN(a.tblName, a.lsn)
+			merged = append(merged, a.tblName.String())
+		}
+		r.groupMergeNeeded = r.groupMergeNeeded || a.mergeNeeded
+
+		if !a.commit {
+			continue
+		}
+
+		for _, pending := range r.pendingCommits {
+			if pending.lsn == a.lsn {
+				pending.remaining--
+				break
+			}
+		}
+	}
+
+	advanced := false
+	for len(r.pendingCommits) > 0 && r.pendingCommits[0].remaining == 0 {
+		r.appliedLSN = r.pendingCommits[0].lsn
+		r.pendingCommits = r.pendingCommits[1:]
+		advanced = true
+	}
+
+	if len(merged) > 0 {
+		if r.appliedLSN.IsValid() && r.canAdvanceLSN() {
+			r.setSlotLSN(r.appliedLSN)
+		}
+
+		if err := r.saveState(); err != nil {
+			return err
+		}
+		r.storeWatermarks(merged)
+		r.storePublishID(merged)
+	}
+
+	if advanced && r.canAdvanceLSN() {
+		r.setSlotLSN(r.appliedLSN)
+	}
+
+	return nil
+}
+
+// resetApplyWorkers forgets the progress of the drained workers, the tables are synced from scratch
+func (r *Replicator) resetApplyWorkers() {
+	for _, w := range r.workers {
+		clear(w.mergeNeeded)
+	}
+
+	clear(r.dispatched)
+	r.pendingCommits = nil
+	r.groupMergeNeeded = false
+}
+
+// mergeTablesParallel flushes the tables to the main tables by their workers, once they applied all the changes
+func (r *Replicator) mergeTablesParallel() error {
+	if err := r.drainWorkers(); err != nil {
+		return err
+	}
+
+	for _, tblName := range r.mergeOrder() {
+		tblName, chTbl, lsn := tblName, r.chTables[tblName], r.finalLSN
+
+		w := r.workerOf(tblName)
+		if err := r.dispatch(w, tblName, func() error {
+			delete(w.mergeNeeded, tblName)
+			chTbl.WaitForMerges()
+			if err := chTbl.FlushToMainTable(); err != nil {
+				return fmt.Errorf("could not commit %s table: %w", tblName.String(), err)
+			}
+			r.reportApplied(appliedCommit{tblName: tblName, lsn: lsn, merged: true})
+
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := r.drainWorkers(); err != nil {
+		return err
+	}
+	r.groupMergeNeeded = false
+	r.advanceLSN()
+
+	if r.slotLSNUnsaved() {
+		return r.saveState()
+	}
+
+	return nil
+}
@@ -0,0 +1,221 @@
+package rowstream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// The event log keeps the retained events on disk, so that the subscribers resume after the restart of pg2ch.
+// The file starts with the offset of the last event dropped from the ring, empty if none, followed by
+// the batches of the published transactions: the number of the events and the events, each prefixed with
+// its length. A batch torn by a crash is dropped: its transaction is decoded again after the restart.
+// Once the file holds twice the retained events it is rewritten with the retained ones
+
+// openLog reads the events of the log file into the ring and opens the file for appending
+func (s *Server) openLog(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("could not create directory: %w", err)
+	}
+
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open file: %w", err)
+	}
+
+	size, err := s.readLog(fp)
+	if err == nil {
+		err = fp.Truncate(size)
+	}
+	if err == nil {
+		_, err = fp.Seek(size, io.SeekStart)
+	}
+	if err == nil && size == 0 {
+		err = writeLogHeader(fp, nil)
+	}
+	if err != nil {
+		fp.Close()
+		return fmt.Errorf("could not read %s: %w", path, err)
+	}
+	s.log, s.logPath = fp, path
+
+	return nil
+}
+
+// readLog reads the events of the complete batches into the ring, returns the size of them in the file
+func (s *Server) readLog(fp *os.File) (int64, error) {
+	rd := bufio.NewReader(fp)
+
+	header, err := readRecord(rd)
+	if isTorn(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if len(header) > 0 {
+		s.dropped = &Offset{}
+		if err := proto.Unmarshal(header, s.dropped); err != nil {
+			return 0, fmt.Errorf("could not parse offset: %w", err)
+		}
+	}
+	pos := int64(protowire.SizeBytes(len(header)))
+
+	for {
+		n, err := binary.ReadUvarint(rd)
+		if isTorn(err) {
+			return pos, nil
+		} else if err != nil {
+			return 0, err
+		}
+		size := protowire.SizeVarint(n)
+
+		batch := make([]*RowEvent, 0, n)
+		for i := uint64(0); i < n; i++ {
+			data, err := readRecord(rd)
+			if isTorn(err) {
+				return pos, nil
+			} else if err != nil {
+				return 0, err
+			}
+			size += protowire.SizeBytes(len(data))
+
+			ev := &RowEvent{}
+			if err := proto.Unmarshal(data, ev); err != nil {
+				return 0, fmt.Errorf("could not parse event: %w", err)
+			}
+			batch = append(batch, ev)
+		}
+
+		for _, ev := range batch {
+			s.append(ev)
+		}
+		s.logEvents += len(batch)
+		pos += int64(size)
+	}
+}
+
+// writeLog appends the batch of the events to the log and syncs it, so that the slot can be advanced past them
+func (s *Server) writeLog(events []*RowEvent) error {
+	buf, err := appendBatch(nil, events)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.log.Write(buf); err != nil {
+		return fmt.Errorf("could not write %s: %w", s.logPath, err)
+	}
+	if err := s.log.Sync(); err != nil {
+		return fmt.Errorf("could not sync %s: %w", s.logPath, err)
+	}
+	s.logEvents += len(events)
+
+	return nil
+}
+
+// compactLog rewrites the log with the retained events only
+func (s *Server) compactLog() error {
+	tmpPath := s.logPath + ".tmp"
+	fp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open file: %w", err)
+	}
+
+	retained := make([]*RowEvent, 0, s.next-s.first())
+	for seq := s.first(); seq < s.next; seq++ {
+		retained = append(retained, s.events[seq%uint64(len(s.events))])
+	}
+
+	err = writeLogHeader(fp, s.dropped)
+	if err == nil {
+		var buf []byte
+		if buf, err = appendBatch(nil, retained); err == nil {
+			_, err = fp.Write(buf)
+		}
+	}
+	if err == nil {
+		err = fp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.logPath)
+	}
+	if err != nil {
+		fp.Close()
+		return fmt.Errorf("could not rewrite %s: %w", s.logPath, err)
+	}
+
+	s.log.Close()
+	s.log, s.logEvents = fp, len(retained)
+
+	return nil
+}
+
+// Close closes the event log
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.log == nil {
+		return nil
+	}
+
+	return s.log.Close()
+}
+
+// writeLogHeader writes the header of the log: the offset of the last dropped event
+func writeLogHeader(fp *os.File, dropped *Offset) error {
+	var data []byte
+	if dropped != nil {
+		var err error
+		if data, err = proto.Marshal(dropped); err != nil {
+			return fmt.Errorf("could not encode offset: %w", err)
+		}
+	}
+
+	_, err := fp.Write(protowire.AppendBytes(nil, data))
+
+	return err
+}
+
+// appendBatch appends the number of the events followed by the length prefixed events to buf
+func appendBatch(buf []byte, events []*RowEvent) ([]byte, error) {
+	buf = protowire.AppendVarint(buf, uint64(len(events)))
+	for _, ev := range events {
+		data, err := proto.Marshal(ev)
+		if err != nil {
+			return nil, fmt.Errorf("could not encode event: %w", err)
+		}
+		buf = protowire.AppendBytes(buf, data)
+	}
+
+	return buf, nil
+}
+
+// readRecord reads the length prefixed record
+func readRecord(rd *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(rd, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// isTorn reports if the read stopped at the end of the file, possibly in the middle of the record left by a crash
+func isTorn(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,454 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: rowstream.proto
+
+package rowstream
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Op int32
+
+const (
+	Op_OP_UNSPECIFIED Op = 0
+	Op_OP_INSERT      Op = 1
+	Op_OP_UPDATE      Op = 2
+	Op_OP_DELETE      Op = 3
+	Op_OP_TRUNCATE    Op = 4
+)
+
+// Enum value maps for Op.
+var (
+	Op_name = map[int32]string{
+		0: "OP_UNSPECIFIED",
+		1: "OP_INSERT",
+		2: "OP_UPDATE",
+		3: "OP_DELETE",
+		4: "OP_TRUNCATE",
+	}
+	Op_value = map[string]int32{
+		"OP_UNSPECIFIED": 0,
+		"OP_INSERT":      1,
+		"OP_UPDATE":      2,
+		"OP_DELETE":      3,
+		"OP_TRUNCATE":    4,
+	}
+)
+
+func (x Op) Enum() *Op {
+	p := new(Op)
+	*p = x
+	return p
+}
+
+func (x Op) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Op) Descriptor() protoreflect.EnumDescriptor {
+	return file_rowstream_proto_enumTypes[0].Descriptor()
+}
+
+func (Op) Type() protoreflect.EnumType {
+	return &file_rowstream_proto_enumTypes[0]
+}
+
+func (x Op) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Op.Descriptor instead.
+func (Op) EnumDescriptor() ([]byte, []int) {
+	return file_rowstream_proto_rawDescGZIP(), []int{0}
+}
+
+// Offset is the position of the event in the stream: the events are ordered by the commit lsn of their
+// transaction, then by the lsn of the change and the index of the table of the truncate. The offsets
+// of the change are the same when it is streamed again after the restart of pg2ch
+type Offset struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	CommitLsn     uint64                 `protobuf:"varint,1,opt,name=commit_lsn,json=commitLsn,proto3" json:"commit_lsn,omitempty"`
+	Lsn           uint64                 `protobuf:"varint,2,opt,name=lsn,proto3" json:"lsn,omitempty"`
+	Index         uint32                 `protobuf:"varint,3,opt,name=index,proto3" json:"index,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Offset) Reset() {
+	*x = Offset{}
+	mi := &file_rowstream_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Offset) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Offset) ProtoMessage() {}
+
+func (x *Offset) ProtoReflect() protoreflect.Message {
+	mi := &file_rowstream_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Offset.ProtoReflect.Descriptor instead.
+func (*Offset) Descriptor() ([]byte, []int) {
+	return file_rowstream_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Offset) GetCommitLsn() uint64 {
+	if x != nil {
+		return x.CommitLsn
+	}
+	return 0
+}
+
+func (x *Offset) GetLsn() uint64 {
+	if x != nil {
+		return x.Lsn
+	}
+	return 0
+}
+
+func (x *Offset) GetIndex() uint32 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+type SubscribeRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// first request: the stream starts with the event following the offset, if set,
+	// or with the next committed transaction
+	After *Offset `protobuf:"bytes,1,opt,name=after,proto3" json:"after,omitempty"`
+	// first request: tables to stream as schema.table, all the replicated tables if empty
+	Tables []string `protobuf:"bytes,2,rep,name=tables,proto3" json:"tables,omitempty"`
+	// first request: events sent ahead of the acknowledgements, 1000 if not set
+	Window uint32 `protobuf:"varint,3,opt,name=window,proto3" json:"window,omitempty"`
+	// following requests: the events up to the offset are received
+	Ack           *Offset `protobuf:"bytes,4,opt,name=ack,proto3" json:"ack,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SubscribeRequest) Reset() {
+	*x = SubscribeRequest{}
+	mi := &file_rowstream_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SubscribeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubscribeRequest) ProtoMessage() {}
+
+func (x *SubscribeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_rowstream_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubscribeRequest.ProtoReflect.Descriptor instead.
+func (*SubscribeRequest) Descriptor() ([]byte, []int) {
+	return file_rowstream_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *SubscribeRequest) GetAfter() *Offset {
+	if x != nil {
+		return x.After
+	}
+	return nil
+}
+
+func (x *SubscribeRequest) GetTables() []string {
+	if x != nil {
+		return x.Tables
+	}
+	return nil
+}
+
+func (x *SubscribeRequest) GetWindow() uint32 {
+	if x != nil {
+		return x.Window
+	}
+	return 0
+}
+
+func (x *SubscribeRequest) GetAck() *Offset {
+	if x != nil {
+		return x.Ack
+	}
+	return nil
+}
+
+// Column is the value of the clickhouse column as pg2ch writes it, with the masking, encryption, tokenization
+// and transforms applied, as text; the value is not set for NULL
+type Column struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value         *string                `protobuf:"bytes,2,opt,name=value,proto3,oneof" json:"value,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Column) Reset() {
+	*x = Column{}
+	mi := &file_rowstream_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Column) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Column) ProtoMessage() {}
+
+func (x *Column) ProtoReflect() protoreflect.Message {
+	mi := &file_rowstream_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Column.ProtoReflect.Descriptor instead.
+func (*Column) Descriptor() ([]byte, []int) {
+	return file_rowstream_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Column) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Column) GetValue() string {
+	if x != nil && x.Value != nil {
+		return *x.Value
+	}
+	return ""
+}
+
+// RowEvent is the row change; unchanged TOASTed values are not sent by postgres, so these columns are omitted
+type RowEvent struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Offset        *Offset                `protobuf:"bytes,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	CommitTime    *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=commit_time,json=commitTime,proto3" json:"commit_time,omitempty"`
+	Table         string                 `protobuf:"bytes,3,opt,name=table,proto3" json:"table,omitempty"`
+	Op            Op                     `protobuf:"varint,4,opt,name=op,proto3,enum=pg2ch.rowstream.v1.Op" json:"op,omitempty"`
+	Columns       []*Column              `protobuf:"bytes,5,rep,name=columns,proto3" json:"columns,omitempty"` // new row of the insert and update
+	Old           []*Column              `protobuf:"bytes,6,rep,name=old,proto3" json:"old,omitempty"`         // old row of the update and delete, key columns only unless replica identity is full
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RowEvent) Reset() {
+	*x = RowEvent{}
+	mi := &file_rowstream_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RowEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RowEvent) ProtoMessage() {}
+
+func (x *RowEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_rowstream_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RowEvent.ProtoReflect.Descriptor instead.
+func (*RowEvent) Descriptor() ([]byte, []int) {
+	return file_rowstream_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *RowEvent) GetOffset() *Offset {
+	if x != nil {
+		return x.Offset
+	}
+	return nil
+}
+
+func (x *RowEvent) GetCommitTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CommitTime
+	}
+	return nil
+}
+
+func (x *RowEvent) GetTable() string {
+	if x != nil {
+		return x.Table
+	}
+	return ""
+}
+
+func (x *RowEvent) GetOp() Op {
+	if x != nil {
+		return x.Op
+	}
+	return Op_OP_UNSPECIFIED
+}
+
+func (x *RowEvent) GetColumns() []*Column {
+	if x != nil {
+		return x.Columns
+	}
+	return nil
+}
+
+func (x *RowEvent) GetOld() []*Column {
+	if x != nil {
+		return x.Old
+	}
+	return nil
+}
+
+var File_rowstream_proto protoreflect.FileDescriptor
+
+const file_rowstream_proto_rawDesc = "" +
+	"\n" +
+	"\x0frowstream.proto\x12\x12pg2ch.rowstream.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"O\n" +
+	"\x06Offset\x12\x1d\n" +
+	"\n" +
+	"commit_lsn\x18\x01 \x01(\x04R\tcommitLsn\x12\x10\n" +
+	"\x03lsn\x18\x02 \x01(\x04R\x03lsn\x12\x14\n" +
+	"\x05index\x18\x03 \x01(\rR\x05index\"\xa2\x01\n" +
+	"\x10SubscribeRequest\x120\n" +
+	"\x05after\x18\x01 \x01(\v2\x1a.pg2ch.rowstream.v1.OffsetR\x05after\x12\x16\n" +
+	"\x06tables\x18\x02 \x03(\tR\x06tables\x12\x16\n" +
+	"\x06window\x18\x03 \x01(\rR\x06window\x12,\n" +
+	"\x03ack\x18\x04 \x01(\v2\x1a.pg2ch.rowstream.v1.OffsetR\x03ack\"A\n" +
+	"\x06Column\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x19\n" +
+	"\x05value\x18\x02 \x01(\tH\x00R\x05value\x88\x01\x01B\b\n" +
+	"\x06_value\"\x9d\x02\n" +
+	"\bRowEvent\x122\n" +
+	"\x06offset\x18\x01 \x01(\v2\x1a.pg2ch.rowstream.v1.OffsetR\x06offset\x12;\n" +
+	"\vcommit_time\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\n" +
+	"commitTime\x12\x14\n" +
+	"\x05table\x18\x03 \x01(\tR\x05table\x12&\n" +
+	"\x02op\x18\x04 \x01(\x0e2\x16.pg2ch.rowstream.v1.OpR\x02op\x124\n" +
+	"\acolumns\x18\x05 \x03(\v2\x1a.pg2ch.rowstream.v1.ColumnR\acolumns\x12,\n" +
+	"\x03old\x18\x06 \x03(\v2\x1a.pg2ch.rowstream.v1.ColumnR\x03old*V\n" +
+	"\x02Op\x12\x12\n" +
+	"\x0eOP_UNSPECIFIED\x10\x00\x12\r\n" +
+	"\tOP_INSERT\x10\x01\x12\r\n" +
+	"\tOP_UPDATE\x10\x02\x12\r\n" +
+	"\tOP_DELETE\x10\x03\x12\x0f\n" +
+	"\vOP_TRUNCATE\x10\x042`\n" +
+	"\tRowStream\x12S\n" +
+	"\tSubscribe\x12$.pg2ch.rowstream.v1.SubscribeRequest\x1a\x1c.pg2ch.rowstream.v1.RowEvent(\x010\x01B)Z'github.com/mkabilov/pg2ch/pkg/rowstreamb\x06proto3"
+
+var (
+	file_rowstream_proto_rawDescOnce sync.Once
+	file_rowstream_proto_rawDescData []byte
+)
+
+func file_rowstream_proto_rawDescGZIP() []byte {
+	file_rowstream_proto_rawDescOnce.Do(func() {
+		file_rowstream_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_rowstream_proto_rawDesc), len(file_rowstream_proto_rawDesc)))
+	})
+	return file_rowstream_proto_rawDescData
+}
+
+var file_rowstream_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_rowstream_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_rowstream_proto_goTypes = []any{
+	(Op)(0),                       // 0: pg2ch.rowstream.v1.Op
+	(*Offset)(nil),                // 1: pg2ch.rowstream.v1.Offset
+	(*SubscribeRequest)(nil),      // 2: pg2ch.rowstream.v1.SubscribeRequest
+	(*Column)(nil),                // 3: pg2ch.rowstream.v1.Column
+	(*RowEvent)(nil),              // 4: pg2ch.rowstream.v1.RowEvent
+	(*timestamppb.Timestamp)(nil), // 5: google.protobuf.Timestamp
+}
+var file_rowstream_proto_depIdxs = []int32{
+	1, // 0: pg2ch.rowstream.v1.SubscribeRequest.after:type_name -> pg2ch.rowstream.v1.Offset
+	1, // 1: pg2ch.rowstream.v1.SubscribeRequest.ack:type_name -> pg2ch.rowstream.v1.Offset
+	1, // 2: pg2ch.rowstream.v1.RowEvent.offset:type_name -> pg2ch.rowstream.v1.Offset
+	5, // 3: pg2ch.rowstream.v1.RowEvent.commit_time:type_name -> google.protobuf.Timestamp
+	0, // 4: pg2ch.rowstream.v1.RowEvent.op:type_name -> pg2ch.rowstream.v1.Op
+	3, // 5: pg2ch.rowstream.v1.RowEvent.columns:type_name -> pg2ch.rowstream.v1.Column
+	3, // 6: pg2ch.rowstream.v1.RowEvent.old:type_name -> pg2ch.rowstream.v1.Column
+	2, // 7: pg2ch.rowstream.v1.RowStream.Subscribe:input_type -> pg2ch.rowstream.v1.SubscribeRequest
+	4, // 8: pg2ch.rowstream.v1.RowStream.Subscribe:output_type -> pg2ch.rowstream.v1.RowEvent
+	8, // [8:9] is the sub-list for method output_type
+	7, // [7:8] is the sub-list for method input_type
+	7, // [7:7] is the sub-list for extension type_name
+	7, // [7:7] is the sub-list for extension extendee
+	0, // [0:7] is the sub-list for field type_name
+}
+
+func init() { file_rowstream_proto_init() }
+func file_rowstream_proto_init() {
+	if File_rowstream_proto != nil {
+		return
+	}
+	file_rowstream_proto_msgTypes[2].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_rowstream_proto_rawDesc), len(file_rowstream_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_rowstream_proto_goTypes,
+		DependencyIndexes: file_rowstream_proto_depIdxs,
+		EnumInfos:         file_rowstream_proto_enumTypes,
+		MessageInfos:      file_rowstream_proto_msgTypes,
+	}.Build()
+	File_rowstream_proto = out.File
+	file_rowstream_proto_goTypes = nil
+	file_rowstream_proto_depIdxs = nil
+}
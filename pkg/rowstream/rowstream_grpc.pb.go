@@ -0,0 +1,127 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: rowstream.proto
+
+package rowstream
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	RowStream_Subscribe_FullMethodName = "/pg2ch.rowstream.v1.RowStream/Subscribe"
+)
+
+// RowStreamClient is the client API for RowStream service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// RowStream streams the row changes of the replicated tables as pg2ch decodes them, so that the downstream
+// services can follow the same changes without a replication slot of their own
+type RowStreamClient interface {
+	// Subscribe streams the row changes of the committed transactions in the commit order. The first request
+	// starts the stream; the following ones acknowledge the received events, the server sends at most window
+	// events ahead of the acknowledgements
+	Subscribe(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[SubscribeRequest, RowEvent], error)
+}
+
+type rowStreamClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRowStreamClient(cc grpc.ClientConnInterface) RowStreamClient {
+	return &rowStreamClient{cc}
+}
+
+func (c *rowStreamClient) Subscribe(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[SubscribeRequest, RowEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &RowStream_ServiceDesc.Streams[0], RowStream_Subscribe_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SubscribeRequest, RowEvent]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type RowStream_SubscribeClient = grpc.BidiStreamingClient[SubscribeRequest, RowEvent]
+
+// RowStreamServer is the server API for RowStream service.
+// All implementations must embed UnimplementedRowStreamServer
+// for forward compatibility.
+//
+// RowStream streams the row changes of the replicated tables as pg2ch decodes them, so that the downstream
+// services can follow the same changes without a replication slot of their own
+type RowStreamServer interface {
+	// Subscribe streams the row changes of the committed transactions in the commit order. The first request
+	// starts the stream; the following ones acknowledge the received events, the server sends at most window
+	// events ahead of the acknowledgements
+	Subscribe(grpc.BidiStreamingServer[SubscribeRequest, RowEvent]) error
+	mustEmbedUnimplementedRowStreamServer()
+}
+
+// UnimplementedRowStreamServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedRowStreamServer struct{}
+
+func (UnimplementedRowStreamServer) Subscribe(grpc.BidiStreamingServer[SubscribeRequest, RowEvent]) error {
+	return status.Error(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedRowStreamServer) mustEmbedUnimplementedRowStreamServer() {}
+func (UnimplementedRowStreamServer) testEmbeddedByValue()                   {}
+
+// UnsafeRowStreamServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RowStreamServer will
+// result in compilation errors.
+type UnsafeRowStreamServer interface {
+	mustEmbedUnimplementedRowStreamServer()
+}
+
+func RegisterRowStreamServer(s grpc.ServiceRegistrar, srv RowStreamServer) {
+	// If the following call panics, it indicates UnimplementedRowStreamServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&RowStream_ServiceDesc, srv)
+}
+
+func _RowStream_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(RowStreamServer).Subscribe(&grpc.GenericServerStream[SubscribeRequest, RowEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type RowStream_SubscribeServer = grpc.BidiStreamingServer[SubscribeRequest, RowEvent]
+
+// RowStream_ServiceDesc is the grpc.ServiceDesc for RowStream service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var RowStream_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pg2ch.rowstream.v1.RowStream",
+	HandlerType: (*RowStreamServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _RowStream_Subscribe_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "rowstream.proto",
+}
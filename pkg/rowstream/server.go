@@ -0,0 +1,249 @@
+package rowstream
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative rowstream.proto
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultWindow  = 1000
+	ackQueueLength = 64 // acknowledgements read ahead of the stream
+)
+
+// Server streams the row changes published by the replication loop to the subscribers. The recent events are
+// retained in memory and in the event log on disk, so that the subscriber resumes from the offset of the last
+// received event after the reconnect or the restart; the replication loop never waits for the subscribers,
+// the ones falling behind the retained events are disconnected
+type Server struct {
+	UnimplementedRowStreamServer
+
+	mutex   sync.Mutex
+	events  []*RowEvent   // ring of the retained events, the event of the seq is at seq % len(events)
+	next    uint64        // seq of the next published event
+	last    *Offset       // offset of the last published event, nil if none
+	dropped *Offset       // offset of the last event dropped from the ring, nil if none
+	changed chan struct{} // closed once the events are published
+
+	log       *os.File // event log, nil if the events are kept in memory only
+	logPath   string
+	logEvents int // events in the event log
+}
+
+// NewServer returns the server retaining the given number of events; the events are kept in the event log
+// at logPath as well, unless it is empty
+func NewServer(retained int, logPath string) (*Server, error) {
+	s := &Server{
+		events:  make([]*RowEvent, retained),
+		changed: make(chan struct{}),
+	}
+
+	if logPath != "" {
+		if err := s.openLog(logPath); err != nil {
+			return nil, fmt.Errorf("could not open event log: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// Publish appends the events of the committed transaction to the stream; the events of the transactions
+// decoded again after the restart are already published, so they are skipped
+func (s *Server) Publish(events []*RowEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.last != nil {
+		for len(events) > 0 && !Less(s.last, events[0].Offset) {
+			events = events[1:]
+		}
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	if s.log != nil {
+		if err := s.writeLog(events); err != nil {
+			return err
+		}
+	}
+
+	for _, ev := range events {
+		s.append(ev)
+	}
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+
+	if s.log != nil && s.logEvents > 2*len(s.events) {
+		return s.compactLog()
+	}
+
+	return nil
+}
+
+// append appends the event to the ring, dropping the oldest one
+func (s *Server) append(ev *RowEvent) {
+	pos := s.next % uint64(len(s.events))
+	if old := s.events[pos]; old != nil {
+		s.dropped = old.Offset
+	}
+	s.events[pos] = ev
+	s.next++
+	s.last = ev.Offset
+}
+
+// first returns the seq of the oldest retained event
+func (s *Server) first() uint64 {
+	if s.next < uint64(len(s.events)) {
+		return 0
+	}
+
+	return s.next - uint64(len(s.events))
+}
+
+// startSeq returns the seq of the first event following the offset, the next published one if the offset is nil
+func (s *Server) startSeq(after *Offset) (uint64, error) {
+	if after == nil {
+		return s.next, nil
+	}
+
+	if s.dropped != nil && Less(after, s.dropped) {
+		return 0, status.Errorf(codes.OutOfRange, "events following offset %s are no longer retained, "+
+			"the oldest retained event follows %s", after, s.dropped)
+	}
+
+	lo, hi := s.first(), s.next
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if Less(after, s.events[mid%uint64(len(s.events))].Offset) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	return lo, nil
+}
+
+// Subscribe streams the events to the subscriber, at most window events ahead of its acknowledgements
+func (s *Server) Subscribe(stream RowStream_SubscribeServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	window := int(req.GetWindow())
+	if window == 0 {
+		window = defaultWindow
+	}
+
+	var tables map[string]struct{}
+	if len(req.GetTables()) > 0 {
+		tables = make(map[string]struct{}, len(req.GetTables()))
+		for _, tblName := range req.GetTables() {
+			tables[tblName] = struct{}{}
+		}
+	}
+
+	s.mutex.Lock()
+	seq, err := s.startSeq(req.GetAfter())
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ctx := stream.Context()
+	acks, recvErr := make(chan *Offset, ackQueueLength), make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			if req.GetAck() == nil {
+				continue
+			}
+
+			select {
+			case acks <- req.GetAck():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var inFlight []*Offset // offsets of the events sent and not acknowledged yet
+	for {
+		var (
+			ev      *RowEvent
+			changed chan struct{}
+		)
+
+		if len(inFlight) < window {
+			s.mutex.Lock()
+			if seq < s.first() {
+				s.mutex.Unlock()
+				return status.Error(codes.ResourceExhausted, "subscriber fell behind the retained events")
+			}
+
+			if seq < s.next {
+				ev = s.events[seq%uint64(len(s.events))]
+				seq++
+			} else {
+				changed = s.changed
+			}
+			s.mutex.Unlock()
+		}
+
+		if ev != nil {
+			if _, ok := tables[ev.GetTable()]; tables != nil && !ok {
+				continue
+			}
+
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+			inFlight = append(inFlight, ev.Offset)
+
+			continue
+		}
+
+		select {
+		case <-changed: // nil if the window is full
+		case ack := <-acks:
+			n := 0
+			for n < len(inFlight) && !Less(ack, inFlight[n]) {
+				n++
+			}
+			inFlight = append(inFlight[:0], inFlight[n:]...)
+		case err := <-recvErr:
+			if err == io.EOF {
+				return nil
+			}
+
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Less reports if the offset a precedes the offset b in the stream
+func Less(a, b *Offset) bool {
+	if a.GetCommitLsn() != b.GetCommitLsn() {
+		return a.GetCommitLsn() < b.GetCommitLsn()
+	}
+	if a.GetLsn() != b.GetLsn() {
+		return a.GetLsn() < b.GetLsn()
+	}
+
+	return a.GetIndex() < b.GetIndex()
+}
@@ -0,0 +1,154 @@
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const metricsPrefix = "pg2ch_"
+
+type metricKind string
+
+const (
+	gauge   metricKind = "gauge"
+	counter metricKind = "counter"
+)
+
+// tableMetric describes the per table metric exposed to prometheus
+type tableMetric struct {
+	name  string
+	kind  metricKind
+	help  string
+	value func(TableSnapshot) float64
+}
+
+var tableMetrics = []tableMetric{
+	{"buffered_rows", gauge, "Number of rows in the memory buffer.",
+		func(s TableSnapshot) float64 { return float64(s.BufferedRows) }},
+	{"buffered_rows_max", gauge, "High-water mark of the rows in the memory buffer.",
+		func(s TableSnapshot) float64 { return float64(s.BufferedRowsMax) }},
+	{"buffered_bytes", gauge, "Approximate size of the rows in the memory buffer.",
+		func(s TableSnapshot) float64 { return float64(s.BufferedBytes) }},
+	{"buffered_bytes_max", gauge, "High-water mark of the approximate size of the rows in the memory buffer.",
+		func(s TableSnapshot) float64 { return float64(s.BufferedBytesMax) }},
+	{"buffer_table_rows", gauge, "Number of rows in the buffer table.",
+		func(s TableSnapshot) float64 { return float64(s.BufferTableRows) }},
+	{"buffer_table_rows_max", gauge, "High-water mark of the rows in the buffer table.",
+		func(s TableSnapshot) float64 { return float64(s.BufferTableRowsMax) }},
+	{"flushed_rows_total", counter, "Number of rows flushed from the memory to the buffer/main table.",
+		func(s TableSnapshot) float64 { return float64(s.FlushedRows) }},
+	{"flushes_total", counter, "Number of memory buffer flushes.",
+		func(s TableSnapshot) float64 { return float64(s.Flushes) }},
+	{"flush_retries_total", counter, "Number of failed flush attempts.",
+		func(s TableSnapshot) float64 { return float64(s.FlushRetries) }},
+	{"failing_flushes", gauge, "Consecutive failed attempts of the flush being retried.",
+		func(s TableSnapshot) float64 { return float64(s.FailingFlushes) }},
+	{"flush_latency_seconds", gauge, "Duration of the last memory buffer flush.",
+		func(s TableSnapshot) float64 { return s.FlushLatency }},
+	{"main_flushes_total", counter, "Number of buffer to main table flushes.",
+		func(s TableSnapshot) float64 { return float64(s.MainFlushes) }},
+	{"main_flush_latency_seconds", gauge, "Duration of the last buffer to main table flush.",
+		func(s TableSnapshot) float64 { return s.MainFlushLatency }},
+	{"lag_bytes", gauge, "Replication lag of the table in bytes of wal.",
+		func(s TableSnapshot) float64 { return float64(s.LagBytes) }},
+	{"lag_seconds", gauge, "Apply lag of the table in seconds.",
+		func(s TableSnapshot) float64 { return s.LagSeconds }},
+	{"sync_rows_total", counter, "Number of rows copied during the initial sync.",
+		func(s TableSnapshot) float64 {
+			if s.Sync == nil {
+				return 0
+			}
+			return float64(s.Sync.Rows)
+		}},
+	{"sync_bytes_total", counter, "Number of bytes received from postgres during the initial sync.",
+		func(s TableSnapshot) float64 {
+			if s.Sync == nil {
+				return 0
+			}
+			return float64(s.Sync.Bytes)
+		}},
+	{"shadow_mismatches_total", counter, "Number of shadow comparisons which found differences.",
+		func(s TableSnapshot) float64 { return float64(s.ShadowMismatches) }},
+	{"overflow_values_total", counter, "Number of values not fitting the clickhouse columns, handled by the overflow policies.",
+		func(s TableSnapshot) float64 { return float64(s.OverflowValues) }},
+	{"dead_letter_rows_total", counter, "Number of rows skipped and written to the dead letter file.",
+		func(s TableSnapshot) float64 { return float64(s.DeadLetterRows) }},
+	{"row_image_hits_total", counter, "Number of key-only old rows completed from the row image cache.",
+		func(s TableSnapshot) float64 { return float64(s.RowImageHits) }},
+	{"row_image_misses_total", counter, "Number of key-only old rows not found in the row image cache.",
+		func(s TableSnapshot) float64 { return float64(s.RowImageMisses) }},
+	{"row_lookups_total", counter, "Number of postgres queries looking up the rows missing in the row image cache.",
+		func(s TableSnapshot) float64 { return float64(s.RowLookups) }},
+	{"row_lookup_hits_total", counter, "Number of key-only old rows completed by the postgres lookups.",
+		func(s TableSnapshot) float64 { return float64(s.RowLookupHits) }},
+}
+
+var states = []string{StateStarting, StateSyncing, StateStreaming, StateResyncing, StateHalted}
+
+// WritePrometheus writes current values of the counters in the prometheus text exposition format,
+// labels are added to every metric
+func (r *Registry) WritePrometheus(w io.Writer, labels map[string]string) error {
+	snap := r.Snapshot()
+	bw := bufio.NewWriter(w)
+
+	common := formatLabels(labels)
+
+	writeHeader(bw, "state", gauge, "Current state of the replicator.")
+	for _, state := range states {
+		val := 0
+		if state == snap.State {
+			val = 1
+		}
+		fmt.Fprintf(bw, "%sstate{%s} %d\n", metricsPrefix, joinLabels(common, label("state", state)), val)
+	}
+
+	tables := make([]string, 0, len(snap.Tables))
+	for name := range snap.Tables {
+		tables = append(tables, name)
+	}
+	sort.Strings(tables)
+
+	for _, m := range tableMetrics {
+		writeHeader(bw, m.name, m.kind, m.help)
+		for _, name := range tables {
+			fmt.Fprintf(bw, "%s%s{%s} %g\n",
+				metricsPrefix, m.name, joinLabels(common, label("table", name)), m.value(snap.Tables[name]))
+		}
+	}
+
+	return bw.Flush()
+}
+
+func writeHeader(w io.Writer, name string, kind metricKind, help string) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsPrefix, name, help, metricsPrefix, name, kind)
+}
+
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := make([]string, len(names))
+	for i, name := range names {
+		res[i] = label(name, labels[name])
+	}
+
+	return strings.Join(res, ",")
+}
+
+func label(name, value string) string {
+	return fmt.Sprintf(`%s="%s"`, name, strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value))
+}
+
+func joinLabels(common, specific string) string {
+	if common == "" {
+		return specific
+	}
+
+	return common + "," + specific
+}
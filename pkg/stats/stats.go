@@ -0,0 +1,441 @@
+package stats
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+// Replicator states
+const (
+	StateStarting  = "starting"
+	StateSyncing   = "syncing"
+	StateStreaming = "streaming"
+	StateResyncing = "resyncing"
+	StatePaused    = "paused"
+	StateHalted    = "halted"
+)
+
+// Table contains counters of the table; all the fields are accessed atomically
+type Table struct {
+	BufferedRows     int64  // number of rows in the memory buffer
+	BufferedBytes    int64  // approximate size of the rows in the memory buffer
+	BufferTableRows  int64  // number of rows in the buffer table
+	FlushedRows      uint64 // number of rows flushed from the memory to the buffer/main table
+	Flushes          uint64 // number of memory buffer flushes
+	FlushRetries     uint64 // number of failed flush attempts
+	FailingFlushes   int64  // consecutive failed attempts of the flush being retried, 0 once it succeeds
+	FlushLatency     int64  // duration of the last memory buffer flush, ns
+	MainFlushes      uint64 // number of buffer to main table flushes
+	MainFlushLatency int64  // duration of the last buffer to main table flush, ns
+	LSN              uint64 // lsn the table is consistent with
+	SyncRows         uint64 // number of rows copied during the initial sync
+	SyncBytes        uint64 // number of bytes received from postgres during the initial sync
+	SyncReadTime     int64  // time spent waiting for the copy data from postgres, ns
+	SyncConvertTime  int64  // time spent decoding and converting the copy data, ns
+	SyncUploadTime   int64  // time spent sending the rows to clickhouse, ns
+
+	SyncExpectedRows int64  // estimated number of rows of the last initial sync
+	SyncStartRows    uint64 // value of SyncRows at the start of the last initial sync
+	SyncStartedAt    int64  // monotonic time the last initial sync started at, ns since the process start
+	SyncFinishedAt   int64  // monotonic time the last initial sync finished at; 0 while running
+
+	LastSeenCommit     int64 // commit timestamp of the last transaction having changes of the table, unix ns
+	LastSeenAt         int64 // monotonic time the last commit was seen at, ns since the process start
+	LastAppliedCommit  int64 // commit timestamp of the last transaction applied to the main table, unix ns
+	FirstPendingCommit int64 // commit timestamp of the oldest not yet applied transaction, unix ns; 0 if none
+
+	ShadowChecks     uint64 // number of comparisons with the table the main table is a shadow of
+	ShadowMismatches uint64 // number of comparisons which found differences
+
+	OverflowValues uint64 // number of values not fitting the clickhouse columns, handled by the overflow policies
+	DeadLetterRows uint64 // number of rows skipped and written to the dead letter file
+
+	RowImageHits   uint64 // key-only old rows completed from the row image cache
+	RowImageMisses uint64 // key-only old rows not found in the row image cache, written as they are
+	RowLookups     uint64 // postgres queries looking up the rows missing in the row image cache
+	RowLookupHits  uint64 // key-only old rows completed by the postgres lookups
+
+	// high-water marks, for sizing max_buffer_length and flush_threshold
+	BufferedRowsMax    int64
+	BufferedBytesMax   int64
+	BufferTableRowsMax int64
+}
+
+// reference point of the monotonic clock readings, wall clock adjustments don't affect the durations since it
+var monoStart = time.Now()
+
+func monoNow() int64 {
+	return int64(time.Since(monoStart))
+}
+
+// SyncPhase contains throughput of the initial sync phase
+type SyncPhase struct {
+	Seconds       float64 `json:"seconds"`
+	RowsPerSecond float64 `json:"rows_per_second"`
+}
+
+// SyncSnapshot contains per-phase metrics of the initial sync
+type SyncSnapshot struct {
+	Rows    uint64    `json:"rows"`
+	Bytes   uint64    `json:"bytes"`
+	Read    SyncPhase `json:"read"`
+	Convert SyncPhase `json:"convert"`
+	Upload  SyncPhase `json:"upload"`
+}
+
+// TableSnapshot contains the values of the table counters at some point in time
+type TableSnapshot struct {
+	BufferedRows     int64         `json:"buffered_rows"`
+	FlushedRows      uint64        `json:"flushed_rows"`
+	Flushes          uint64        `json:"flushes"`
+	FlushRetries     uint64        `json:"flush_retries"`
+	FailingFlushes   int64         `json:"failing_flushes"`
+	FlushLatency     float64       `json:"flush_latency_seconds"`
+	MainFlushes      uint64        `json:"main_flushes"`
+	MainFlushLatency float64       `json:"main_flush_latency_seconds"`
+	LSN              string        `json:"lsn"`
+	LagBytes         uint64        `json:"lag_bytes"`
+	Sync             *SyncSnapshot `json:"sync,omitempty"`
+
+	LastSeenCommit    *time.Time `json:"last_seen_commit,omitempty"`
+	LastAppliedCommit *time.Time `json:"last_applied_commit,omitempty"`
+	LagSeconds        float64    `json:"lag_seconds"`
+
+	ShadowChecks     uint64 `json:"shadow_checks"`
+	ShadowMismatches uint64 `json:"shadow_mismatches"`
+
+	OverflowValues uint64 `json:"overflow_values"`
+	DeadLetterRows uint64 `json:"dead_letter_rows"`
+
+	RowImageHits   uint64 `json:"row_image_hits"`
+	RowImageMisses uint64 `json:"row_image_misses"`
+	RowLookups     uint64 `json:"row_lookups"`
+	RowLookupHits  uint64 `json:"row_lookup_hits"`
+
+	BufferedRowsMax    int64 `json:"buffered_rows_max"`
+	BufferedBytes      int64 `json:"buffered_bytes"`
+	BufferedBytesMax   int64 `json:"buffered_bytes_max"`
+	BufferTableRows    int64 `json:"buffer_table_rows"`
+	BufferTableRowsMax int64 `json:"buffer_table_rows_max"`
+}
+
+// SyncProgress is the progress of the table's initial sync
+type SyncProgress struct {
+	Rows         uint64        // rows copied so far
+	ExpectedRows int64         // estimated number of the rows, may be off
+	Elapsed      time.Duration // time since the start
+	Started      bool
+	Finished     bool
+}
+
+// SyncReport is the tuning report of the table's initial sync
+type SyncReport struct {
+	Table       string       `json:"table"`
+	Sync        SyncSnapshot `json:"sync"`
+	Bottleneck  string       `json:"bottleneck"`
+	Suggestions []string     `json:"suggestions"`
+}
+
+// Snapshot represents state of all the counters
+type Snapshot struct {
+	State  string                   `json:"state"`
+	LSN    string                   `json:"lsn"`
+	Tables map[string]TableSnapshot `json:"tables"`
+}
+
+// Registry holds the counters of the replicator and its tables
+type Registry struct {
+	mutex  *sync.RWMutex
+	tables map[string]*Table
+	state  string
+	lsn    uint64 // current lsn of the replicator, accessed atomically
+
+	syncReports map[string]SyncReport
+}
+
+// New instantiates the registry
+func New() *Registry {
+	return &Registry{
+		mutex:  &sync.RWMutex{},
+		tables: make(map[string]*Table),
+		state:  StateStarting,
+
+		syncReports: make(map[string]SyncReport),
+	}
+}
+
+// SetState sets current state of the replicator
+func (r *Registry) SetState(state string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.state = state
+}
+
+// State returns current state of the replicator
+func (r *Registry) State() string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.state
+}
+
+// SwapState sets the state of the replicator if it is in the old one, returns false otherwise
+func (r *Registry) SwapState(old, new string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.state != old {
+		return false
+	}
+	r.state = new
+
+	return true
+}
+
+// Table returns counters of the table, registering them if needed
+func (r *Registry) Table(name string) *Table {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if t, ok := r.tables[name]; ok {
+		return t
+	}
+
+	t := &Table{}
+	r.tables[name] = t
+
+	return t
+}
+
+// SetSyncReport stores tuning report of the table's initial sync
+func (r *Registry) SetSyncReport(report SyncReport) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.syncReports[report.Table] = report
+}
+
+// SyncReports returns tuning reports of the initial syncs
+func (r *Registry) SyncReports() []SyncReport {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	res := make([]SyncReport, 0, len(r.syncReports))
+	for _, report := range r.syncReports {
+		res = append(res, report)
+	}
+
+	return res
+}
+
+// SetLSN sets current lsn of the replicator
+func (r *Registry) SetLSN(lsn utils.LSN) {
+	atomic.StoreUint64(&r.lsn, uint64(lsn))
+}
+
+// Snapshot returns current values of the counters
+func (r *Registry) Snapshot() Snapshot {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	lsn := atomic.LoadUint64(&r.lsn)
+	res := Snapshot{
+		State:  r.state,
+		LSN:    utils.LSN(lsn).String(),
+		Tables: make(map[string]TableSnapshot, len(r.tables)),
+	}
+
+	for name, t := range r.tables {
+		tblLSN := atomic.LoadUint64(&t.LSN)
+		snap := TableSnapshot{
+			BufferedRows:     atomic.LoadInt64(&t.BufferedRows),
+			FlushedRows:      atomic.LoadUint64(&t.FlushedRows),
+			Flushes:          atomic.LoadUint64(&t.Flushes),
+			FlushRetries:     atomic.LoadUint64(&t.FlushRetries),
+			FailingFlushes:   atomic.LoadInt64(&t.FailingFlushes),
+			FlushLatency:     time.Duration(atomic.LoadInt64(&t.FlushLatency)).Seconds(),
+			MainFlushes:      atomic.LoadUint64(&t.MainFlushes),
+			MainFlushLatency: time.Duration(atomic.LoadInt64(&t.MainFlushLatency)).Seconds(),
+			LSN:              utils.LSN(tblLSN).String(),
+		}
+		if lsn > tblLSN {
+			snap.LagBytes = lsn - tblLSN
+		}
+		snap.Sync = t.SyncSnapshot()
+		snap.LastSeenCommit = unixNanoTime(atomic.LoadInt64(&t.LastSeenCommit))
+		snap.LastAppliedCommit = unixNanoTime(atomic.LoadInt64(&t.LastAppliedCommit))
+		snap.ShadowChecks = atomic.LoadUint64(&t.ShadowChecks)
+		snap.ShadowMismatches = atomic.LoadUint64(&t.ShadowMismatches)
+		snap.OverflowValues = atomic.LoadUint64(&t.OverflowValues)
+		snap.DeadLetterRows = atomic.LoadUint64(&t.DeadLetterRows)
+		snap.RowImageHits = atomic.LoadUint64(&t.RowImageHits)
+		snap.RowImageMisses = atomic.LoadUint64(&t.RowImageMisses)
+		snap.RowLookups = atomic.LoadUint64(&t.RowLookups)
+		snap.RowLookupHits = atomic.LoadUint64(&t.RowLookupHits)
+		snap.LagSeconds = t.lag().Seconds()
+		snap.BufferedRowsMax = atomic.LoadInt64(&t.BufferedRowsMax)
+		snap.BufferedBytes = atomic.LoadInt64(&t.BufferedBytes)
+		snap.BufferedBytesMax = atomic.LoadInt64(&t.BufferedBytesMax)
+		snap.BufferTableRows = atomic.LoadInt64(&t.BufferTableRows)
+		snap.BufferTableRowsMax = atomic.LoadInt64(&t.BufferTableRowsMax)
+
+		res.Tables[name] = snap
+	}
+
+	return res
+}
+
+// CommitSeen registers commit of the transaction having changes of the table
+func (t *Table) CommitSeen(ts time.Time) {
+	atomic.StoreInt64(&t.LastSeenCommit, ts.UnixNano())
+	atomic.StoreInt64(&t.LastSeenAt, monoNow())
+	atomic.CompareAndSwapInt64(&t.FirstPendingCommit, 0, ts.UnixNano())
+}
+
+// lag returns the apply lag: the difference between the commit timestamps of the last seen and the oldest pending
+// transactions plus the time passed since the last commit was seen; commit timestamps come from the postgres clock
+// and the time passed from the local monotonic clock, so the clock skew between the hosts doesn't matter
+func (t *Table) lag() time.Duration {
+	pending := atomic.LoadInt64(&t.FirstPendingCommit)
+	if pending == 0 {
+		return 0
+	}
+
+	lag := nonNegative(time.Duration(atomic.LoadInt64(&t.LastSeenCommit) - pending))
+
+	return lag + nonNegative(time.Duration(monoNow()-atomic.LoadInt64(&t.LastSeenAt)))
+}
+
+// CommitApplied registers that all the seen transactions are applied to the main table
+func (t *Table) CommitApplied() {
+	atomic.StoreInt64(&t.LastAppliedCommit, atomic.LoadInt64(&t.LastSeenCommit))
+	atomic.StoreInt64(&t.FirstPendingCommit, 0)
+}
+
+// FlushFailed registers the failed flush attempt which is going to be retried
+func (t *Table) FlushFailed() {
+	atomic.AddUint64(&t.FlushRetries, 1)
+	atomic.AddInt64(&t.FailingFlushes, 1)
+}
+
+// FlushSucceeded registers that the retried flush succeeded
+func (t *Table) FlushSucceeded() {
+	atomic.StoreInt64(&t.FailingFlushes, 0)
+}
+
+// AddBuffered registers the rows appended to the memory buffer
+func (t *Table) AddBuffered(rows, bytes int64) {
+	storeMax(&t.BufferedRowsMax, atomic.AddInt64(&t.BufferedRows, rows))
+	storeMax(&t.BufferedBytesMax, atomic.AddInt64(&t.BufferedBytes, bytes))
+}
+
+// ResetBuffered registers that the memory buffer is emptied, returns the number of rows it had
+func (t *Table) ResetBuffered() int64 {
+	atomic.StoreInt64(&t.BufferedBytes, 0)
+
+	return atomic.SwapInt64(&t.BufferedRows, 0)
+}
+
+// AddBufferTableRows registers the rows written to the buffer table
+func (t *Table) AddBufferTableRows(rows int64) {
+	storeMax(&t.BufferTableRowsMax, atomic.AddInt64(&t.BufferTableRows, rows))
+}
+
+// ResetBufferTableRows registers that the buffer table is emptied
+func (t *Table) ResetBufferTableRows() {
+	atomic.StoreInt64(&t.BufferTableRows, 0)
+}
+
+// storeMax raises the high-water mark to val
+func storeMax(addr *int64, val int64) {
+	for {
+		cur := atomic.LoadInt64(addr)
+		if val <= cur || atomic.CompareAndSwapInt64(addr, cur, val) {
+			return
+		}
+	}
+}
+
+// SyncSnapshot returns per-phase metrics of the initial sync, nil if the table was not synced
+func (t *Table) SyncSnapshot() *SyncSnapshot {
+	rows := atomic.LoadUint64(&t.SyncRows)
+	if rows == 0 {
+		return nil
+	}
+
+	return &SyncSnapshot{
+		Rows:    rows,
+		Bytes:   atomic.LoadUint64(&t.SyncBytes),
+		Read:    syncPhase(rows, atomic.LoadInt64(&t.SyncReadTime)),
+		Convert: syncPhase(rows, atomic.LoadInt64(&t.SyncConvertTime)),
+		Upload:  syncPhase(rows, atomic.LoadInt64(&t.SyncUploadTime)),
+	}
+}
+
+// StartSync registers the start of the initial sync of about expectedRows rows
+func (t *Table) StartSync(expectedRows int64) {
+	atomic.StoreInt64(&t.SyncExpectedRows, expectedRows)
+	atomic.StoreUint64(&t.SyncStartRows, atomic.LoadUint64(&t.SyncRows))
+	atomic.StoreInt64(&t.SyncFinishedAt, 0)
+	atomic.StoreInt64(&t.SyncStartedAt, monoNow())
+}
+
+// FinishSync registers the end of the initial sync
+func (t *Table) FinishSync() {
+	atomic.StoreInt64(&t.SyncFinishedAt, monoNow())
+}
+
+// SyncProgress returns the progress of the running or the last initial sync
+func (t *Table) SyncProgress() SyncProgress {
+	startedAt := atomic.LoadInt64(&t.SyncStartedAt)
+	if startedAt == 0 {
+		return SyncProgress{}
+	}
+
+	progress := SyncProgress{
+		Rows:         atomic.LoadUint64(&t.SyncRows) - atomic.LoadUint64(&t.SyncStartRows),
+		ExpectedRows: atomic.LoadInt64(&t.SyncExpectedRows),
+		Started:      true,
+	}
+
+	finishedAt := atomic.LoadInt64(&t.SyncFinishedAt)
+	if finishedAt != 0 {
+		progress.Finished = true
+		progress.Elapsed = nonNegative(time.Duration(finishedAt - startedAt))
+	} else {
+		progress.Elapsed = nonNegative(time.Duration(monoNow() - startedAt))
+	}
+
+	return progress
+}
+
+func syncPhase(rows uint64, ns int64) SyncPhase {
+	phase := SyncPhase{Seconds: nonNegative(time.Duration(ns)).Seconds()}
+	if phase.Seconds > 0 {
+		phase.RowsPerSecond = float64(rows) / phase.Seconds
+	}
+
+	return phase
+}
+
+func unixNanoTime(ns int64) *time.Time {
+	if ns == 0 {
+		return nil
+	}
+
+	ts := time.Unix(0, ns)
+
+	return &ts
+}
+
+func nonNegative(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+
+	return d
+}
@@ -0,0 +1,110 @@
+package tableengines
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+	"github.com/mkabilov/pg2ch/pkg/utils/chutils"
+	"github.com/mkabilov/pg2ch/pkg/utils/tableinfo"
+)
+
+const zeroUUID = "00000000-0000-0000-0000-000000000000"
+
+// convertArray converts the text output of the postgresql array into the value of the Array column,
+// nested Array columns take the multidimensional arrays; the element errors are not wrapped,
+// so that the overflow of an element is not taken for the overflow of the column
+func convertArray(val string, chType config.ChColumn, pgType config.PgColumn) (interface{}, error) {
+	elems, err := chutils.ParseArray(val)
+	if err != nil {
+		return nil, err
+	}
+
+	depth := 1
+	elemType := chType
+	for strings.HasPrefix(elemType.BaseType, "Array(") {
+		elemType.Column = tableinfo.ParseChType(elemType.BaseType)
+		depth++
+	}
+	elemType.IsArray = false
+	pgType.IsArray = false
+
+	return convertElems(elems, depth, elemType, pgType)
+}
+
+// convertElems converts the elements of the array of the depth into []interface{}, [][]interface{} etc.,
+// the NULL elements are written as the default values of the element type
+func convertElems(elems []interface{}, depth int, chType config.ChColumn, pgType config.PgColumn) (interface{}, error) {
+	if depth > 1 {
+		res := reflect.MakeSlice(arrayType(depth), 0, len(elems))
+		for _, elem := range elems {
+			nested, ok := elem.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("array has fewer dimensions than the clickhouse column")
+			}
+
+			conv, err := convertElems(nested, depth-1, chType, pgType)
+			if err != nil {
+				return nil, err
+			}
+			res = reflect.Append(res, reflect.ValueOf(conv))
+		}
+
+		return res.Interface(), nil
+	}
+
+	res := make([]interface{}, 0, len(elems))
+	for i, elem := range elems {
+		switch elem := elem.(type) {
+		case nil:
+			res = append(res, zeroValue(chType))
+		case string:
+			conv, err := convert(elem, chType, pgType)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %v", i+1, err)
+			}
+			res = append(res, conv)
+		default:
+			return nil, fmt.Errorf("array has more dimensions than the clickhouse column")
+		}
+	}
+
+	return res, nil
+}
+
+// arrayType returns []interface{} nested depth times
+func arrayType(depth int) reflect.Type {
+	typ := reflect.TypeOf([]interface{}{})
+	for i := 1; i < depth; i++ {
+		typ = reflect.SliceOf(typ)
+	}
+
+	return typ
+}
+
+// zeroValue returns the default value of the clickhouse type, written for the NULL elements of the arrays
+func zeroValue(chType config.ChColumn) interface{} {
+	switch chType.BaseType {
+	case utils.ChString, utils.ChFixedString:
+		return ""
+	case utils.ChUUID:
+		return zeroUUID
+	case utils.ChIPv4:
+		return "0.0.0.0"
+	case utils.ChIPv6:
+		return "::"
+	case utils.ChFloat32, utils.ChFloat64, utils.ChDecimal:
+		return float64(0)
+	case utils.ChDate, utils.ChDateTime:
+		return time.Unix(0, 0).UTC()
+	case utils.ChEnum8, utils.ChEnum16:
+		if len(chType.Labels) > 0 {
+			return chType.Labels[0] // the one of the lowest value, same as clickhouse
+		}
+	}
+
+	return int64(0)
+}
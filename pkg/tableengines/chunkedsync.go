@@ -0,0 +1,264 @@
+package tableengines
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx"
+
+	"github.com/mkabilov/pg2ch/pkg/utils"
+	"github.com/mkabilov/pg2ch/pkg/utils/expr"
+)
+
+// copySource is the part of the table read by a single copy of the initial sync
+type copySource struct {
+	table string // table or partition name
+	where string // condition selecting the rows of the part, empty for all of them
+	query bool   // copy via query including the inheritance children, COPY TO reads neither partitioned nor foreign tables
+}
+
+func (s copySource) String() string {
+	if s.where == "" {
+		return s.table
+	}
+
+	return fmt.Sprintf("%q range of %s", s.where, s.table)
+}
+
+// copyCondition returns the condition selecting the rows of the source copied: the part of the table
+// matching the row filters of the publication and of the table, empty for all of them
+func (t *genericTable) copyCondition(src copySource) string {
+	conds := make([]string, 0, 3)
+	for _, cond := range []string{src.where, t.cfg.PubRowFilter, t.cfg.RowFilter} {
+		if cond != "" {
+			conds = append(conds, cond)
+		}
+	}
+
+	if len(conds) == 1 {
+		return conds[0]
+	}
+	for i, cond := range conds {
+		conds[i] = "(" + cond + ")"
+	}
+
+	return strings.Join(conds, " and ")
+}
+
+// tableSource returns the source reading the whole table
+func (t *genericTable) tableSource() copySource {
+	return copySource{table: t.cfg.PgTableName.String(), query: t.cfg.Partitioned || t.cfg.IncludeInherited}
+}
+
+// chunkedCopy copies the table in ctid ranges concurrently under the snapshot of pgTx
+func (t *genericTable) chunkedCopy(pgTx *pgx.Tx, w syncTable) error {
+	var pages int64
+
+	err := pgTx.QueryRow("select pg_relation_size($1::regclass) / current_setting('block_size')::int",
+		t.cfg.PgTableName.String()).Scan(&pages)
+	if err != nil {
+		return fmt.Errorf("could not get number of pages: %w", err)
+	}
+
+	ranges := ctidRanges(pages, t.cfg.SyncChunks)
+	sources := make([]copySource, len(ranges))
+	for i, where := range ranges {
+		sources[i] = t.tableSource()
+		sources[i].where = where
+	}
+
+	workers := t.cfg.SyncChunkWorkers
+	if workers > len(sources) {
+		workers = len(sources)
+	}
+	t.log.Info("copying table in ctid ranges", "pages", pages, "ranges", len(sources), "workers", workers)
+
+	return t.concurrentCopy(pgTx, w, sources, workers)
+}
+
+// partitionedCopy copies the leaf partitions of the partitioned table concurrently under the snapshot of pgTx,
+// the biggest ones first
+func (t *genericTable) partitionedCopy(pgTx *pgx.Tx, w syncTable) error {
+	rows, err := pgTx.Query(`select c.oid::regclass::text, c.relkind = 'f'
+			from pg_class c
+			where c.oid in (`+utils.PartitionTreeQuery+`) and c.relkind in ('r', 'f')
+			order by pg_relation_size(c.oid) desc`, t.cfg.PgTableName.String())
+	if err != nil {
+		return fmt.Errorf("could not query partitions: %w", err)
+	}
+
+	sources := make([]copySource, 0)
+	for rows.Next() {
+		var src copySource
+
+		if err := rows.Scan(&src.table, &src.query); err != nil {
+			rows.Close()
+			return fmt.Errorf("could not scan: %w", err)
+		}
+		sources = append(sources, src)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not query partitions: %w", err)
+	}
+
+	if len(sources) == 0 {
+		return t.uploadCopy(pgTx, w, t.tableSource())
+	}
+
+	workers := t.cfg.SyncPartitionWorkers
+	if workers > len(sources) {
+		workers = len(sources)
+	}
+	t.log.Info("copying table partitions", "partitions", len(sources), "workers", workers)
+
+	return t.concurrentCopy(pgTx, w, sources, workers)
+}
+
+// concurrentCopy copies the sources by the workers under the snapshot of pgTx; each worker reads over
+// its own postgres connection and writes via its own copy of the table within its own clickhouse transactions
+func (t *genericTable) concurrentCopy(pgTx *pgx.Tx, w syncTable, sources []copySource, workers int) error {
+	var snapshot string
+
+	if t.syncConn == nil {
+		return fmt.Errorf("no postgres connection for the concurrent sync")
+	}
+
+	if err := pgTx.QueryRow("select pg_export_snapshot()").Scan(&snapshot); err != nil {
+		return fmt.Errorf("could not export snapshot: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errMutex sync.Mutex
+		copyErr  error
+		rowID    uint64
+	)
+
+	chunks := make(chan copySource)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := t.chunkWorker(ctx, w, workers, snapshot, &rowID, chunks); err != nil {
+				errMutex.Lock()
+				if copyErr == nil {
+					copyErr = err
+				}
+				errMutex.Unlock()
+				cancel()
+			}
+		}()
+	}
+
+dispatch:
+	for _, src := range sources {
+		select {
+		case chunks <- src:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(chunks)
+	wg.Wait()
+
+	if copyErr != nil {
+		return copyErr
+	}
+
+	if err := t.ctx.Err(); err != nil {
+		return fmt.Errorf("copy of %s aborted: %w", t.cfg.PgTableName.String(), err)
+	}
+	t.bufferRowId = rowID
+
+	return nil
+}
+
+// chunkWorker copies the sources received from chunks; the sync rate limits are shared between the workers
+func (t *genericTable) chunkWorker(ctx context.Context, w syncTable, workers int, snapshot string,
+	rowID *uint64, chunks <-chan copySource) error {
+	conn, err := t.syncConn()
+	if err != nil {
+		return fmt.Errorf("could not connect to postgres: %w", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.log.Warn("could not close connection to postgres", "error", err)
+		}
+	}()
+
+	// the copy shares the maps and slices of the table, the ones written by the sync must be its own
+	cw, ct := w.syncChunkWriter()
+	ct.ctx = ctx
+	ct.chTx, ct.chStmnt, ct.syncChunk = nil, nil, nil
+	ct.shardTx, ct.shardStmnt, ct.syncPending = nil, nil, nil
+	ct.exprEnv = make(expr.Env)
+	ct.buffer, ct.shardDone = nil, nil
+	ct.bufferRowId = 0
+	ct.syncRowID = rowID
+	ct.cfg.SyncMaxRowsPerSecond = (ct.cfg.SyncMaxRowsPerSecond + workers - 1) / workers
+	ct.cfg.SyncMaxBytesPerSecond = (ct.cfg.SyncMaxBytesPerSecond + workers - 1) / workers
+
+	for src := range chunks {
+		if err := ct.copyChunk(conn, cw, snapshot, src); err != nil {
+			return fmt.Errorf("could not copy %s: %w", src.String(), err)
+		}
+	}
+
+	return nil
+}
+
+// copyChunk copies the rows of the source within a transaction importing the snapshot of the sync
+func (t *genericTable) copyChunk(conn *pgx.Conn, w io.Writer, snapshot string, src copySource) error {
+	pgTx, err := conn.BeginEx(t.ctx, &pgx.TxOptions{
+		IsoLevel:   pgx.RepeatableRead,
+		AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return fmt.Errorf("could not start pg transaction: %w", err)
+	}
+	defer func() {
+		_ = pgTx.Rollback()
+	}()
+
+	if _, err := pgTx.Exec(fmt.Sprintf("SET TRANSACTION SNAPSHOT '%s'", snapshot)); err != nil {
+		return fmt.Errorf("could not import snapshot: %w", err)
+	}
+
+	return t.uploadCopy(pgTx, w, src)
+}
+
+// ctidRanges splits the pages of the table into the conditions selecting the rows of each range,
+// the first and the last ranges are open-ended
+func ctidRanges(pages int64, chunks int) []string {
+	if int64(chunks) > pages {
+		chunks = int(pages)
+	}
+
+	if chunks <= 1 {
+		return []string{""}
+	}
+
+	ranges := make([]string, chunks)
+	for i := range ranges {
+		from := pages * int64(i) / int64(chunks)
+		to := pages * int64(i+1) / int64(chunks)
+
+		switch i {
+		case 0:
+			ranges[i] = fmt.Sprintf("ctid < '(%d,0)'::tid", to)
+		case chunks - 1:
+			ranges[i] = fmt.Sprintf("ctid >= '(%d,0)'::tid", from)
+		default:
+			ranges[i] = fmt.Sprintf("ctid >= '(%d,0)'::tid and ctid < '(%d,0)'::tid", from, to)
+		}
+	}
+
+	return ranges
+}
@@ -4,12 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"strings"
+	"io"
 
 	"github.com/jackc/pgx"
 
 	"github.com/mkabilov/pg2ch/pkg/config"
 	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/stats"
 	"github.com/mkabilov/pg2ch/pkg/utils"
 )
 
@@ -17,18 +18,23 @@ type collapsingMergeTreeTable struct {
 	genericTable
 
 	signColumn string
+	signInsert int // sign column value for the inserted rows
+	signDelete int // sign column value for the deleted rows
 }
 
 // NewCollapsingMergeTree instantiates collapsingMergeTreeTable
-func NewCollapsingMergeTree(ctx context.Context, conn *sql.DB, tblCfg config.Table, genID *uint64) *collapsingMergeTreeTable {
+func NewCollapsingMergeTree(ctx context.Context, conn *sql.DB, tblCfg config.Table, genID *uint64, tblStats *stats.Table) *collapsingMergeTreeTable {
 	t := collapsingMergeTreeTable{
-		genericTable: newGenericTable(ctx, conn, tblCfg, genID),
+		genericTable: newGenericTable(ctx, conn, tblCfg, genID, tblStats),
 		signColumn:   tblCfg.SignColumn,
+		signInsert:   1,
+		signDelete:   -1,
+	}
+	if tblCfg.SignInverted {
+		t.signInsert, t.signDelete = t.signDelete, t.signInsert
 	}
 	t.chUsedColumns = append(t.chUsedColumns, tblCfg.SignColumn)
-
-	t.flushQueries = []string{fmt.Sprintf("INSERT INTO %[1]s (%[2]s) SELECT %[2]s FROM %[3]s ORDER BY %[4]s",
-		t.cfg.ChMainTable, strings.Join(t.chUsedColumns, ", "), t.cfg.ChBufferTable, t.cfg.BufferTableRowIdColumn)}
+	t.compareFilter = fmt.Sprintf("FINAL WHERE %s = %d", tblCfg.SignColumn, t.signInsert)
 
 	return &t
 }
@@ -38,6 +44,13 @@ func (t *collapsingMergeTreeTable) Sync(pgTx *pgx.Tx) error {
 	return t.genSync(pgTx, t)
 }
 
+// syncChunkWriter returns a copy of the table writing a chunk of the concurrent sync, see chunkedCopy
+func (t *collapsingMergeTreeTable) syncChunkWriter() (io.Writer, *genericTable) {
+	c := *t
+
+	return &c, &c.genericTable
+}
+
 // Write implements io.Writer which is used during the Sync process, see genSync method
 func (t *collapsingMergeTreeTable) Write(p []byte) (int, error) {
 	var row []interface{}
@@ -46,37 +59,61 @@ func (t *collapsingMergeTreeTable) Write(p []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	if row == nil { // written to the dead letter file
+		return n, nil
+	}
 
 	if t.cfg.GenerationColumn != "" {
 		row = append(row, 0) // generationID
 	}
-	row = append(row, 1) // append sign column value
+	row = append(row, t.signInsert) // append sign column value
 
 	return n, t.insertRow(row)
 }
 
 // Insert handles incoming insert DML operation
 func (t *collapsingMergeTreeTable) Insert(lsn utils.LSN, new message.Row) (bool, error) {
-	return t.processCommandSet(commandSet{
-		append(t.convertTuples(new), 1),
+	newRow, err := t.convertTuples(new)
+	if err != nil {
+		return false, err
+	}
+
+	return t.processCommandSet(lsn, commandSet{
+		append(newRow, t.signInsert),
 	})
 }
 
 // Update handles incoming update DML operation
 func (t *collapsingMergeTreeTable) Update(lsn utils.LSN, old, new message.Row) (bool, error) {
+	new = withUnchanged(new, old)
 	if equal, _ := t.compareRows(old, new); equal {
-		return t.processCommandSet(nil)
+		return t.processCommandSet(lsn, nil)
 	}
 
-	return t.processCommandSet(commandSet{
-		append(t.convertTuples(old), -1),
-		append(t.convertTuples(new), 1),
+	oldRow, err := t.convertTuples(old)
+	if err != nil {
+		return false, err
+	}
+
+	newRow, err := t.convertTuples(new)
+	if err != nil {
+		return false, err
+	}
+
+	return t.processCommandSet(lsn, commandSet{
+		append(oldRow, t.signDelete),
+		append(newRow, t.signInsert),
 	})
 }
 
 // Delete handles incoming delete DML operation
 func (t *collapsingMergeTreeTable) Delete(lsn utils.LSN, old message.Row) (bool, error) {
-	return t.processCommandSet(commandSet{
-		append(t.convertTuples(old), -1),
+	oldRow, err := t.convertTuples(old)
+	if err != nil {
+		return false, err
+	}
+
+	return t.processCommandSet(lsn, commandSet{
+		append(oldRow, t.signDelete),
 	})
 }
@@ -0,0 +1,81 @@
+package tableengines
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+// the DateTime64 values of precision 9 end earlier than 2299-12-31: the ticks are Int64 nanoseconds
+var maxDateTime64Nano = time.Unix(0, 1<<63-1)
+
+var errDateTime64Overflow = errors.New("value does not fit the DateTime64 column")
+
+// pg timestamptz output layouts, the offset may have the minutes and the seconds;
+// the fraction of the seconds is parsed even if the layout has none
+var pgTimestampTzLayouts = []string{"2006-01-02 15:04:05-07", "2006-01-02 15:04:05-07:00", "2006-01-02 15:04:05-07:00:00"}
+
+const pgTimestampLayout = "2006-01-02 15:04:05"
+
+// convertDateTime64 converts the text of the timestamp or timestamptz value into the text of the DateTime64(P) value,
+// cast to it when moved from the buffer table; the timestamptz values are written in the location, the timestamps
+// as they are; the fraction beyond the precision is truncated. The infinities and the values out of the range
+// are returned clamped to the range along with errDateTime64Overflow
+func convertDateTime64(val string, chType config.ChColumn, pgType config.PgColumn, loc *time.Location) (string, error) {
+	if len(chType.Ext) != 1 || chType.Ext[0] < 0 || chType.Ext[0] > 9 {
+		return "", fmt.Errorf("unsupported DateTime64 precision: %v", chType.Ext)
+	}
+	precision := chType.Ext[0]
+
+	layout := pgTimestampLayout
+	if precision > 0 {
+		layout += "." + strings.Repeat("0", precision)
+	}
+
+	if pgType.BaseType != utils.PgTimestampWithTimeZone {
+		loc = time.UTC // the wall clock of the timestamps is written as it is
+	}
+
+	minValue := time.Date(1900, 1, 1, 0, 0, 0, 0, loc)
+	maxValue := time.Date(2299, 12, 31, 23, 59, 59, 999999999, loc)
+	if precision == 9 {
+		maxValue = maxDateTime64Nano
+	}
+
+	switch {
+	case val == "infinity":
+		return maxValue.In(loc).Format(layout), errDateTime64Overflow
+	case val == "-infinity", strings.HasSuffix(val, " BC"):
+		return minValue.Format(layout), errDateTime64Overflow
+	}
+
+	var (
+		ts  time.Time
+		err error
+	)
+	if pgType.BaseType == utils.PgTimestampWithTimeZone {
+		for _, pgLayout := range pgTimestampTzLayouts {
+			if ts, err = time.Parse(pgLayout, val); err == nil {
+				break
+			}
+		}
+	} else {
+		ts, err = time.Parse(pgTimestampLayout, val)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case ts.Before(minValue):
+		return minValue.Format(layout), errDateTime64Overflow
+	case ts.After(maxValue):
+		return maxValue.In(loc).Format(layout), errDateTime64Overflow
+	}
+
+	return ts.In(loc).Format(layout), nil
+}
@@ -0,0 +1,128 @@
+package tableengines
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+)
+
+// MaxDecimalPrecision is the max precision of the Decimal columns the driver can write
+const MaxDecimalPrecision = 18
+
+var errDecimalOverflow = errors.New("value does not fit the decimal column")
+
+// convertDecimal converts the text of the numeric value into the scaled integer of the Decimal(P, S) column,
+// int32 for P up to 9 and int64 for the rest, rounded to the scale S by the rounding of the column; the value
+// not fitting the column is returned clamped to the column's range along with errDecimalOverflow
+func convertDecimal(val string, chType config.ChColumn, prop config.ColumnProperty) (interface{}, error) {
+	if len(chType.Ext) != 2 || chType.Ext[0] > MaxDecimalPrecision {
+		return nil, fmt.Errorf("unsupported decimal precision and scale: %v", chType.Ext)
+	}
+	precision, scale := chType.Ext[0], chType.Ext[1]
+
+	str := strings.TrimSpace(val)
+	neg := strings.HasPrefix(str, "-")
+	if neg || strings.HasPrefix(str, "+") {
+		str = str[1:]
+	}
+
+	switch strings.ToLower(str) {
+	case "nan":
+		return nil, fmt.Errorf("NaN can not be written into the decimal column")
+	case "infinity":
+		return decimalLimit(precision, neg), errDecimalOverflow
+	}
+
+	intPart, fracPart := str, ""
+	if pos := strings.IndexByte(str, '.'); pos >= 0 {
+		intPart, fracPart = str[:pos], str[pos+1:]
+	}
+	if intPart == "" && fracPart == "" || !isDigits(intPart) || !isDigits(fracPart) {
+		return nil, fmt.Errorf("invalid numeric value %q", val)
+	}
+
+	var dropped string
+	if len(fracPart) > scale {
+		fracPart, dropped = fracPart[:scale], fracPart[scale:]
+	} else {
+		fracPart += strings.Repeat("0", scale-len(fracPart))
+	}
+
+	digits := strings.TrimLeft(intPart+fracPart, "0")
+	if len(digits) > precision {
+		return decimalLimit(precision, neg), errDecimalOverflow
+	}
+
+	var n uint64
+	if digits != "" {
+		n, _ = strconv.ParseUint(digits, 10, 64) // up to 18 digits always fit
+	}
+	if roundUp(n, dropped, prop) {
+		n++
+	}
+	if n > pow10(precision)-1 {
+		return decimalLimit(precision, neg), errDecimalOverflow
+	}
+
+	res := int64(n)
+	if neg {
+		res = -res
+	}
+	if precision <= 9 {
+		return int32(res), nil
+	}
+
+	return res, nil
+}
+
+// roundUp checks if the magnitude of the value is rounded up by the rounding of the column and the dropped digits
+func roundUp(kept uint64, dropped string, prop config.ColumnProperty) bool {
+	if dropped == "" || prop.Rounding == config.RoundTruncate {
+		return false
+	}
+
+	if dropped[0] != '5' {
+		return dropped[0] > '5'
+	}
+
+	if prop.Rounding == config.RoundHalfUp || strings.Trim(dropped[1:], "0") != "" {
+		return true
+	}
+
+	return kept%2 == 1 // exactly the half is rounded to the even digit
+}
+
+func isDigits(str string) bool {
+	for i := 0; i < len(str); i++ {
+		if str[i] < '0' || str[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func pow10(n int) uint64 {
+	res := uint64(1)
+	for i := 0; i < n; i++ {
+		res *= 10
+	}
+
+	return res
+}
+
+// decimalLimit returns the max or min value of the Decimal column of the precision
+func decimalLimit(precision int, neg bool) interface{} {
+	res := int64(pow10(precision) - 1)
+	if neg {
+		res = -res
+	}
+	if precision <= 9 {
+		return int32(res)
+	}
+
+	return res
+}
@@ -4,25 +4,38 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx"
 
 	"github.com/mkabilov/pg2ch/pkg/config"
 	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/stats"
 	"github.com/mkabilov/pg2ch/pkg/utils"
+	"github.com/mkabilov/pg2ch/pkg/utils/chutils"
+	"github.com/mkabilov/pg2ch/pkg/utils/expr"
+	"github.com/mkabilov/pg2ch/pkg/utils/logger"
+	"github.com/mkabilov/pg2ch/pkg/utils/mask"
 )
 
 // Generic table is a "parent" struct for all the table engines
 const (
 	attemptInterval = time.Second
 	maxAttempts     = 100
+
+	partsCheckInterval = 5 * time.Second
+	minPacingDelay     = 10 * time.Millisecond
+
+	syncCursorName = "pg2ch_sync"
 )
 
 const (
@@ -30,13 +43,28 @@ const (
 	pgFalse = "f"
 )
 
+// once the row id reaches the threshold, buffer table is requested to be flushed to the main table,
+// which truncates the buffer table and resets the row id; it is far below the overflow of the UInt64 row id
+// column, but is reached by a buffer table never flushed because of a high merge_threshold
+const rowIDFlushThreshold = 1 << 32
+
 type bufRow struct {
-	rowID int
+	rowID uint64
+	lsn   utils.LSN
+	txPos int // position of the command in its transaction
 	data  []interface{}
+	skip  bool // already written or rejected by clickhouse, see handleRejectedRows
 }
 
 type commandSet [][]interface{}
 
+// syncTable is the table of a specific engine, converting the copy data of the initial sync into the rows
+type syncTable interface {
+	io.Writer
+	// syncChunkWriter returns a copy of the table writing a chunk of the concurrent sync, see chunkedCopy
+	syncChunkWriter() (io.Writer, *genericTable)
+}
+
 type bufCommand []bufRow
 
 type genericTable struct {
@@ -49,18 +77,54 @@ type genericTable struct {
 
 	chUsedColumns  []string
 	pgUsedColumns  []string
+	pgUsedIndex    map[string]int       // position of the pg column among the used ones
+	pgCopyColumns  []string             // pg columns read during the sync: the used ones followed by the expression-only ones
+	exprColumns    map[string]struct{}  // pg columns referenced by the column expressions and the transforms
+	transforms     map[string]expr.Expr // transforms of the used pg columns
+	exprEnv        expr.Env
 	columnMapping  map[string]config.ChColumn // [pg column name]ch column description
 	flushMutex     *sync.Mutex
 	buffer         []bufCommand
-	bufferCmdId    int // number of commands in the current buffer
-	bufferRowId    int // row id in the buffer
-	bufferFlushCnt int // number of flushed buffers
-	flushQueries   []string
+	bufferCmdId    int       // number of commands in the current buffer
+	bufferRowId    uint64    // row id in the buffer, reset on buffer table truncation
+	bufferFlushCnt int       // number of flushed buffers
+	mergedRowId    uint64    // rows of the buffer table below that row id are already moved to the main table
+	mergedLSN      utils.LSN // rows of the buffer table up to that lsn are already moved to the main table
+	compareFilter  string    // FINAL/WHERE clause selecting the actual rows of the table, used in the shadow comparison
+	bufTableMinLSN utils.LSN // lsn range of the rows in the buffer table
+	bufTableMaxLSN utils.LSN
+	flushedLSN     utils.LSN        // lsn of the last command flushed from the memory buffer
+	flushedOfLSN   int              // number of the flushed commands of the flushedLSN transaction, which may span the flushes
+	txLSN          utils.LSN        // lsn of the transaction of the last command received
+	txCmds         int              // number of the commands of the txLSN transaction received
+	replaySkip     int              // commands of the flushedLSN transaction to skip, flushed before the reconnect
 	tupleColumns   []message.Column // Columns description taken from RELATION rep message
 	generationID   *uint64
+	stats          *stats.Table
+	mergeProgress  func(utils.LSN) error     // called once the rows up to the lsn are moved to the main table
+	syncChunk      [][]interface{}           // rows of the initial sync chunk not yet committed to clickhouse
+	syncRowID      *uint64                   // row id counter shared by the concurrent chunk writers of the initial sync
+	syncConn       func() (*pgx.Conn, error) // opens postgres connections for the concurrent chunks of the initial sync
+
+	serialSeenMax    int64 // max value of the serial gap column seen in the stream
+	serialFlushedMax int64 // max value of the serial gap column flushed to the main table, accessed atomically
+
+	shards      []*sql.DB   // connections of the shards the rows are written to directly, nil for the single host
+	shardSlots  []int       // shard by the hash of the sharding key modulo the number of slots, see SetShards
+	shardKeyIdx int         // position of the sharding key column in the rows
+	shardTx     []*sql.Tx   // transactions of the shards, in place of chTx
+	shardStmnt  []*sql.Stmt // statements of the shards, in place of chStmnt
+	shardDone   []bool      // shards the current memory buffer is already written to, kept between the flush retries
+
+	syncPending [][]interface{} // rows of the initial sync waiting for the tokens of their tokenized columns
+	binaryCopy  bool            // the initial sync is copied in the binary format
+
+	converter *RowConverter // converter of the rows for the other outputs, nil until requested
+
+	log *slog.Logger // logger with the table fields
 }
 
-func newGenericTable(ctx context.Context, chConn *sql.DB, tblCfg config.Table, genID *uint64) genericTable {
+func newGenericTable(ctx context.Context, chConn *sql.DB, tblCfg config.Table, genID *uint64, tblStats *stats.Table) genericTable {
 	t := genericTable{
 		ctx:           ctx,
 		chConn:        chConn,
@@ -68,9 +132,12 @@ func newGenericTable(ctx context.Context, chConn *sql.DB, tblCfg config.Table, g
 		columnMapping: make(map[string]config.ChColumn),
 		chUsedColumns: make([]string, 0),
 		pgUsedColumns: make([]string, 0),
+		pgUsedIndex:   make(map[string]int),
 		flushMutex:    &sync.Mutex{},
 		tupleColumns:  tblCfg.TupleColumns,
 		generationID:  genID,
+		stats:         tblStats,
+		log:           logger.For("tableengines").With("table", tblCfg.PgTableName.String(), "ch_table", tblCfg.ChMainTable),
 	}
 
 	t.buffer = make([]bufCommand, t.cfg.MaxBufferLength)
@@ -82,10 +149,44 @@ func newGenericTable(ctx context.Context, chConn *sql.DB, tblCfg config.Table, g
 		}
 
 		t.columnMapping[pgCol.Name] = chCol
+		t.pgUsedIndex[pgCol.Name] = len(t.pgUsedColumns)
 		t.chUsedColumns = append(t.chUsedColumns, chCol.Name)
 		t.pgUsedColumns = append(t.pgUsedColumns, pgCol.Name)
 	}
 
+	t.exprColumns = make(map[string]struct{})
+	t.exprEnv = make(expr.Env)
+	for _, derived := range tblCfg.Derived {
+		t.chUsedColumns = append(t.chUsedColumns, derived.Name)
+		for _, pgColName := range expr.Columns(derived.Expr) {
+			t.exprColumns[pgColName] = struct{}{}
+		}
+	}
+
+	t.transforms = make(map[string]expr.Expr)
+	for _, pgColName := range t.pgUsedColumns {
+		transform := tblCfg.ColumnProperties[pgColName].TransformExpr
+		if transform == nil {
+			continue
+		}
+
+		t.transforms[pgColName] = transform
+		for _, exprColName := range expr.Columns(transform) {
+			t.exprColumns[exprColName] = struct{}{}
+		}
+	}
+
+	t.pgCopyColumns = append(t.pgCopyColumns, t.pgUsedColumns...)
+	for _, pgCol := range t.tupleColumns {
+		if _, ok := t.exprColumns[pgCol.Name]; !ok {
+			continue
+		}
+
+		if _, ok := t.columnMapping[pgCol.Name]; !ok {
+			t.pgCopyColumns = append(t.pgCopyColumns, pgCol.Name)
+		}
+	}
+
 	if tblCfg.GenerationColumn != "" {
 		t.chUsedColumns = append(t.chUsedColumns, tblCfg.GenerationColumn)
 	}
@@ -94,69 +195,272 @@ func newGenericTable(ctx context.Context, chConn *sql.DB, tblCfg config.Table, g
 }
 
 func (t *genericTable) truncateMainTable() error {
-	if _, err := t.chConn.Exec(fmt.Sprintf("truncate table %s", t.cfg.ChMainTable)); err != nil {
+	if t.cfg.Inspect {
+		return nil
+	}
+
+	if t.cfg.RestrictedPrivileges {
+		return t.checkMainTableEmpty()
+	}
+
+	if t.shards != nil {
+		for i, conn := range t.shards {
+			if _, err := conn.Exec(fmt.Sprintf("truncate table %s", t.cfg.ChMainTable)); err != nil {
+				return fmt.Errorf("shard %d: %w", i+1, err)
+			}
+		}
+
+		return nil
+	}
+
+	if t.cfg.LocalTable != "" {
+		_, err := t.chConn.Exec(fmt.Sprintf("truncate table %s%s", t.cfg.LocalTable, chutils.OnCluster(t.cfg.Cluster)))
+
+		return err
+	}
+
+	if _, err := t.chConn.Exec(fmt.Sprintf("truncate table %s%s", t.cfg.ChMainTable, chutils.OnCluster(t.cfg.Cluster))); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (t *genericTable) truncateBufTable() error {
-	if t.cfg.ChBufferTable == "" {
-		return nil
+// checkMainTableEmpty is used instead of the truncation in the restricted privileges mode:
+// the rows are only appended to the main table, so it has to be empty
+func (t *genericTable) checkMainTableEmpty() error {
+	var rows uint64
+
+	conns := t.shards
+	if conns == nil {
+		conns = []*sql.DB{t.chConn}
 	}
 
-	if _, err := t.chConn.Exec(fmt.Sprintf("truncate table %s", t.cfg.ChBufferTable)); err != nil {
-		return err
+	for _, conn := range conns {
+		var shardRows uint64
+
+		if err := conn.QueryRow(fmt.Sprintf("SELECT count() FROM %s", t.cfg.ChMainTable)).Scan(&shardRows); err != nil {
+			return fmt.Errorf("could not count main table rows: %w", err)
+		}
+		rows += shardRows
+	}
+
+	if rows > 0 {
+		return fmt.Errorf("%q main table has %d rows; with restricted_privileges it is not truncated, "+
+			"truncate it manually or grant TRUNCATE on it and disable restricted_privileges", t.cfg.ChMainTable, rows)
 	}
 
 	return nil
 }
 
-func (t *genericTable) stmntPrepare(sync bool) error {
-	var (
-		tableName string
-		err       error
-	)
+func (t *genericTable) truncateBufTable() error {
+	if t.cfg.ChBufferTable != "" && !t.cfg.Inspect {
+		if _, err := t.chConn.Exec(fmt.Sprintf("truncate table %s%s", t.cfg.ChBufferTable, chutils.OnCluster(t.cfg.Cluster))); err != nil {
+			return err
+		}
+	}
+	t.stats.ResetBufferTableRows()
+	t.bufferRowId = 0
+	t.mergedRowId = 0
+	t.mergedLSN = utils.InvalidLSN
+
+	return nil
+}
+
+// lsnRange returns lsn range of the rows in the memory buffer
+func (t *genericTable) lsnRange() (utils.LSN, utils.LSN) {
+	var minLSN, maxLSN utils.LSN
+
+	for i := 0; i < t.bufferCmdId; i++ {
+		for _, cmd := range t.buffer[i] {
+			if minLSN == utils.InvalidLSN || cmd.lsn < minLSN {
+				minLSN = cmd.lsn
+			}
+			if cmd.lsn > maxLSN {
+				maxLSN = cmd.lsn
+			}
+		}
+	}
+
+	return minLSN, maxLSN
+}
+
+// logComment returns quoted log_comment setting value identifying the query in the clickhouse query log,
+// empty string if disabled
+func (t *genericTable) logComment(kind string, minLSN, maxLSN utils.LSN) string {
+	if !t.cfg.LogComment {
+		return ""
+	}
+
+	comment := fmt.Sprintf("pg2ch %s table=%s lsn=%s-%s generation=%d",
+		kind, t.cfg.PgTableName.String(), minLSN.String(), maxLSN.String(), atomic.LoadUint64(t.generationID))
+
+	return chQuote(comment)
+}
+
+// dedupSettings returns the settings making clickhouse skip the insert of the lsn range it already has,
+// e.g. replayed after a crash before the lsn was stored; empty string if disabled. offset is the number of
+// the commands of the minLSN transaction flushed before, the rows of a transaction share the lsn
+func (t *genericTable) dedupSettings(kind string, minLSN, maxLSN utils.LSN, offset int) string {
+	if !t.cfg.InsertDeduplication || minLSN == utils.InvalidLSN {
+		return ""
+	}
+
+	token := fmt.Sprintf("pg2ch %s table=%s lsn=%s-%s offset=%d",
+		kind, t.cfg.PgTableName.String(), minLSN.String(), maxLSN.String(), offset)
+
+	return "insert_deduplicate = 1, insert_deduplication_token = " + chQuote(token)
+}
+
+// chQuote returns the string literal for the clickhouse query
+func chQuote(str string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(str) + "'"
+}
+
+// settingValue returns the literal of the setting value: numbers as is, string literal otherwise
+func settingValue(val string) string {
+	intPart, fracPart, _ := strings.Cut(strings.TrimPrefix(val, "-"), ".")
+	if intPart != "" && isDigits(intPart) && isDigits(fracPart) {
+		return val
+	}
+
+	return chQuote(val)
+}
+
+// withSetting appends the setting to the SETTINGS clause
+func withSetting(settingsClause, setting string) string {
+	if setting == "" {
+		return settingsClause
+	}
+	if settingsClause == "" {
+		return " SETTINGS " + setting
+	}
+
+	return settingsClause + ", " + setting
+}
+
+// insertQuery returns the query inserting the rows into the buffer/main table; dedup is the deduplication
+// settings of the flushed lsn range, see dedupSettings
+func (t *genericTable) insertQuery(sync bool, logComment, dedup string) string {
+	var tableName string
 
 	columns := t.chUsedColumns
 	if t.cfg.ChBufferTable != "" && ((sync && !t.cfg.InitSyncSkipBufferTable) || !sync) {
 		tableName = t.cfg.ChBufferTable
 		columns = append(columns, t.cfg.BufferTableRowIdColumn)
+		if t.cfg.BufferTableLSNColumn != "" {
+			columns = append(columns, t.cfg.BufferTableLSNColumn)
+		}
 	} else {
 		tableName = t.cfg.ChMainTable
 	}
 
-	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+	settings := make([]string, 0, 2)
+	if t.cfg.LocalTable != "" && tableName == t.cfg.ChMainTable {
+		settings = append(settings, "insert_distributed_sync = 1") // the rows are on the shards once committed
+	}
+	if logComment != "" {
+		settings = append(settings, "log_comment = "+logComment)
+	}
+	if dedup != "" {
+		settings = append(settings, dedup)
+	}
+
+	settingsClause := ""
+	if len(settings) > 0 {
+		settingsClause = " SETTINGS " + strings.Join(settings, ", ")
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s)%s VALUES (%s)",
 		tableName,
 		strings.Join(columns, ", "),
+		settingsClause,
 		strings.Join(strings.Split(strings.Repeat("?", len(columns)), ""), ", "))
+}
+
+func (t *genericTable) stmntPrepare(sync bool, logComment, dedup string) error {
+	var err error
+
+	query := t.insertQuery(sync, logComment, dedup)
+	if t.shards != nil {
+		t.shardStmnt = make([]*sql.Stmt, len(t.shards))
+		for i, tx := range t.shardTx {
+			if t.shardStmnt[i], err = tx.Prepare(query); err != nil {
+				return fmt.Errorf("could not prepare statement on shard %d: %w", i+1, err)
+			}
+		}
+
+		return nil
+	}
 
 	t.chStmnt, err = t.chTx.Prepare(query)
 	if err != nil {
-		return fmt.Errorf("could not prepare statement: %v", err)
+		return fmt.Errorf("could not prepare statement: %w", err)
 	}
 
 	return nil
 }
 
 func (t *genericTable) stmntExec(params []interface{}) error {
+	if t.shards != nil {
+		_, err := t.shardStmnt[t.shardOf(params)].Exec(params...)
+
+		return err
+	}
+
 	_, err := t.chStmnt.Exec(params...)
 
 	return err
 }
 
 func (t *genericTable) begin() (err error) {
+	if t.shards != nil {
+		t.shardTx = make([]*sql.Tx, len(t.shards))
+		for i, conn := range t.shards {
+			if t.shardTx[i], err = conn.Begin(); err != nil {
+				return fmt.Errorf("shard %d: %w", i+1, err)
+			}
+		}
+
+		return nil
+	}
+
 	t.chTx, err = t.chConn.Begin()
 
 	return
 }
 
+func (t *genericTable) rollback() {
+	txs := t.shardTx
+	if t.shards == nil {
+		txs = []*sql.Tx{t.chTx}
+	}
+
+	for _, tx := range txs {
+		if tx == nil {
+			continue
+		}
+
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			t.log.Warn("could not rollback clickhouse transaction", "error", err)
+		}
+	}
+}
+
 func (t *genericTable) pgStatLiveTuples(pgTx *pgx.Tx) (int64, error) {
-	var rows sql.NullInt64
-	err := pgTx.QueryRow("select n_live_tup from pg_stat_all_tables where schemaname = $1 and relname = $2",
-		t.cfg.PgTableName.SchemaName,
-		t.cfg.PgTableName.TableName).Scan(&rows)
+	var (
+		rows sql.NullInt64
+		err  error
+	)
+
+	if t.cfg.Partitioned {
+		err = pgTx.QueryRow("select sum(n_live_tup)::bigint from pg_stat_all_tables where relid in ("+
+			utils.PartitionTreeQuery+")", t.cfg.PgTableName.String()).Scan(&rows)
+	} else {
+		err = pgTx.QueryRow("select n_live_tup from pg_stat_all_tables where schemaname = $1 and relname = $2",
+			t.cfg.PgTableName.SchemaName,
+			t.cfg.PgTableName.TableName).Scan(&rows)
+	}
 	if err != nil || !rows.Valid {
 		return 0, err
 	}
@@ -164,219 +468,1044 @@ func (t *genericTable) pgStatLiveTuples(pgTx *pgx.Tx) (int64, error) {
 	return rows.Int64, nil
 }
 
-func (t *genericTable) genSync(pgTx *pgx.Tx, w io.Writer) error {
+// syncWriter aborts the copy as soon as the context is cancelled, paces it
+// and accounts time spent in the underlying writer
+type syncWriter struct {
+	ctx context.Context
+	w   io.Writer
+
+	maxRowsPerSecond  int
+	maxBytesPerSecond int
+	startTime         time.Time
+	rows              int64
+	bytes             int64
+
+	writeTime  time.Duration
+	pacingTime time.Duration
+}
+
+func newSyncWriter(ctx context.Context, w io.Writer, maxRowsPerSecond, maxBytesPerSecond int) *syncWriter {
+	return &syncWriter{
+		ctx:               ctx,
+		w:                 w,
+		maxRowsPerSecond:  maxRowsPerSecond,
+		maxBytesPerSecond: maxBytesPerSecond,
+		startTime:         time.Now(),
+	}
+}
+
+func (sw *syncWriter) Write(p []byte) (int, error) {
+	if err := sw.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	n, err := sw.w.Write(p)
+	sw.writeTime += time.Since(start)
+	if err != nil {
+		return n, err
+	}
+
+	sw.rows++
+	sw.bytes += int64(len(p))
+
+	return n, sw.pace()
+}
+
+// pace sleeps if the copy goes faster than allowed; slowing down reading the copy data
+// slows down the source server as well
+func (sw *syncWriter) pace() error {
+	var expected time.Duration
+
+	if sw.maxRowsPerSecond > 0 {
+		expected = time.Duration(sw.rows) * time.Second / time.Duration(sw.maxRowsPerSecond)
+	}
+
+	if sw.maxBytesPerSecond > 0 {
+		if d := time.Duration(sw.bytes) * time.Second / time.Duration(sw.maxBytesPerSecond); d > expected {
+			expected = d
+		}
+	}
+
+	delay := expected - time.Since(sw.startTime)
+	if delay < minPacingDelay {
+		return nil
+	}
+
+	sw.pacingTime += delay
+	select {
+	case <-sw.ctx.Done():
+		return sw.ctx.Err()
+	case <-time.After(delay):
+	}
+
+	return nil
+}
+
+func (t *genericTable) genSync(pgTx *pgx.Tx, w syncTable) (err error) {
 	if t.cfg.InitSyncSkip {
 		return nil
 	}
 
-	if err := t.begin(); err != nil {
-		return fmt.Errorf("could not begin: %v", err)
+	if t.cfg.Inspect {
+		t.log.Info("inspection mode: skipping initial sync")
+		return nil
 	}
 
+	defer func() {
+		if err != nil {
+			t.bufferRowId = 0
+		}
+	}()
+
 	tblLiveTuples, err := t.pgStatLiveTuples(pgTx)
 	if err != nil {
-		log.Printf("Could not get approx number of rows in the source table: %v", err)
+		t.log.Warn("could not get approx number of rows in the source table", "error", err)
 	}
+	t.stats.StartSync(tblLiveTuples)
 
 	if t.cfg.ChBufferTable != "" && !t.cfg.InitSyncSkipBufferTable {
-		log.Printf("Copy from %s postgres table to %q clickhouse table via %q buffer table started. ~%v rows to copy",
-			t.cfg.PgTableName.String(), t.cfg.ChMainTable, t.cfg.ChBufferTable, tblLiveTuples)
+		t.log.Info("initial sync started", "buffer_table", t.cfg.ChBufferTable, "approx_rows", tblLiveTuples)
 		if err := t.truncateBufTable(); err != nil {
-			return fmt.Errorf("could not truncate buffer table: %v", err)
+			return fmt.Errorf("could not truncate buffer table: %w", err)
 		}
 	} else {
-		log.Printf("Copy from %s postgres table to %q clickhouse table started. ~%v rows to copy",
-			t.cfg.PgTableName.String(), t.cfg.ChMainTable, tblLiveTuples)
+		t.log.Info("initial sync started", "approx_rows", tblLiveTuples)
 		if !t.cfg.InitSyncSkipTruncate {
 			if err := t.truncateMainTable(); err != nil {
-				return fmt.Errorf("could not truncate main table: %v", err)
+				return fmt.Errorf("could not truncate main table: %w", err)
 			}
 		}
 	}
 
-	if err := t.stmntPrepare(true); err != nil {
-		return fmt.Errorf("could not prepare: %v", err)
-	}
-
-	query := fmt.Sprintf("copy %s(%s) to stdout", t.cfg.PgTableName.String(), strings.Join(t.pgUsedColumns, ", "))
-	if _, err := pgTx.CopyToWriter(w, query); err != nil {
-		return fmt.Errorf("could not copy: %v", err)
-	}
+	t.binaryCopy = t.useBinaryCopy()
 
-	if err := t.stmntCloseCommit(); err != nil {
+	if t.cfg.Partitioned && t.cfg.SyncPartitionWorkers > 1 {
+		if err := t.partitionedCopy(pgTx, w); err != nil {
+			return err
+		}
+	} else if t.cfg.SyncChunks > 1 {
+		if err := t.chunkedCopy(pgTx, w); err != nil {
+			return err
+		}
+	} else if err := t.uploadCopy(pgTx, w, t.tableSource()); err != nil {
 		return err
 	}
+
 	rows := t.bufferRowId
 	t.bufferCmdId = 0
 	if t.cfg.ChBufferTable != "" && !t.cfg.InitSyncSkipBufferTable {
 		if !t.cfg.InitSyncSkipTruncate {
 			if err := t.truncateMainTable(); err != nil {
-				return fmt.Errorf("could not truncate main table: %v", err)
+				return fmt.Errorf("could not truncate main table: %w", err)
 			}
 		}
 
 		t.bufferFlushCnt++
 		if err := t.FlushToMainTable(); err != nil {
-			return fmt.Errorf("could not move from buffer to the main table: %v", err)
+			return fmt.Errorf("could not move from buffer to the main table: %w", err)
 		}
 	}
+	t.optimizeAfterSync()
 	t.bufferRowId = 0
-	log.Printf("Pg table %s: %d rows copied to ClickHouse %q table", t.cfg.PgTableName.String(), rows, t.cfg.ChMainTable)
+	t.stats.FinishSync()
+	t.log.Info("initial sync finished", "rows", rows,
+		"read_time", time.Duration(atomic.LoadInt64(&t.stats.SyncReadTime)),
+		"convert_time", time.Duration(atomic.LoadInt64(&t.stats.SyncConvertTime)),
+		"upload_time", time.Duration(atomic.LoadInt64(&t.stats.SyncUploadTime)))
 
 	return nil
 }
 
-func (t *genericTable) stmntCloseCommit() error {
-	if err := t.chStmnt.Close(); err != nil {
-		return fmt.Errorf("could not close statement: %v", err)
+// uploadCopy copies the rows of the source to w within a clickhouse transaction,
+// or a series of them with sync_chunk_rows
+func (t *genericTable) uploadCopy(pgTx *pgx.Tx, w io.Writer, src copySource) (err error) {
+	if err := t.begin(); err != nil {
+		return fmt.Errorf("could not begin: %w", err)
 	}
+	defer func() {
+		if err == nil {
+			return
+		}
 
-	if err := t.chTx.Commit(); err != nil {
-		return fmt.Errorf("could not commit transaction: %v", err)
+		t.rollback()
+	}()
+
+	if err := t.stmntPrepare(true, t.logComment("sync", utils.InvalidLSN, utils.InvalidLSN), ""); err != nil {
+		return fmt.Errorf("could not prepare: %w", err)
+	}
+
+	sw := newSyncWriter(t.ctx, w, t.cfg.SyncMaxRowsPerSecond, t.cfg.SyncMaxBytesPerSecond)
+	copyStart := time.Now()
+	if err := t.copyTable(pgTx, sw, src); err != nil {
+		if ctxErr := t.ctx.Err(); ctxErr != nil {
+			return fmt.Errorf("copy of %s aborted: %w", t.cfg.PgTableName.String(), ctxErr)
+		}
+
+		return fmt.Errorf("could not copy: %w", err)
+	}
+	if err := t.flushSyncPending(); err != nil {
+		return err
+	}
+	if readTime := time.Since(copyStart) - sw.writeTime - sw.pacingTime; readTime > 0 {
+		atomic.AddInt64(&t.stats.SyncReadTime, int64(readTime))
+	}
+	if sw.pacingTime > 0 {
+		t.log.Info("initial sync was paced", "pacing_time", sw.pacingTime.Truncate(time.Second))
+	}
+
+	commitStart := time.Now()
+	if t.cfg.SyncChunkRows > 0 {
+		if err := t.commitSyncChunk(false); err != nil {
+			return err
+		}
+	} else if err := t.stmntCloseCommit(); err != nil {
+		return err
 	}
+	atomic.AddInt64(&t.stats.SyncUploadTime, int64(time.Since(commitStart)))
 
 	return nil
 }
 
-func (t *genericTable) bufferAppend(cmdSet commandSet) {
-	bufItem := make([]bufRow, len(cmdSet))
-	for i := range cmdSet {
-		bufItem[i] = bufRow{rowID: t.bufferRowId, data: cmdSet[i]}
-		t.bufferRowId++
+// useBinaryCopy checks if the initial sync can be copied in the binary format: the text format is used
+// if any of the copied columns has a type without the binary decoder
+func (t *genericTable) useBinaryCopy() bool {
+	if t.cfg.SyncCopyFormat != config.CopyBinary || t.cfg.SyncFetchSize > 0 {
+		return false
 	}
 
-	t.buffer[t.bufferCmdId] = bufItem
-	t.bufferCmdId++
+	for _, pgColName := range t.pgCopyColumns {
+		if pgType := t.cfg.PgColumns[pgColName].BaseType; !utils.HasBinaryText(pgType) {
+			t.log.Warn("column type has no binary decoder, copying in the text format",
+				"column", pgColName, "type", pgType)
+			return false
+		}
+	}
+
+	return true
 }
 
-func (t *genericTable) processCommandSet(set commandSet) (bool, error) {
-	if set != nil {
-		t.bufferAppend(set)
+// copyTable passes rows of the source in the copy text format to w, or in the binary format one tuple per write
+func (t *genericTable) copyTable(pgTx *pgx.Tx, w io.Writer, src copySource) error {
+	if t.cfg.SyncFetchSize > 0 {
+		return t.cursorCopy(pgTx, w, src)
 	}
 
-	if t.bufferCmdId == t.cfg.MaxBufferLength {
-		t.flushMutex.Lock()
-		defer t.flushMutex.Unlock()
-
-		if err := t.flushBuffer(); err != nil {
-			return false, fmt.Errorf("could not flush buffer: %v", err)
+	query := fmt.Sprintf("copy %s(%s) to stdout", src.table, strings.Join(t.pgCopyColumns, ", "))
+	if cond := t.copyCondition(src); cond != "" || src.query {
+		where, only := "", "only "
+		if cond != "" {
+			where = " where " + cond
 		}
+		if src.query {
+			only = ""
+		}
+		query = fmt.Sprintf("copy (select %s from %s%s%s) to stdout",
+			strings.Join(t.pgCopyColumns, ", "), only, src.table, where)
 	}
 
-	if t.cfg.ChBufferTable == "" {
-		return false, nil
+	if !t.binaryCopy {
+		_, err := pgTx.CopyToWriter(w, query)
+
+		return err
+	}
+
+	bw := utils.NewBinaryCopyWriter(w)
+	if _, err := pgTx.CopyToWriter(bw, query+" with (format binary)"); err != nil {
+		return err
 	}
 
-	return t.bufferFlushCnt >= t.cfg.FlushThreshold, nil
+	return bw.Finish()
 }
 
-func (t *genericTable) syncConvertIntoRow(p []byte) ([]interface{}, int, error) {
-	rec, err := utils.DecodeCopy(p)
-	if err != nil {
-		return nil, 0, err
+// cursorCopy reads the table via server-side cursor in chunks of the fetch size
+// instead of a single COPY, rows are passed to w in the copy text format
+func (t *genericTable) cursorCopy(pgTx *pgx.Tx, w io.Writer, src copySource) error {
+	columns := make([]string, len(t.pgCopyColumns))
+	for i, pgColName := range t.pgCopyColumns {
+		columns[i] = pgColName + "::text"
 	}
 
-	row, err := t.syncConvertStrings(rec)
-	if err != nil {
-		return nil, 0, fmt.Errorf("could not parse record: %v", err)
+	where := ""
+	if cond := t.copyCondition(src); cond != "" {
+		where = " WHERE " + cond
 	}
 
-	return row, len(p), nil
-}
+	// the rows of the inheritance children are read only if asked, same as by COPY
+	only := "ONLY "
+	if src.query {
+		only = ""
+	}
 
-func (t *genericTable) insertRow(row []interface{}) error {
-	var chTableName string
+	if _, err := pgTx.Exec(fmt.Sprintf("DECLARE %s NO SCROLL CURSOR FOR SELECT %s FROM %s%s%s",
+		syncCursorName, strings.Join(columns, ", "), only, src.table, where)); err != nil {
+		return fmt.Errorf("could not declare cursor: %w", err)
+	}
 
-	if t.cfg.ChBufferTable != "" && !t.cfg.InitSyncSkipBufferTable {
-		chTableName = t.cfg.ChBufferTable
-		row = append(row, t.bufferRowId)
-	} else {
-		chTableName = t.cfg.ChMainTable
+	fields := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range fields {
+		dest[i] = &fields[i]
 	}
 
-	if err := t.stmntExec(row); err != nil {
-		return fmt.Errorf("could not insert: %v", err)
+	fetchQuery := fmt.Sprintf("FETCH FORWARD %d FROM %s", t.cfg.SyncFetchSize, syncCursorName)
+	for {
+		fetched, err := t.fetchChunk(pgTx, fetchQuery, fields, dest, w)
+		if err != nil {
+			return err
+		}
+
+		if fetched < t.cfg.SyncFetchSize {
+			break
+		}
 	}
-	t.bufferRowId++
 
-	if t.bufferRowId%1000000 == 0 {
-		log.Printf("clickhouse %q table: %d rows inserted", chTableName, t.bufferRowId)
+	if _, err := pgTx.Exec("CLOSE " + syncCursorName); err != nil {
+		return fmt.Errorf("could not close cursor: %w", err)
 	}
 
 	return nil
 }
 
-func (t *genericTable) flushBuffer() error {
-	var err error
+func (t *genericTable) fetchChunk(pgTx *pgx.Tx, fetchQuery string, fields []sql.NullString, dest []interface{}, w io.Writer) (int, error) {
+	rows, err := pgTx.Query(fetchQuery)
+	if err != nil {
+		return 0, fmt.Errorf("could not fetch: %w", err)
+	}
+	defer rows.Close()
 
-	for attempt := 0; attempt < maxAttempts; attempt++ {
-		err = t.attemptFlushBuffer()
-		if err == nil {
-			if attempt > 0 {
-				log.Printf("succeeded buffer flush after %v attempts", attempt)
-			}
-			break
+	fetched := 0
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return 0, fmt.Errorf("could not scan: %w", err)
 		}
 
-		log.Printf("could not flush buffer: %v, retrying after %v", err, attemptInterval)
-		select {
-		case <-t.ctx.Done():
-			return fmt.Errorf("abort retrying")
-		case <-time.After(attemptInterval):
+		if _, err := w.Write(utils.EncodeCopy(fields)); err != nil {
+			return 0, err
 		}
+		fetched++
 	}
 
-	return err
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("could not fetch: %w", err)
+	}
+
+	return fetched, nil
+}
+
+func (t *genericTable) stmntCloseCommit() error {
+	if t.shards != nil {
+		for i := range t.shards {
+			if err := t.shardStmnt[i].Close(); err != nil {
+				return fmt.Errorf("could not close statement on shard %d: %w", i+1, err)
+			}
+
+			if err := t.shardTx[i].Commit(); err != nil {
+				return fmt.Errorf("could not commit transaction on shard %d: %w", i+1, err)
+			}
+		}
+
+		return nil
+	}
+
+	if err := t.chStmnt.Close(); err != nil {
+		return fmt.Errorf("could not close statement: %w", err)
+	}
+
+	if err := t.chTx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (t *genericTable) bufferAppend(lsn utils.LSN, cmdSet commandSet) {
+	var size int64
+
+	bufItem := make([]bufRow, len(cmdSet))
+	for i := range cmdSet {
+		bufItem[i] = bufRow{rowID: t.bufferRowId, lsn: lsn, txPos: t.txCmds - 1, data: cmdSet[i]}
+		t.bufferRowId++
+		size += rowSize(cmdSet[i])
+	}
+
+	if t.buffer == nil { // released by the idle table
+		t.buffer = make([]bufCommand, t.cfg.MaxBufferLength)
+	}
+	t.buffer[t.bufferCmdId] = bufItem
+	t.bufferCmdId++
+	t.stats.AddBuffered(int64(len(cmdSet)), size)
+}
+
+// DiscardTx drops the commands of the transaction interrupted by the reconnect from the memory buffer: postgres
+// sends the transaction again from its beginning, its commands flushed before the reconnect are skipped then
+func (t *genericTable) DiscardTx(lsn utils.LSN) {
+	var rows, size int64
+
+	for t.bufferCmdId > 0 && t.buffer[t.bufferCmdId-1][0].lsn == lsn {
+		t.bufferCmdId--
+		for _, row := range t.buffer[t.bufferCmdId] {
+			rows++
+			size += rowSize(row.data)
+		}
+		t.buffer[t.bufferCmdId] = nil
+	}
+	t.stats.AddBuffered(-rows, -size)
+
+	t.replaySkip = t.flushOffset(lsn)
+	t.txLSN = utils.InvalidLSN // counted again from its beginning
+}
+
+// Release frees the memory buffer and the values of the last row of the idle table, they are allocated again
+// on the next change; reports false if the buffer is not empty
+func (t *genericTable) Release() bool {
+	if t.bufferCmdId > 0 {
+		return false
+	}
+
+	t.buffer = nil
+	t.exprEnv = make(expr.Env)
+
+	return true
+}
+
+// rowSize returns approximate memory size of the row values
+func rowSize(row []interface{}) int64 {
+	size := int64(0)
+	for _, val := range row {
+		switch v := val.(type) {
+		case string:
+			size += int64(len(v))
+		case []byte:
+			size += int64(len(v))
+		default:
+			size += 8
+		}
+	}
+
+	return size
+}
+
+func (t *genericTable) processCommandSet(lsn utils.LSN, set commandSet) (bool, error) {
+	if t.replaySkip > 0 && lsn != t.flushedLSN {
+		t.replaySkip = t.flushOffset(lsn)
+	}
+
+	if set != nil {
+		if lsn != t.txLSN {
+			t.txLSN, t.txCmds = lsn, 0
+		}
+		t.txCmds++
+	}
+
+	if set != nil && t.replaySkip > 0 {
+		t.replaySkip--
+	} else if set != nil {
+		t.bufferAppend(lsn, set)
+	}
+
+	if t.bufferCmdId == t.cfg.MaxBufferLength {
+		t.flushMutex.Lock()
+		defer t.flushMutex.Unlock()
+
+		if err := t.flushBuffer(); err != nil {
+			return false, fmt.Errorf("could not flush buffer: %w", err)
+		}
+	}
+
+	if t.cfg.ChBufferTable == "" {
+		return false, nil
+	}
+
+	return t.bufferFlushCnt >= t.cfg.FlushThreshold || t.bufferRowId >= rowIDFlushThreshold, nil
+}
+
+func (t *genericTable) syncConvertIntoRow(p []byte) ([]interface{}, int, error) {
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&t.stats.SyncConvertTime, int64(time.Since(start)))
+	}()
+	atomic.AddUint64(&t.stats.SyncBytes, uint64(len(p)))
+
+	rec, err := t.decodeSyncRow(p)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	row, err := t.syncConvertStrings(rec)
+	if errors.Is(err, utils.ErrDeadLetter) {
+		return nil, len(p), t.syncDeadLetter(rec, err) // nil row is skipped
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("could not parse record: %w", err)
+	}
+
+	return row, len(p), nil
+}
+
+// decodeSyncRow decodes the copied row into the text values of the columns
+func (t *genericTable) decodeSyncRow(p []byte) ([]sql.NullString, error) {
+	if !t.binaryCopy {
+		return utils.DecodeCopy(p)
+	}
+
+	fields, err := utils.DecodeBinaryCopy(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) != len(t.pgCopyColumns) {
+		return nil, fmt.Errorf("unexpected number of fields: %d", len(fields))
+	}
+
+	rec := make([]sql.NullString, len(fields))
+	for i, field := range fields {
+		if field == nil {
+			continue
+		}
+
+		pgColName := t.pgCopyColumns[i]
+		if rec[i].String, err = utils.BinaryText(t.cfg.PgColumns[pgColName].BaseType, field); err != nil {
+			return nil, fmt.Errorf("could not decode %s column: %w", pgColName, err)
+		}
+		rec[i].Valid = true
+	}
+
+	return rec, nil
+}
+
+func (t *genericTable) insertRow(row []interface{}) error {
+	var chTableName string
+
+	rowID := t.bufferRowId
+	if t.syncRowID != nil {
+		rowID = atomic.AddUint64(t.syncRowID, 1) - 1
+	}
+
+	if t.cfg.ChBufferTable != "" && !t.cfg.InitSyncSkipBufferTable {
+		chTableName = t.cfg.ChBufferTable
+		row = append(row, rowID)
+		if t.cfg.BufferTableLSNColumn != "" {
+			row = append(row, uint64(utils.InvalidLSN))
+		}
+	} else {
+		chTableName = t.cfg.ChMainTable
+	}
+
+	if len(t.cfg.Tokenizers) > 0 {
+		t.syncPending = append(t.syncPending, row)
+		if len(t.syncPending) >= t.cfg.MaxBufferLength {
+			if err := t.flushSyncPending(); err != nil {
+				return err
+			}
+		}
+	} else if err := t.execSyncRow(row); err != nil {
+		return err
+	}
+	t.bufferRowId++
+
+	if t.bufferRowId%1000000 == 0 {
+		t.log.Info("initial sync progress", "rows", t.bufferRowId, "insert_table", chTableName)
+	}
+
+	return nil
+}
+
+func (t *genericTable) execSyncRow(row []interface{}) error {
+	start := time.Now()
+	if t.cfg.SyncChunkRows > 0 {
+		if err := t.insertChunkRow(row); err != nil {
+			return err
+		}
+	} else if err := t.stmntExec(row); err != nil {
+		return fmt.Errorf("could not insert: %w", chutils.ClassifyError(err))
+	}
+	atomic.AddInt64(&t.stats.SyncUploadTime, int64(time.Since(start)))
+	atomic.AddUint64(&t.stats.SyncRows, 1)
+
+	return nil
+}
+
+// insertChunkRow inserts the row of the initial sync keeping it in the current chunk until the chunk is committed,
+// so that a failed insert re-uploads only the chunk instead of restarting the whole sync
+func (t *genericTable) insertChunkRow(row []interface{}) error {
+	t.syncChunk = append(t.syncChunk, row)
+	if err := t.stmntExec(row); err != nil {
+		if err := t.retrySyncChunk(err); err != nil {
+			return fmt.Errorf("could not insert: %w", err)
+		}
+
+		return t.beginSyncChunk()
+	}
+
+	if len(t.syncChunk) < t.cfg.SyncChunkRows {
+		return nil
+	}
+
+	return t.commitSyncChunk(true)
+}
+
+// commitSyncChunk commits the current chunk of the initial sync, re-uploading it on retriable errors;
+// if next is set, the transaction for the next chunk is started
+func (t *genericTable) commitSyncChunk(next bool) error {
+	if err := t.stmntCloseCommit(); err != nil {
+		if err := t.retrySyncChunk(err); err != nil {
+			return err
+		}
+	}
+	t.syncChunk = t.syncChunk[:0]
+
+	if !next {
+		return nil
+	}
+
+	return t.beginSyncChunk()
+}
+
+func (t *genericTable) beginSyncChunk() error {
+	t.syncChunk = t.syncChunk[:0]
+	if err := t.begin(); err != nil {
+		return fmt.Errorf("could not begin: %w", err)
+	}
+
+	return t.stmntPrepare(true, t.logComment("sync", utils.InvalidLSN, utils.InvalidLSN), "")
+}
+
+// retrySyncChunk re-uploads and commits the rows of the current chunk in a new transaction
+// until it succeeds, err is the error of the failed upload
+func (t *genericTable) retrySyncChunk(err error) error {
+	for attempt := 1; ; attempt++ {
+		err = chutils.ClassifyError(err)
+		if !chutils.IsRetriable(err) || attempt >= maxAttempts {
+			return err
+		}
+
+		t.stats.FlushFailed()
+		t.log.Warn("could not upload chunk of the initial sync, retrying",
+			"rows", len(t.syncChunk), "attempt", attempt, "retry_after", attemptInterval, "error", err)
+		t.rollback()
+
+		select {
+		case <-t.ctx.Done():
+			return fmt.Errorf("abort retrying")
+		case <-time.After(attemptInterval):
+		}
+
+		if err = t.uploadSyncChunk(); err == nil {
+			t.log.Info("succeeded chunk upload of the initial sync", "attempts", attempt)
+			t.stats.FlushSucceeded()
+			return nil
+		}
+	}
+}
+
+func (t *genericTable) uploadSyncChunk() error {
+	if err := t.begin(); err != nil {
+		return fmt.Errorf("could not begin: %w", err)
+	}
+
+	if err := t.stmntPrepare(true, t.logComment("sync", utils.InvalidLSN, utils.InvalidLSN), ""); err != nil {
+		return err
+	}
+
+	for _, row := range t.syncChunk {
+		if err := t.stmntExec(row); err != nil {
+			return err
+		}
+	}
+
+	return t.stmntCloseCommit()
+}
+
+func (t *genericTable) flushBuffer() error {
+	var err error
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		err = chutils.ClassifyError(t.attemptFlushBuffer())
+		if err == nil {
+			if attempt > 0 {
+				t.log.Info("succeeded buffer flush", "attempts", attempt)
+				t.stats.FlushSucceeded()
+			}
+			break
+		}
+
+		if !chutils.IsRetriable(err) {
+			return err
+		}
+
+		if t.shards == nil && isRejection(err) {
+			t.rollback()
+			if err := t.handleRejectedRows(err); err != nil {
+				return err
+			}
+			continue // the rest of the buffer is retried right away
+		}
+
+		t.stats.FlushFailed()
+		t.log.Warn("could not flush buffer, retrying", "attempt", attempt, "retry_after", attemptInterval, "error", err)
+		select {
+		case <-t.ctx.Done():
+			return fmt.Errorf("abort retrying")
+		case <-time.After(attemptInterval):
+		}
+	}
+
+	return err
+}
+
+// writeBuffer writes the rows of the memory buffer to the buffer/main table
+func (t *genericTable) writeBuffer(minLSN, maxLSN utils.LSN) error {
+	if t.shards != nil {
+		return t.writeBufferShards(minLSN, maxLSN)
+	}
+
+	return t.writeRows(t.pendingRows(), t.logComment("flush", minLSN, maxLSN),
+		t.dedupSettings("flush", minLSN, maxLSN, t.bufferOffset()))
+}
+
+// bufferOffset returns the position of the first command of the memory buffer in its transaction. It is taken
+// from the stream, which is sent again from the beginning of the transaction after the restart, so the replayed
+// flush gets the same deduplication token as the one written before the crash
+func (t *genericTable) bufferOffset() int {
+	if t.bufferCmdId == 0 {
+		return 0
+	}
+
+	return t.buffer[0][0].txPos
+}
+
+// flushOffset returns the number of the commands of the minLSN transaction flushed before
+func (t *genericTable) flushOffset(minLSN utils.LSN) int {
+	if minLSN != t.flushedLSN {
+		return 0
+	}
+
+	return t.flushedOfLSN
+}
+
+// trackFlushedLSN remembers the number of the flushed commands of the last transaction in the memory buffer
+func (t *genericTable) trackFlushedLSN() {
+	last := t.buffer[t.bufferCmdId-1][0]
+	t.flushedLSN, t.flushedOfLSN = last.lsn, last.txPos+1
+}
+
+// writeRows writes the rows of the memory buffer at the positions to the buffer/main table in one insert
+func (t *genericTable) writeRows(positions []bufPos, logComment, dedup string) error {
+	if err := t.begin(); err != nil {
+		return err
+	}
+
+	if err := t.stmntPrepare(false, logComment, dedup); err != nil {
+		return err
+	}
+
+	for n, pos := range positions {
+		cmd := t.buffer[pos.cmd][pos.row]
+		row := cmd.data
+		if t.cfg.ChBufferTable != "" {
+			row = append(row, cmd.rowID)
+			if t.cfg.BufferTableLSNColumn != "" {
+				row = append(row, uint64(cmd.lsn))
+			}
+		}
+
+		if err := t.stmntExec(row); err != nil {
+			return &rowError{pos: n, err: fmt.Errorf("could not exec(%#v): %w", row, err)}
+		}
+	}
+
+	return t.stmntCloseCommit()
+}
+
+// flush from memory to the buffer/main table
+func (t *genericTable) attemptFlushBuffer() error {
+	if t.bufferCmdId == 0 {
+		return nil
+	}
+	startTime := time.Now()
+
+	minLSN, maxLSN := t.lsnRange()
+	if !t.cfg.Inspect {
+		if err := t.resolveBufferTokens(); err != nil {
+			return err
+		}
+
+		if err := t.writeBuffer(minLSN, maxLSN); err != nil {
+			return err
+		}
+	}
+	t.trackFlushedLSN()
+
+	if t.cfg.ChBufferTable != "" {
+		if t.bufTableMinLSN == utils.InvalidLSN || minLSN < t.bufTableMinLSN {
+			t.bufTableMinLSN = minLSN
+		}
+		if maxLSN > t.bufTableMaxLSN {
+			t.bufTableMaxLSN = maxLSN
+		}
+	}
+
+	flushedRows := t.stats.ResetBuffered()
+	atomic.AddUint64(&t.stats.FlushedRows, uint64(flushedRows))
+	if t.cfg.ChBufferTable != "" {
+		t.stats.AddBufferTableRows(flushedRows)
+	}
+	atomic.AddUint64(&t.stats.Flushes, 1)
+	atomic.StoreInt64(&t.stats.FlushLatency, int64(time.Since(startTime)))
+
+	t.bufferCmdId = 0
+	t.bufferFlushCnt++
+	if t.cfg.ChBufferTable == "" {
+		t.bufferRowId = 0 // the row ids are written to the buffer table only
+		t.promoteSerialMax()
+	}
+
+	return nil
+}
+
+// flushSettingsClause returns SETTINGS clause for the buffer to main table queries
+func (t *genericTable) flushSettingsClause(logComment string) string {
+	names := make([]string, 0, len(t.cfg.FlushSettings))
+	for name := range t.cfg.FlushSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	settings := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		settings = append(settings, fmt.Sprintf("%s = %s", name, settingValue(t.cfg.FlushSettings[name])))
+	}
+
+	if _, ok := t.cfg.FlushSettings["insert_distributed_sync"]; !ok && t.cfg.LocalTable != "" {
+		settings = append(settings, "insert_distributed_sync = 1")
+	}
+
+	if _, ok := t.cfg.FlushSettings["max_execution_time"]; !ok && t.cfg.MergeTimeout > 0 {
+		settings = append(settings, fmt.Sprintf("max_execution_time = %d", int64(t.cfg.MergeTimeout.Seconds())))
+	}
+
+	if logComment != "" {
+		settings = append(settings, "log_comment = "+logComment)
+	}
+
+	if len(settings) == 0 {
+		return ""
+	}
+
+	return " SETTINGS " + strings.Join(settings, ", ")
+}
+
+// bufferMoveQuery returns query moving rows of the buffer table matching the condition to the main table
+func (t *genericTable) bufferMoveQuery(where string) string {
+	if where != "" {
+		where = " WHERE " + where
+	}
+
+	return fmt.Sprintf("INSERT INTO %[1]s (%[2]s) SELECT %[2]s FROM %[3]s%[4]s ORDER BY %[5]s",
+		t.cfg.ChMainTable, strings.Join(t.chUsedColumns, ", "), t.cfg.ChBufferTable, where,
+		strings.Join(t.cfg.BufferOrderBy, ", "))
+}
+
+// moveBufferBatches moves rows of the buffer table to the main table in row id ranges of the merge batch size,
+// on failure the next call continues from the first not moved batch
+func (t *genericTable) moveBufferBatches(settings string) error {
+	for t.mergedRowId < t.bufferRowId {
+		to := t.mergedRowId + uint64(t.cfg.MergeBatchSize)
+		where := fmt.Sprintf("%[1]s >= %[2]d AND %[1]s < %[3]d", t.cfg.BufferTableRowIdColumn, t.mergedRowId, to)
+		if _, err := t.chConn.Exec(t.bufferMoveQuery(where) + settings); err != nil {
+			return fmt.Errorf("could not move rows %d-%d: %w", t.mergedRowId, to, err)
+		}
+
+		if to > t.bufferRowId {
+			to = t.bufferRowId
+		}
+		t.mergedRowId = to
+		t.log.Info("moved batch of buffer table rows to the main table", "row_id", to, "max_row_id", t.bufferRowId)
+	}
+
+	return nil
+}
+
+// moveBufferLSNBatches moves rows of the buffer table to the main table in lsn ranges covering at least
+// the merge batch size rows, rows of a transaction share the lsn and are never split between the batches;
+// progress is reported after each batch so the merge interrupted by a restart is resumed from the next batch
+func (t *genericTable) moveBufferLSNBatches(settings string) error {
+	for {
+		var upperLSN uint64
+
+		err := t.chConn.QueryRow(fmt.Sprintf("SELECT max(%[1]s) FROM (SELECT %[1]s FROM %[2]s WHERE %[1]s > %[3]d ORDER BY %[1]s LIMIT %[4]d)",
+			t.cfg.BufferTableLSNColumn, t.cfg.ChBufferTable, uint64(t.mergedLSN), t.cfg.MergeBatchSize)).Scan(&upperLSN)
+		if err != nil {
+			return fmt.Errorf("could not query next batch lsn: %w", err)
+		}
+
+		if utils.LSN(upperLSN) <= t.mergedLSN {
+			return nil
+		}
+
+		where := fmt.Sprintf("%[1]s > %[2]d AND %[1]s <= %[3]d", t.cfg.BufferTableLSNColumn, uint64(t.mergedLSN), upperLSN)
+		batchSettings := withSetting(settings, t.dedupSettings("merge", t.mergedLSN, utils.LSN(upperLSN), 0))
+		if _, err := t.chConn.Exec(t.bufferMoveQuery(where) + batchSettings); err != nil {
+			return fmt.Errorf("could not move rows of %v-%v lsn range: %w", t.mergedLSN, utils.LSN(upperLSN), err)
+		}
+
+		t.mergedLSN = utils.LSN(upperLSN)
+		t.log.Info("moved batch of buffer table rows to the main table", "lsn", t.mergedLSN, "max_lsn", t.bufTableMaxLSN)
+
+		if t.mergeProgress != nil {
+			if err := t.mergeProgress(t.mergedLSN); err != nil {
+				return fmt.Errorf("could not store merge progress: %w", err)
+			}
+		}
+	}
+}
+
+func (t *genericTable) tryFlushToMainTable() error { //TODO: consider better name
+	if !t.cfg.Inspect {
+		settings := t.flushSettingsClause(t.logComment("merge", t.bufTableMinLSN, t.bufTableMaxLSN))
+		if t.cfg.MergeBatchSize > 0 && t.cfg.BufferTableLSNColumn != "" && t.bufTableMaxLSN != utils.InvalidLSN {
+			if err := t.moveBufferLSNBatches(settings); err != nil {
+				return err
+			}
+		} else if t.cfg.MergeBatchSize > 0 {
+			if err := t.moveBufferBatches(settings); err != nil {
+				return err
+			}
+		} else if _, err := t.chConn.Exec(t.bufferMoveQuery("") +
+			withSetting(settings, t.dedupSettings("merge", t.bufTableMinLSN, t.bufTableMaxLSN, 0))); err != nil {
+			return err
+		}
+	}
+
+	t.bufTableMinLSN, t.bufTableMaxLSN = utils.InvalidLSN, utils.InvalidLSN
+	t.bufferFlushCnt = 0
+	t.promoteSerialMax()
+
+	return nil
 }
 
-// flush from memory to the buffer/main table
-func (t *genericTable) attemptFlushBuffer() error {
-	if t.bufferCmdId == 0 {
-		return nil
+func (t *genericTable) promoteSerialMax() {
+	atomic.StoreInt64(&t.serialFlushedMax, t.serialSeenMax)
+}
+
+func (t *genericTable) trackSerialMax(pgColName string, val []byte) {
+	if pgColName != t.cfg.SerialGapColumn {
+		return
 	}
 
-	if err := t.begin(); err != nil {
-		return err
+	v, err := strconv.ParseInt(string(val), 10, 64)
+	if err != nil {
+		t.log.Warn("could not parse serial column value", "column", pgColName, "error", err)
+		return
 	}
 
-	if err := t.stmntPrepare(false); err != nil {
-		return err
+	if v > t.serialSeenMax {
+		t.serialSeenMax = v
 	}
+}
 
-	for i := 0; i < t.bufferCmdId; i++ {
-		for _, cmd := range t.buffer[i] {
-			row := cmd.data
-			if t.cfg.ChBufferTable != "" {
-				row = append(row, cmd.rowID)
-			}
+// SerialGap returns the difference between max value of the serial column flushed to the main table
+// and the max value of the column stored in the clickhouse table
+func (t *genericTable) SerialGap() (int64, error) {
+	flushedMax := atomic.LoadInt64(&t.serialFlushedMax)
+	if t.cfg.SerialGapColumn == "" || flushedMax == 0 || t.cfg.Inspect {
+		return 0, nil
+	}
 
-			if err := t.stmntExec(row); err != nil {
-				return fmt.Errorf("could not exec(%#v): %v", row, err)
-			}
-		}
+	var chMax sql.NullInt64
+	err := t.chConn.QueryRow(fmt.Sprintf("SELECT toInt64(max(%s)) FROM %s",
+		t.columnMapping[t.cfg.SerialGapColumn].Name, t.cfg.ChMainTable)).Scan(&chMax)
+	if err != nil {
+		return 0, fmt.Errorf("could not query max value: %w", err)
 	}
 
-	if err := t.stmntCloseCommit(); err != nil {
-		return err
+	return flushedMax - chMax.Int64, nil
+}
+
+// maxActiveParts returns the biggest number of active parts in a partition of the main table
+func (t *genericTable) maxActiveParts() (int, error) {
+	var parts int
+
+	tblName := t.cfg.ChMainTable
+	if t.cfg.LocalTable != "" {
+		tblName = t.cfg.LocalTable // parts of the shard of the connected host
 	}
 
-	t.bufferCmdId = 0
-	t.bufferFlushCnt++
+	filter, args := chutils.SystemTableFilter(tblName)
+	err := t.chConn.QueryRow(`SELECT toInt64(count()) AS cnt FROM system.parts
+		WHERE `+filter+` AND active
+		GROUP BY partition_id ORDER BY cnt DESC LIMIT 1`, args...).Scan(&parts)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
 
-	return nil
+	return parts, err
 }
 
-func (t *genericTable) tryFlushToMainTable() error { //TODO: consider better name
-	for _, query := range t.flushQueries {
-		if _, err := t.chConn.Exec(query); err != nil {
-			return err
+// WaitForMerges delays the flush to the main table while any of its partitions has too many active parts,
+// giving clickhouse a chance to merge them; it is called before the merge without holding the replicator lock
+func (t *genericTable) WaitForMerges() {
+	if t.cfg.MaxPartsPerPartition == 0 || t.cfg.Inspect {
+		return
+	}
+
+	deadline := time.Now().Add(t.cfg.PartsMaxDelay)
+	for {
+		parts, err := t.maxActiveParts()
+		if err != nil {
+			t.log.Warn("could not get number of active parts", "error", err)
+			return
+		}
+
+		if parts <= t.cfg.MaxPartsPerPartition {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.log.Warn("too many active parts in a partition, flushing anyway", "parts", parts, "delay", t.cfg.PartsMaxDelay)
+			return
+		}
+
+		t.log.Info("too many active parts in a partition, delaying flush", "parts", parts, "delay", partsCheckInterval)
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-time.After(partsCheckInterval):
 		}
 	}
+}
 
-	t.bufferFlushCnt = 0
-	t.bufferRowId = 0
+// tableDigest returns number of the actual rows of the table and the hash of their data columns
+func (t *genericTable) tableDigest(tblName string) (uint64, uint64, error) {
+	var rows, hash uint64
 
-	return nil
+	columns := make([]string, 0, len(t.pgUsedColumns))
+	for _, pgColName := range t.pgUsedColumns {
+		columns = append(columns, t.columnMapping[pgColName].Name)
+	}
+
+	err := t.chConn.QueryRow(fmt.Sprintf("SELECT count(), groupBitXor(cityHash64(%s)) FROM %s %s",
+		strings.Join(columns, ", "), tblName, t.compareFilter)).Scan(&rows, &hash)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not query %q table: %w", tblName, err)
+	}
+
+	return rows, hash, nil
+}
+
+// CompareShadow compares data columns of the main table with the ones of the table it is a shadow of,
+// returns the numbers of the actual rows in both tables and whether the contents match
+func (t *genericTable) CompareShadow() (uint64, uint64, bool, error) {
+	rows, hash, err := t.tableDigest(t.cfg.ChMainTable)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	shadowOfRows, shadowOfHash, err := t.tableDigest(t.cfg.ShadowOf)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	return rows, shadowOfRows, rows == shadowOfRows && hash == shadowOfHash, nil
 }
 
 //FlushToMainTable flushes data from buffer table to the main one
@@ -385,43 +1514,66 @@ func (t *genericTable) FlushToMainTable() error {
 	defer t.flushMutex.Unlock()
 
 	if err := t.flushBuffer(); err != nil {
-		return fmt.Errorf("could not flush buffers: %v", err)
+		return fmt.Errorf("could not flush buffers: %w", err)
 	}
 
 	if t.cfg.ChBufferTable == "" || t.bufferFlushCnt == 0 {
 		return nil
 	}
 
-	defer func(startTime time.Time, rows int) {
-		log.Printf("FlushToMainTable for %s pg table processed in %v (rows: %d)",
-			t.cfg.PgTableName.String(), time.Since(startTime).Truncate(time.Second), rows)
-	}(time.Now(), t.bufferRowId)
+	startTime := time.Now()
+	defer func(rows uint64) {
+		t.log.Info("flushed to the main table", "duration", time.Since(startTime).Truncate(time.Second), "rows", rows)
+	}(t.bufferRowId)
 
+	var err error
 	for attempt := 0; attempt < maxAttempts; attempt++ {
-		err := t.tryFlushToMainTable()
+		err = chutils.ClassifyError(t.tryFlushToMainTable())
 		if err == nil {
 			if attempt > 0 {
-				log.Printf("succeeded flush to main table after %v attempts", attempt)
+				t.log.Info("succeeded flush to the main table", "attempts", attempt)
+				t.stats.FlushSucceeded()
 			}
 			break
 		}
 
-		log.Printf("could not flush: %v, retrying after %v", err, attemptInterval)
+		t.stats.FlushFailed()
+		t.log.Warn("could not flush to the main table, retrying", "attempt", attempt, "retry_after", attemptInterval, "error", err)
 		select {
 		case <-t.ctx.Done():
 			return fmt.Errorf("abort retrying")
 		case <-time.After(attemptInterval):
 		}
 	}
+	if err != nil {
+		return fmt.Errorf("could not flush to main table: %w", err)
+	}
 
 	if err := t.truncateBufTable(); err != nil {
-		return fmt.Errorf("could not truncate buffer table: %v", err)
+		return fmt.Errorf("could not truncate buffer table: %w", err)
 	}
+	atomic.AddUint64(&t.stats.MainFlushes, 1)
+	atomic.StoreInt64(&t.stats.MainFlushLatency, int64(time.Since(startTime)))
 
 	return nil
 }
 
 func convert(val string, chType config.ChColumn, pgType config.PgColumn) (interface{}, error) {
+	if chType.IsArray && pgType.IsArray {
+		return convertArray(val, chType, pgType)
+	}
+
+	switch pgType.BaseType {
+	case utils.PgInet, utils.PgCidr:
+		if chType.BaseType != utils.ChString {
+			return convertIP(val, chType)
+		}
+	case utils.PgMacaddr, utils.PgMacaddr8:
+		if chType.BaseType == utils.ChUint64 || chType.BaseType == utils.ChFixedString {
+			return convertMAC(val, chType)
+		}
+	}
+
 	switch chType.BaseType {
 	case utils.ChInt8:
 		return strconv.ParseInt(val, 10, 8)
@@ -472,68 +1624,283 @@ func convert(val string, chType config.ChColumn, pgType config.PgColumn) (interf
 		return time.Parse("2006-01-02 15:04:05", val[:19])
 	case utils.ChUUID:
 		return val, nil
+	case utils.ChIPv4, utils.ChIPv6:
+		return convertIP(val, chType)
+	case utils.ChEnum8, utils.ChEnum16:
+		for _, label := range chType.Labels {
+			if val == label {
+				return val, nil
+			}
+		}
+
+		return nil, fmt.Errorf("%q is not a label of the %s column", val, chType.BaseType)
 	}
 
 	return nil, fmt.Errorf("unknown type: %v", chType)
 }
 
-func (t *genericTable) convertTuples(row message.Row) []interface{} {
+// convertValue converts pg value of the column into the clickhouse one, applying the column properties;
+// used by both sync and streaming paths, so that they produce the same values
+func (t *genericTable) convertValue(pgColName string, val string) (interface{}, error) {
+	pgCol := t.cfg.PgColumns[pgColName]
+	prop := t.cfg.ColumnProperties[pgColName]
+
+	if pgCol.BaseType == utils.PgCharacter || pgCol.BaseType == utils.PgChar {
+		if prop.Trim == config.TrimRight {
+			val = strings.TrimRight(val, " ")
+		}
+	}
+
+	if prop.JSON == config.JSONObject {
+		return val, nil // cast to the object when moved from the buffer table
+	}
+
+	if prop.HStore == config.HStoreMap {
+		res, err := hstoreMap(val, prop.HStoreKeys, t.columnMapping[pgColName])
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not convert %q column value: %v", utils.ErrConversion, pgColName, err)
+		}
+
+		return res, nil // cast to the map when moved from the buffer table
+	}
+
+	switch prop.Mask {
+	case config.MaskHash:
+		return mask.Hash(prop.Salt, val), nil
+	case config.MaskRedact:
+		return mask.Redacted, nil
+	case config.MaskPartial:
+		return mask.Partial(val, prop.MaskKeep), nil
+	case config.MaskNull:
+		return nil, nil
+	}
+
+	if tok, ok := t.cfg.Tokenizers[pgColName]; ok {
+		return tokenRef{tokenizer: tok, value: val}, nil // replaced with the token before the insert, in batches
+	}
+
+	if prop.Cipher != nil {
+		res, err := prop.Cipher.Encrypt([]byte(val))
+		if err != nil {
+			return nil, fmt.Errorf("could not encrypt %q column value: %w", pgColName, err)
+		}
+
+		return res, nil
+	}
+
+	if chCol := t.columnMapping[pgColName]; chCol.BaseType == utils.ChDateTime64 && !chCol.IsArray {
+		loc := prop.Location
+		if loc == nil {
+			loc = time.UTC
+		}
+
+		res, err := convertDateTime64(val, chCol, pgCol, loc)
+		if errors.Is(err, errDateTime64Overflow) {
+			return t.handleOverflow(pgColName, val, res)
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: could not convert %q column value: %v", utils.ErrConversion, pgColName, err)
+		}
+
+		return res, nil // cast to DateTime64 when moved from the buffer table
+	}
+
+	if prop.Decimal == config.DecimalExact {
+		res, err := convertDecimal(val, t.columnMapping[pgColName], prop)
+		if errors.Is(err, errDecimalOverflow) {
+			return t.handleOverflow(pgColName, val, res)
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: could not convert %q column value: %v", utils.ErrConversion, pgColName, err)
+		}
+
+		return res, nil
+	}
+
+	res, err := convert(val, t.columnMapping[pgColName], pgCol)
+	if err != nil {
+		if clamped, ok := overflowValue(val, t.columnMapping[pgColName].BaseType, res, err); ok {
+			return t.handleOverflow(pgColName, val, clamped)
+		}
+
+		return nil, fmt.Errorf("%w: could not convert %q column value: %v", utils.ErrConversion, pgColName, err)
+	}
+
+	return res, nil
+}
+
+// convertTransformed evaluates the transform of the column over the values of the pg columns in t.exprEnv
+// and converts its result in place of the value of the column
+func (t *genericTable) convertTransformed(pgColName string, transform expr.Expr) (interface{}, error) {
+	val, err := transform.Eval(t.exprEnv)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not evaluate transform of %q column: %v", utils.ErrConversion, pgColName, err)
+	}
+
+	if val.Null {
+		if !t.columnMapping[pgColName].IsNullable {
+			return nil, fmt.Errorf("%w: transform of %q column is null, the column is not nullable on the ClickHouse side",
+				utils.ErrSchemaMismatch, pgColName)
+		}
+
+		return nil, nil
+	}
+
+	return t.convertValue(pgColName, val.Str)
+}
+
+// evalDerived evaluates the column expressions over the values of the pg columns in t.exprEnv
+func (t *genericTable) evalDerived() ([]interface{}, error) {
+	res := make([]interface{}, 0, len(t.cfg.Derived))
+
+	for _, derived := range t.cfg.Derived {
+		val, err := derived.Expr.Eval(t.exprEnv)
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not evaluate expression of %q column: %v", utils.ErrConversion, derived.Name, err)
+		}
+
+		if val.Null {
+			if !derived.IsNullable {
+				return nil, fmt.Errorf("%w: expression of %q column is null, the column is not nullable on the ClickHouse side",
+					utils.ErrSchemaMismatch, derived.Name)
+			}
+			res = append(res, nil)
+			continue
+		}
+
+		// the array expressions, e.g. of the hstore arrays, give the text of the postgres arrays
+		chVal, err := convert(val.Str, derived.ChColumn, config.PgColumn{Column: config.Column{IsArray: derived.IsArray}})
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not convert expression value of %q column: %v", utils.ErrConversion, derived.Name, err)
+		}
+		res = append(res, chVal)
+	}
+
+	return res, nil
+}
+
+func (t *genericTable) convertTuples(row message.Row) ([]interface{}, error) {
 	var err error
-	res := make([]interface{}, 0)
+	// the values are placed by the position of the column, the relation columns may come in a different order
+	res := make([]interface{}, len(t.pgUsedColumns), len(t.chUsedColumns))
+
+	// the expressions may refer to any of the columns, so the values are collected first; the unchanged TOASTed
+	// values not filled from the old row are unknown, the expressions referring to them fail instead of taking NULL
+	for colId, col := range t.tupleColumns {
+		if _, ok := t.exprColumns[col.Name]; !ok {
+			continue
+		}
+
+		if row[colId].Kind == message.TupleUnchanged {
+			delete(t.exprEnv, col.Name)
+			continue
+		}
+		t.exprEnv[col.Name] = expr.Value{Str: string(row[colId].Value), Null: row[colId].Kind == message.TupleNull}
+	}
 
 	for colId, col := range t.tupleColumns {
 		var val interface{}
-		if _, ok := t.columnMapping[col.Name]; !ok {
+
+		idx, ok := t.pgUsedIndex[col.Name]
+		if !ok {
 			continue
 		}
 
 		if row[colId].Kind != message.TupleNull {
-			val, err = convert(string(row[colId].Value), t.columnMapping[col.Name], t.cfg.PgColumns[col.Name])
-			if err != nil {
-				panic(err)
-			}
+			t.trackSerialMax(col.Name, row[colId].Value)
 		}
 
-		res = append(res, val)
+		if transform, ok := t.transforms[col.Name]; ok {
+			val, err = t.convertTransformed(col.Name, transform)
+		} else if row[colId].Kind != message.TupleNull {
+			val, err = t.convertValue(col.Name, string(row[colId].Value))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		res[idx] = val
+	}
+
+	if len(t.cfg.Derived) > 0 {
+		derived, err := t.evalDerived()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, derived...)
 	}
+
 	if t.cfg.GenerationColumn != "" {
-		res = append(res, uint32(*t.generationID))
+		res = append(res, uint32(atomic.LoadUint64(t.generationID)))
 	}
 
-	return res
+	return res, nil
 }
 
 // gets row from the copy
 func (t *genericTable) syncConvertStrings(fields []sql.NullString) ([]interface{}, error) {
 	res := make([]interface{}, 0)
+
+	// the expressions may refer to any of the columns, so the values are collected first
+	for i, field := range fields {
+		if _, ok := t.exprColumns[t.pgCopyColumns[i]]; ok {
+			t.exprEnv[t.pgCopyColumns[i]] = expr.Value{Str: field.String, Null: !field.Valid}
+		}
+	}
+
 	for i, field := range fields {
-		pgColName := t.pgUsedColumns[i]
+		if i >= len(t.pgUsedColumns) {
+			break
+		}
+		pgColName := t.pgCopyColumns[i]
 		column := t.columnMapping[pgColName]
 
+		if transform, ok := t.transforms[pgColName]; ok {
+			val, err := t.convertTransformed(pgColName, transform)
+			if err != nil {
+				return nil, err
+			}
+
+			res = append(res, val)
+			continue
+		}
+
 		if !field.Valid {
 			if !column.IsNullable {
-				return nil, fmt.Errorf("got null in %s field, which is not nullable on the ClickHouse side", pgColName)
+				return nil, fmt.Errorf("%w: got null in %s field, which is not nullable on the ClickHouse side",
+					utils.ErrSchemaMismatch, pgColName)
 			}
 			res = append(res, nil)
 			continue
 		}
 
-		val, err := convert(field.String, column, t.cfg.PgColumns[pgColName])
+		val, err := t.convertValue(pgColName, field.String)
 		if err != nil {
-			return nil, fmt.Errorf("could not parse %q field with %s type: %v", pgColName, column.BaseType, err)
+			return nil, fmt.Errorf("could not parse field with %s type: %w", column.BaseType, err)
 		}
 
 		res = append(res, val)
 	}
 
+	if len(t.cfg.Derived) > 0 {
+		derived, err := t.evalDerived()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, derived...)
+	}
+
 	return res, nil
 }
 
 // Truncate truncates main and buffer(if used) tables
 func (t *genericTable) Truncate() error {
 	t.bufferCmdId = 0
+	t.bufferFlushCnt = 0
+	t.bufTableMinLSN, t.bufTableMaxLSN = utils.InvalidLSN, utils.InvalidLSN
+	t.stats.ResetBuffered()
 
-	if err := t.truncateMainTable(); err != nil {
+	if t.cfg.RestrictedPrivileges && t.cfg.RestrictedTruncate == config.TruncateIgnore && !t.cfg.Inspect {
+		t.log.Warn("replicated TRUNCATE is ignored with restricted_privileges, the main table keeps its rows")
+	} else if err := t.truncateMainTable(); err != nil {
 		return err
 	}
 
@@ -545,10 +1912,161 @@ func (t *genericTable) Init() error {
 	return t.truncateBufTable()
 }
 
+// Reconcile handles the rows left in the buffer table by the previous run: rows with lsn above the table lsn,
+// which are not going to be streamed again (i.e. below the slot's confirmed lsn), are moved to the main table,
+// the rest is discarded. Returns the max lsn of the moved rows
+func (t *genericTable) Reconcile(tableLSN, confirmedLSN utils.LSN) (utils.LSN, error) {
+	var (
+		rows   uint64
+		maxLSN uint64
+	)
+
+	if t.cfg.ChBufferTable == "" || t.cfg.Inspect {
+		return utils.InvalidLSN, nil
+	}
+
+	if t.cfg.BufferTableLSNColumn == "" {
+		if err := t.chConn.QueryRow(fmt.Sprintf("SELECT count() FROM %s", t.cfg.ChBufferTable)).Scan(&rows); err != nil {
+			return utils.InvalidLSN, fmt.Errorf("could not count buffer table rows: %w", err)
+		}
+
+		if rows > 0 {
+			t.log.Warn("discarding rows left in the buffer table, set buffer_table_lsn_column to keep them",
+				"rows", rows, "buffer_table", t.cfg.ChBufferTable)
+		}
+
+		return utils.InvalidLSN, t.truncateBufTable()
+	}
+
+	where := fmt.Sprintf("%[1]s > %[2]d AND %[1]s <= %[3]d", t.cfg.BufferTableLSNColumn, uint64(tableLSN), uint64(confirmedLSN))
+	err := t.chConn.QueryRow(fmt.Sprintf("SELECT count(), max(%s) FROM %s WHERE %s",
+		t.cfg.BufferTableLSNColumn, t.cfg.ChBufferTable, where)).Scan(&rows, &maxLSN)
+	if err != nil {
+		return utils.InvalidLSN, fmt.Errorf("could not query buffer table leftovers: %w", err)
+	}
+
+	if rows > 0 {
+		if _, err := t.chConn.Exec(t.bufferMoveQuery(where)); err != nil {
+			return utils.InvalidLSN, fmt.Errorf("could not move buffer table leftovers to the main table: %w", err)
+		}
+
+		t.log.Info("rows left in the buffer table moved to the main table",
+			"rows", rows, "buffer_table", t.cfg.ChBufferTable, "lsn", utils.LSN(maxLSN))
+	}
+
+	if err := t.truncateBufTable(); err != nil {
+		return utils.InvalidLSN, fmt.Errorf("could not truncate buffer table: %w", err)
+	}
+
+	return utils.LSN(maxLSN), nil
+}
+
+// SetSyncConnFunc sets the function opening postgres connections for the concurrent chunks of the initial sync
+func (t *genericTable) SetSyncConnFunc(fn func() (*pgx.Conn, error)) {
+	t.syncConn = fn
+}
+
+// SetMergeProgressFunc sets the function called after each batch of the buffer table rows is moved to the main table
+func (t *genericTable) SetMergeProgressFunc(fn func(utils.LSN) error) {
+	t.mergeProgress = fn
+}
+
 // SetTupleColumns sets the tuple columns
 func (t *genericTable) SetTupleColumns(tupleColumns []message.Column) {
-	//TODO: suggest alter table message for adding/deleting new/old columns on clickhouse side
+	//TODO: suggest alter table message for deleting old columns on clickhouse side
 	t.tupleColumns = tupleColumns
+	if t.converter != nil {
+		t.converter.SetTupleColumns(tupleColumns)
+	}
+}
+
+// NewColumns returns the tuple columns unknown to the table, i.e. added to the pg table after the start
+func (t *genericTable) NewColumns(tupleColumns []message.Column) []string {
+	res := make([]string, 0)
+	for _, col := range tupleColumns {
+		if _, ok := t.cfg.PgColumns[col.Name]; !ok {
+			res = append(res, col.Name)
+		}
+	}
+
+	return res
+}
+
+// AddColumns registers the new pg columns; the ones mapped to the clickhouse columns are replicated from now on.
+// The rows in the memory buffer lack the new columns, so they are flushed beforehand
+func (t *genericTable) AddColumns(pgColumns map[string]config.PgColumn, chColumns map[string]config.ChColumn) error {
+	if len(chColumns) > 0 {
+		t.flushMutex.Lock()
+		defer t.flushMutex.Unlock()
+
+		if err := t.flushBuffer(); err != nil {
+			return fmt.Errorf("could not flush buffer: %w", err)
+		}
+	}
+
+	for pgColName, pgCol := range pgColumns {
+		t.cfg.PgColumns[pgColName] = pgCol
+	}
+	t.addColumnMapping(chColumns)
+	if t.converter != nil {
+		t.converter.AddColumns(pgColumns, chColumns)
+	}
+
+	return nil
+}
+
+// RowConverter returns the converter of the rows of the table for the other outputs, created on the first call
+func (t *genericTable) RowConverter() *RowConverter {
+	if t.converter == nil {
+		t.converter = NewRowConverter(t.cfg)
+		t.converter.SetTupleColumns(t.tupleColumns)
+		t.converter.t.addColumnMapping(t.columnMapping) // the columns added after the start
+	}
+
+	return t.converter
+}
+
+// addColumnMapping maps the tuple columns to the new clickhouse columns
+func (t *genericTable) addColumnMapping(chColumns map[string]config.ChColumn) {
+	// the mapped columns go before the derived and the engine specific ones
+	pos := len(t.pgUsedColumns)
+	chUsedColumns := append([]string{}, t.chUsedColumns[:pos]...)
+	pgCopyColumns := append([]string{}, t.pgCopyColumns[:pos]...)
+	for _, col := range t.tupleColumns {
+		chCol, ok := chColumns[col.Name]
+		if !ok {
+			continue
+		}
+		if _, ok := t.columnMapping[col.Name]; ok {
+			continue
+		}
+
+		t.columnMapping[col.Name] = chCol
+		t.pgUsedIndex[col.Name] = len(t.pgUsedColumns)
+		t.pgUsedColumns = append(t.pgUsedColumns, col.Name)
+		chUsedColumns = append(chUsedColumns, chCol.Name)
+		pgCopyColumns = append(pgCopyColumns, col.Name)
+	}
+	t.chUsedColumns = append(chUsedColumns, t.chUsedColumns[pos:]...)
+	t.pgCopyColumns = append(pgCopyColumns, t.pgCopyColumns[pos:]...)
+}
+
+// withUnchanged fills the unchanged TOASTed values of the new row, which postgres does not send, from the old row
+// if it has them, i.e. with FULL replica identity
+func withUnchanged(new, old message.Row) message.Row {
+	res := new
+	for colId, tuple := range new {
+		if tuple.Kind != message.TupleUnchanged || colId >= len(old) || old[colId].Kind == message.TupleUnchanged {
+			continue
+		}
+
+		if &res[0] == &new[0] {
+			res = append(message.Row(nil), new...)
+		}
+		res[colId] = old[colId]
+	}
+
+	return res
 }
 
 func (t *genericTable) compareRows(a, b message.Row) (bool, bool) {
@@ -0,0 +1,45 @@
+package tableengines
+
+import (
+	"strings"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/utils/hstore"
+)
+
+var chStringEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// hstoreMap converts the text output of the postgresql hstore into the text of the clickhouse map of the keys,
+// e.g. {'a':'1','b':NULL}, the NULL values are written as empty strings unless the map values are nullable
+func hstoreMap(val string, keys []string, chType config.ChColumn) (string, error) {
+	pairs, err := hstore.Parse(val)
+	if err != nil {
+		return "", err
+	}
+	nullable := strings.Contains(chType.BaseType, "Nullable(")
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, pair := range hstore.Filter(pairs, keys) {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+
+		sb.WriteByte('\'')
+		sb.WriteString(chStringEscaper.Replace(pair.Key))
+		sb.WriteString("':")
+		if pair.Null && nullable {
+			sb.WriteString("NULL")
+			continue
+		}
+
+		sb.WriteByte('\'')
+		if !pair.Null {
+			sb.WriteString(chStringEscaper.Replace(pair.Value))
+		}
+		sb.WriteByte('\'')
+	}
+	sb.WriteByte('}')
+
+	return sb.String(), nil
+}
@@ -3,13 +3,13 @@ package tableengines
 import (
 	"context"
 	"database/sql"
-	"fmt"
-	"strings"
+	"io"
 
 	"github.com/jackc/pgx"
 
 	"github.com/mkabilov/pg2ch/pkg/config"
 	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/stats"
 	"github.com/mkabilov/pg2ch/pkg/utils"
 )
 
@@ -18,18 +18,11 @@ type mergeTreeTable struct {
 }
 
 // NewMergeTree instantiates mergeTreeTable
-func NewMergeTree(ctx context.Context, conn *sql.DB, tblCfg config.Table, genID *uint64) *mergeTreeTable {
+func NewMergeTree(ctx context.Context, conn *sql.DB, tblCfg config.Table, genID *uint64, tblStats *stats.Table) *mergeTreeTable {
 	t := mergeTreeTable{
-		genericTable: newGenericTable(ctx, conn, tblCfg, genID),
+		genericTable: newGenericTable(ctx, conn, tblCfg, genID, tblStats),
 	}
 
-	if t.cfg.ChBufferTable == "" {
-		return &t
-	}
-
-	t.flushQueries = []string{fmt.Sprintf("INSERT INTO %[1]s (%[2]s) SELECT %[2]s FROM %[3]s ORDER BY %[4]s",
-		t.cfg.ChMainTable, strings.Join(t.chUsedColumns, ", "), t.cfg.ChBufferTable, t.cfg.BufferTableRowIdColumn)}
-
 	return &t
 }
 
@@ -38,6 +31,13 @@ func (t *mergeTreeTable) Sync(pgTx *pgx.Tx) error {
 	return t.genSync(pgTx, t)
 }
 
+// syncChunkWriter returns a copy of the table writing a chunk of the concurrent sync, see chunkedCopy
+func (t *mergeTreeTable) syncChunkWriter() (io.Writer, *genericTable) {
+	c := *t
+
+	return &c, &c.genericTable
+}
+
 // Write implements io.Writer which is used during the Sync process, see genSync method
 func (t *mergeTreeTable) Write(p []byte) (int, error) {
 	var row []interface{}
@@ -46,6 +46,9 @@ func (t *mergeTreeTable) Write(p []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	if row == nil { // written to the dead letter file
+		return n, nil
+	}
 
 	if t.cfg.GenerationColumn != "" {
 		row = append(row, 0)
@@ -56,15 +59,20 @@ func (t *mergeTreeTable) Write(p []byte) (int, error) {
 
 // Insert handles incoming insert DML operation
 func (t *mergeTreeTable) Insert(lsn utils.LSN, new message.Row) (bool, error) {
-	return t.processCommandSet(commandSet{t.convertTuples(new)})
+	newRow, err := t.convertTuples(new)
+	if err != nil {
+		return false, err
+	}
+
+	return t.processCommandSet(lsn, commandSet{newRow})
 }
 
 // Update handles incoming update DML operation
 func (t *mergeTreeTable) Update(lsn utils.LSN, old, new message.Row) (bool, error) {
-	return t.processCommandSet(nil)
+	return t.processCommandSet(lsn, nil)
 }
 
 // Delete handles incoming delete DML operation
 func (t *mergeTreeTable) Delete(lsn utils.LSN, old message.Row) (bool, error) {
-	return t.processCommandSet(nil)
+	return t.processCommandSet(lsn, nil)
 }
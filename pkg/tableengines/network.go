@@ -0,0 +1,78 @@
+package tableengines
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+// convertIP converts the text output of the inet or cidr value into the value of the IPv4, IPv6, UInt32
+// or FixedString(16) column, the netmask is dropped: the text of the address for the IPv4 and IPv6 columns,
+// cast to them when moved from the buffer table, the number of the IPv4 address for UInt32 and the 16 bytes
+// of the IPv6 one for FixedString(16); the IPv4 addresses are written into the IPv6 columns as IPv4-mapped
+func convertIP(val string, chType config.ChColumn) (interface{}, error) {
+	host := val
+	if pos := strings.IndexByte(host, '/'); pos >= 0 {
+		host = host[:pos]
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil, err
+	}
+
+	switch chType.BaseType {
+	case utils.ChIPv4, utils.ChUint32:
+		if addr = addr.Unmap(); !addr.Is4() {
+			return nil, fmt.Errorf("IPv6 address %s does not fit the %s column", addr, chType.BaseType)
+		}
+
+		if chType.BaseType == utils.ChUint32 {
+			ip := addr.As4()
+			return binary.BigEndian.Uint32(ip[:]), nil
+		}
+
+		return addr.String(), nil
+	case utils.ChIPv6:
+		return netip.AddrFrom16(addr.As16()).String(), nil
+	case utils.ChFixedString:
+		if len(chType.Ext) == 1 && chType.Ext[0] == 16 {
+			ip := addr.As16()
+			return ip[:], nil
+		}
+
+		return val, nil
+	}
+
+	return nil, fmt.Errorf("can't convert inet to %v", chType.BaseType)
+}
+
+// convertMAC converts the text output of the macaddr or macaddr8 value into the number for the UInt64 column,
+// the bytes for the FixedString(6) or FixedString(8) one of the same length, the text for the rest
+func convertMAC(val string, chType config.ChColumn) (interface{}, error) {
+	mac, err := net.ParseMAC(val)
+	if err != nil {
+		return nil, err
+	}
+
+	switch chType.BaseType {
+	case utils.ChUint64:
+		var n uint64
+		for _, b := range mac {
+			n = n<<8 | uint64(b)
+		}
+
+		return n, nil
+	case utils.ChFixedString:
+		if len(chType.Ext) == 1 && chType.Ext[0] == len(mac) {
+			return []byte(mac), nil
+		}
+	}
+
+	return val, nil
+}
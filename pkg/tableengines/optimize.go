@@ -0,0 +1,95 @@
+package tableengines
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/utils/chutils"
+)
+
+// optimizeAfterSync merges the parts of the freshly synced main table, so that the replaced and collapsed rows
+// are gone before it is queried; the rows are already there, so the failure only gets logged
+func (t *genericTable) optimizeAfterSync() {
+	if t.cfg.SyncOptimize == config.OptimizeNone || t.cfg.Inspect {
+		return
+	}
+
+	start := time.Now()
+	if err := t.optimizeMainTable(); err != nil {
+		t.log.Warn("could not optimize main table after the initial sync", "error", err)
+		return
+	}
+
+	t.log.Info("main table optimized after the initial sync",
+		"mode", t.cfg.SyncOptimize.String(), "duration", time.Since(start).Truncate(time.Millisecond))
+}
+
+// optimizeMainTable runs OPTIMIZE on the main table, on each of the shards if the rows are written to them directly
+func (t *genericTable) optimizeMainTable() error {
+	if t.shards != nil {
+		for i, conn := range t.shards {
+			if err := t.optimize(conn, t.cfg.ChMainTable, ""); err != nil {
+				return fmt.Errorf("shard %d: %w", i+1, err)
+			}
+		}
+
+		return nil
+	}
+
+	if t.cfg.LocalTable != "" {
+		return t.optimize(t.chConn, t.cfg.LocalTable, t.cfg.Cluster)
+	}
+
+	return t.optimize(t.chConn, t.cfg.ChMainTable, t.cfg.Cluster)
+}
+
+func (t *genericTable) optimize(conn *sql.DB, tblName, cluster string) error {
+	switch t.cfg.SyncOptimize {
+	case config.OptimizeFinal:
+		_, err := conn.Exec(fmt.Sprintf("optimize table %s%s final", tblName, chutils.OnCluster(cluster)))
+
+		return err
+	case config.OptimizeDeduplicate:
+		_, err := conn.Exec(fmt.Sprintf("optimize table %s%s final deduplicate", tblName, chutils.OnCluster(cluster)))
+
+		return err
+	}
+
+	partitions, err := activePartitions(conn, tblName)
+	if err != nil {
+		return fmt.Errorf("could not get partitions: %w", err)
+	}
+
+	for _, partitionID := range partitions {
+		if _, err := conn.Exec(fmt.Sprintf("optimize table %s%s partition id %s final",
+			tblName, chutils.OnCluster(cluster), chQuote(partitionID))); err != nil {
+			return fmt.Errorf("partition %s: %w", partitionID, err)
+		}
+	}
+
+	return nil
+}
+
+// activePartitions returns ids of the partitions of the table having active parts on the connected host
+func activePartitions(conn *sql.DB, tblName string) ([]string, error) {
+	filter, args := chutils.SystemTableFilter(tblName)
+	rows, err := conn.Query(`SELECT DISTINCT partition_id FROM system.parts
+		WHERE `+filter+` AND active ORDER BY partition_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	partitions := make([]string, 0)
+	for rows.Next() {
+		var partitionID string
+		if err := rows.Scan(&partitionID); err != nil {
+			return nil, err
+		}
+		partitions = append(partitions, partitionID)
+	}
+
+	return partitions, rows.Err()
+}
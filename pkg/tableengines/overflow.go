@@ -0,0 +1,94 @@
+package tableengines
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+	"github.com/mkabilov/pg2ch/pkg/utils/deadletter"
+)
+
+// overflowValue checks if the conversion failed because the numeric value does not fit the clickhouse column,
+// e.g. bigint into Int32 or a negative value into UInt64; returns the value clamped to the column's range.
+// res is the result of the failed conversion: strconv returns the range limit on the overflow
+func overflowValue(val string, chType string, res interface{}, err error) (interface{}, bool) {
+	var numErr *strconv.NumError
+
+	if !errors.As(err, &numErr) {
+		return nil, false
+	}
+
+	switch chType {
+	case utils.ChInt8, utils.ChInt16, utils.ChInt32, utils.ChInt64:
+		return res, numErr.Err == strconv.ErrRange
+	case utils.ChUInt16, utils.ChUint32, utils.ChUint64:
+		if numErr.Err == strconv.ErrRange {
+			return res, true
+		}
+
+		if _, err := strconv.ParseInt(val, 10, 64); strings.HasPrefix(val, "-") &&
+			(err == nil || errors.Is(err, strconv.ErrRange)) {
+			return uint64(0), true
+		}
+	case utils.ChFloat32:
+		if numErr.Err == strconv.ErrRange {
+			return math.Copysign(math.MaxFloat32, res.(float64)), true
+		}
+	case utils.ChFloat64, utils.ChDecimal:
+		if numErr.Err == strconv.ErrRange {
+			return math.Copysign(math.MaxFloat64, res.(float64)), true
+		}
+	}
+
+	return nil, false
+}
+
+// handleOverflow applies the overflow policy of the column to the value not fitting it
+func (t *genericTable) handleOverflow(pgColName, val string, clamped interface{}) (interface{}, error) {
+	chCol := t.columnMapping[pgColName]
+	atomic.AddUint64(&t.stats.OverflowValues, 1)
+
+	switch t.cfg.ColumnProperties[pgColName].Overflow {
+	case config.OverflowClamp:
+		return clamped, nil
+	case config.OverflowNull:
+		return nil, nil
+	case config.OverflowDeadLetter:
+		return nil, fmt.Errorf("%w: %q column value %s does not fit %s", utils.ErrDeadLetter, pgColName, val, chCol.BaseType)
+	}
+
+	return nil, fmt.Errorf("%w: %q column value %s does not fit %s", utils.ErrConversion, pgColName, val, chCol.BaseType)
+}
+
+// syncDeadLetter writes the row of the initial sync skipped by the dead_letter overflow policy to the dead letter file
+func (t *genericTable) syncDeadLetter(fields []sql.NullString, reason error) error {
+	row := make(map[string]*string, len(fields))
+	for i, field := range fields {
+		if !field.Valid {
+			row[t.pgCopyColumns[i]] = nil
+			continue
+		}
+
+		val := field.String
+		row[t.pgCopyColumns[i]] = &val
+	}
+
+	if err := t.cfg.DeadLetter.Write(deadletter.Record{
+		Table:  t.cfg.PgTableName.String(),
+		Op:     "sync",
+		Reason: reason.Error(),
+		Row:    row,
+	}); err != nil {
+		return err
+	}
+	atomic.AddUint64(&t.stats.DeadLetterRows, 1)
+	t.log.Warn("row is written to the dead letter file", "op", "sync", "reason", reason)
+
+	return nil
+}
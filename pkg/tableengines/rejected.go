@@ -0,0 +1,267 @@
+package tableengines
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/kshvakov/clickhouse"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+	"github.com/mkabilov/pg2ch/pkg/utils/chutils"
+	"github.com/mkabilov/pg2ch/pkg/utils/deadletter"
+)
+
+// codes of the clickhouse exceptions caused by the inserted values, not by the server or the connection state:
+// retrying the same block fails the same way
+var dataErrorCodes = map[int32]struct{}{
+	6:   {}, // CANNOT_PARSE_TEXT
+	27:  {}, // CANNOT_PARSE_INPUT_ASSERTION_FAILED
+	38:  {}, // CANNOT_PARSE_DATE
+	41:  {}, // CANNOT_PARSE_DATETIME
+	53:  {}, // TYPE_MISMATCH
+	69:  {}, // ARGUMENT_OUT_OF_BOUND
+	70:  {}, // CANNOT_CONVERT_TYPE
+	72:  {}, // CANNOT_PARSE_NUMBER
+	321: {}, // VALUE_IS_OUT_OF_RANGE_OF_DATA_TYPE
+	469: {}, // VIOLATED_CONSTRAINT
+}
+
+// position of the offending row in the inserted block, 1-based, e.g. "Constraint `c` ... is violated at row 3"
+var rejectedRowRegexp = regexp.MustCompile(`at row (\d+)`)
+
+// bufPos is the position of the row in the memory buffer
+type bufPos struct {
+	cmd int
+	row int
+}
+
+// rowError is the error of the driver on the row appended to the insert block
+type rowError struct {
+	pos int // position of the row among the written ones
+	err error
+}
+
+func (e *rowError) Error() string {
+	return e.err.Error()
+}
+
+func (e *rowError) Unwrap() error {
+	return e.err
+}
+
+// isRejection checks if clickhouse rejected the flushed rows because of their values
+func isRejection(err error) bool {
+	var (
+		rowErr    *rowError
+		exception *clickhouse.Exception
+	)
+
+	if errors.As(err, &exception) {
+		_, ok := dataErrorCodes[exception.Code]
+		return ok
+	}
+
+	return errors.As(err, &rowErr)
+}
+
+// rejectedRowPos returns the position of the rejected row among the written ones, -1 if the error doesn't tell
+func rejectedRowPos(err error, rows int) int {
+	var (
+		rowErr    *rowError
+		exception *clickhouse.Exception
+	)
+
+	if errors.As(err, &rowErr) {
+		return rowErr.pos
+	}
+
+	if !errors.As(err, &exception) {
+		return -1
+	}
+
+	match := rejectedRowRegexp.FindStringSubmatch(exception.Message)
+	if match == nil {
+		return -1
+	}
+
+	n, convErr := strconv.Atoi(match[1])
+	if convErr != nil || n < 1 || n > rows {
+		return -1
+	}
+
+	return n - 1
+}
+
+// pendingRows returns the positions of the rows of the memory buffer not yet written to clickhouse
+func (t *genericTable) pendingRows() []bufPos {
+	positions := make([]bufPos, 0)
+
+	for i := 0; i < t.bufferCmdId; i++ {
+		for j, cmd := range t.buffer[i] {
+			if !cmd.skip {
+				positions = append(positions, bufPos{cmd: i, row: j})
+			}
+		}
+	}
+
+	return positions
+}
+
+// handleRejectedRows pinpoints the rows of the memory buffer rejected by clickhouse and logs them;
+// with the dead_letter rejected rows policy the rows are written to the dead letter file and skipped,
+// so the rest of the buffer can be flushed, otherwise the replication is stopped instead of retrying the
+// block which fails the same way each time
+func (t *genericTable) handleRejectedRows(err error) error {
+	positions := t.pendingRows()
+
+	var rejected []bufPos
+	if pos := rejectedRowPos(err, len(positions)); pos >= 0 {
+		rejected = []bufPos{positions[pos]}
+	} else if t.cfg.RejectedRows == config.RejectDeadLetter {
+		var bisectErr error
+		if rejected, bisectErr = t.bisectRejected(positions); bisectErr != nil {
+			return bisectErr
+		}
+	}
+
+	for _, pos := range rejected {
+		t.logRejectedRow(pos, err)
+	}
+
+	if t.cfg.RejectedRows != config.RejectDeadLetter {
+		if len(rejected) == 0 {
+			minLSN, maxLSN := t.lsnRange()
+			t.log.Error("rows are rejected by clickhouse", "min_lsn", minLSN, "max_lsn", maxLSN)
+		}
+
+		return fmt.Errorf("%w: rows are rejected by clickhouse: %v", utils.ErrConversion, err)
+	}
+
+	for _, pos := range rejected {
+		if err := t.deadLetterRow(pos, err); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bisectRejected writes the halves of the rows separately, the halves written fine are marked as written,
+// the failing ones are split further down to the rejected rows
+func (t *genericTable) bisectRejected(positions []bufPos) ([]bufPos, error) {
+	if len(positions) == 0 {
+		return nil, nil
+	}
+
+	err := chutils.ClassifyError(t.writeRows(positions, "", t.bisectDedup(positions)))
+	if err == nil {
+		for _, pos := range positions {
+			t.buffer[pos.cmd][pos.row].skip = true
+		}
+
+		return nil, nil
+	}
+	t.rollback()
+
+	if !isRejection(err) {
+		return nil, err
+	}
+
+	if pos := rejectedRowPos(err, len(positions)); pos >= 0 {
+		return []bufPos{positions[pos]}, nil
+	}
+
+	if len(positions) == 1 {
+		return positions, nil
+	}
+
+	half := len(positions) / 2
+	rejected, err := t.bisectRejected(positions[:half])
+	if err != nil {
+		return nil, err
+	}
+
+	rest, err := t.bisectRejected(positions[half:])
+	if err != nil {
+		return nil, err
+	}
+
+	return append(rejected, rest...), nil
+}
+
+// bisectDedup returns the deduplication settings of the insert of the rows at the positions: the token tells
+// apart the parts of the buffer, which is split the same way when the flush is replayed after the crash
+func (t *genericTable) bisectDedup(positions []bufPos) string {
+	first := t.buffer[positions[0].cmd][positions[0].row]
+	last := t.buffer[positions[len(positions)-1].cmd][positions[len(positions)-1].row]
+	kind := fmt.Sprintf("bisect row=%d rows=%d", positions[0].row, len(positions))
+
+	return t.dedupSettings(kind, first.lsn, last.lsn, first.txPos)
+}
+
+// rowValues returns the values of the buffered row by the clickhouse column names
+func (t *genericTable) rowValues(pos bufPos) map[string]*string {
+	data := t.buffer[pos.cmd][pos.row].data
+	row := make(map[string]*string, len(data))
+
+	for i, chColName := range t.chUsedColumns {
+		if i >= len(data) {
+			break
+		}
+
+		row[chColName] = formatValue(data[i])
+	}
+
+	return row
+}
+
+// formatValue returns the converted value as text, nil for NULL
+func formatValue(val interface{}) *string {
+	if val == nil {
+		return nil
+	}
+
+	res := fmt.Sprint(val)
+
+	return &res
+}
+
+func (t *genericTable) logRejectedRow(pos bufPos, reason error) {
+	cmd := t.buffer[pos.cmd][pos.row]
+
+	values := make(map[string]string)
+	for chColName, val := range t.rowValues(pos) {
+		if val == nil {
+			values[chColName] = "NULL"
+			continue
+		}
+		values[chColName] = *val
+	}
+
+	t.log.Error("row is rejected by clickhouse", "lsn", cmd.lsn, "reason", reason, "values", values)
+}
+
+// deadLetterRow writes the rejected row to the dead letter file and skips it
+func (t *genericTable) deadLetterRow(pos bufPos, reason error) error {
+	cmd := &t.buffer[pos.cmd][pos.row]
+
+	if err := t.cfg.DeadLetter.Write(deadletter.Record{
+		Table:  t.cfg.PgTableName.String(),
+		LSN:    cmd.lsn.String(),
+		Op:     "flush",
+		Reason: reason.Error(),
+		Row:    t.rowValues(pos),
+	}); err != nil {
+		return err
+	}
+
+	cmd.skip = true
+	t.stats.AddBuffered(-1, -rowSize(cmd.data))
+	atomic.AddUint64(&t.stats.DeadLetterRows, 1)
+
+	return nil
+}
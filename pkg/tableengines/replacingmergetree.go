@@ -4,12 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"strings"
+	"io"
 
 	"github.com/jackc/pgx"
 
 	"github.com/mkabilov/pg2ch/pkg/config"
 	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/stats"
 	"github.com/mkabilov/pg2ch/pkg/utils"
 )
 
@@ -20,18 +21,16 @@ type replacingMergeTree struct {
 }
 
 // NewReplacingMergeTree instantiates replacingMergeTree
-func NewReplacingMergeTree(ctx context.Context, conn *sql.DB, tblCfg config.Table, genID *uint64) *replacingMergeTree {
+func NewReplacingMergeTree(ctx context.Context, conn *sql.DB, tblCfg config.Table, genID *uint64, tblStats *stats.Table) *replacingMergeTree {
 	t := replacingMergeTree{
-		genericTable: newGenericTable(ctx, conn, tblCfg, genID),
+		genericTable: newGenericTable(ctx, conn, tblCfg, genID, tblStats),
 		verColumn:    tblCfg.VerColumn,
 	}
 	if tblCfg.VerColumn != "" {
 		t.chUsedColumns = append(t.chUsedColumns, tblCfg.VerColumn)
 	}
 	t.chUsedColumns = append(t.chUsedColumns, tblCfg.IsDeletedColumn)
-
-	t.flushQueries = []string{fmt.Sprintf("INSERT INTO %[1]s (%[2]s) SELECT %[2]s FROM %[3]s ORDER BY %[4]s",
-		t.cfg.ChMainTable, strings.Join(t.chUsedColumns, ", "), t.cfg.ChBufferTable, t.cfg.BufferTableRowIdColumn)}
+	t.compareFilter = fmt.Sprintf("FINAL WHERE %s = 0", tblCfg.IsDeletedColumn)
 
 	return &t
 }
@@ -41,6 +40,13 @@ func (t *replacingMergeTree) Sync(pgTx *pgx.Tx) error {
 	return t.genSync(pgTx, t)
 }
 
+// syncChunkWriter returns a copy of the table writing a chunk of the concurrent sync, see chunkedCopy
+func (t *replacingMergeTree) syncChunkWriter() (io.Writer, *genericTable) {
+	c := *t
+
+	return &c, &c.genericTable
+}
+
 // Write implements io.Writer which is used during the Sync process, see genSync method
 func (t *replacingMergeTree) Write(p []byte) (int, error) {
 	var row []interface{}
@@ -49,6 +55,9 @@ func (t *replacingMergeTree) Write(p []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	if row == nil { // written to the dead letter file
+		return n, nil
+	}
 	if t.cfg.GenerationColumn != "" {
 		row = append(row, 0) // "generationID"
 	}
@@ -62,47 +71,69 @@ func (t *replacingMergeTree) Write(p []byte) (int, error) {
 
 // Insert handles incoming insert DML operation
 func (t *replacingMergeTree) Insert(lsn utils.LSN, new message.Row) (bool, error) {
+	newRow, err := t.convertTuples(new)
+	if err != nil {
+		return false, err
+	}
+
 	if t.cfg.VerColumn != "" {
-		return t.processCommandSet(commandSet{append(t.convertTuples(new), uint64(lsn), 0)})
+		return t.processCommandSet(lsn, commandSet{append(newRow, uint64(lsn), 0)})
 	} else {
-		return t.processCommandSet(commandSet{append(t.convertTuples(new), 0)})
+		return t.processCommandSet(lsn, commandSet{append(newRow, 0)})
 	}
 }
 
 // Update handles incoming update DML operation
 func (t *replacingMergeTree) Update(lsn utils.LSN, old, new message.Row) (bool, error) {
+	new = withUnchanged(new, old)
+
 	var cmdSet commandSet
 	equal, keyChanged := t.compareRows(old, new)
 	if equal {
-		return t.processCommandSet(nil)
+		return t.processCommandSet(lsn, nil)
+	}
+
+	newRow, err := t.convertTuples(new)
+	if err != nil {
+		return false, err
 	}
 
 	if keyChanged {
+		oldRow, err := t.convertTuples(old)
+		if err != nil {
+			return false, err
+		}
+
 		if t.cfg.VerColumn != "" {
 			cmdSet = commandSet{
-				append(t.convertTuples(old), uint64(lsn), 1),
-				append(t.convertTuples(new), uint64(lsn), 0),
+				append(oldRow, uint64(lsn), 1),
+				append(newRow, uint64(lsn), 0),
 			}
 		} else {
 			cmdSet = commandSet{
-				append(t.convertTuples(old), 1),
-				append(t.convertTuples(new), 0),
+				append(oldRow, 1),
+				append(newRow, 0),
 			}
 		}
 	} else if t.cfg.VerColumn != "" {
-		cmdSet = commandSet{append(t.convertTuples(new), uint64(lsn), 0)}
+		cmdSet = commandSet{append(newRow, uint64(lsn), 0)}
 	} else {
-		cmdSet = commandSet{append(t.convertTuples(new), 0)}
+		cmdSet = commandSet{append(newRow, 0)}
 	}
 
-	return t.processCommandSet(cmdSet)
+	return t.processCommandSet(lsn, cmdSet)
 }
 
 // Delete handles incoming delete DML operation
 func (t *replacingMergeTree) Delete(lsn utils.LSN, old message.Row) (bool, error) {
+	oldRow, err := t.convertTuples(old)
+	if err != nil {
+		return false, err
+	}
+
 	if t.cfg.VerColumn != "" {
-		return t.processCommandSet(commandSet{append(t.convertTuples(old), uint64(lsn), 0)})
+		return t.processCommandSet(lsn, commandSet{append(oldRow, uint64(lsn), 1)})
 	} else {
-		return t.processCommandSet(commandSet{append(t.convertTuples(old), 0)})
+		return t.processCommandSet(lsn, commandSet{append(oldRow, 1)})
 	}
 }
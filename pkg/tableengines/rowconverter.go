@@ -0,0 +1,74 @@
+package tableengines
+
+import (
+	"context"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/stats"
+)
+
+// RowConverter converts the rows of the table into the values written to clickhouse, with the masking,
+// encryption, tokenization, transforms and derived columns applied, for the outputs other than the table itself,
+// e.g. the row stream. It keeps the conversion state of its own, so it is used next to the table
+// without sharing it with the table's apply worker; not safe for concurrent use
+type RowConverter struct {
+	t genericTable
+}
+
+// NewRowConverter instantiates RowConverter for the table config
+func NewRowConverter(tblCfg config.Table) *RowConverter {
+	pgColumns := make(map[string]config.PgColumn, len(tblCfg.PgColumns))
+	for pgColName, pgCol := range tblCfg.PgColumns {
+		pgColumns[pgColName] = pgCol
+	}
+	tblCfg.PgColumns = pgColumns
+	tblCfg.MaxBufferLength = 0
+	tblCfg.GenerationColumn, tblCfg.SerialGapColumn = "", "" // the state of the table, not of the row
+
+	return &RowConverter{t: newGenericTable(context.Background(), nil, tblCfg, nil, &stats.Table{})}
+}
+
+// SetTupleColumns sets the tuple columns of the relation
+func (c *RowConverter) SetTupleColumns(tupleColumns []message.Column) {
+	c.t.SetTupleColumns(tupleColumns)
+}
+
+// AddColumns registers the pg columns added to the table
+func (c *RowConverter) AddColumns(pgColumns map[string]config.PgColumn, chColumns map[string]config.ChColumn) {
+	for pgColName, pgCol := range pgColumns {
+		c.t.cfg.PgColumns[pgColName] = pgCol
+	}
+	c.t.addColumnMapping(chColumns)
+}
+
+// Convert returns the converted values of the row by the clickhouse column names, nil for NULL; the unchanged
+// TOASTed values are taken from the old row of the update, if it has them, the columns are omitted otherwise
+func (c *RowConverter) Convert(row, old message.Row) (map[string]*string, error) {
+	if row == nil {
+		return nil, nil
+	}
+	row = withUnchanged(row, old)
+
+	data, err := c.t.convertTuples(row)
+	if err != nil {
+		return nil, err
+	}
+
+	unchanged := make(map[int]struct{})
+	for colID, col := range c.t.tupleColumns {
+		if idx, ok := c.t.pgUsedIndex[col.Name]; ok && colID < len(row) && row[colID].Kind == message.TupleUnchanged {
+			unchanged[idx] = struct{}{}
+		}
+	}
+
+	res := make(map[string]*string, len(data))
+	for i, val := range data {
+		if _, ok := unchanged[i]; ok || i >= len(c.t.chUsedColumns) {
+			continue
+		}
+		res[c.t.chUsedColumns[i]] = formatValue(val)
+	}
+
+	return res, nil
+}
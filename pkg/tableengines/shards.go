@@ -0,0 +1,142 @@
+package tableengines
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/mkabilov/pg2ch/pkg/utils"
+	"github.com/mkabilov/pg2ch/pkg/utils/chutils"
+)
+
+// SetShards makes the table write the rows directly to the shards instead of the single host: the row goes to
+// the shard picked by the hash of its sharding key column value, proportionally to the weights of the shards
+func (t *genericTable) SetShards(conns []*sql.DB, weights []int) error {
+	t.shardKeyIdx = -1
+	for i, chColName := range t.chUsedColumns {
+		if chColName == t.cfg.ShardingKey {
+			t.shardKeyIdx = i
+			break
+		}
+	}
+	if t.shardKeyIdx < 0 {
+		return fmt.Errorf("sharding key %q is not one of the replicated columns", t.cfg.ShardingKey)
+	}
+
+	t.shardSlots = make([]int, 0)
+	for i, weight := range weights {
+		for j := 0; j < weight; j++ {
+			t.shardSlots = append(t.shardSlots, i)
+		}
+	}
+	t.shards = conns
+
+	return nil
+}
+
+// shardOf returns the shard of the row; the converted values are hashed, so the sync and streaming agree
+func (t *genericTable) shardOf(row []interface{}) int {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%v", row[t.shardKeyIdx])
+
+	return t.shardSlots[h.Sum64()%uint64(len(t.shardSlots))]
+}
+
+// writeBufferShards writes the rows of the memory buffer to the shards, retrying each shard separately;
+// the shards already written are skipped when the flush is retried
+func (t *genericTable) writeBufferShards(minLSN, maxLSN utils.LSN) error {
+	rows := make([][][]interface{}, len(t.shards))
+	for i := 0; i < t.bufferCmdId; i++ {
+		for _, cmd := range t.buffer[i] {
+			shard := t.shardOf(cmd.data)
+			rows[shard] = append(rows[shard], cmd.data)
+		}
+	}
+
+	if t.shardDone == nil {
+		t.shardDone = make([]bool, len(t.shards))
+	}
+
+	query := t.insertQuery(false, t.logComment("flush", minLSN, maxLSN), t.dedupSettings("flush", minLSN, maxLSN, t.bufferOffset()))
+	for i := range t.shards {
+		if t.shardDone[i] || len(rows[i]) == 0 {
+			continue
+		}
+
+		if err := t.writeShard(i, query, rows[i]); err != nil {
+			return fmt.Errorf("could not write to shard %d: %w", i+1, err)
+		}
+		t.shardDone[i] = true
+	}
+	t.shardDone = nil
+
+	return nil
+}
+
+func (t *genericTable) writeShard(shard int, query string, rows [][]interface{}) error {
+	var err error
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		err = chutils.ClassifyError(t.attemptWriteShard(t.shards[shard], query, rows))
+		if err == nil {
+			if attempt > 0 {
+				t.log.Info("succeeded write to shard", "shard", shard+1, "attempts", attempt)
+				t.stats.FlushSucceeded()
+			}
+			return nil
+		}
+
+		if !chutils.IsRetriable(err) {
+			return err
+		}
+
+		t.stats.FlushFailed()
+		t.log.Warn("could not write to shard, retrying", "shard", shard+1, "rows", len(rows),
+			"attempt", attempt, "retry_after", attemptInterval, "error", err)
+		select {
+		case <-t.ctx.Done():
+			return fmt.Errorf("abort retrying")
+		case <-time.After(attemptInterval):
+		}
+	}
+
+	return err
+}
+
+func (t *genericTable) attemptWriteShard(conn *sql.DB, query string, rows [][]interface{}) (err error) {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if rbErr := tx.Rollback(); rbErr != nil && rbErr != sql.ErrTxDone {
+			t.log.Warn("could not rollback clickhouse transaction", "error", rbErr)
+		}
+	}()
+
+	stmnt, err := tx.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("could not prepare statement: %w", err)
+	}
+
+	for _, row := range rows {
+		if _, err := stmnt.Exec(row...); err != nil {
+			return fmt.Errorf("could not exec(%#v): %w", row, err)
+		}
+	}
+
+	if err := stmnt.Close(); err != nil {
+		return fmt.Errorf("could not close statement: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return nil
+}
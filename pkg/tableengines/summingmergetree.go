@@ -0,0 +1,261 @@
+package tableengines
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/jackc/pgx"
+
+	"github.com/mkabilov/pg2ch/pkg/config"
+	"github.com/mkabilov/pg2ch/pkg/message"
+	"github.com/mkabilov/pg2ch/pkg/stats"
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+var errDeltaOverflow = errors.New("delta does not fit the column")
+
+// summingMergeTreeTable replicates into SummingMergeTree or AggregatingMergeTree tables: the updates and deletes
+// are written as the changes of the delta columns, which are summed up by the engine on merge
+type summingMergeTreeTable struct {
+	genericTable
+
+	deltaIndex []int // positions of the delta columns among the used ones
+}
+
+// NewSummingMergeTree instantiates summingMergeTreeTable
+func NewSummingMergeTree(ctx context.Context, conn *sql.DB, tblCfg config.Table, genID *uint64, tblStats *stats.Table) *summingMergeTreeTable {
+	t := summingMergeTreeTable{
+		genericTable: newGenericTable(ctx, conn, tblCfg, genID, tblStats),
+	}
+
+	for _, pgColName := range t.pgUsedColumns {
+		if tblCfg.ColumnProperties[pgColName].Delta {
+			t.deltaIndex = append(t.deltaIndex, t.pgUsedIndex[pgColName])
+		}
+	}
+
+	return &t
+}
+
+// Sync performs initial sync of the data; pgTx is a transaction in which temporary replication slot is created
+func (t *summingMergeTreeTable) Sync(pgTx *pgx.Tx) error {
+	return t.genSync(pgTx, t)
+}
+
+// syncChunkWriter returns a copy of the table writing a chunk of the concurrent sync, see chunkedCopy
+func (t *summingMergeTreeTable) syncChunkWriter() (io.Writer, *genericTable) {
+	c := *t
+
+	return &c, &c.genericTable
+}
+
+// Write implements io.Writer which is used during the Sync process, see genSync method
+func (t *summingMergeTreeTable) Write(p []byte) (int, error) {
+	var row []interface{}
+
+	row, n, err := t.syncConvertIntoRow(p)
+	if err != nil {
+		return 0, err
+	}
+	if row == nil { // written to the dead letter file
+		return n, nil
+	}
+
+	if t.cfg.GenerationColumn != "" {
+		row = append(row, 0)
+	}
+
+	return n, t.insertRow(row)
+}
+
+// Insert handles incoming insert DML operation
+func (t *summingMergeTreeTable) Insert(lsn utils.LSN, new message.Row) (bool, error) {
+	newRow, err := t.convertTuples(new)
+	if err != nil {
+		return false, err
+	}
+
+	return t.processCommandSet(lsn, commandSet{newRow})
+}
+
+// Update handles incoming update DML operation: the delta columns get the new minus old values,
+// the rest the new ones; the row with the changed key is moved by subtracting it from the old key
+func (t *summingMergeTreeTable) Update(lsn utils.LSN, old, new message.Row) (bool, error) {
+	new = withUnchanged(new, old)
+	equal, keyChanged := t.compareRows(old, new)
+	if equal {
+		return t.processCommandSet(lsn, nil)
+	}
+
+	oldRow, err := t.convertTuples(old)
+	if err != nil {
+		return false, err
+	}
+
+	newRow, err := t.convertTuples(new)
+	if err != nil {
+		return false, err
+	}
+
+	if keyChanged {
+		if err := t.negate(oldRow); err != nil {
+			return false, err
+		}
+
+		return t.processCommandSet(lsn, commandSet{oldRow, newRow})
+	}
+
+	for _, idx := range t.deltaIndex {
+		negated, err := negateValue(oldRow[idx])
+		if err != nil {
+			return false, fmt.Errorf("%w: could not compute delta of %q column: %v",
+				utils.ErrConversion, t.pgUsedColumns[idx], err)
+		}
+
+		newRow[idx], err = addValues(newRow[idx], negated)
+		if err == nil {
+			err = t.checkDelta(idx, newRow[idx])
+		}
+		if err != nil {
+			return false, fmt.Errorf("%w: could not compute delta of %q column: %v",
+				utils.ErrConversion, t.pgUsedColumns[idx], err)
+		}
+	}
+
+	return t.processCommandSet(lsn, commandSet{newRow})
+}
+
+// Delete handles incoming delete DML operation by subtracting the row
+func (t *summingMergeTreeTable) Delete(lsn utils.LSN, old message.Row) (bool, error) {
+	oldRow, err := t.convertTuples(old)
+	if err != nil {
+		return false, err
+	}
+
+	if err := t.negate(oldRow); err != nil {
+		return false, err
+	}
+
+	return t.processCommandSet(lsn, commandSet{oldRow})
+}
+
+// negate negates the values of the delta columns of the row
+func (t *summingMergeTreeTable) negate(row []interface{}) error {
+	for _, idx := range t.deltaIndex {
+		val, err := negateValue(row[idx])
+		if err == nil {
+			err = t.checkDelta(idx, val)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: could not negate %q column value: %v", utils.ErrConversion, t.pgUsedColumns[idx], err)
+		}
+		row[idx] = val
+	}
+
+	return nil
+}
+
+// negateValue negates the converted value of the signed numeric column; NULL stays NULL
+func negateValue(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case nil:
+		return nil, nil
+	case int32:
+		if v == math.MinInt32 {
+			return nil, errDeltaOverflow
+		}
+
+		return -v, nil
+	case int64:
+		if v == math.MinInt64 {
+			return nil, errDeltaOverflow
+		}
+
+		return -v, nil
+	case float64:
+		return -v, nil
+	}
+
+	return nil, fmt.Errorf("unsupported value type %T", val)
+}
+
+// addValues adds the converted values of the signed numeric column; NULL counts as 0 unless both are NULL
+func addValues(a, b interface{}) (interface{}, error) {
+	if a == nil {
+		return b, nil
+	}
+	if b == nil {
+		return a, nil
+	}
+
+	switch av := a.(type) {
+	case int32:
+		if bv, ok := b.(int32); ok {
+			sum := int64(av) + int64(bv)
+			if sum < math.MinInt32 || sum > math.MaxInt32 {
+				return nil, errDeltaOverflow
+			}
+
+			return int32(sum), nil
+		}
+	case int64:
+		if bv, ok := b.(int64); ok {
+			sum := av + bv
+			if (sum > av) != (bv > 0) {
+				return nil, errDeltaOverflow
+			}
+
+			return sum, nil
+		}
+	case float64:
+		if bv, ok := b.(float64); ok {
+			return av + bv, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported value types %T and %T", a, b)
+}
+
+// checkDelta checks if the delta fits the clickhouse column: the change of the value may not fit the column
+// holding the value, e.g. the delta of the Decimal(9, S) column can take 10 digits
+func (t *summingMergeTreeTable) checkDelta(idx int, val interface{}) error {
+	var min, max int64
+
+	chCol := t.columnMapping[t.pgUsedColumns[idx]]
+	switch chCol.BaseType {
+	case utils.ChInt8:
+		min, max = math.MinInt8, math.MaxInt8
+	case utils.ChInt16:
+		min, max = math.MinInt16, math.MaxInt16
+	case utils.ChInt32:
+		min, max = math.MinInt32, math.MaxInt32
+	case utils.ChDecimal:
+		if len(chCol.Ext) != 2 {
+			return nil
+		}
+		max = int64(pow10(chCol.Ext[0]) - 1)
+		min = -max
+	default:
+		return nil
+	}
+
+	var v int64
+	switch val := val.(type) {
+	case int32:
+		v = int64(val)
+	case int64:
+		v = val
+	default: // NULL or float decimal
+		return nil
+	}
+
+	if v < min || v > max {
+		return errDeltaOverflow
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package tableengines
+
+import (
+	"fmt"
+
+	"github.com/mkabilov/pg2ch/pkg/tokenizer"
+)
+
+// tokenRef is the value of the tokenized column until it is replaced with the token, so that the values
+// of many rows are tokenized in a single request
+type tokenRef struct {
+	tokenizer *tokenizer.Tokenizer
+	value     string
+}
+
+// resolveTokens replaces the values of the tokenized columns of the rows with their tokens
+func (t *genericTable) resolveTokens(rows [][]interface{}) error {
+	type position struct {
+		row, col int
+	}
+
+	positions := make(map[*tokenizer.Tokenizer][]position)
+	values := make(map[*tokenizer.Tokenizer][]string)
+	for i, row := range rows {
+		for j, val := range row {
+			ref, ok := val.(tokenRef)
+			if !ok {
+				continue
+			}
+
+			positions[ref.tokenizer] = append(positions[ref.tokenizer], position{i, j})
+			values[ref.tokenizer] = append(values[ref.tokenizer], ref.value)
+		}
+	}
+
+	for tok, vals := range values {
+		tokens, err := tok.Tokenize(t.ctx, vals)
+		if err != nil {
+			// not wrapped, the failures of the tokenizer are not the clickhouse connection errors
+			return fmt.Errorf("could not tokenize values of %s table: %v", t.cfg.PgTableName.String(), err)
+		}
+
+		for k, pos := range positions[tok] {
+			rows[pos.row][pos.col] = tokens[k]
+		}
+	}
+
+	return nil
+}
+
+// resolveBufferTokens tokenizes the rows of the memory buffer before the flush
+func (t *genericTable) resolveBufferTokens() error {
+	if len(t.cfg.Tokenizers) == 0 {
+		return nil
+	}
+
+	rows := make([][]interface{}, 0, t.bufferCmdId)
+	for i := 0; i < t.bufferCmdId; i++ {
+		for _, cmd := range t.buffer[i] {
+			rows = append(rows, cmd.data)
+		}
+	}
+
+	return t.resolveTokens(rows)
+}
+
+// flushSyncPending tokenizes and inserts the pending rows of the initial sync
+func (t *genericTable) flushSyncPending() error {
+	if len(t.syncPending) == 0 {
+		return nil
+	}
+
+	if err := t.resolveTokens(t.syncPending); err != nil {
+		return err
+	}
+
+	for _, row := range t.syncPending {
+		if err := t.execSyncRow(row); err != nil {
+			return err
+		}
+	}
+	t.syncPending = t.syncPending[:0]
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package tokenizer
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Tokenizer replaces the values with the tokens of the external tokenization service: the values are POSTed
+// as {"values": [...]} in batches, the service responds with {"tokens": [...]} in the same order.
+// Recently used tokens are cached, so that the repeated values are not sent again
+type Tokenizer struct {
+	url        string
+	batchSize  int
+	httpClient *http.Client
+
+	mutex     sync.Mutex
+	cacheSize int
+	cache     map[string]*list.Element
+	lru       *list.List // of *cacheEntry, most recently used first
+}
+
+type cacheEntry struct {
+	value string
+	token string
+}
+
+type request struct {
+	Values []string `json:"values"`
+}
+
+type response struct {
+	Tokens []string `json:"tokens"`
+}
+
+// New instantiates tokenizer
+func New(url string, batchSize, cacheSize int, timeout time.Duration) *Tokenizer {
+	return &Tokenizer{
+		url:        url,
+		batchSize:  batchSize,
+		httpClient: &http.Client{Timeout: timeout},
+		cacheSize:  cacheSize,
+		cache:      make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Tokenize returns the tokens of the values
+func (t *Tokenizer) Tokenize(ctx context.Context, values []string) ([]string, error) {
+	tokens := make([]string, len(values))
+
+	missing := make([]string, 0)
+	missingIdx := make(map[string][]int)
+	t.mutex.Lock()
+	for i, val := range values {
+		if token, ok := t.cached(val); ok {
+			tokens[i] = token
+			continue
+		}
+
+		if _, ok := missingIdx[val]; !ok {
+			missing = append(missing, val)
+		}
+		missingIdx[val] = append(missingIdx[val], i)
+	}
+	t.mutex.Unlock()
+
+	for len(missing) > 0 {
+		batch := missing
+		if len(batch) > t.batchSize {
+			batch = batch[:t.batchSize]
+		}
+		missing = missing[len(batch):]
+
+		batchTokens, err := t.request(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+
+		t.mutex.Lock()
+		for i, val := range batch {
+			for _, idx := range missingIdx[val] {
+				tokens[idx] = batchTokens[i]
+			}
+			t.store(val, batchTokens[i])
+		}
+		t.mutex.Unlock()
+	}
+
+	return tokens, nil
+}
+
+func (t *Tokenizer) request(ctx context.Context, values []string) ([]string, error) {
+	var resp response
+
+	body, err := json.Marshal(request{Values: values})
+	if err != nil {
+		return nil, fmt.Errorf("could not encode request: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := t.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", httpResp.Status)
+	}
+
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("could not decode response: %w", err)
+	}
+
+	if len(resp.Tokens) != len(values) {
+		return nil, fmt.Errorf("got %d tokens for %d values", len(resp.Tokens), len(values))
+	}
+
+	return resp.Tokens, nil
+}
+
+// cached returns the cached token of the value. Must be called with the mutex locked
+func (t *Tokenizer) cached(val string) (string, bool) {
+	el, ok := t.cache[val]
+	if !ok {
+		return "", false
+	}
+	t.lru.MoveToFront(el)
+
+	return el.Value.(*cacheEntry).token, true
+}
+
+// store caches the token of the value evicting the least recently used one. Must be called with the mutex locked
+func (t *Tokenizer) store(val, token string) {
+	if t.cacheSize <= 0 {
+		return
+	}
+
+	if el, ok := t.cache[val]; ok {
+		el.Value.(*cacheEntry).token = token
+		t.lru.MoveToFront(el)
+		return
+	}
+
+	t.cache[val] = t.lru.PushFront(&cacheEntry{value: val, token: token})
+	if t.lru.Len() > t.cacheSize {
+		oldest := t.lru.Back()
+		t.lru.Remove(oldest)
+		delete(t.cache, oldest.Value.(*cacheEntry).value)
+	}
+}
@@ -0,0 +1,365 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signature of the postgresql binary copy format followed by the flags and the header extension length
+var binaryCopySignature = []byte("PGCOPY\n\377\r\n\x00")
+
+const binaryCopyHeaderLen = 11 + 4 + 4
+
+// postgres epoch of the binary date and timestamp values
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// binaryText converts the binary values of the postgresql types into their text output, so that the rows
+// of the binary copy are converted the same way as the streamed ones
+var binaryText = map[string]func([]byte) (string, error){
+	PgBoolean:                  binaryBool,
+	PgSmallint:                 binaryInt,
+	PgInteger:                  binaryInt,
+	PgBigint:                   binaryInt,
+	"oid":                      binaryOID,
+	PgReal:                     binaryFloat,
+	PgDoublePrecision:          binaryFloat,
+	PgText:                     binaryString,
+	PgCharacterVarying:         binaryString,
+	PgVarchar:                  binaryString,
+	PgCharacter:                binaryString,
+	"name":                     binaryString,
+	PgJson:                     binaryString,
+	PgJsonb:                    binaryJsonb,
+	PgUuid:                     binaryUUID,
+	PgBytea:                    binaryBytea,
+	PgDate:                     binaryDate,
+	PgTimestamp:                binaryTimestamp,
+	PgTimestampWithoutTimeZone: binaryTimestamp,
+	PgInet:                     binaryInet,
+	PgCidr:                     binaryInet,
+	PgMacaddr:                  binaryMacaddr,
+	PgMacaddr8:                 binaryMacaddr,
+}
+
+// HasBinaryText checks if the binary values of the type can be converted into the text output
+func HasBinaryText(pgType string) bool {
+	_, ok := binaryText[pgType]
+
+	return ok
+}
+
+// BinaryText converts the binary value of the type into its text output
+func BinaryText(pgType string, val []byte) (string, error) {
+	fn, ok := binaryText[pgType]
+	if !ok {
+		return "", fmt.Errorf("unsupported type of binary copy: %s", pgType)
+	}
+
+	return fn(val)
+}
+
+// BinaryCopyWriter splits the stream of the postgresql binary copy format into the tuples, each tuple is passed
+// to the underlying writer in a single Write call, same as the lines of the text copy format
+type BinaryCopyWriter struct {
+	w      io.Writer
+	buf    []byte
+	header bool // the header is read
+	done   bool // the trailer is read
+}
+
+// NewBinaryCopyWriter instantiates BinaryCopyWriter
+func NewBinaryCopyWriter(w io.Writer) *BinaryCopyWriter {
+	return &BinaryCopyWriter{w: w}
+}
+
+// Write implements io.Writer, the data may end in the middle of the tuple
+func (b *BinaryCopyWriter) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+
+	if !b.header {
+		if len(b.buf) < binaryCopyHeaderLen {
+			return len(p), nil
+		}
+		if !bytes.Equal(b.buf[:len(binaryCopySignature)], binaryCopySignature) {
+			return 0, fmt.Errorf("invalid binary copy signature")
+		}
+
+		extLen := int(binary.BigEndian.Uint32(b.buf[binaryCopyHeaderLen-4:]))
+		if len(b.buf) < binaryCopyHeaderLen+extLen {
+			return len(p), nil
+		}
+		b.buf = append(b.buf[:0], b.buf[binaryCopyHeaderLen+extLen:]...)
+		b.header = true
+	}
+
+	pos := 0
+	for !b.done {
+		n, ok := binaryTupleLen(b.buf[pos:])
+		if !ok {
+			break
+		}
+
+		if int16(binary.BigEndian.Uint16(b.buf[pos:])) == -1 {
+			b.done = true
+		} else if _, err := b.w.Write(b.buf[pos : pos+n]); err != nil {
+			return 0, err
+		}
+		pos += n
+	}
+	b.buf = append(b.buf[:0], b.buf[pos:]...)
+
+	return len(p), nil
+}
+
+// Finish checks that the copy is complete
+func (b *BinaryCopyWriter) Finish() error {
+	if !b.done || len(b.buf) > 0 {
+		return fmt.Errorf("incomplete binary copy data")
+	}
+
+	return nil
+}
+
+// binaryTupleLen returns the length of the tuple at the start of the buffer if it is there entirely
+func binaryTupleLen(buf []byte) (int, bool) {
+	if len(buf) < 2 {
+		return 0, false
+	}
+
+	fields := int16(binary.BigEndian.Uint16(buf))
+	pos := 2
+	for i := int16(0); i < fields; i++ {
+		if len(buf) < pos+4 {
+			return 0, false
+		}
+
+		size := int32(binary.BigEndian.Uint32(buf[pos:]))
+		pos += 4
+		if size > 0 {
+			pos += int(size)
+		}
+	}
+
+	if len(buf) < pos {
+		return 0, false
+	}
+
+	return pos, true
+}
+
+// DecodeBinaryCopy extracts fields from the tuple of the postgresql binary copy format, nil for NULL
+func DecodeBinaryCopy(in []byte) ([][]byte, error) {
+	if len(in) < 2 {
+		return nil, fmt.Errorf("truncated tuple")
+	}
+
+	fields := int16(binary.BigEndian.Uint16(in))
+	result := make([][]byte, 0, fields)
+	pos := 2
+	for i := int16(0); i < fields; i++ {
+		if len(in) < pos+4 {
+			return nil, fmt.Errorf("truncated tuple")
+		}
+
+		size := int32(binary.BigEndian.Uint32(in[pos:]))
+		pos += 4
+		if size < 0 {
+			result = append(result, nil)
+			continue
+		}
+
+		if len(in) < pos+int(size) {
+			return nil, fmt.Errorf("truncated tuple")
+		}
+		result = append(result, in[pos:pos+int(size)])
+		pos += int(size)
+	}
+
+	return result, nil
+}
+
+func binaryBool(val []byte) (string, error) {
+	if len(val) != 1 {
+		return "", fmt.Errorf("invalid boolean length: %d", len(val))
+	}
+
+	if val[0] != 0 {
+		return "t", nil
+	}
+
+	return "f", nil
+}
+
+func binaryInt(val []byte) (string, error) {
+	switch len(val) {
+	case 2:
+		return strconv.FormatInt(int64(int16(binary.BigEndian.Uint16(val))), 10), nil
+	case 4:
+		return strconv.FormatInt(int64(int32(binary.BigEndian.Uint32(val))), 10), nil
+	case 8:
+		return strconv.FormatInt(int64(binary.BigEndian.Uint64(val)), 10), nil
+	}
+
+	return "", fmt.Errorf("invalid integer length: %d", len(val))
+}
+
+func binaryOID(val []byte) (string, error) {
+	if len(val) != 4 {
+		return "", fmt.Errorf("invalid oid length: %d", len(val))
+	}
+
+	return strconv.FormatUint(uint64(binary.BigEndian.Uint32(val)), 10), nil
+}
+
+// binaryFloat formats the float the way postgresql does: the shortest exact digits, in the exponent notation
+// if the exponent is less than -4 or not less than the number of the significant digits of the type
+func binaryFloat(val []byte) (string, error) {
+	var (
+		v       float64
+		bitSize int
+		maxExp  int
+	)
+
+	switch len(val) {
+	case 4:
+		v, bitSize, maxExp = float64(math.Float32frombits(binary.BigEndian.Uint32(val))), 32, 6
+	case 8:
+		v, bitSize, maxExp = math.Float64frombits(binary.BigEndian.Uint64(val)), 64, 15
+	default:
+		return "", fmt.Errorf("invalid float length: %d", len(val))
+	}
+
+	switch {
+	case math.IsNaN(v):
+		return "NaN", nil
+	case math.IsInf(v, 1):
+		return "Infinity", nil
+	case math.IsInf(v, -1):
+		return "-Infinity", nil
+	}
+
+	str := strconv.FormatFloat(v, 'e', -1, bitSize)
+	exp, err := strconv.Atoi(str[strings.IndexByte(str, 'e')+1:])
+	if err != nil {
+		return "", err
+	}
+
+	if exp < -4 || exp >= maxExp {
+		return str, nil
+	}
+
+	return strconv.FormatFloat(v, 'f', -1, bitSize), nil
+}
+
+func binaryString(val []byte) (string, error) {
+	return string(val), nil
+}
+
+func binaryJsonb(val []byte) (string, error) {
+	if len(val) == 0 || val[0] != 1 {
+		return "", fmt.Errorf("unsupported jsonb version")
+	}
+
+	return string(val[1:]), nil
+}
+
+func binaryUUID(val []byte) (string, error) {
+	if len(val) != 16 {
+		return "", fmt.Errorf("invalid uuid length: %d", len(val))
+	}
+
+	str := hex.EncodeToString(val)
+
+	return str[:8] + "-" + str[8:12] + "-" + str[12:16] + "-" + str[16:20] + "-" + str[20:], nil
+}
+
+// binaryInet converts the family, the netmask bits, the cidr flag, the address length and the address of the inet
+// or cidr value into its text output, the netmask is omitted for the inet hosts
+func binaryInet(val []byte) (string, error) {
+	if len(val) < 4 || len(val) != 4+int(val[3]) {
+		return "", fmt.Errorf("invalid inet length: %d", len(val))
+	}
+
+	var (
+		addr    netip.Addr
+		maxBits int
+	)
+	switch family, addrLen := val[0], val[3]; {
+	case family == 2 && addrLen == 4: // PGSQL_AF_INET
+		addr, maxBits = netip.AddrFrom4([4]byte(val[4:])), 32
+	case family == 3 && addrLen == 16: // PGSQL_AF_INET6
+		addr, maxBits = netip.AddrFrom16([16]byte(val[4:])), 128
+	default:
+		return "", fmt.Errorf("invalid inet family %d of length %d", family, addrLen)
+	}
+
+	if bits, isCidr := int(val[1]), val[2] != 0; isCidr || bits != maxBits {
+		return addr.String() + "/" + strconv.Itoa(bits), nil
+	}
+
+	return addr.String(), nil
+}
+
+func binaryMacaddr(val []byte) (string, error) {
+	if len(val) != 6 && len(val) != 8 {
+		return "", fmt.Errorf("invalid macaddr length: %d", len(val))
+	}
+
+	return net.HardwareAddr(val).String(), nil
+}
+
+func binaryBytea(val []byte) (string, error) {
+	return `\x` + hex.EncodeToString(val), nil
+}
+
+func binaryDate(val []byte) (string, error) {
+	if len(val) != 4 {
+		return "", fmt.Errorf("invalid date length: %d", len(val))
+	}
+
+	switch days := int32(binary.BigEndian.Uint32(val)); days {
+	case math.MaxInt32:
+		return "infinity", nil
+	case math.MinInt32:
+		return "-infinity", nil
+	default:
+		return formatBC(pgEpoch.AddDate(0, 0, int(days)), "2006-01-02"), nil
+	}
+}
+
+func binaryTimestamp(val []byte) (string, error) {
+	if len(val) != 8 {
+		return "", fmt.Errorf("invalid timestamp length: %d", len(val))
+	}
+
+	switch usec := int64(binary.BigEndian.Uint64(val)); usec {
+	case math.MaxInt64:
+		return "infinity", nil
+	case math.MinInt64:
+		return "-infinity", nil
+	default:
+		ts := time.Unix(pgEpoch.Unix()+usec/1e6, usec%1e6*1e3).UTC()
+
+		return formatBC(ts, "2006-01-02 15:04:05.999999"), nil
+	}
+}
+
+// formatBC formats the time, the years before 1 AD are formatted as postgresql does: 0 is 1 BC
+func formatBC(t time.Time, layout string) string {
+	if t.Year() > 0 {
+		return t.Format(layout)
+	}
+
+	str := t.Format(layout) // e.g. -0001-02-03, the year is followed by the first dash after the sign
+
+	return fmt.Sprintf("%04d", 1-t.Year()) + str[strings.IndexByte(str[1:], '-')+1:] + " BC"
+}
@@ -0,0 +1,142 @@
+package chutils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseArray parses the text output of the postgresql array into its elements: strings, nils for the NULL ones
+// and []interface{} for the nested arrays of the multidimensional array; the dimensions decoration of the arrays
+// with non default lower bounds, e.g. [0:1]={1,2}, is skipped
+func ParseArray(val string) ([]interface{}, error) {
+	if strings.HasPrefix(val, "[") {
+		pos := strings.IndexByte(val, '=')
+		if pos < 0 {
+			return nil, fmt.Errorf("malformed array: no '=' after the dimensions")
+		}
+		val = val[pos+1:]
+	}
+
+	p := &arrayParser{val: val}
+	res, err := p.array()
+	if err != nil {
+		return nil, fmt.Errorf("malformed array: %w", err)
+	}
+
+	if p.skipSpaces(); p.pos < len(p.val) {
+		return nil, fmt.Errorf("malformed array: unexpected %q at %d", p.val[p.pos], p.pos)
+	}
+
+	return res, nil
+}
+
+type arrayParser struct {
+	val string
+	pos int
+}
+
+func (p *arrayParser) skipSpaces() {
+	for p.pos < len(p.val) && isArraySpace(p.val[p.pos]) {
+		p.pos++
+	}
+}
+
+func isArraySpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func (p *arrayParser) array() ([]interface{}, error) {
+	if p.skipSpaces(); p.pos >= len(p.val) || p.val[p.pos] != '{' {
+		return nil, fmt.Errorf("'{' expected at %d", p.pos)
+	}
+	p.pos++
+
+	res := make([]interface{}, 0)
+	if p.skipSpaces(); p.pos < len(p.val) && p.val[p.pos] == '}' {
+		p.pos++
+		return res, nil
+	}
+
+	for {
+		p.skipSpaces()
+		elem, err := p.element()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, elem)
+
+		if p.skipSpaces(); p.pos >= len(p.val) {
+			return nil, fmt.Errorf("unterminated array")
+		}
+
+		switch p.val[p.pos] {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return res, nil
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", p.val[p.pos], p.pos)
+		}
+	}
+}
+
+// element parses the element: the nested array, the quoted string or the unquoted one, NULL if not quoted is nil
+func (p *arrayParser) element() (interface{}, error) {
+	if p.pos >= len(p.val) {
+		return nil, fmt.Errorf("unterminated array")
+	}
+
+	switch p.val[p.pos] {
+	case '{':
+		return p.array()
+	case '"':
+		return p.quoted()
+	}
+
+	var sb strings.Builder
+	for p.pos < len(p.val) {
+		c := p.val[p.pos]
+		if c == ',' || c == '}' {
+			break
+		}
+		if c == '\\' && p.pos+1 < len(p.val) {
+			p.pos++
+			c = p.val[p.pos]
+		} else if c == '"' || c == '{' {
+			return nil, fmt.Errorf("unexpected %q at %d", c, p.pos)
+		}
+		sb.WriteByte(c)
+		p.pos++
+	}
+
+	elem := strings.TrimRightFunc(sb.String(), func(r rune) bool { return r < 0x80 && isArraySpace(byte(r)) })
+	if elem == "" {
+		return nil, fmt.Errorf("empty element at %d", p.pos)
+	}
+	if strings.EqualFold(elem, "NULL") {
+		return nil, nil
+	}
+
+	return elem, nil
+}
+
+func (p *arrayParser) quoted() (string, error) {
+	var sb strings.Builder
+
+	for p.pos++; p.pos < len(p.val); p.pos++ {
+		switch c := p.val[p.pos]; c {
+		case '\\':
+			if p.pos++; p.pos < len(p.val) {
+				sb.WriteByte(p.val[p.pos])
+			}
+		case '"':
+			p.pos++
+			return sb.String(), nil
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	return "", fmt.Errorf("unterminated quoted element")
+}
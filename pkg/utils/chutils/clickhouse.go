@@ -2,6 +2,8 @@ package chutils
 
 import (
 	"fmt"
+	"math"
+	"strings"
 
 	"github.com/mkabilov/pg2ch/pkg/config"
 	"github.com/mkabilov/pg2ch/pkg/utils"
@@ -26,7 +28,10 @@ var pgToChMap = map[string]string{
 	utils.PgJson:                     utils.ChString,
 	utils.PgUuid:                     utils.ChUUID,
 	utils.PgBytea:                    utils.ChUInt8Array,
-	utils.PgInet:                     utils.ChInt64,
+	utils.PgInet:                     utils.ChIPv6,
+	utils.PgCidr:                     utils.ChIPv6,
+	utils.PgMacaddr:                  utils.ChUint64,
+	utils.PgMacaddr8:                 utils.ChUint64,
 	utils.PgTimestamp:                utils.ChDateTime,
 	utils.PgTimestampWithTimeZone:    utils.ChDateTime,
 	utils.PgTimestampWithoutTimeZone: utils.ChDateTime,
@@ -36,13 +41,39 @@ var pgToChMap = map[string]string{
 	utils.PgTimeWithTimeZone:         utils.ChUint32,
 }
 
-// ToClickHouseType converts pg type into clickhouse type
-func ToClickHouseType(pgColumn config.PgColumn) (string, error) {
+// SystemTableFilter returns the condition with its arguments matching the rows of the table in the system tables,
+// e.g. system.parts; the table not qualified with the database name is looked up in the current database
+func SystemTableFilter(name string) (string, []interface{}) {
+	database, table := config.SplitChTableName(name)
+	if database == "" {
+		return "database = currentDatabase() AND table = ?", []interface{}{table}
+	}
+
+	return "database = ? AND table = ?", []interface{}{database, table}
+}
+
+// OnCluster returns the ON CLUSTER clause of the DDL queries, empty if the cluster is not set
+func OnCluster(cluster string) string {
+	if cluster == "" {
+		return ""
+	}
+
+	return " ON CLUSTER " + cluster
+}
+
+// ToClickHouseType converts pg type into clickhouse type; the pg enums are converted into Enum8 or Enum16
+// of the same labels, or into LowCardinality(String) if lowCardinalityEnums is set
+func ToClickHouseType(pgColumn config.PgColumn, lowCardinalityEnums bool) (string, error) {
 	chType, ok := pgToChMap[pgColumn.BaseType]
 	if !ok {
 		chType = utils.ChString
 	}
 
+	lowCardinality := false
+	if pgColumn.Labels != nil {
+		chType, lowCardinality = enumType(pgColumn.Labels, lowCardinalityEnums)
+	}
+
 	switch pgColumn.BaseType {
 	case utils.PgDecimal:
 		fallthrough
@@ -60,13 +91,52 @@ func ToClickHouseType(pgColumn config.PgColumn) (string, error) {
 		chType = fmt.Sprintf("%s(%d)", chType, pgColumn.Ext[0])
 	}
 
+	if pgColumn.IsNullable && !pgColumn.IsArray {
+		chType = fmt.Sprintf("Nullable(%s)", chType)
+	}
+
+	if lowCardinality {
+		chType = fmt.Sprintf("LowCardinality(%s)", chType)
+	}
+
 	if pgColumn.IsArray {
 		chType = fmt.Sprintf("Array(%s)", chType)
 	}
 
-	if pgColumn.IsNullable && !pgColumn.IsArray {
-		chType = fmt.Sprintf("Nullable(%s)", chType)
+	return chType, nil
+}
+
+// ipWritable replaces the IPv4 and IPv6 types the driver can't write with String
+var ipWritable = strings.NewReplacer(utils.ChIPv4, utils.ChString, utils.ChIPv6, utils.ChString)
+
+// WritableType returns the type of the buffer table column the driver can write the values of the clickhouse type
+// into: the IPv4 and IPv6 values are written as text into the String columns and cast when moved to the main table
+func WritableType(chType string) string {
+	if strings.Contains(chType, "Enum") { // the labels are not types
+		return chType
 	}
 
-	return chType, nil
+	return ipWritable.Replace(chType)
+}
+
+// enumType returns Enum8 or Enum16 type of the labels valued from 1 on in their order, or String to be wrapped
+// into LowCardinality if lowCardinality is set, there are too many labels or the driver can't write some of them
+func enumType(labels []string, lowCardinality bool) (string, bool) {
+	if lowCardinality || len(labels) > math.MaxInt16 {
+		return utils.ChString, true
+	}
+
+	values := make([]string, len(labels))
+	for i, label := range labels {
+		if strings.ContainsAny(label, `',=\`) {
+			return utils.ChString, true
+		}
+		values[i] = fmt.Sprintf("'%s' = %d", label, i+1)
+	}
+
+	if len(labels) > math.MaxInt8 {
+		return fmt.Sprintf("%s(%s)", utils.ChEnum16, strings.Join(values, ", ")), false
+	}
+
+	return fmt.Sprintf("%s(%s)", utils.ChEnum8, strings.Join(values, ", ")), false
 }
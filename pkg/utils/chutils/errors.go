@@ -0,0 +1,37 @@
+package chutils
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/kshvakov/clickhouse"
+
+	"github.com/mkabilov/pg2ch/pkg/utils"
+)
+
+// ClassifyError wraps connection level errors into utils.ErrCHUnavailable,
+// errors reported by the clickhouse server are returned as is
+func ClassifyError(err error) error {
+	var (
+		exception *clickhouse.Exception
+		netErr    net.Error
+	)
+
+	if err == nil || errors.Is(err, utils.ErrCHUnavailable) || errors.As(err, &exception) {
+		return err
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.As(err, &netErr) {
+		return fmt.Errorf("%w: %v", utils.ErrCHUnavailable, err)
+	}
+
+	return err
+}
+
+// IsRetriable checks if it makes sense to retry the operation failed with the error
+func IsRetriable(err error) bool {
+	return !errors.Is(err, utils.ErrConversion) && !errors.Is(err, utils.ErrSchemaMismatch)
+}
@@ -0,0 +1,59 @@
+package chutils
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is the major and minor version of the clickhouse server, e.g. 21.8
+type Version struct {
+	Major int
+	Minor int
+}
+
+// ParseVersion parses the version reported by the server, e.g. "21.8.10.19"
+func ParseVersion(str string) (Version, error) {
+	parts := strings.SplitN(strings.TrimSpace(str), ".", 3)
+	if len(parts) < 2 {
+		return Version{}, fmt.Errorf("unexpected version format: %q", str)
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Version{}, fmt.Errorf("unexpected version format: %q", str)
+	}
+
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Version{}, fmt.Errorf("unexpected version format: %q", str)
+	}
+
+	return Version{Major: major, Minor: minor}, nil
+}
+
+// ServerVersion queries the version of the server
+func ServerVersion(conn *sql.DB) (Version, error) {
+	var str string
+
+	if err := conn.QueryRow("select version()").Scan(&str); err != nil {
+		return Version{}, fmt.Errorf("could not query version: %w", ClassifyError(err))
+	}
+
+	return ParseVersion(str)
+}
+
+// AtLeast checks if the version is the given one or newer
+func (v Version) AtLeast(major, minor int) bool {
+	return v.Major > major || v.Major == major && v.Minor >= minor
+}
+
+// Less checks if the version is older than the other one
+func (v Version) Less(other Version) bool {
+	return !v.AtLeast(other.Major, other.Minor)
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
@@ -0,0 +1,82 @@
+package colcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// Cipher encrypts the column values with AES-GCM; the values are stored as base64 of the nonce followed by
+// the ciphertext. Deterministic cipher derives the nonce from the HMAC of the value, like SIV, so that equal
+// values give equal ciphertexts and stay joinable, at the cost of revealing which values are equal
+type Cipher struct {
+	aead          cipher.AEAD
+	nonceKey      []byte // HMAC key of the deterministic nonces, nil for the random ones
+	deterministic bool
+}
+
+// New instantiates Cipher with the AES-128, AES-192 or AES-256 key
+func New(key []byte, deterministic bool) (*Cipher, error) {
+	encKey := derive(key, "pg2ch column encryption")
+
+	block, err := aes.NewCipher(encKey[:len(key)])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cipher{aead: aead, deterministic: deterministic}
+	if deterministic {
+		c.nonceKey = derive(key, "pg2ch column encryption nonce")
+	}
+
+	return c, nil
+}
+
+// ParseKey decodes the base64 encoded AES key
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode base64: %w", err)
+	}
+
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("key must be 16, 24 or 32 bytes long, got %d", len(key))
+	}
+
+	return key, nil
+}
+
+// Encrypt returns the encrypted value
+func (c *Cipher) Encrypt(val []byte) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+
+	if c.deterministic {
+		mac := hmac.New(sha256.New, c.nonceKey)
+		mac.Write(val)
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("could not generate nonce: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(c.aead.Seal(nonce, nonce, val, nil)), nil
+}
+
+// derive returns the subkey for the purpose, so that the encryption and the nonce keys are independent
+func derive(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+
+	return mac.Sum(nil)
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bytes"
 	"database/sql"
 	"fmt"
 	"strings"
@@ -10,6 +11,16 @@ const (
 	// OutputPlugin contains logical decoder plugin name
 	OutputPlugin = "pgoutput"
 
+	// PartitionTreeQuery selects oids of the table passed as $1 and of all its partitions, if any
+	PartitionTreeQuery = `with recursive tree(relid) as (
+		select $1::regclass::oid
+		union all
+		select i.inhrelid from pg_inherits i
+			join tree t on t.relid = i.inhparent
+			join pg_class c on c.oid = i.inhrelid
+		where c.relispartition)
+	select relid from tree`
+
 	copyNull = 'N'
 )
 
@@ -157,3 +168,37 @@ func DecodeCopy(in []byte) ([]sql.NullString, error) {
 
 	return result, nil
 }
+
+//EncodeCopy encodes fields into the line of the postgresql text copy format, see DecodeCopy
+func EncodeCopy(fields []sql.NullString) []byte {
+	buf := &bytes.Buffer{}
+
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteByte('\t')
+		}
+
+		if !field.Valid {
+			buf.WriteString(`\N`)
+			continue
+		}
+
+		for j := 0; j < len(field.String); j++ {
+			switch ch := field.String[j]; ch {
+			case '\\':
+				buf.WriteString(`\\`)
+			case '\t':
+				buf.WriteString(`\t`)
+			case '\n':
+				buf.WriteString(`\n`)
+			case '\r':
+				buf.WriteString(`\r`)
+			default:
+				buf.WriteByte(ch)
+			}
+		}
+	}
+	buf.WriteByte('\n')
+
+	return buf.Bytes()
+}
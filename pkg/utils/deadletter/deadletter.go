@@ -0,0 +1,59 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record is the row skipped by the replication, written as a line of JSON; values are in the postgres text format,
+// null for NULL; the rows rejected by clickhouse on the flush have the converted values by clickhouse column
+type Record struct {
+	Time   time.Time          `json:"time"`
+	Table  string             `json:"table"`
+	LSN    string             `json:"lsn,omitempty"` // empty for the rows of the initial sync
+	Op     string             `json:"op"`
+	Reason string             `json:"reason"`
+	Row    map[string]*string `json:"row,omitempty"`
+	Old    map[string]*string `json:"old,omitempty"`
+}
+
+// Writer appends the records to the file; safe for concurrent use by the tables synced in parallel
+type Writer struct {
+	mutex sync.Mutex
+	fp    *os.File
+	enc   *json.Encoder
+}
+
+// Open opens the file for appending
+func Open(path string) (*Writer, error) {
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file: %w", err)
+	}
+
+	return &Writer{fp: fp, enc: json.NewEncoder(fp)}, nil
+}
+
+// Write writes the record; the file is not buffered, so the record is there once the row is skipped
+func (w *Writer) Write(rec Record) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	rec.Time = time.Now()
+	if err := w.enc.Encode(rec); err != nil {
+		return fmt.Errorf("could not write dead letter record: %w", err)
+	}
+
+	return nil
+}
+
+// Close closes the file
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.fp.Close()
+}
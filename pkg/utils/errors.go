@@ -0,0 +1,18 @@
+package utils
+
+import "errors"
+
+// Error classes, use errors.Is to check if the error belongs to the class
+var (
+	// ErrCHUnavailable indicates clickhouse server could not be reached
+	ErrCHUnavailable = errors.New("clickhouse is unavailable")
+
+	// ErrConversion indicates postgresql value could not be converted into the clickhouse one
+	ErrConversion = errors.New("conversion error")
+
+	// ErrSchemaMismatch indicates postgresql and clickhouse table structures do not match
+	ErrSchemaMismatch = errors.New("schema mismatch")
+
+	// ErrDeadLetter indicates the row is skipped and written to the dead letter file instead
+	ErrDeadLetter = errors.New("dead letter")
+)
@@ -0,0 +1,1130 @@
+package expr
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mkabilov/pg2ch/pkg/utils/hstore"
+)
+
+// Value is the text representation of the postgres value, Null is set for NULL
+type Value struct {
+	Str  string
+	Null bool
+}
+
+// Env provides values of the postgres columns referenced by the expression
+type Env map[string]Value
+
+// Expr is a parsed expression over the postgres columns
+type Expr interface {
+	Eval(env Env) (Value, error)
+}
+
+var (
+	errIntOverflow    = errors.New("integer out of range")
+	errDivisionByZero = errors.New("division by zero")
+)
+
+var (
+	null       = Value{Null: true}
+	trueValue  = Value{Str: "t"}
+	falseValue = Value{Str: "f"}
+)
+
+const (
+	timestampLayout = "2006-01-02 15:04:05"
+	dateLayout      = "2006-01-02"
+)
+
+// Parse parses the expression: column references, 'string' and numeric literals, null, true, false,
+// arithmetic operators + - * / with parentheses and coalesce, substring, date_trunc functions, the hstore functions
+// akeys, avals, fetchval and slice,
+// comparisons = != <> < <= > >=, is [not] null, [not] in (...) and the and, or, not operators;
+// the booleans are "t" and "f", same as the text output of the postgres booleans
+func Parse(src string) (Expr, error) {
+	p := &parser{lex: lexer{src: src}}
+	p.next()
+
+	e, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	if p.tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.tok.val, p.tok.pos)
+	}
+
+	return e, nil
+}
+
+// Columns returns names of the columns referenced by the expression
+func Columns(e Expr) []string {
+	seen := make(map[string]struct{})
+	res := make([]string, 0)
+
+	var walk func(Expr)
+	walk = func(e Expr) {
+		switch v := e.(type) {
+		case column:
+			if _, ok := seen[string(v)]; !ok {
+				seen[string(v)] = struct{}{}
+				res = append(res, string(v))
+			}
+		case binary:
+			walk(v.left)
+			walk(v.right)
+		case comparison:
+			walk(v.left)
+			walk(v.right)
+		case logical:
+			walk(v.left)
+			walk(v.right)
+		case negation:
+			walk(v.operand)
+		case isNull:
+			walk(v.operand)
+		case inList:
+			walk(v.operand)
+			for _, item := range v.list {
+				walk(item)
+			}
+		case call:
+			for _, arg := range v.args {
+				walk(arg)
+			}
+		}
+	}
+	walk(e)
+
+	return res
+}
+
+// IsTrue checks if the value is the true boolean, NULL is not
+func IsTrue(val Value) bool {
+	return !val.Null && val.Str == trueValue.Str
+}
+
+func boolValue(b bool) Value {
+	if b {
+		return trueValue
+	}
+
+	return falseValue
+}
+
+type literal Value
+
+func (l literal) Eval(Env) (Value, error) {
+	return Value(l), nil
+}
+
+type column string
+
+func (c column) Eval(env Env) (Value, error) {
+	val, ok := env[string(c)]
+	if !ok {
+		return null, fmt.Errorf("no value for %q column", string(c))
+	}
+
+	return val, nil
+}
+
+type binary struct {
+	op          byte
+	left, right Expr
+}
+
+func (b binary) Eval(env Env) (Value, error) {
+	left, err := b.left.Eval(env)
+	if err != nil {
+		return null, err
+	}
+
+	right, err := b.right.Eval(env)
+	if err != nil {
+		return null, err
+	}
+
+	if left.Null || right.Null {
+		return null, nil
+	}
+
+	if l, err := strconv.ParseInt(left.Str, 10, 64); err == nil {
+		if r, err := strconv.ParseInt(right.Str, 10, 64); err == nil {
+			res, err := intOp(b.op, l, r)
+			if err != nil {
+				return null, err
+			}
+
+			return Value{Str: strconv.FormatInt(res, 10)}, nil
+		}
+	}
+
+	l, err := strconv.ParseFloat(left.Str, 64)
+	if err != nil {
+		return null, fmt.Errorf("%q is not a number", left.Str)
+	}
+
+	r, err := strconv.ParseFloat(right.Str, 64)
+	if err != nil {
+		return null, fmt.Errorf("%q is not a number", right.Str)
+	}
+
+	var res float64
+	switch b.op {
+	case '+':
+		res = l + r
+	case '-':
+		res = l - r
+	case '*':
+		res = l * r
+	case '/':
+		if r == 0 {
+			return null, errDivisionByZero
+		}
+		res = l / r
+	}
+
+	return Value{Str: strconv.FormatFloat(res, 'f', -1, 64)}, nil
+}
+
+// intOp applies the arithmetic operator to the integers the way postgres does with bigint: the division truncates
+// toward zero, the overflow is an error
+func intOp(op byte, l, r int64) (int64, error) {
+	var res int64
+
+	switch op {
+	case '+':
+		res = l + r
+		if (r > 0 && res < l) || (r < 0 && res > l) {
+			return 0, errIntOverflow
+		}
+	case '-':
+		res = l - r
+		if (r < 0 && res < l) || (r > 0 && res > l) {
+			return 0, errIntOverflow
+		}
+	case '*':
+		res = l * r
+		if l != 0 && (res/l != r || (l == -1 && r == math.MinInt64)) {
+			return 0, errIntOverflow
+		}
+	case '/':
+		if r == 0 {
+			return 0, errDivisionByZero
+		}
+		if l == math.MinInt64 && r == -1 {
+			return 0, errIntOverflow
+		}
+		res = l / r
+	}
+
+	return res, nil
+}
+
+// compareValues compares the values as numbers if both of them are numeric, as strings otherwise
+func compareValues(left, right Value) int {
+	// the integers are compared exactly, the float64 ones lose the precision past 2^53
+	if l, err := strconv.ParseInt(left.Str, 10, 64); err == nil {
+		if r, err := strconv.ParseInt(right.Str, 10, 64); err == nil {
+			switch {
+			case l < r:
+				return -1
+			case l > r:
+				return 1
+			}
+
+			return 0
+		}
+	}
+
+	if l, err := strconv.ParseFloat(left.Str, 64); err == nil {
+		if r, err := strconv.ParseFloat(right.Str, 64); err == nil {
+			switch {
+			case l < r:
+				return -1
+			case l > r:
+				return 1
+			}
+
+			return 0
+		}
+	}
+
+	return strings.Compare(left.Str, right.Str)
+}
+
+type comparison struct {
+	op          string
+	left, right Expr
+}
+
+func (c comparison) Eval(env Env) (Value, error) {
+	left, err := c.left.Eval(env)
+	if err != nil {
+		return null, err
+	}
+
+	right, err := c.right.Eval(env)
+	if err != nil {
+		return null, err
+	}
+
+	if left.Null || right.Null {
+		return null, nil
+	}
+
+	cmp := compareValues(left, right)
+	switch c.op {
+	case "=":
+		return boolValue(cmp == 0), nil
+	case "!=", "<>":
+		return boolValue(cmp != 0), nil
+	case "<":
+		return boolValue(cmp < 0), nil
+	case "<=":
+		return boolValue(cmp <= 0), nil
+	case ">":
+		return boolValue(cmp > 0), nil
+	case ">=":
+		return boolValue(cmp >= 0), nil
+	}
+
+	return null, fmt.Errorf("unknown operator %q", c.op)
+}
+
+// logical is the and/or operator with the three-valued logic of sql
+type logical struct {
+	and         bool
+	left, right Expr
+}
+
+func (l logical) Eval(env Env) (Value, error) {
+	left, err := l.left.Eval(env)
+	if err != nil {
+		return null, err
+	}
+
+	right, err := l.right.Eval(env)
+	if err != nil {
+		return null, err
+	}
+
+	// false for and, true for or decides regardless of the other operand
+	decisive := boolValue(!l.and)
+	if !left.Null && left.Str == decisive.Str || !right.Null && right.Str == decisive.Str {
+		return decisive, nil
+	}
+
+	if left.Null || right.Null {
+		return null, nil
+	}
+
+	return boolValue(l.and), nil
+}
+
+type negation struct {
+	operand Expr
+}
+
+func (n negation) Eval(env Env) (Value, error) {
+	val, err := n.operand.Eval(env)
+	if err != nil || val.Null {
+		return null, err
+	}
+
+	return boolValue(!IsTrue(val)), nil
+}
+
+type isNull struct {
+	operand Expr
+	not     bool
+}
+
+func (i isNull) Eval(env Env) (Value, error) {
+	val, err := i.operand.Eval(env)
+	if err != nil {
+		return null, err
+	}
+
+	return boolValue(val.Null != i.not), nil
+}
+
+type inList struct {
+	operand Expr
+	list    []Expr
+	not     bool
+}
+
+func (i inList) Eval(env Env) (Value, error) {
+	val, err := i.operand.Eval(env)
+	if err != nil || val.Null {
+		return null, err
+	}
+
+	hasNull := false
+	for _, item := range i.list {
+		itemVal, err := item.Eval(env)
+		if err != nil {
+			return null, err
+		}
+
+		if itemVal.Null {
+			hasNull = true
+		} else if compareValues(val, itemVal) == 0 {
+			return boolValue(!i.not), nil
+		}
+	}
+
+	if hasNull {
+		return null, nil
+	}
+
+	return boolValue(i.not), nil
+}
+
+type call struct {
+	name string
+	args []Expr
+}
+
+var functions = map[string]struct {
+	minArgs, maxArgs int
+}{
+	"coalesce":   {1, -1},
+	"substring":  {2, 3},
+	"date_trunc": {2, 2},
+	"lower":      {1, 1},
+	"upper":      {1, 1},
+	"trim":       {1, 1},
+	"left":       {2, 2},
+
+	"json_extract_path_text": {2, -1},
+
+	"akeys":    {1, 1},
+	"avals":    {1, 1},
+	"fetchval": {2, 2},
+	"slice":    {1, -1},
+}
+
+func (c call) Eval(env Env) (Value, error) {
+	args := make([]Value, len(c.args))
+	for i, arg := range c.args {
+		val, err := arg.Eval(env)
+		if err != nil {
+			return null, err
+		}
+		args[i] = val
+	}
+
+	switch c.name {
+	case "coalesce":
+		for _, arg := range args {
+			if !arg.Null {
+				return arg, nil
+			}
+		}
+
+		return null, nil
+	case "substring":
+		return substring(args)
+	case "date_trunc":
+		return dateTrunc(args)
+	}
+
+	for _, arg := range args {
+		if arg.Null {
+			return null, nil
+		}
+	}
+
+	switch c.name {
+	case "lower":
+		return Value{Str: strings.ToLower(args[0].Str)}, nil
+	case "upper":
+		return Value{Str: strings.ToUpper(args[0].Str)}, nil
+	case "trim":
+		return Value{Str: strings.Trim(args[0].Str, " ")}, nil
+	case "left":
+		return left(args)
+	case "json_extract_path_text":
+		return jsonExtractPathText(args)
+	case "akeys", "avals", "fetchval", "slice":
+		return hstoreFunc(c.name, args)
+	}
+
+	return null, fmt.Errorf("unknown function %q", c.name)
+}
+
+// JSONPath returns the expression extracting the value at the path of the json column as text,
+// same as json_extract_path_text(column, path...)
+func JSONPath(columnName string, path []string) Expr {
+	c := call{name: "json_extract_path_text", args: []Expr{column(columnName)}}
+	for _, key := range path {
+		c.args = append(c.args, literal(Value{Str: key}))
+	}
+
+	return c
+}
+
+// HStoreKeys returns the expression of the keys of the hstore column as the text of the postgres array,
+// the keys are limited to the given ones if any; the empty array for NULL
+func HStoreKeys(columnName string, keys []string) Expr {
+	return hstoreArray("akeys", columnName, keys)
+}
+
+// HStoreValues returns the expression of the values of the hstore column in the order of HStoreKeys
+func HStoreValues(columnName string, keys []string) Expr {
+	return hstoreArray("avals", columnName, keys)
+}
+
+func hstoreArray(name string, columnName string, keys []string) Expr {
+	var src Expr = column(columnName)
+	if len(keys) > 0 {
+		c := call{name: "slice", args: []Expr{src}}
+		for _, key := range keys {
+			c.args = append(c.args, literal(Value{Str: key}))
+		}
+		src = c
+	}
+
+	return call{name: "coalesce", args: []Expr{call{name: name, args: []Expr{src}}, literal(Value{Str: "{}"})}}
+}
+
+// HStoreValue returns the expression of the value of the key of the hstore column, same as fetchval(column, key)
+func HStoreValue(columnName string, key string) Expr {
+	return call{name: "fetchval", args: []Expr{column(columnName), literal(Value{Str: key})}}
+}
+
+var arrayEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// hstoreFunc mirrors the postgres hstore functions: akeys and avals return the text of the arrays of the keys
+// and the values, fetchval the value of the key, NULL if there is no such key; slice keeps only the pairs
+// of the keys given as the rest of the arguments instead of the text[] of postgres
+func hstoreFunc(name string, args []Value) (Value, error) {
+	pairs, err := hstore.Parse(args[0].Str)
+	if err != nil {
+		return null, err
+	}
+
+	switch name {
+	case "fetchval":
+		for _, pair := range pairs {
+			if pair.Key == args[1].Str {
+				if pair.Null {
+					return null, nil
+				}
+				return Value{Str: pair.Value}, nil
+			}
+		}
+
+		return null, nil
+	case "slice":
+		keys := make([]string, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			keys = append(keys, arg.Str)
+		}
+		if len(keys) == 0 {
+			return Value{Str: ""}, nil
+		}
+
+		return Value{Str: hstore.Format(hstore.Filter(pairs, keys))}, nil
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, pair := range pairs {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+
+		elem, isNull := pair.Key, false
+		if name == "avals" {
+			elem, isNull = pair.Value, pair.Null
+		}
+		if isNull {
+			sb.WriteString("NULL")
+			continue
+		}
+
+		sb.WriteByte('"')
+		sb.WriteString(arrayEscaper.Replace(elem))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+
+	return Value{Str: sb.String()}, nil
+}
+
+// jsonExtractPathText mirrors postgres json_extract_path_text(json, key...): the keys of the objects and
+// the zero-based indexes of the arrays lead to the value, the strings are unquoted, the objects and arrays
+// are returned as their text in the document; NULL if there is no such value
+func jsonExtractPathText(args []Value) (Value, error) {
+	doc := []byte(args[0].Str)
+	if !json.Valid(doc) {
+		return null, fmt.Errorf("invalid json")
+	}
+
+	raw := json.RawMessage(bytes.TrimSpace(doc))
+	for _, key := range args[1:] {
+		switch raw[0] {
+		case '{':
+			var obj map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &obj); err != nil {
+				return null, err
+			}
+
+			val, ok := obj[key.Str]
+			if !ok {
+				return null, nil
+			}
+			raw = val
+		case '[':
+			var arr []json.RawMessage
+			if err := json.Unmarshal(raw, &arr); err != nil {
+				return null, err
+			}
+
+			idx, err := strconv.Atoi(key.Str)
+			if err != nil || idx < 0 || idx >= len(arr) {
+				return null, nil
+			}
+			raw = arr[idx]
+		default:
+			return null, nil
+		}
+	}
+
+	switch raw[0] {
+	case 'n':
+		return null, nil
+	case '"':
+		var str string
+		if err := json.Unmarshal(raw, &str); err != nil {
+			return null, err
+		}
+
+		return Value{Str: str}, nil
+	}
+
+	return Value{Str: string(raw)}, nil
+}
+
+// left mirrors postgres left(string, n): the first n characters, all but the last -n ones if n is negative
+func left(args []Value) (Value, error) {
+	str := []rune(args[0].Str)
+	n, err := strconv.Atoi(args[1].Str)
+	if err != nil {
+		return null, fmt.Errorf("invalid left length %q", args[1].Str)
+	}
+
+	if n < 0 {
+		n += len(str)
+	}
+	if n < 0 {
+		n = 0
+	}
+	if n > len(str) {
+		n = len(str)
+	}
+
+	return Value{Str: string(str[:n])}, nil
+}
+
+// substring mirrors postgres substring(string, from [, count]), positions are 1-based characters
+func substring(args []Value) (Value, error) {
+	for _, arg := range args {
+		if arg.Null {
+			return null, nil
+		}
+	}
+
+	str := []rune(args[0].Str)
+	from, err := strconv.Atoi(args[1].Str)
+	if err != nil {
+		return null, fmt.Errorf("invalid substring start %q", args[1].Str)
+	}
+
+	end := len(str) + 1
+	if len(args) == 3 {
+		count, err := strconv.Atoi(args[2].Str)
+		if err != nil || count < 0 {
+			return null, fmt.Errorf("invalid substring length %q", args[2].Str)
+		}
+		end = from + count
+	}
+
+	if from < 1 {
+		from = 1
+	}
+	if end > len(str)+1 {
+		end = len(str) + 1
+	}
+	if from >= end {
+		return Value{}, nil
+	}
+
+	return Value{Str: string(str[from-1 : end-1])}, nil
+}
+
+// dateTrunc mirrors postgres date_trunc(unit, timestamp) for the text representation of date and timestamp values,
+// the time zone offset, if any, is kept as is
+func dateTrunc(args []Value) (Value, error) {
+	if args[0].Null || args[1].Null {
+		return null, nil
+	}
+
+	val := args[1].Str
+	if len(val) < len(dateLayout) {
+		return null, fmt.Errorf("invalid timestamp %q", val)
+	}
+
+	layout, rest := timestampLayout, ""
+	if len(val) < len(timestampLayout) {
+		layout = dateLayout
+	} else if idx := strings.IndexAny(val[len(timestampLayout):], "+-"); idx >= 0 {
+		rest = val[len(timestampLayout)+idx:]
+	}
+
+	ts, err := time.Parse(layout, val[:len(layout)])
+	if err != nil {
+		return null, fmt.Errorf("invalid timestamp %q: %v", val, err)
+	}
+
+	year, month, day := ts.Date()
+	switch strings.ToLower(args[0].Str) {
+	case "year":
+		ts = time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	case "quarter":
+		ts = time.Date(year, month-(month-1)%3, 1, 0, 0, 0, 0, time.UTC)
+	case "month":
+		ts = time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	case "week":
+		ts = time.Date(year, month, day-(int(ts.Weekday())+6)%7, 0, 0, 0, 0, time.UTC)
+	case "day":
+		ts = time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	case "hour":
+		ts = ts.Truncate(time.Hour)
+	case "minute":
+		ts = ts.Truncate(time.Minute)
+	case "second":
+		ts = ts.Truncate(time.Second)
+	default:
+		return null, fmt.Errorf("unsupported date_trunc unit %q", args[0].Str)
+	}
+
+	return Value{Str: ts.Format(timestampLayout) + rest}, nil
+}
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokKind
+	val  string
+	pos  int
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.src) && unicode.IsSpace(rune(l.src[l.pos])) {
+		l.pos++
+	}
+
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+
+	ch := l.src[l.pos]
+	switch {
+	case ch == '\'':
+		var sb strings.Builder
+		l.pos++
+		for {
+			if l.pos >= len(l.src) {
+				return token{}, fmt.Errorf("unterminated string at position %d", start)
+			}
+
+			if l.src[l.pos] == '\'' {
+				if l.pos+1 < len(l.src) && l.src[l.pos+1] == '\'' {
+					sb.WriteByte('\'')
+					l.pos += 2
+					continue
+				}
+				l.pos++
+				break
+			}
+			sb.WriteByte(l.src[l.pos])
+			l.pos++
+		}
+
+		return token{kind: tokString, val: sb.String(), pos: start}, nil
+	case ch >= '0' && ch <= '9' || ch == '.':
+		for l.pos < len(l.src) && (l.src[l.pos] >= '0' && l.src[l.pos] <= '9' || l.src[l.pos] == '.') {
+			l.pos++
+		}
+
+		return token{kind: tokNumber, val: l.src[start:l.pos], pos: start}, nil
+	case ch == '_' || unicode.IsLetter(rune(ch)):
+		for l.pos < len(l.src) && (l.src[l.pos] == '_' || unicode.IsLetter(rune(l.src[l.pos])) || unicode.IsDigit(rune(l.src[l.pos]))) {
+			l.pos++
+		}
+
+		return token{kind: tokIdent, val: l.src[start:l.pos], pos: start}, nil
+	case strings.IndexByte("=<>!", ch) >= 0:
+		l.pos++
+		if l.pos < len(l.src) && (l.src[l.pos] == '=' || ch == '<' && l.src[l.pos] == '>') {
+			l.pos++
+		}
+
+		if op := l.src[start:l.pos]; op != "!" {
+			return token{kind: tokOp, val: op, pos: start}, nil
+		}
+	case strings.IndexByte("+-*/(),", ch) >= 0:
+		l.pos++
+
+		return token{kind: tokOp, val: string(ch), pos: start}, nil
+	}
+
+	return token{}, fmt.Errorf("unexpected %q at position %d", ch, start)
+}
+
+type parser struct {
+	lex lexer
+	tok token
+	err error
+}
+
+func (p *parser) next() {
+	if p.err != nil {
+		return
+	}
+
+	p.tok, p.err = p.lex.next()
+}
+
+func (p *parser) isOp(ops string) bool {
+	return p.err == nil && p.tok.kind == tokOp && strings.Contains(ops, p.tok.val)
+}
+
+func (p *parser) expect(op string) error {
+	if !p.isOp(op) {
+		if p.err != nil {
+			return p.err
+		}
+
+		return fmt.Errorf("expected %q at position %d", op, p.tok.pos)
+	}
+	p.next()
+
+	return nil
+}
+
+// isKeyword checks if the current token is the keyword, e.g. and
+func (p *parser) isKeyword(keyword string) bool {
+	return p.err == nil && p.tok.kind == tokIdent && strings.EqualFold(p.tok.val, keyword)
+}
+
+// isComparison checks if the current token is the comparison operator
+func (p *parser) isComparison() bool {
+	if p.err != nil || p.tok.kind != tokOp {
+		return false
+	}
+
+	switch p.tok.val {
+	case "=", "!=", "<>", "<", "<=", ">", ">=":
+		return true
+	}
+
+	return false
+}
+
+// parseExpr parses expr := and {or and}
+func (p *parser) parseExpr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("or") {
+		p.next()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logical{and: false, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+// parseAnd parses and := not {and not}
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("and") {
+		p.next()
+
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = logical{and: true, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+// parseNot parses not := not not | comparison
+func (p *parser) parseNot() (Expr, error) {
+	if !p.isKeyword("not") {
+		return p.parseComparison()
+	}
+	p.next()
+
+	operand, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	return negation{operand: operand}, nil
+}
+
+// parseComparison parses comparison := sum [op sum | is [not] null | [not] in (expr {, expr})]
+func (p *parser) parseComparison() (Expr, error) {
+	left, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.isComparison():
+		op := p.tok.val
+		p.next()
+
+		right, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+
+		return comparison{op: op, left: left, right: right}, nil
+	case p.isKeyword("is"):
+		p.next()
+
+		not := p.isKeyword("not")
+		if not {
+			p.next()
+		}
+
+		if !p.isKeyword("null") {
+			if p.err != nil {
+				return nil, p.err
+			}
+
+			return nil, fmt.Errorf("expected null at position %d", p.tok.pos)
+		}
+		p.next()
+
+		return isNull{operand: left, not: not}, p.err
+	case p.isKeyword("not"), p.isKeyword("in"):
+		not := p.isKeyword("not")
+		if not {
+			p.next()
+			if !p.isKeyword("in") {
+				if p.err != nil {
+					return nil, p.err
+				}
+
+				return nil, fmt.Errorf("expected in at position %d", p.tok.pos)
+			}
+		}
+		p.next()
+
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+
+		in := inList{operand: left, not: not}
+		for {
+			item, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			in.list = append(in.list, item)
+
+			if !p.isOp(",") {
+				break
+			}
+			p.next()
+		}
+
+		return in, p.expect(")")
+	}
+
+	return left, nil
+}
+
+// parseSum parses sum := term {(+|-) term}
+func (p *parser) parseSum() (Expr, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp("+-") {
+		op := p.tok.val[0]
+		p.next()
+
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = binary{op: op, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+// parseTerm parses term := factor {(*|/) factor}
+func (p *parser) parseTerm() (Expr, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp("*/") {
+		op := p.tok.val[0]
+		p.next()
+
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = binary{op: op, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+// parseFactor parses factor := -factor | (expr) | literal | column | function(args)
+func (p *parser) parseFactor() (Expr, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	tok := p.tok
+	switch tok.kind {
+	case tokOp:
+		switch tok.val {
+		case "-":
+			p.next()
+			operand, err := p.parseFactor()
+			if err != nil {
+				return nil, err
+			}
+
+			return binary{op: '-', left: literal{Str: "0"}, right: operand}, nil
+		case "(":
+			p.next()
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+
+			return e, p.expect(")")
+		}
+	case tokNumber:
+		if _, err := strconv.ParseFloat(tok.val, 64); err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", tok.val, tok.pos)
+		}
+		p.next()
+
+		return literal{Str: tok.val}, p.err
+	case tokString:
+		p.next()
+
+		return literal{Str: tok.val}, p.err
+	case tokIdent:
+		p.next()
+		switch strings.ToLower(tok.val) {
+		case "null":
+			return literal(null), p.err
+		case "true":
+			return literal(trueValue), p.err
+		case "false":
+			return literal(falseValue), p.err
+		}
+
+		if !p.isOp("(") {
+			return column(tok.val), p.err
+		}
+
+		return p.parseCall(strings.ToLower(tok.val), tok.pos)
+	case tokEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	return nil, fmt.Errorf("unexpected %q at position %d", tok.val, tok.pos)
+}
+
+func (p *parser) parseCall(name string, pos int) (Expr, error) {
+	fn, ok := functions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at position %d", name, pos)
+	}
+	p.next()
+
+	c := call{name: name, args: make([]Expr, 0)}
+	if !p.isOp(")") {
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			c.args = append(c.args, arg)
+
+			if !p.isOp(",") {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	if len(c.args) < fn.minArgs || fn.maxArgs >= 0 && len(c.args) > fn.maxArgs {
+		return nil, fmt.Errorf("wrong number of arguments of %s at position %d", name, pos)
+	}
+
+	return c, nil
+}
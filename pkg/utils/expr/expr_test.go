@@ -0,0 +1,98 @@
+package expr
+
+import (
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	env := Env{
+		"a":    {Str: "7"},
+		"b":    {Str: "2"},
+		"f":    {Str: "2.5"},
+		"big":  {Str: "9223372036854775807"},
+		"min":  {Str: "-9223372036854775808"},
+		"name": {Str: "Alice"},
+		"n":    {Null: true},
+	}
+
+	tests := []struct {
+		src  string
+		want Value
+	}{
+		{"a + b", Value{Str: "9"}},
+		{"a - b * 3", Value{Str: "1"}},
+		{"(a - b) * 3", Value{Str: "15"}},
+		{"a / b", Value{Str: "3"}},
+		{"-7 / 2", Value{Str: "-3"}},
+		{"a / f", Value{Str: "2.8"}},
+		{"f * 2", Value{Str: "5"}},
+		{"big - 1", Value{Str: "9223372036854775806"}},
+		{"min + 1", Value{Str: "-9223372036854775807"}},
+		{"a + n", null},
+		{"coalesce(n, a)", Value{Str: "7"}},
+		{"big = 9223372036854775806", falseValue},
+		{"big > 9223372036854775806", trueValue},
+		{"a > 10", falseValue},
+		{"name = 'Alice'", trueValue},
+		{"n is null and a in (1, 7)", trueValue},
+		{"n = 1", null},
+		{"not (a < b)", trueValue},
+	}
+
+	for _, tt := range tests {
+		e, err := Parse(tt.src)
+		if err != nil {
+			t.Errorf("%s: could not parse: %v", tt.src, err)
+			continue
+		}
+
+		got, err := e.Eval(env)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	env := Env{
+		"big": {Str: "9223372036854775807"},
+		"min": {Str: "-9223372036854775808"},
+		"s":   {Str: "abc"},
+	}
+
+	tests := []struct {
+		src  string
+		want error
+	}{
+		{"big + 1", errIntOverflow},
+		{"min - 1", errIntOverflow},
+		{"big * 2", errIntOverflow},
+		{"min * -1", errIntOverflow},
+		{"-1 * min", errIntOverflow},
+		{"min / -1", errIntOverflow},
+		{"big / 0", errDivisionByZero},
+		{"1.5 / 0", errDivisionByZero},
+		{"s + 1", nil},
+		{"missing + 1", nil},
+	}
+
+	for _, tt := range tests {
+		e, err := Parse(tt.src)
+		if err != nil {
+			t.Errorf("%s: could not parse: %v", tt.src, err)
+			continue
+		}
+
+		_, err = e.Eval(env)
+		if err == nil {
+			t.Errorf("%s: want error", tt.src)
+		} else if tt.want != nil && err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.src, err, tt.want)
+		}
+	}
+}
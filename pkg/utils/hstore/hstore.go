@@ -0,0 +1,164 @@
+package hstore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Pair is the key of the hstore with its value, Null is set for the NULL values
+type Pair struct {
+	Key   string
+	Value string
+	Null  bool
+}
+
+// Parse parses the text output of the postgresql hstore, e.g. "a"=>"1", "b"=>NULL, into its pairs
+// in the order of the text
+func Parse(val string) ([]Pair, error) {
+	p := &parser{val: val}
+	res := make([]Pair, 0)
+
+	for {
+		if p.skipSpaces(); p.pos >= len(p.val) {
+			return res, nil
+		}
+
+		if len(res) > 0 {
+			if p.val[p.pos] != ',' {
+				return nil, fmt.Errorf("malformed hstore: ',' expected at %d", p.pos)
+			}
+			p.pos++
+			p.skipSpaces()
+		}
+
+		key, quoted, err := p.token()
+		if err != nil {
+			return nil, fmt.Errorf("malformed hstore: %w", err)
+		}
+		if !quoted && strings.EqualFold(key, "NULL") {
+			return nil, fmt.Errorf("malformed hstore: NULL key at %d", p.pos)
+		}
+
+		if p.skipSpaces(); !strings.HasPrefix(p.val[p.pos:], "=>") {
+			return nil, fmt.Errorf("malformed hstore: '=>' expected at %d", p.pos)
+		}
+		p.pos += 2
+		p.skipSpaces()
+
+		value, quoted, err := p.token()
+		if err != nil {
+			return nil, fmt.Errorf("malformed hstore: %w", err)
+		}
+
+		res = append(res, Pair{Key: key, Value: value, Null: !quoted && strings.EqualFold(value, "NULL")})
+	}
+}
+
+// Filter returns the pairs of the keys, all of them if no keys are given
+func Filter(pairs []Pair, keys []string) []Pair {
+	if len(keys) == 0 {
+		return pairs
+	}
+
+	res := make([]Pair, 0, len(keys))
+	for _, pair := range pairs {
+		for _, key := range keys {
+			if pair.Key == key {
+				res = append(res, pair)
+				break
+			}
+		}
+	}
+
+	return res
+}
+
+// Format returns the text of the hstore, the same as the postgresql output
+func Format(pairs []Pair) string {
+	var sb strings.Builder
+	for i, pair := range pairs {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		writeQuoted(&sb, pair.Key)
+		sb.WriteString("=>")
+		if pair.Null {
+			sb.WriteString("NULL")
+		} else {
+			writeQuoted(&sb, pair.Value)
+		}
+	}
+
+	return sb.String()
+}
+
+func writeQuoted(sb *strings.Builder, val string) {
+	sb.WriteByte('"')
+	for i := 0; i < len(val); i++ {
+		if val[i] == '"' || val[i] == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(val[i])
+	}
+	sb.WriteByte('"')
+}
+
+type parser struct {
+	val string
+	pos int
+}
+
+func (p *parser) skipSpaces() {
+	for p.pos < len(p.val) && isSpace(p.val[p.pos]) {
+		p.pos++
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// token parses the quoted or unquoted key or value, the latter ends at the space, ',' or '=>'
+func (p *parser) token() (string, bool, error) {
+	if p.pos >= len(p.val) {
+		return "", false, fmt.Errorf("unexpected end at %d", p.pos)
+	}
+
+	var sb strings.Builder
+	if p.val[p.pos] == '"' {
+		for p.pos++; p.pos < len(p.val); p.pos++ {
+			switch c := p.val[p.pos]; c {
+			case '\\':
+				if p.pos++; p.pos < len(p.val) {
+					sb.WriteByte(p.val[p.pos])
+				}
+			case '"':
+				p.pos++
+				return sb.String(), true, nil
+			default:
+				sb.WriteByte(c)
+			}
+		}
+
+		return "", false, fmt.Errorf("unterminated quoted string")
+	}
+
+	for p.pos < len(p.val) {
+		c := p.val[p.pos]
+		if isSpace(c) || c == ',' || strings.HasPrefix(p.val[p.pos:], "=>") {
+			break
+		}
+		if c == '\\' && p.pos+1 < len(p.val) {
+			p.pos++
+			c = p.val[p.pos]
+		}
+		sb.WriteByte(c)
+		p.pos++
+	}
+
+	if sb.Len() == 0 {
+		return "", false, fmt.Errorf("empty string at %d", p.pos)
+	}
+
+	return sb.String(), false, nil
+}
@@ -0,0 +1,27 @@
+package logger
+
+import (
+	"log/slog"
+	"os"
+)
+
+// Setup makes the logger writing the records of the level and above to stderr the default one, as key=value
+// lines or JSON lines; the messages of the standard log package, e.g. of the vendored libraries, go to it too
+func Setup(level slog.Level, json bool) {
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if json {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+
+	slog.SetDefault(slog.New(handler))
+}
+
+// For returns the logger of the component, e.g. "replicator" or "tableengines";
+// must be called after Setup, the logger keeps the handler of the default logger at the time of the call
+func For(component string) *slog.Logger {
+	return slog.Default().With("component", component)
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"log/slog"
 
 	"github.com/jackc/pgx"
 )
@@ -21,11 +22,16 @@ func (l LSN) String() string {
 	return pgx.FormatLSN(uint64(l))
 }
 
+// LogValue logs the lsn in the postgres format
+func (l LSN) LogValue() slog.Value {
+	return slog.StringValue(l.String())
+}
+
 func (l *LSN) ParseHex(hexStr string) error {
 	var lsn LSN
 
 	if n, err := fmt.Sscanf(hexStr, hexFmt, &lsn); err != nil {
-		return fmt.Errorf("could not parse hex: %v", err)
+		return fmt.Errorf("could not parse hex: %w", err)
 	} else if n != 1 {
 		return fmt.Errorf("could not parse hex")
 	}
@@ -64,7 +70,7 @@ func (l *LSN) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	}
 
 	if err := lsn.Parse(val); err != nil {
-		return fmt.Errorf("could not parse lsn %q: %v", val, err)
+		return fmt.Errorf("could not parse lsn %q: %w", val, err)
 	}
 
 	*l = lsn
@@ -0,0 +1,38 @@
+package mask
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"unicode/utf8"
+)
+
+// Redacted replaces the values of the redacted columns
+const Redacted = "[REDACTED]"
+
+// partialChar replaces the hidden characters of the partially masked values
+const partialChar = "*"
+
+// Hash returns the hex encoded HMAC-SHA256 of the value with the salt; equal values give equal hashes,
+// so that the column stays joinable, while the salt keeps the short values like phone numbers from being
+// brute forced by hashing all of them
+func Hash(salt []byte, val string) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(val))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Partial replaces all but the last keep characters of the value with asterisks, e.g. ************1234;
+// the values not longer than keep characters are hidden entirely
+func Partial(val string, keep int) string {
+	n := utf8.RuneCountInString(val)
+	if n <= keep {
+		return strings.Repeat(partialChar, n)
+	}
+
+	runes := []rune(val)
+
+	return strings.Repeat(partialChar, n-keep) + string(runes[n-keep:])
+}
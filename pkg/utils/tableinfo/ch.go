@@ -3,31 +3,181 @@ package tableinfo
 import (
 	"database/sql"
 	"fmt"
+	"strings"
+	"sync"
 
 	"github.com/mkabilov/pg2ch/pkg/config"
 )
 
+// clickhouse column default kinds of the columns which can not be inserted into
+const (
+	chDefaultMaterialized = "MATERIALIZED"
+	chDefaultAlias        = "ALIAS"
+)
+
+// ChSchema caches the columns of the clickhouse tables: fetched at startup with a single query
+// and again after the DDL, so that the conversion and the checks use the actual schema
+type ChSchema struct {
+	mutex        sync.Mutex
+	chConn       *sql.DB
+	databaseName string
+	tables       map[string]map[string]config.ChColumn // [database.table][column name]
+}
+
+// NewChSchema instantiates the schema cache, the table names not qualified with the database name
+// are looked up in databaseName
+func NewChSchema(chConn *sql.DB, databaseName string) *ChSchema {
+	return &ChSchema{
+		chConn:       chConn,
+		databaseName: databaseName,
+		tables:       make(map[string]map[string]config.ChColumn),
+	}
+}
+
+// IsInsertable checks if the column can be inserted into, i.e. it is not MATERIALIZED or ALIAS column
+func IsInsertable(chCol config.ChColumn) bool {
+	return chCol.DefaultKind != chDefaultMaterialized && chCol.DefaultKind != chDefaultAlias
+}
+
+func (s *ChSchema) qualify(chTableName string) (string, string) {
+	if database, table := config.SplitChTableName(chTableName); database != "" {
+		return database, table
+	}
+
+	return s.databaseName, chTableName
+}
+
+// Load fetches the columns of the tables at once
+func (s *ChSchema) Load(chTableNames []string) error {
+	if len(chTableNames) == 0 {
+		return nil
+	}
+
+	names := make([]interface{}, 0, len(chTableNames))
+	for _, chTableName := range chTableNames {
+		database, table := s.qualify(chTableName)
+		names = append(names, database+"."+table)
+	}
+
+	rows, err := s.chConn.Query("select database, table, name, type, default_kind, default_expression "+
+		"from system.columns where concat(database, '.', table) in ("+
+		strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ")+")", names...)
+	if err != nil {
+		return fmt.Errorf("could not query: %w", err)
+	}
+	defer rows.Close()
+
+	tables := make(map[string]map[string]config.ChColumn)
+	for rows.Next() {
+		var database, table, colName, colType, defaultKind, defaultExpr string
+
+		if err := rows.Scan(&database, &table, &colName, &colType, &defaultKind, &defaultExpr); err != nil {
+			return fmt.Errorf("could not scan: %w", err)
+		}
+
+		key := database + "." + table
+		if _, ok := tables[key]; !ok {
+			tables[key] = make(map[string]config.ChColumn)
+		}
+		tables[key][colName] = chColumn(colName, colType, defaultKind, defaultExpr)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("could not fetch: %w", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, columns := range tables {
+		s.tables[key] = columns
+	}
+
+	return nil
+}
+
+// Columns returns the cached columns of the table, fetching them if not cached yet
+func (s *ChSchema) Columns(chTableName string) (map[string]config.ChColumn, error) {
+	database, table := s.qualify(chTableName)
+
+	s.mutex.Lock()
+	columns, ok := s.tables[database+"."+table]
+	s.mutex.Unlock()
+
+	if !ok {
+		return s.Refresh(chTableName)
+	}
+
+	return copyColumns(columns), nil
+}
+
+// Refresh fetches the columns of the table again, e.g. after the DDL; missing tables are not cached
+func (s *ChSchema) Refresh(chTableName string) (map[string]config.ChColumn, error) {
+	database, table := s.qualify(chTableName)
+
+	columns, err := TableChColumns(s.chConn, database, table)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(columns) > 0 {
+		s.mutex.Lock()
+		s.tables[database+"."+table] = columns
+		s.mutex.Unlock()
+	}
+
+	return copyColumns(columns), nil
+}
+
+// Reset drops the cached columns, e.g. when the tables are reloaded, as they may have been changed meanwhile
+func (s *ChSchema) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.tables = make(map[string]map[string]config.ChColumn)
+}
+
+func copyColumns(columns map[string]config.ChColumn) map[string]config.ChColumn {
+	res := make(map[string]config.ChColumn, len(columns))
+	for colName, chCol := range columns {
+		res[colName] = chCol
+	}
+
+	return res
+}
+
+func chColumn(colName, colType, defaultKind, defaultExpr string) config.ChColumn {
+	return config.ChColumn{
+		Name:        colName,
+		Column:      ParseChType(colType),
+		DefaultKind: defaultKind,
+		DefaultExpr: defaultExpr,
+	}
+}
+
+// TableChColumns returns columns of the clickhouse table, the table name not qualified
+// with the database name is looked up in databaseName
 func TableChColumns(chConn *sql.DB, databaseName, chTableName string) (map[string]config.ChColumn, error) {
 	result := make(map[string]config.ChColumn)
 
-	rows, err := chConn.Query("select name, type from system.columns where database = ? and table = ?",
-		databaseName, chTableName)
+	if database, table := config.SplitChTableName(chTableName); database != "" {
+		databaseName, chTableName = database, table
+	}
+
+	rows, err := chConn.Query("select name, type, default_kind, default_expression from system.columns "+
+		"where database = ? and table = ?", databaseName, chTableName)
 
 	if err != nil {
-		return nil, fmt.Errorf("could not query: %v", err)
+		return nil, fmt.Errorf("could not query: %w", err)
 	}
 
 	for rows.Next() {
-		var colName, colType string
+		var colName, colType, defaultKind, defaultExpr string
 
-		if err := rows.Scan(&colName, &colType); err != nil {
-			return nil, fmt.Errorf("could not scan: %v", err)
+		if err := rows.Scan(&colName, &colType, &defaultKind, &defaultExpr); err != nil {
+			return nil, fmt.Errorf("could not scan: %w", err)
 		}
 
-		result[colName] = config.ChColumn{
-			Name:   colName,
-			Column: parseChType(colType),
-		}
+		result[colName] = chColumn(colName, colType, defaultKind, defaultExpr)
 	}
 
 	return result, nil
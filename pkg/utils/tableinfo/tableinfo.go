@@ -2,6 +2,7 @@ package tableinfo
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -24,10 +25,13 @@ func TablePgColumns(tx *pgx.Tx, tblName config.PgTableName) ([]message.Column, m
   string_to_array(substring(format_type(a.atttypid, a.atttypmod) from '\((.*)\)'), ',') as ext,
   coalesce(ai.attnum, 0) as pk_attnum,
   a.atttypmod,
-  a.atttypid
+  a.atttypid,
+  (select array_agg(e.enumlabel::text order by e.enumsortorder)
+    from pg_enum e where e.enumtypid in (t.oid, t.typelem)) as enum_labels
 from pg_class c
   inner join pg_namespace n on n.oid = c.relnamespace
   inner join pg_attribute a on a.attrelid = c.oid
+  inner join pg_type t on t.oid = a.atttypid
   left join pg_index i on i.indrelid = a.attrelid and i.indisprimary
   left join pg_attribute ai on ai.attrelid = i.indexrelid and ai.attname = a.attname and ai.attisdropped = false
 where
@@ -39,7 +43,7 @@ order by
   a.attnum`, tblName.SchemaName, tblName.TableName)
 
 	if err != nil {
-		return nil, nil, fmt.Errorf("could not query: %v", err)
+		return nil, nil, fmt.Errorf("could not query: %w", err)
 	}
 
 	for rows.Next() {
@@ -51,8 +55,9 @@ order by
 			attOID            utils.OID
 		)
 
-		if err := rows.Scan(&colName, &pgColumn.IsNullable, &baseType, &extStr, &pgColumn.PkCol, &attTypMod, &attOID); err != nil {
-			return nil, nil, fmt.Errorf("could not scan: %v", err)
+		if err := rows.Scan(&colName, &pgColumn.IsNullable, &baseType, &extStr, &pgColumn.PkCol, &attTypMod, &attOID,
+			&pgColumn.Labels); err != nil {
+			return nil, nil, fmt.Errorf("could not scan: %w", err)
 		}
 
 		if baseType[len(baseType)-2:] == "[]" {
@@ -65,7 +70,7 @@ order by
 		if extStr != nil {
 			pgColumn.Ext, err = strToIntArray(extStr)
 			if err != nil {
-				return nil, nil, fmt.Errorf("could not convert into int array: %v", err)
+				return nil, nil, fmt.Errorf("could not convert into int array: %w", err)
 			}
 		}
 
@@ -94,7 +99,7 @@ func strToIntArray(str []string) ([]int, error) {
 	return ints, nil
 }
 
-func parseChType(chType string) (col config.Column) {
+func ParseChType(chType string) (col config.Column) {
 	if strings.HasPrefix(chType, "LowCardinality(") {
 		chType = chType[15 : len(chType)-1]
 	}
@@ -111,13 +116,128 @@ func parseChType(chType string) (col config.Column) {
 		}
 	}
 
+	if strings.HasPrefix(col.BaseType, "LowCardinality(") { // Array(LowCardinality(...))
+		col.BaseType = col.BaseType[15 : len(col.BaseType)-1]
+		if strings.HasPrefix(col.BaseType, "Nullable(") {
+			col.BaseType, col.IsNullable = col.BaseType[9:len(col.BaseType)-1], true
+		}
+	}
+
 	if strings.HasPrefix(col.BaseType, "FixedString(") {
+		if length, err := strconv.Atoi(strings.TrimSuffix(col.BaseType[12:], ")")); err == nil {
+			col.Ext = []int{length}
+		}
 		col.BaseType = "FixedString"
 	}
 
-	if strings.HasPrefix(col.BaseType, "Decimal(") {
+	if strings.HasPrefix(col.BaseType, "DateTime64(") && strings.HasSuffix(col.BaseType, ")") {
+		col.Ext, col.Timezone = dateTime64Ext(col.BaseType)
+		col.BaseType = "DateTime64"
+	}
+
+	for _, enumType := range []string{utils.ChEnum8, utils.ChEnum16} {
+		if strings.HasPrefix(col.BaseType, enumType+"(") && strings.HasSuffix(col.BaseType, ")") {
+			col.Labels = enumLabels(col.BaseType[len(enumType)+1 : len(col.BaseType)-1])
+			col.BaseType = enumType
+		}
+	}
+
+	if ext := decimalExt(col.BaseType); ext != nil || strings.HasPrefix(col.BaseType, "Decimal(") {
+		col.Ext = ext
 		col.BaseType = "Decimal"
 	}
 
 	return
 }
+
+// decimalPrecisions are the precisions of the DecimalN(S) types
+var decimalPrecisions = map[string]int{"Decimal32": 9, "Decimal64": 18, "Decimal128": 38, "Decimal256": 76}
+
+// decimalExt returns the precision and the scale of Decimal(P, S) or DecimalN(S) type, nil if it is malformed
+func decimalExt(chType string) []int {
+	pos := strings.IndexByte(chType, '(')
+	if !strings.HasPrefix(chType, "Decimal") || pos < 0 || !strings.HasSuffix(chType, ")") {
+		return nil
+	}
+
+	params, err := strToIntArray(strings.Split(strings.Replace(chType[pos+1:len(chType)-1], " ", "", -1), ","))
+	if err != nil {
+		return nil
+	}
+
+	if precision, ok := decimalPrecisions[chType[:pos]]; ok && len(params) == 1 {
+		return []int{precision, params[0]}
+	} else if chType[:pos] == "Decimal" && len(params) == 2 {
+		return params
+	}
+
+	return nil
+}
+
+// enumLabels returns the labels of the Enum8('a' = 1, 'b' = 2) or Enum16 type ordered by their values
+func enumLabels(params string) []string {
+	type enumValue struct {
+		label string
+		value int
+	}
+
+	values := make([]enumValue, 0)
+	for len(params) > 0 {
+		params = strings.TrimLeft(params, " ,")
+		if !strings.HasPrefix(params, "'") {
+			break
+		}
+
+		var label strings.Builder
+		pos := 1
+		for ; pos < len(params) && params[pos] != '\''; pos++ {
+			if params[pos] == '\\' && pos+1 < len(params) {
+				pos++
+			}
+			label.WriteByte(params[pos])
+		}
+
+		if pos < len(params) {
+			pos++ // closing quote
+		}
+
+		rest := strings.TrimLeft(params[pos:], " =")
+		end := strings.IndexByte(rest, ',')
+		if end < 0 {
+			end = len(rest)
+		}
+
+		value, err := strconv.Atoi(strings.TrimSpace(rest[:end]))
+		if err != nil {
+			break
+		}
+		values = append(values, enumValue{label: label.String(), value: value})
+		params = rest[end:]
+	}
+
+	sort.Slice(values, func(i, j int) bool { return values[i].value < values[j].value })
+
+	labels := make([]string, len(values))
+	for i, v := range values {
+		labels[i] = v.label
+	}
+
+	return labels
+}
+
+// dateTime64Ext returns the precision and the timezone of DateTime64(P[, 'timezone']) type
+func dateTime64Ext(chType string) ([]int, string) {
+	params := strings.SplitN(chType[len("DateTime64("):len(chType)-1], ",", 2)
+
+	precision, err := strconv.Atoi(strings.TrimSpace(params[0]))
+	if err != nil {
+		return nil, ""
+	}
+
+	timezone := ""
+	if len(params) == 2 {
+		timezone = strings.Trim(strings.TrimSpace(params[1]), "'")
+	}
+
+	return []int{precision}, timezone
+}
@@ -15,7 +15,12 @@ const (
 	ChString      = "String"
 	ChDate        = "Date"
 	ChDateTime    = "DateTime"
+	ChDateTime64  = "DateTime64"
 	ChDecimal     = "Decimal"
+	ChEnum8       = "Enum8"
+	ChEnum16      = "Enum16"
+	ChIPv4        = "IPv4"
+	ChIPv6        = "IPv6"
 	ChUUID        = "UUID"
 	ChUInt8Array  = "Array(UInt8)"
 
@@ -45,4 +50,8 @@ const (
 	PgUuid                     = "uuid"
 	PgBytea                    = "bytea"
 	PgInet                     = "inet"
+	PgCidr                     = "cidr"
+	PgMacaddr                  = "macaddr"
+	PgMacaddr8                 = "macaddr8"
+	PgHstore                   = "hstore"
 )